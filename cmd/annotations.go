@@ -0,0 +1,94 @@
+package cmd
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"bbi/configlib"
+)
+
+// annotationRegex matches the comments in a control stream holding settings for that model alone, such as
+// ;; bbi: nm_version=nm75 parallel=true threads=8
+var annotationRegex = regexp.MustCompile(`(?i)^\s*;;\s*bbi:(.*)$`)
+
+// modelAnnotations collects the settings from the bbi annotations of a control stream, keyed by their dotted names.
+// Options to nmfe such as maxlim may be written without their nmfe_options prefix. Later annotations take precedence
+func modelAnnotations(lines []string) (map[string]string, error) {
+	annotations := make(map[string]string)
+
+	for _, line := range lines {
+		matches := annotationRegex.FindStringSubmatch(line)
+		if matches == nil {
+			continue
+		}
+
+		for _, token := range strings.Fields(matches[1]) {
+			pieces := strings.SplitN(token, "=", 2)
+			if len(pieces) != 2 || pieces[0] == "" {
+				return nil, fmt.Errorf("the bbi annotation %s must be written as setting=value", token)
+			}
+
+			annotations[annotationKey(pieces[0])] = pieces[1]
+		}
+	}
+
+	return annotations, nil
+}
+
+// annotationKey expands the name of an nmfe option into its full key, leaving all other keys alone
+func annotationKey(key string) string {
+	key = strings.ToLower(key)
+
+	if strings.Contains(key, ".") || configKeyExists(reflect.TypeOf(configlib.Config{}), key) {
+		return key
+	}
+
+	if configKeyExists(reflect.TypeOf(configlib.NMFEOptions{}), key) {
+		return "nmfe_options." + key
+	}
+
+	return key
+}
+
+func configKeyExists(t reflect.Type, key string) bool {
+	for i := 0; i < t.NumField(); i++ {
+		if strings.EqualFold(strings.Split(t.Field(i).Tag.Get("mapstructure"), ",")[0], key) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// annotatedConfig merges the settings annotated in a control stream over the configuration of the batch
+func annotatedConfig(lines []string, config configlib.Config) (configlib.Config, map[string]string, error) {
+	annotations, err := modelAnnotations(lines)
+	if err != nil || len(annotations) == 0 {
+		return config, nil, err
+	}
+
+	overrides, err := configlib.ParseOverrides(annotations)
+	if err != nil {
+		return config, nil, fmt.Errorf("invalid bbi annotation: %w", err)
+	}
+
+	merged, err := config.ApplyOverrides(overrides)
+	if err != nil {
+		return config, nil, fmt.Errorf("unable to apply the bbi annotations: %w", err)
+	}
+
+	if _, ok := annotations["nm_version"]; ok {
+		if _, installed := merged.Nonmem[merged.NMVersion]; !installed {
+			return config, nil, fmt.Errorf("the annotated nm_version of %s has no configurations in bbi.yaml", merged.NMVersion)
+		}
+	}
+
+	//Annotations may enable parallel execution which the batch never validated
+	if err = validateConfiguredParaFile(merged); err != nil {
+		return config, nil, err
+	}
+
+	return merged, annotations, nil
+}
@@ -0,0 +1,127 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"bbi/configlib"
+)
+
+func Test_modelAnnotations(t *testing.T) {
+	tests := []struct {
+		name    string
+		lines   []string
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			name: "settings and nmfe options",
+			lines: []string{
+				"$PROBLEM acop",
+				";; bbi: nm_version=nm75 parallel=true threads=8",
+				";; BBI: maxlim=2",
+				"$DATA ../acop.csv IGNORE=@",
+			},
+			want: map[string]string{
+				"nm_version":          "nm75",
+				"parallel":            "true",
+				"threads":             "8",
+				"nmfe_options.maxlim": "2",
+			},
+		},
+		{
+			name:  "later annotations take precedence",
+			lines: []string{";; bbi: threads=4", ";; bbi: threads=8"},
+			want:  map[string]string{"threads": "8"},
+		},
+		{
+			name:  "ordinary comments",
+			lines: []string{"; bbi is used to run this model", "; bbi: single semicolon", "$EST METHOD=1 ;; bbi: unrelated"},
+			want:  map[string]string{},
+		},
+		{
+			name:    "missing value",
+			lines:   []string{";; bbi: parallel"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := modelAnnotations(tt.lines)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("modelAnnotations() error = %v, wantErr %t", err, tt.wantErr)
+			}
+
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("modelAnnotations() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_annotatedNonMemModel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bbi_annotations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "acop.csv"), []byte("ID,TIME,DV\n"), 0640)
+	ioutil.WriteFile(filepath.Join(dir, "annotated.mod"), []byte("$PROBLEM annotated\n;; bbi: nm_version=nm75 threads=8 maxlim=2 retry_on=license\n$DATA acop.csv\n"), 0640)
+	ioutil.WriteFile(filepath.Join(dir, "plain.mod"), []byte("$PROBLEM plain\n$DATA acop.csv\n"), 0640)
+	ioutil.WriteFile(filepath.Join(dir, "unknown.mod"), []byte("$PROBLEM unknown\n;; bbi: nm_version=nm80\n$DATA acop.csv\n"), 0640)
+	ioutil.WriteFile(filepath.Join(dir, "invalid.mod"), []byte("$PROBLEM invalid\n;; bbi: threads=many\n$DATA acop.csv\n"), 0640)
+
+	config := configlib.Config{
+		NMVersion: "nm74gf",
+		Threads:   2,
+		OutputDir: "{{ .Name }}",
+		RetryOn:   []string{"timeout", "signal"},
+		Nonmem: map[string]configlib.NonMemDetail{
+			"nm74gf": {Home: "/opt/NONMEM/nm74gf", Executable: "nmfe74"},
+			"nm75":   {Home: "/opt/NONMEM/nm75", Executable: "nmfe75"},
+		},
+	}
+
+	annotated, err := NewNonMemModel(filepath.Join(dir, "annotated.mod"), config)
+	if err != nil {
+		t.Fatalf("NewNonMemModel() error = %s", err)
+	}
+
+	merged := annotated.Configuration
+	if merged.NMVersion != "nm75" || merged.Threads != 8 || merged.NMFEOptions.MaxLim != 2 {
+		t.Errorf("the annotations were not merged: %+v", merged)
+	}
+
+	if !reflect.DeepEqual(merged.RetryOn, []string{"license"}) {
+		t.Errorf("RetryOn = %v, want the annotated list alone", merged.RetryOn)
+	}
+
+	if annotated.Annotations["nmfe_options.maxlim"] != "2" {
+		t.Errorf("Annotations = %v, want the annotated settings recorded", annotated.Annotations)
+	}
+
+	//Other models in the batch keep its configuration
+	plain, err := NewNonMemModel(filepath.Join(dir, "plain.mod"), config)
+	if err != nil {
+		t.Fatalf("NewNonMemModel() error = %s", err)
+	}
+
+	if plain.Configuration.NMVersion != "nm74gf" || plain.Configuration.Threads != 2 || len(plain.Annotations) != 0 {
+		t.Errorf("the batch configuration was changed: %+v", plain.Configuration)
+	}
+
+	if !reflect.DeepEqual(config.RetryOn, []string{"timeout", "signal"}) {
+		t.Errorf("the batch RetryOn was changed to %v", config.RetryOn)
+	}
+
+	for _, m := range []string{"unknown.mod", "invalid.mod"} {
+		if _, err := NewNonMemModel(filepath.Join(dir, m), config); err == nil {
+			t.Errorf("NewNonMemModel() of %s did not report the invalid annotation", m)
+		}
+	}
+}
@@ -0,0 +1,508 @@
+package cmd
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+const (
+	//bundleVersion is incremented when the layout of bundles changes
+	bundleVersion int = 1
+	//bundleManifestName is the first entry of every bundle, listing the checksums of the others
+	bundleManifestName string = "bundle_manifest.json"
+)
+
+var (
+	bundleOutput  string
+	bundleCopyLvl int
+	bundleNoData  bool
+	importDir     string
+)
+
+const exportLongDescription string = `package an executed model into a portable tar.gz bundle holding the control stream,
+its data, the outputs selected by the copy level, bbi_config.json and a manifest of SHA-256 checksums. Models may be
+provided as control streams, which are resolved to their output directory through bbi.yaml, or as the output
+directories themselves
+
+ bbi nonmem export run001.mod
+ bbi nonmem export run001.mod --copy_lvl 3 --output run001.tar.gz
+ bbi nonmem export run001 --no_data
+`
+
+const importLongDescription string = `unpack a bundle created by bbi nonmem export and verify the checksums of its files
+
+ bbi nonmem import run001-bundle.tar.gz
+ bbi nonmem import run001-bundle.tar.gz --dir review/run001
+`
+
+const verifyLongDescription string = `verify the files of a bundle, or of a directory into which one was imported, against
+the SHA-256 checksums of its manifest. Exits non-zero if any file is missing, altered or unexpected
+
+ bbi nonmem verify run001-bundle.tar.gz
+ bbi nonmem verify review/run001
+`
+
+var exportCmd = &cobra.Command{
+	Use:   "export [model]",
+	Short: "package an executed model into a portable bundle",
+	Long:  exportLongDescription,
+	Args:  cobra.ExactArgs(1),
+	Run:   export,
+}
+
+var importCmd = &cobra.Command{
+	Use:   "import [bundle]",
+	Short: "unpack and verify a bundle",
+	Long:  importLongDescription,
+	Args:  cobra.ExactArgs(1),
+	Run:   importBundle,
+}
+
+var verifyCmd = &cobra.Command{
+	Use:   "verify [bundle or directory]",
+	Short: "verify the checksums of a bundle",
+	Long:  verifyLongDescription,
+	Args:  cobra.ExactArgs(1),
+	Run:   verify,
+}
+
+func init() {
+	nonmemCmd.AddCommand(exportCmd)
+	nonmemCmd.AddCommand(importCmd)
+	nonmemCmd.AddCommand(verifyCmd)
+
+	exportCmd.Flags().StringVar(&bundleOutput, "output", "", "File into which to write the bundle. Defaults to <model>-bundle.tar.gz in the current directory")
+	exportCmd.Flags().IntVar(&bundleCopyLvl, "copy_lvl", 1, "Copy level selecting the output files to include in the bundle")
+	exportCmd.Flags().BoolVar(&bundleNoData, "no_data", false, "Record only the path and checksum of the data rather than including it in the bundle")
+
+	importCmd.Flags().StringVar(&importDir, "dir", "", "Directory into which to unpack the bundle. Defaults to the name of the bundle without .tar.gz")
+}
+
+// bundleManifest describes the contents of a bundle
+type bundleManifest struct {
+	BundleVersion int       `json:"bundle_version"`
+	CreatedAt     time.Time `json:"created_at"`
+	BBIVersion    string    `json:"bbi_version"`
+	Model         string    `json:"model"`
+	//ModelPath is the location of the control stream when the bundle was exported
+	ModelPath string       `json:"model_path"`
+	OutputDir string       `json:"output_dir"`
+	CopyLvl   int          `json:"copy_lvl"`
+	Data      bundleData   `json:"data"`
+	Files     []bundleFile `json:"files"`
+}
+
+// bundleData records the data of the model, which is only present in the bundle when Included is set
+type bundleData struct {
+	Path     string `json:"path"`
+	Included bool   `json:"included"`
+	File     string `json:"file,omitempty"`
+	SHA256   string `json:"sha256"`
+	Size     int64  `json:"size"`
+}
+
+// bundleFile is a file within a bundle, named by its slash separated path
+type bundleFile struct {
+	Path   string `json:"path"`
+	SHA256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+}
+
+func export(cmd *cobra.Command, args []string) {
+	outputDir, _, err := modelRunDirectory(args[0])
+	if err != nil {
+		log.Fatalf("Unable to locate the output directory for %s: %s", args[0], err)
+	}
+
+	destination := bundleOutput
+	if destination == "" {
+		destination = filepath.Base(outputDir) + "-bundle.tar.gz"
+	}
+
+	manifest, err := exportBundle(outputDir, destination, bundleCopyLvl, !bundleNoData)
+	if err != nil {
+		log.Fatalf("Unable to export %s: %s", args[0], err)
+	}
+
+	log.Infof("Exported %s with %d files to %s", manifest.Model, len(manifest.Files), destination)
+}
+
+func importBundle(cmd *cobra.Command, args []string) {
+	destination := importDir
+	if destination == "" {
+		destination = strings.TrimSuffix(filepath.Base(args[0]), ".tar.gz")
+	}
+
+	if err := extractTarball(args[0], destination); err != nil {
+		log.Fatalf("Unable to unpack %s: %s", args[0], err)
+	}
+
+	manifest, problems, err := verifyBundleDirectory(destination)
+	if err != nil {
+		log.Fatalf("Unable to verify %s: %s", destination, err)
+	}
+
+	reportBundleVerification(destination, manifest, problems)
+}
+
+func verify(cmd *cobra.Command, args []string) {
+	verifier := verifyBundleArchive
+	if info, err := os.Stat(args[0]); err == nil && info.IsDir() {
+		verifier = verifyBundleDirectory
+	}
+
+	manifest, problems, err := verifier(args[0])
+	if err != nil {
+		log.Fatalf("Unable to verify %s: %s", args[0], err)
+	}
+
+	reportBundleVerification(args[0], manifest, problems)
+}
+
+func reportBundleVerification(target string, manifest bundleManifest, problems []string) {
+	if Json {
+		jsonRes, _ := json.MarshalIndent(struct {
+			Target   string         `json:"target"`
+			Verified bool           `json:"verified"`
+			Problems []string       `json:"problems,omitempty"`
+			Manifest bundleManifest `json:"manifest"`
+		}{target, len(problems) == 0, problems, manifest}, "", "\t")
+		fmt.Printf("%s\n", jsonRes)
+	} else {
+		for _, p := range problems {
+			log.Error(p)
+		}
+
+		if !manifest.Data.Included {
+			log.Infof("The data was not included in the bundle. It was located at %s with the SHA-256 checksum %s", manifest.Data.Path, manifest.Data.SHA256)
+		}
+	}
+
+	if len(problems) > 0 {
+		log.Fatalf("%s failed verification with %d problems", target, len(problems))
+	}
+
+	if !Json {
+		log.Infof("%s verified: all %d files match their checksums", target, len(manifest.Files))
+	}
+}
+
+// exportBundle writes the executed model in the output directory into a bundle at destination
+func exportBundle(outputDir string, destination string, copyLvl int, includeData bool) (bundleManifest, error) {
+	contents, err := ioutil.ReadFile(filepath.Join(outputDir, "bbi_config.json"))
+	if err != nil {
+		return bundleManifest{}, fmt.Errorf("no bbi_config.json was found in %s. Has the model been executed? %s", outputDir, err)
+	}
+
+	var model struct {
+		Model         string `json:"model_name"`
+		OriginalModel string `json:"original_model"`
+		Path          string `json:"model_path"`
+		DataPath      string `json:"data_path"`
+	}
+
+	if err = json.Unmarshal(contents, &model); err != nil {
+		return bundleManifest{}, fmt.Errorf("unable to read %s: %s", filepath.Join(outputDir, "bbi_config.json"), err)
+	}
+
+	manifest := bundleManifest{
+		BundleVersion: bundleVersion,
+		CreatedAt:     time.Now(),
+		BBIVersion:    VERSION,
+		Model:         model.OriginalModel,
+		ModelPath:     model.Path,
+		OutputDir:     outputDir,
+		CopyLvl:       copyLvl,
+	}
+
+	//Bundle paths mapped to the files on disk
+	sources := make(map[string]string)
+
+	//The original control stream, rather than the copy in the output directory whose data path was adjusted
+	controlStream := model.Path
+	if _, err := os.Stat(controlStream); err != nil {
+		controlStream = filepath.Join(outputDir, model.Model)
+	}
+	sources[manifest.Model] = controlStream
+
+	sources["output/bbi_config.json"] = filepath.Join(outputDir, "bbi_config.json")
+
+	for _, f := range getCopiableFileList(model.Model, copyLvl, outputDir) {
+		if info, err := os.Stat(filepath.Join(outputDir, f)); err == nil && info.Mode().IsRegular() {
+			sources["output/"+filepath.ToSlash(f)] = filepath.Join(outputDir, f)
+		}
+	}
+
+	if model.DataPath != "" {
+		dataPath := model.DataPath
+		if !filepath.IsAbs(dataPath) {
+			dataPath = filepath.Join(outputDir, dataPath)
+		}
+
+		manifest.Data.Path = filepath.Clean(dataPath)
+		manifest.Data.SHA256, manifest.Data.Size, err = sha256File(manifest.Data.Path)
+		if err != nil {
+			return manifest, fmt.Errorf("unable to read the data of %s: %s", manifest.Model, err)
+		}
+
+		if includeData {
+			manifest.Data.Included = true
+			manifest.Data.File = "data/" + filepath.Base(dataPath)
+			sources[manifest.Data.File] = manifest.Data.Path
+		}
+	}
+
+	var paths []string
+	for p := range sources {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	for _, p := range paths {
+		sum, size, err := sha256File(sources[p])
+		if err != nil {
+			return manifest, err
+		}
+
+		manifest.Files = append(manifest.Files, bundleFile{Path: p, SHA256: sum, Size: size})
+	}
+
+	return manifest, writeBundle(destination, manifest, sources)
+}
+
+// writeBundle writes the manifest followed by each of the files it lists into a gzip compressed tarball
+func writeBundle(destination string, manifest bundleManifest, sources map[string]string) error {
+	out, err := os.Create(destination)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	gz := gzip.NewWriter(out)
+	tw := tar.NewWriter(gz)
+
+	manifestContents, err := json.MarshalIndent(manifest, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	err = tw.WriteHeader(&tar.Header{
+		Name:    bundleManifestName,
+		Mode:    0640,
+		Size:    int64(len(manifestContents)),
+		ModTime: manifest.CreatedAt,
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if _, err = tw.Write(manifestContents); err != nil {
+		return err
+	}
+
+	for _, f := range manifest.Files {
+		if err = writeBundleFile(tw, f.Path, sources[f.Path]); err != nil {
+			return err
+		}
+	}
+
+	if err = tw.Close(); err != nil {
+		return err
+	}
+
+	return gz.Close()
+}
+
+func writeBundleFile(tw *tar.Writer, name string, source string) error {
+	f, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+
+	header.Name = name
+
+	if err = tw.WriteHeader(header); err != nil {
+		return err
+	}
+
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// verifyBundleArchive checks each file within a bundle against its manifest without unpacking it
+func verifyBundleArchive(bundle string) (bundleManifest, []string, error) {
+	var manifest bundleManifest
+
+	in, err := os.Open(bundle)
+	if err != nil {
+		return manifest, nil, err
+	}
+	defer in.Close()
+
+	gz, err := gzip.NewReader(in)
+	if err != nil {
+		return manifest, nil, err
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+
+	header, err := tr.Next()
+	if err != nil || header.Name != bundleManifestName {
+		return manifest, nil, fmt.Errorf("%s does not begin with a %s, so is not a bundle", bundle, bundleManifestName)
+	}
+
+	contents, err := ioutil.ReadAll(tr)
+	if err != nil {
+		return manifest, nil, err
+	}
+
+	if err = json.Unmarshal(contents, &manifest); err != nil {
+		return manifest, nil, fmt.Errorf("unable to read the manifest of %s: %s", bundle, err)
+	}
+
+	expected := make(map[string]bundleFile)
+	for _, f := range manifest.Files {
+		expected[f.Path] = f
+	}
+
+	var problems []string
+	seen := make(map[string]bool)
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return manifest, problems, err
+		}
+
+		if header.Typeflag == tar.TypeDir {
+			continue
+		}
+
+		seen[header.Name] = true
+
+		f, ok := expected[header.Name]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%s is not listed in the manifest", header.Name))
+			continue
+		}
+
+		h := sha256.New()
+		if _, err = io.Copy(h, tr); err != nil {
+			return manifest, problems, err
+		}
+
+		if sum := fmt.Sprintf("%x", h.Sum(nil)); sum != f.SHA256 {
+			problems = append(problems, fmt.Sprintf("%s has the checksum %s rather than %s", f.Path, sum, f.SHA256))
+		}
+	}
+
+	for _, f := range manifest.Files {
+		if !seen[f.Path] {
+			problems = append(problems, fmt.Sprintf("%s is listed in the manifest but missing", f.Path))
+		}
+	}
+
+	return manifest, problems, nil
+}
+
+// verifyBundleDirectory checks the files of a bundle unpacked into a directory against its manifest
+func verifyBundleDirectory(dir string) (bundleManifest, []string, error) {
+	var manifest bundleManifest
+
+	contents, err := ioutil.ReadFile(filepath.Join(dir, bundleManifestName))
+	if err != nil {
+		return manifest, nil, fmt.Errorf("no %s was found in %s: %s", bundleManifestName, dir, err)
+	}
+
+	if err = json.Unmarshal(contents, &manifest); err != nil {
+		return manifest, nil, fmt.Errorf("unable to read the manifest in %s: %s", dir, err)
+	}
+
+	var problems []string
+	listed := make(map[string]bool)
+
+	for _, f := range manifest.Files {
+		listed[f.Path] = true
+		sum, _, err := sha256File(filepath.Join(dir, filepath.FromSlash(f.Path)))
+
+		if os.IsNotExist(err) {
+			problems = append(problems, fmt.Sprintf("%s is listed in the manifest but missing", f.Path))
+			continue
+		}
+
+		if err != nil {
+			return manifest, problems, err
+		}
+
+		if sum != f.SHA256 {
+			problems = append(problems, fmt.Sprintf("%s has the checksum %s rather than %s", f.Path, sum, f.SHA256))
+		}
+	}
+
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+
+		rel = filepath.ToSlash(rel)
+		if rel != bundleManifestName && !listed[rel] {
+			problems = append(problems, fmt.Sprintf("%s isn't listed in the manifest", rel))
+		}
+
+		return nil
+	})
+
+	return manifest, problems, err
+}
+
+// sha256File returns the hex encoded SHA-256 digest and the size of a file
+func sha256File(file string) (string, int64, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil)), size, nil
+}
@@ -0,0 +1,107 @@
+package cmd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_exportBundle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bbi_bundle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	outputDir := filepath.Join(dir, "run001")
+	os.MkdirAll(outputDir, 0750)
+
+	model := "$PROBLEM run001\n$DATA ../acop.csv\n$TABLE ID DV FILE=run001.tab\n"
+	ioutil.WriteFile(filepath.Join(dir, "run001.mod"), []byte(model), 0640)
+	ioutil.WriteFile(filepath.Join(outputDir, "run001.mod"), []byte(model), 0640)
+	ioutil.WriteFile(filepath.Join(dir, "acop.csv"), []byte("ID,TIME,DV\n1,0,0\n"), 0640)
+	ioutil.WriteFile(filepath.Join(outputDir, "run001.lst"), []byte("MINIMIZATION SUCCESSFUL\n"), 0640)
+	ioutil.WriteFile(filepath.Join(outputDir, "run001.tab"), []byte("ID DV\n"), 0640)
+	ioutil.WriteFile(filepath.Join(outputDir, "run001.phi"), []byte("phi\n"), 0640)
+
+	//Errors are recorded as objects which can't be read back into an error
+	recorded, _ := json.Marshal(map[string]interface{}{
+		"model_name":     "run001.mod",
+		"original_model": "run001.mod",
+		"model_path":     filepath.Join(dir, "run001.mod"),
+		"data_path":      "../acop.csv",
+		"output_dir":     outputDir,
+		"error":          map[string]interface{}{},
+	})
+	ioutil.WriteFile(filepath.Join(outputDir, "bbi_config.json"), recorded, 0640)
+
+	bundle := filepath.Join(dir, "run001-bundle.tar.gz")
+
+	manifest, err := exportBundle(outputDir, bundle, 1, true)
+	if err != nil {
+		t.Fatalf("exportBundle() error = %s", err)
+	}
+
+	var paths []string
+	for _, f := range manifest.Files {
+		paths = append(paths, f.Path)
+	}
+
+	want := "data/acop.csv,output/bbi_config.json,output/run001.lst,output/run001.tab,run001.mod"
+	if strings.Join(paths, ",") != want {
+		t.Errorf("the bundle holds %v, want %s", paths, want)
+	}
+
+	if !manifest.Data.Included || manifest.Data.Path != filepath.Join(dir, "acop.csv") || len(manifest.Data.SHA256) != 64 {
+		t.Errorf("the data was recorded as %+v", manifest.Data)
+	}
+
+	if _, problems, err := verifyBundleArchive(bundle); err != nil || len(problems) > 0 {
+		t.Errorf("verifyBundleArchive() = %v, %v", problems, err)
+	}
+
+	imported := filepath.Join(dir, "imported")
+	if err = extractTarball(bundle, imported); err != nil {
+		t.Fatalf("extractTarball() error = %s", err)
+	}
+
+	if _, problems, err := verifyBundleDirectory(imported); err != nil || len(problems) > 0 {
+		t.Errorf("verifyBundleDirectory() = %v, %v", problems, err)
+	}
+
+	//Altered, missing and unlisted files are reported
+	ioutil.WriteFile(filepath.Join(imported, "output", "run001.lst"), []byte("MINIMIZATION TERMINATED\n"), 0640)
+	os.Remove(filepath.Join(imported, "data", "acop.csv"))
+	ioutil.WriteFile(filepath.Join(imported, "output", "extra.txt"), []byte("not bundled\n"), 0640)
+
+	if _, problems, _ := verifyBundleDirectory(imported); len(problems) != 3 {
+		t.Errorf("verifyBundleDirectory() of an altered bundle = %v, want 3 problems", problems)
+	}
+
+	//Without the data only its checksum is recorded
+	manifest, err = exportBundle(outputDir, bundle, 2, false)
+	if err != nil {
+		t.Fatalf("exportBundle() error = %s", err)
+	}
+
+	for _, f := range manifest.Files {
+		if strings.HasPrefix(f.Path, "data/") {
+			t.Errorf("the data was included in the bundle as %s", f.Path)
+		}
+	}
+
+	if manifest.Data.Included || manifest.Data.SHA256 == "" {
+		t.Errorf("the data was recorded as %+v", manifest.Data)
+	}
+
+	if len(manifest.Files) != 5 {
+		t.Errorf("copy level 2 bundled %d files, want the phi file as well", len(manifest.Files))
+	}
+
+	if _, err = exportBundle(dir, bundle, 1, true); err == nil {
+		t.Errorf("exportBundle() of a directory without bbi_config.json did not fail")
+	}
+}
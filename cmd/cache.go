@@ -0,0 +1,594 @@
+package cmd
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"bbi/configlib"
+	"bbi/utils"
+	"github.com/olekukonko/tablewriter"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/afero"
+	"github.com/spf13/cobra"
+)
+
+// cacheMetadataFile is stored alongside each cached executable and describes how it was built
+const cacheMetadataFile string = "bbi_cache.json"
+
+// cacheLockFile is held while the cache is read and changed, so that the models of a batch, and any other bbi processes
+// sharing the cache, don't interleave their changes
+const cacheLockFile string = ".bbi_cache.lock"
+
+// cacheLockAbandoned is how long a lock may be held before it is considered abandoned by a process which exited without
+// releasing it. Locks are only held while copying an executable and updating the metadata of the cache
+const cacheLockAbandoned time.Duration = 10 * time.Minute
+
+// cacheLockPoll is the interval at which a held lock is checked for release
+const cacheLockPoll time.Duration = 100 * time.Millisecond
+
+// generatedCodeFiles are the files written by NM-TRAN which, with the PREDPP routines listed in LINK.LNK, determine the compiled executable
+var generatedCodeFiles []string = []string{
+	"FSUBS",
+	"FSUBS.f90",
+	"FSUBS2",
+	"FSUBS_MU.F90",
+	"FSIZES",
+	"PRSIZES.f90",
+	"LINK.LNK",
+}
+
+var (
+	cacheMaxEntries    int
+	cacheOlderThan     string
+	cachePruneAll      bool
+	cacheDirectoryFlag string
+)
+
+// cacheEntry is a compiled nonmem executable stored in the cache, keyed by the digest of the code generated for it and
+// the nonmem settings it was compiled with
+type cacheEntry struct {
+	Key       string    `json:"key"`
+	NMVersion string    `json:"nm_version"`
+	Model     string    `json:"model"`
+	Created   time.Time `json:"created"`
+	LastUsed  time.Time `json:"last_used"`
+	Uses      int       `json:"uses"`
+	Size      int64     `json:"size"`
+	path      string
+}
+
+func (e cacheEntry) executable() string {
+	return filepath.Join(e.path, nonmemExecutableName())
+}
+
+// write replaces the metadata of the entry by renaming a complete file over it, so it is never read partially written
+func (e cacheEntry) write() error {
+	contents, err := json.MarshalIndent(e, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(e.path, cacheMetadataFile)
+	temporary := fmt.Sprintf("%s.%d", path, os.Getpid())
+
+	if err = afero.WriteFile(afero.NewOsFs(), temporary, contents, 0640); err != nil {
+		return err
+	}
+
+	return os.Rename(temporary, path)
+}
+
+// lockCache creates the lock file of the cache, waiting while another model or process holds it. The returned function
+// releases the lock
+func lockCache(cacheDir string) (func(), error) {
+	if err := os.MkdirAll(cacheDir, 0750); err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(cacheDir, cacheLockFile)
+
+	for {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0640)
+		if err == nil {
+			fmt.Fprintf(f, "%d\n", os.Getpid())
+			f.Close()
+
+			return func() {
+				os.Remove(path)
+			}, nil
+		}
+
+		if !os.IsExist(err) {
+			return nil, err
+		}
+
+		if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) > cacheLockAbandoned {
+			log.Warnf("Removing the cache lock %s, which has been held for over %s", path, cacheLockAbandoned)
+
+			if err = os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return nil, err
+			}
+
+			continue
+		}
+
+		time.Sleep(cacheLockPoll)
+	}
+}
+
+func nonmemExecutableName() string {
+	if os.PathSeparator == '\\' {
+		return "nonmem.exe"
+	}
+
+	return "nonmem"
+}
+
+// nmtranArguments are the options nmfe passes on to NM-TRAN, which change the code it generates
+func nmtranArguments(config configlib.Config) []string {
+	var arguments []string
+
+	if config.NMFEOptions.PRDefault {
+		arguments = append(arguments, "-prdefault")
+	}
+
+	if config.NMFEOptions.TPRDefault {
+		arguments = append(arguments, "-tprdefault")
+	}
+
+	if config.NMFEOptions.MaxLim < 50 {
+		arguments = append(arguments, "-maxlim="+strconv.Itoa(config.NMFEOptions.MaxLim))
+	}
+
+	return arguments
+}
+
+// translateModel runs NM-TRAN on the control stream in the output directory, as nmfe does before compiling, so the
+// generated code can be looked up in the cache before choosing whether to compile
+func translateModel(model *NonMemModel) error {
+	_, detail := effectiveNonMemVersion(model.Configuration)
+	if detail.Home == "" {
+		return errors.New("no nonmem installation is configured to run NM-TRAN with")
+	}
+
+	control, err := os.Open(filepath.Join(model.OutputDir, model.Model))
+	if err != nil {
+		return err
+	}
+	defer control.Close()
+
+	command := exec.Command(filepath.Join(detail.Home, "tr", "NMTRAN.exe"), nmtranArguments(model.Configuration)...)
+	command.Dir = model.OutputDir
+	command.Stdin = control
+
+	if output, err := command.CombinedOutput(); err != nil {
+		return fmt.Errorf("NM-TRAN failed: %s: %s", err, strings.TrimSpace(string(output)))
+	}
+
+	return nil
+}
+
+// executableCacheKey digests the code NM-TRAN generated in the output directory of the model along with the nonmem
+// installation and NMFE options it is compiled with
+func executableCacheKey(model *NonMemModel) (string, error) {
+	code, err := generatedCodeKey(model.OutputDir)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%x", md5.Sum([]byte(code+"\n"+nonmemSettingsHash(model.Configuration)))), nil
+}
+
+// generatedCodeKey digests the code NM-TRAN generated in the directory
+func generatedCodeKey(dir string) (string, error) {
+	h := md5.New()
+	found := false
+
+	for _, f := range generatedCodeFiles {
+		contents, err := ioutil.ReadFile(filepath.Join(dir, f))
+		if err != nil {
+			continue
+		}
+
+		found = true
+		fmt.Fprintf(h, "%s\n", f)
+		h.Write(contents)
+	}
+
+	if !found {
+		return "", fmt.Errorf("no generated code was located in %s", dir)
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+func readCacheEntries(cacheDir string) ([]cacheEntry, error) {
+	var entries []cacheEntry
+
+	contents, err := ioutil.ReadDir(cacheDir)
+	if err != nil {
+		return entries, err
+	}
+
+	for _, c := range contents {
+		if !c.IsDir() {
+			continue
+		}
+
+		metadata, err := ioutil.ReadFile(filepath.Join(cacheDir, c.Name(), cacheMetadataFile))
+		if err != nil {
+			continue
+		}
+
+		var e cacheEntry
+		if err = json.Unmarshal(metadata, &e); err != nil {
+			log.Warnf("Unable to parse the cache entry in %s: %s", filepath.Join(cacheDir, c.Name()), err)
+			continue
+		}
+
+		e.path = filepath.Join(cacheDir, c.Name())
+		entries = append(entries, e)
+	}
+
+	return entries, nil
+}
+
+// cacheEntryForKey reads the entry stored under the key, returning nil if the cache has none
+func cacheEntryForKey(cacheDir string, key string) (*cacheEntry, error) {
+	path := filepath.Join(cacheDir, key)
+
+	metadata, err := ioutil.ReadFile(filepath.Join(path, cacheMetadataFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var e cacheEntry
+	if err = json.Unmarshal(metadata, &e); err != nil {
+		return nil, fmt.Errorf("unable to parse the cache entry in %s: %w", path, err)
+	}
+
+	e.path = path
+
+	return &e, nil
+}
+
+// cacheEnabled indicates whether compiled executables should be looked up and stored for this model
+func cacheEnabled(model *NonMemModel) bool {
+	return model.Configuration.CacheDir != "" && !model.Configuration.NMQual && !model.Configuration.NMFEOptions.NoBuild
+}
+
+// useCachedExecutable copies a previously compiled executable into the output directory if one is available for the model.
+// Explicitly named executables (cache_exe) are used as provided. Otherwise NM-TRAN is run first, and the cache is searched
+// for an executable compiled from the same generated code
+func useCachedExecutable(model *NonMemModel) error {
+	if !cacheEnabled(model) {
+		return nil
+	}
+
+	fs := afero.NewOsFs()
+	config := model.Configuration
+
+	if config.CacheExe != "" {
+		err := utils.SetupCacheForRun(fs, model.OriginalPath, model.OutputDir, config.CacheDir, config.CacheExe, config.Debug)
+		if err != nil {
+			return err
+		}
+
+		model.CachedExecutable = config.CacheExe
+		return nil
+	}
+
+	if err := translateModel(model); err != nil {
+		return err
+	}
+
+	key, err := executableCacheKey(model)
+	if err != nil {
+		return err
+	}
+
+	model.cacheKey = key
+
+	unlock, err := lockCache(config.CacheDir)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	entry, err := cacheEntryForKey(config.CacheDir, key)
+	if err != nil || entry == nil {
+		log.Debugf("%s No cached executable located for key %s", model.LogIdentifier(), key)
+		return err
+	}
+
+	err = utils.SetupCacheForRun(fs, model.OriginalPath, model.OutputDir, entry.path, nonmemExecutableName(), config.Debug)
+	if err != nil {
+		return err
+	}
+
+	entry.LastUsed = time.Now()
+	entry.Uses++
+	model.CachedExecutable = entry.Key
+
+	log.Infof("%s Using cached nonmem executable %s", model.LogIdentifier(), entry.Key)
+
+	return entry.write()
+}
+
+// cacheCompiledExecutable stores the executable built for the model, keyed by the code NM-TRAN generated. If the model ran
+// with an executable from the cache, the code nmfe generated is checked against the key it was chosen by, and an entry
+// which doesn't match is removed
+func cacheCompiledExecutable(model *NonMemModel) error {
+	if !cacheEnabled(model) {
+		return nil
+	}
+
+	fs := afero.NewOsFs()
+	config := model.Configuration
+
+	if config.SaveExe != "" {
+		if err := utils.CopyExeToCache(fs, model.OutputDir, config.CacheDir, config.SaveExe); err != nil {
+			log.Errorf("%s Unable to save the executable as %s: %s", model.LogIdentifier(), config.SaveExe, err)
+		}
+	}
+
+	//Named executables are the responsibility of the user
+	if config.CacheExe != "" || model.cacheKey == "" {
+		return nil
+	}
+
+	key, err := executableCacheKey(model)
+	if err != nil {
+		log.Warnf("%s Unable to cache the compiled executable: %s", model.LogIdentifier(), err)
+		return nil
+	}
+
+	unlock, err := lockCache(config.CacheDir)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if model.CachedExecutable != "" {
+		if model.CachedExecutable == key {
+			return nil
+		}
+
+		//NM-TRAN generated the same code before the executable was chosen, so this entry is not to be trusted again
+		log.Errorf("%s The code generated by nmfe differs from that the cached executable %s was chosen by. The entry is "+
+			"removed from the cache", model.LogIdentifier(), model.CachedExecutable)
+
+		return os.RemoveAll(filepath.Join(config.CacheDir, model.CachedExecutable))
+	}
+
+	entryPath := filepath.Join(config.CacheDir, key)
+	name, _ := effectiveNonMemVersion(config)
+
+	entry := cacheEntry{
+		Key:      key,
+		Created:  time.Now(),
+		LastUsed: time.Now(),
+		Model:    model.Path,
+		path:     entryPath,
+	}
+
+	if metadata, err := ioutil.ReadFile(filepath.Join(entryPath, cacheMetadataFile)); err == nil {
+		json.Unmarshal(metadata, &entry)
+		entry.path = entryPath
+	} else {
+		if err = fs.MkdirAll(entryPath, 0750); err != nil {
+			return err
+		}
+
+		if err = utils.CopyExeToCache(fs, model.OutputDir, entryPath, nonmemExecutableName()); err != nil {
+			return err
+		}
+
+		if err = os.Chmod(entry.executable(), 0750); err != nil {
+			return err
+		}
+
+		entry.NMVersion = name
+		if stat, err := os.Stat(entry.executable()); err == nil {
+			entry.Size = stat.Size()
+		}
+
+		log.Infof("%s Stored compiled nonmem executable in the cache as %s", model.LogIdentifier(), key)
+	}
+
+	if err = entry.write(); err != nil {
+		return err
+	}
+
+	if config.CacheMaxEntries > 0 {
+		if _, err := pruneCache(config.CacheDir, config.CacheMaxEntries, 0); err != nil {
+			log.Warnf("Unable to evict entries from the cache: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// pruneCache removes entries not used within olderThan (if non-zero) and then the least recently used entries beyond maxEntries (if non-zero)
+func pruneCache(cacheDir string, maxEntries int, olderThan time.Duration) ([]cacheEntry, error) {
+	entries, err := readCacheEntries(cacheDir)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].LastUsed.After(entries[j].LastUsed)
+	})
+
+	var removed []cacheEntry
+
+	for i, e := range entries {
+		expired := olderThan > 0 && time.Since(e.LastUsed) > olderThan
+		excess := maxEntries > 0 && i >= maxEntries
+
+		if !expired && !excess {
+			continue
+		}
+
+		if err := os.RemoveAll(e.path); err != nil {
+			return removed, err
+		}
+
+		removed = append(removed, e)
+	}
+
+	return removed, nil
+}
+
+const cacheLongDescription string = `manage the cache of compiled nonmem executables used when --cache_dir is set, for example:
+bbi nonmem cache ls --cache_dir nmcache
+bbi nonmem cache prune --cache_dir nmcache --max_entries 10
+bbi nonmem cache prune --cache_dir nmcache --older_than 720h
+bbi nonmem cache prune --cache_dir nmcache --all
+ `
+
+var cacheCmd = &cobra.Command{
+	Use:   "cache",
+	Short: "list or prune the cache of compiled nonmem executables",
+	Long:  cacheLongDescription,
+	Run: func(cmd *cobra.Command, args []string) {
+		println(cacheLongDescription)
+	},
+}
+
+var cacheLsCmd = &cobra.Command{
+	Use:   "ls",
+	Short: "list the compiled nonmem executables in the cache",
+	Long:  cacheLongDescription,
+	Run:   cacheLs,
+}
+
+var cachePruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "evict compiled nonmem executables from the cache",
+	Long:  cacheLongDescription,
+	Run:   cachePrune,
+}
+
+func init() {
+	nonmemCmd.AddCommand(cacheCmd)
+	cacheCmd.AddCommand(cacheLsCmd)
+	cacheCmd.AddCommand(cachePruneCmd)
+
+	cacheCmd.PersistentFlags().StringVar(&cacheDirectoryFlag, "cache_dir", "", "directory path for cache of nonmem executables. Defaults to the cache_dir in bbi.yaml")
+
+	cachePruneCmd.Flags().IntVar(&cacheMaxEntries, "max_entries", 0, "Keep at most this many of the most recently used executables")
+	cachePruneCmd.Flags().StringVar(&cacheOlderThan, "older_than", "", "Remove executables which have not been used within this duration (e.g. 720h)")
+	cachePruneCmd.Flags().BoolVar(&cachePruneAll, "all", false, "Remove every executable from the cache")
+}
+
+// cacheDirectory locates the cache from the flag or the config file, relative to the current directory
+func cacheDirectory() (string, error) {
+	cacheDir := cacheDirectoryFlag
+
+	//The config is optional here, so it is only used if present. Only the cache_dir is of interest
+	if cacheDir == "" {
+		if config, err := configlib.LocateAndReadConfigFile(); err == nil {
+			cacheDir = config.CacheDir
+		}
+	}
+
+	if cacheDir == "" {
+		return "", errors.New("no cache directory was provided with --cache_dir or located in bbi.yaml")
+	}
+
+	return filepath.Abs(cacheDir)
+}
+
+func cacheLs(cmd *cobra.Command, args []string) {
+	cacheDir, err := cacheDirectory()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	entries, err := readCacheEntries(cacheDir)
+	if err != nil {
+		log.Fatalf("Unable to read the cache at %s: %s", cacheDir, err)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].LastUsed.After(entries[j].LastUsed)
+	})
+
+	if Json {
+		jsonRes, _ := json.MarshalIndent(entries, "", "\t")
+		fmt.Printf("%s\n", jsonRes)
+		return
+	}
+
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetAlignment(tablewriter.ALIGN_LEFT)
+	table.SetHeader([]string{"Key", "NM Version", "Built From", "Uses", "Last Used", "Size (MB)"})
+
+	for _, e := range entries {
+		table.Append([]string{
+			e.Key,
+			e.NMVersion,
+			filepath.Base(e.Model),
+			strconv.Itoa(e.Uses),
+			e.LastUsed.Format(time.RFC3339),
+			fmt.Sprintf("%.1f", float64(e.Size)/1024/1024),
+		})
+	}
+
+	table.Render()
+}
+
+func cachePrune(cmd *cobra.Command, args []string) {
+	cacheDir, err := cacheDirectory()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var olderThan time.Duration
+	if cacheOlderThan != "" {
+		olderThan, err = time.ParseDuration(cacheOlderThan)
+		if err != nil {
+			log.Fatalf("Unable to parse older_than value of %s: %s", cacheOlderThan, err)
+		}
+	}
+
+	if cachePruneAll {
+		//Any entry is older than a nanosecond
+		olderThan = time.Nanosecond
+	}
+
+	if olderThan == 0 && cacheMaxEntries == 0 {
+		log.Fatal("Please specify one of --max_entries, --older_than or --all")
+	}
+
+	unlock, err := lockCache(cacheDir)
+	if err != nil {
+		log.Fatalf("Unable to lock the cache at %s: %s", cacheDir, err)
+	}
+
+	removed, err := pruneCache(cacheDir, cacheMaxEntries, olderThan)
+	unlock()
+
+	for _, e := range removed {
+		log.Infof("Removed cached executable %s built from %s", e.Key, filepath.Base(e.Model))
+	}
+
+	if err != nil {
+		log.Fatalf("An error occurred pruning the cache: %s", err)
+	}
+
+	log.Infof("Removed %d executables from the cache", len(removed))
+}
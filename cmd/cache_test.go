@@ -0,0 +1,186 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"bbi/configlib"
+)
+
+func Test_useCachedExecutable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bbi_cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	//NM-TRAN stands in as a script generating code from everything but the problem and the initial estimates, failing
+	//on control streams it can't translate
+	home := filepath.Join(dir, "nm75")
+	os.MkdirAll(filepath.Join(home, "tr"), 0750)
+	ioutil.WriteFile(filepath.Join(home, "tr", "NMTRAN.exe"), []byte("#!/bin/sh\n"+
+		"input=$(cat)\n"+
+		"echo \"$input\" | grep -q INVALID && { echo 'AN ERROR WAS FOUND IN THE CONTROL STREAM'; exit 1; }\n"+
+		"echo \"$input\" | grep -v -e '^\\$PROBLEM' -e '^\\$THETA' > FSUBS\n"), 0750)
+
+	config := configlib.Config{
+		CacheDir: filepath.Join(dir, "cache"),
+		Nonmem: map[string]configlib.NonMemDetail{
+			"nm75": {Home: home, Executable: "nmfe75", Default: true},
+		},
+	}
+
+	model := func(name string, contents string) *NonMemModel {
+		outputDir := filepath.Join(dir, name)
+		os.MkdirAll(outputDir, 0750)
+		ioutil.WriteFile(filepath.Join(outputDir, name+".mod"), []byte(contents), 0640)
+
+		return &NonMemModel{
+			Path:          filepath.Join(dir, name+".mod"),
+			Model:         name + ".mod",
+			FileName:      name,
+			OriginalPath:  dir,
+			OutputDir:     outputDir,
+			Configuration: config,
+		}
+	}
+
+	compiled := model("run001", "$PROBLEM base\n$PK\nCL = THETA(1)\n$THETA (0, 2)\n")
+	if err = useCachedExecutable(compiled); err != nil || compiled.CachedExecutable != "" {
+		t.Fatalf("useCachedExecutable() with an empty cache = %s, %v", compiled.CachedExecutable, err)
+	}
+
+	//nmfe compiles the model, whose executable is then stored under the code NM-TRAN generated
+	ioutil.WriteFile(filepath.Join(compiled.OutputDir, nonmemExecutableName()), []byte("compiled"), 0750)
+	if err = cacheCompiledExecutable(compiled); err != nil {
+		t.Fatalf("cacheCompiledExecutable() error = %s", err)
+	}
+
+	estimates := model("run002", "$PROBLEM new estimates\n$PK\nCL = THETA(1)\n$THETA (0, 4) FIX\n")
+	if err = useCachedExecutable(estimates); err != nil || estimates.CachedExecutable != compiled.cacheKey {
+		t.Errorf("useCachedExecutable() for the same generated code = %s, %v. Want %s", estimates.CachedExecutable, err, compiled.cacheKey)
+	}
+
+	if contents, _ := ioutil.ReadFile(filepath.Join(estimates.OutputDir, nonmemExecutableName())); string(contents) != "compiled" {
+		t.Errorf("useCachedExecutable() did not copy the cached executable")
+	}
+
+	code := model("run003", "$PROBLEM new code\n$PK\nCL = THETA(1) * EXP(ETA(1))\n$THETA (0, 2)\n")
+	if err = useCachedExecutable(code); err != nil || code.CachedExecutable != "" {
+		t.Errorf("useCachedExecutable() for different generated code = %s, %v", code.CachedExecutable, err)
+	}
+
+	//The nonmem installation the executable is compiled with is part of the key
+	settings := model("run004", "$PROBLEM base\n$PK\nCL = THETA(1)\n$THETA (0, 2)\n")
+	settings.Configuration.NMFEOptions.MaxLim = 2
+	if err = useCachedExecutable(settings); err != nil || settings.CachedExecutable != "" {
+		t.Errorf("useCachedExecutable() with different NMFE options = %s, %v", settings.CachedExecutable, err)
+	}
+
+	//Models NM-TRAN can't translate are compiled by nmfe, which reports the error
+	if err = useCachedExecutable(model("run005", "$PROBLEM INVALID\n")); err == nil {
+		t.Errorf("useCachedExecutable() of a model NM-TRAN rejected did not fail")
+	}
+
+	//Code generated by nmfe which differs from the key the executable was chosen by removes the entry without failing
+	ioutil.WriteFile(filepath.Join(estimates.OutputDir, "FSUBS"), []byte("changed"), 0640)
+	if err = cacheCompiledExecutable(estimates); err != nil {
+		t.Errorf("cacheCompiledExecutable() after a mismatch error = %s", err)
+	}
+
+	if entry, _ := cacheEntryForKey(config.CacheDir, compiled.cacheKey); entry != nil {
+		t.Errorf("cacheCompiledExecutable() kept the entry which didn't match the generated code")
+	}
+}
+
+func Test_pruneCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bbi_cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for i, used := range []time.Duration{time.Hour, 48 * time.Hour, time.Minute} {
+		e := cacheEntry{
+			Key:      string(rune('a' + i)),
+			LastUsed: time.Now().Add(-used),
+			path:     filepath.Join(dir, string(rune('a'+i))),
+		}
+		os.Mkdir(e.path, 0755)
+		e.write()
+	}
+
+	removed, err := pruneCache(dir, 0, 24*time.Hour)
+	if err != nil || len(removed) != 1 || removed[0].Key != "b" {
+		t.Fatalf("pruneCache() by age removed %v, %v. Want entry b", removed, err)
+	}
+
+	removed, err = pruneCache(dir, 1, 0)
+	if err != nil || len(removed) != 1 || removed[0].Key != "a" {
+		t.Fatalf("pruneCache() by count removed %v, %v. Want least recently used entry a", removed, err)
+	}
+
+	entries, _ := readCacheEntries(dir)
+	if len(entries) != 1 || entries[0].Key != "c" {
+		t.Errorf("readCacheEntries() after pruning = %v, want only entry c", entries)
+	}
+}
+
+func Test_lockCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bbi_cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	//The cache directory is created if it doesn't exist yet
+	cacheDir := filepath.Join(dir, "nmcache")
+
+	unlock, err := lockCache(cacheDir)
+	if err != nil {
+		t.Fatalf("lockCache() error = %s", err)
+	}
+
+	acquired := make(chan func())
+	go func() {
+		second, err := lockCache(cacheDir)
+		if err != nil {
+			t.Errorf("lockCache() error = %s", err)
+		}
+		acquired <- second
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatalf("lockCache() acquired a held lock")
+	case <-time.After(5 * cacheLockPoll):
+	}
+
+	unlock()
+
+	select {
+	case second := <-acquired:
+		second()
+	case <-time.After(time.Second):
+		t.Fatalf("lockCache() wasn't acquired once released")
+	}
+
+	//Locks left by processes which exited while holding them are removed
+	lock := filepath.Join(cacheDir, cacheLockFile)
+	ioutil.WriteFile(lock, []byte("1\n"), 0640)
+	abandoned := time.Now().Add(-2 * cacheLockAbandoned)
+	os.Chtimes(lock, abandoned, abandoned)
+
+	unlock, err = lockCache(cacheDir)
+	if err != nil {
+		t.Fatalf("lockCache() of an abandoned lock error = %s", err)
+	}
+	unlock()
+
+	if _, err = os.Stat(lock); !os.IsNotExist(err) {
+		t.Errorf("the lock file remained after it was released")
+	}
+}
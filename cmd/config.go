@@ -0,0 +1,218 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"bbi/configlib"
+	"github.com/olekukonko/tablewriter"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var showEffective bool
+
+const configLongDescription string = `inspect and validate the configuration, for example:
+bbi config show
+bbi config show --effective
+bbi config validate
+bbi config validate bbi.yaml ~/.config/bbi/bbi.yaml
+bbi config schema > bbi.schema.json
+
+Configuration is merged from /etc/bbi/bbi.yaml, the user's ~/.config/bbi/bbi.yaml, the bbi.yaml of the current
+directory and the file provided with --config, in that order. Flags and BBI_ environment variables take precedence
+over all of them.
+ `
+
+// configCmd represents the config command
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "inspect and validate the configuration",
+	Long:  configLongDescription,
+}
+
+var configShowCmd = &cobra.Command{
+	Use:   "show",
+	Short: "list the configuration files, or with --effective the merged settings and their sources",
+	Long:  configLongDescription,
+	Run:   configShow,
+}
+
+var configValidateCmd = &cobra.Command{
+	Use:   "validate [files]",
+	Short: "validate configuration files against the schema of bbi.yaml, exiting non-zero on errors",
+	Long:  configLongDescription,
+	Run:   configValidate,
+}
+
+var configSchemaCmd = &cobra.Command{
+	Use:   "schema",
+	Short: "print the JSON Schema of bbi.yaml",
+	Long:  configLongDescription,
+	Run:   configSchema,
+}
+
+func init() {
+	RootCmd.AddCommand(configCmd)
+	configCmd.AddCommand(configShowCmd)
+	configCmd.AddCommand(configValidateCmd)
+	configCmd.AddCommand(configSchemaCmd)
+
+	configShowCmd.Flags().BoolVar(&showEffective, "effective", false, "Show every setting of the merged configuration and where its value came from")
+}
+
+func configShow(cmd *cobra.Command, args []string) {
+	if !showEffective {
+		layers, err := configlib.ConfigLayers()
+		if err != nil {
+			log.Fatalf("Unable to locate the configuration: %s", err)
+		}
+
+		if Json {
+			jsonRes, _ := json.MarshalIndent(layers, "", "\t")
+			fmt.Printf("%s\n", jsonRes)
+			return
+		}
+
+		printConfigLayers(os.Stdout, layers)
+		return
+	}
+
+	layers, values, err := configlib.EffectiveConfig(func(key string) bool {
+		return flagChanged(cmd.Flags(), key)
+	})
+
+	if err != nil {
+		log.Fatalf("Failed to process configuration: %s", err)
+	}
+
+	if Json {
+		jsonRes, _ := json.MarshalIndent(struct {
+			Layers []configlib.ConfigLayer `json:"layers"`
+			Values []configlib.ConfigValue `json:"values"`
+		}{layers, values}, "", "\t")
+		fmt.Printf("%s\n", jsonRes)
+		return
+	}
+
+	printConfigLayers(os.Stdout, layers)
+	fmt.Println()
+	printConfigValues(os.Stdout, values)
+}
+
+func configValidate(cmd *cobra.Command, args []string) {
+	files := args
+
+	if len(files) == 0 {
+		layers, err := configlib.ConfigLayers()
+		if err != nil {
+			log.Fatalf("Unable to locate the configuration: %s", err)
+		}
+
+		for _, l := range layers {
+			if l.Found || l.Name == "config" {
+				files = append(files, l.Path)
+			}
+		}
+
+		if len(files) == 0 {
+			log.Fatal("No configuration files were located to validate")
+		}
+	}
+
+	results := validateConfigFiles(files)
+
+	if Json {
+		jsonRes, _ := json.MarshalIndent(results, "", "\t")
+		fmt.Printf("%s\n", jsonRes)
+	} else {
+		for _, r := range results {
+			if r.Valid {
+				fmt.Printf("%s is valid\n", r.File)
+				continue
+			}
+
+			for _, e := range r.Errors {
+				fmt.Println(e)
+			}
+		}
+	}
+
+	for _, r := range results {
+		if !r.Valid {
+			os.Exit(1)
+		}
+	}
+}
+
+func configSchema(cmd *cobra.Command, args []string) {
+	jsonRes, _ := json.MarshalIndent(configlib.Schema(), "", "\t")
+	fmt.Printf("%s\n", jsonRes)
+}
+
+// configValidation is the outcome of validating a single configuration file
+type configValidation struct {
+	File   string   `json:"file"`
+	Valid  bool     `json:"valid"`
+	Errors []string `json:"errors,omitempty"`
+}
+
+func validateConfigFiles(files []string) []configValidation {
+	var results []configValidation
+
+	for _, f := range files {
+		result := configValidation{
+			File:  f,
+			Valid: true,
+		}
+
+		err := configlib.ValidateConfigFile(f)
+
+		if validation, ok := err.(configlib.ValidationErrors); ok {
+			for _, e := range validation {
+				result.Errors = append(result.Errors, e.Error())
+			}
+		} else if err != nil {
+			result.Errors = append(result.Errors, fmt.Sprintf("%s: %s", f, err))
+		}
+
+		result.Valid = len(result.Errors) == 0
+		results = append(results, result)
+	}
+
+	return results
+}
+
+func printConfigLayers(out io.Writer, layers []configlib.ConfigLayer) {
+	table := tablewriter.NewWriter(out)
+	table.SetAlignment(tablewriter.ALIGN_LEFT)
+	table.SetAutoWrapText(false)
+	table.SetHeader([]string{"Layer", "Path", "Found"})
+
+	for _, l := range layers {
+		table.Append([]string{l.Name, l.Path, fmt.Sprintf("%t", l.Found)})
+	}
+
+	table.Render()
+}
+
+func printConfigValues(out io.Writer, values []configlib.ConfigValue) {
+	table := tablewriter.NewWriter(out)
+	table.SetAlignment(tablewriter.ALIGN_LEFT)
+	table.SetAutoWrapText(false)
+	table.SetHeader([]string{"Key", "Value", "Source"})
+
+	for _, v := range values {
+		source := v.Source
+		if v.Origin != "" {
+			source = fmt.Sprintf("%s (%s)", v.Source, v.Origin)
+		}
+
+		table.Append([]string{v.Key, strings.TrimSpace(fmt.Sprintf("%v", v.Value)), source})
+	}
+
+	table.Render()
+}
@@ -0,0 +1,356 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	parser "bbi/parsers/nmparser"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	phaseQueued    string = "queued"
+	phasePrepare   string = "prepare"
+	phaseWork      string = "work"
+	phaseCleanup   string = "cleanup"
+	phaseSubmitted string = "submitted"
+	phaseCompleted string = "completed"
+	phaseFailed    string = "failed"
+	phaseCancelled string = "cancelled"
+)
+
+// dashboardMessages is the number of recent log lines shown beneath the models
+const dashboardMessages int = 5
+
+var tuiEnabled bool
+
+// dashboard is the terminal dashboard of the batch in progress. All of its methods are no-ops when it is nil, which is
+// the case unless --tui was requested and stdout is a terminal
+var dashboard *batchDashboard
+
+type dashboardEntry struct {
+	Path      string
+	Model     string
+	FileName  string
+	OutputDir string
+	Phase     string
+	Started   time.Time
+	Finished  time.Time
+	Error     string
+	Progress  parser.ExtProgress
+	HasExt    bool
+}
+
+type batchDashboard struct {
+	lock     sync.Mutex
+	entries  []*dashboardEntry
+	started  time.Time
+	messages []string
+	out      *os.File
+	previous io.Writer
+	done     chan bool
+	stopped  chan bool
+}
+
+// startDashboard takes over the terminal to display the progress of the models. Logging is redirected into the
+// dashboard, and to the log file if one is configured. If stdout is not a terminal, nil is returned and logging is unchanged
+func startDashboard(models []*NonMemModel) *batchDashboard {
+	if !tuiEnabled {
+		return nil
+	}
+
+	if eventsTarget == "-" {
+		log.Warn("--tui was requested, but stdout is taken by --events. Continuing with plain logs")
+		return nil
+	}
+
+	if !isTerminal(os.Stdout) {
+		log.Warn("--tui was requested, but stdout is not a terminal. Continuing with plain logs")
+		return nil
+	}
+
+	d := newBatchDashboard(models)
+	d.out = os.Stdout
+	d.done = make(chan bool)
+	d.stopped = make(chan bool)
+
+	d.previous = log.StandardLogger().Out
+	if logFileOutput != nil {
+		log.SetOutput(io.MultiWriter(logFileOutput, d))
+	} else {
+		log.SetOutput(d)
+	}
+
+	//Leave the alternate screen even if bbi exits through log.Fatal
+	log.RegisterExitHandler(d.restoreTerminal)
+
+	//Alternate screen and hidden cursor
+	fmt.Fprint(d.out, "\033[?1049h\033[?25l")
+
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+
+		for {
+			d.refresh()
+
+			select {
+			case <-d.done:
+				close(d.stopped)
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	return d
+}
+
+func newBatchDashboard(models []*NonMemModel) *batchDashboard {
+	d := &batchDashboard{
+		started: time.Now(),
+	}
+
+	for _, m := range models {
+		d.entries = append(d.entries, &dashboardEntry{
+			Path:      m.Path,
+			Model:     m.Model,
+			FileName:  m.FileName,
+			OutputDir: m.OutputDir,
+			Phase:     phaseQueued,
+		})
+	}
+
+	return d
+}
+
+// Stop returns the terminal to its previous state and restores logging
+func (d *batchDashboard) Stop() {
+	if d == nil {
+		return
+	}
+
+	close(d.done)
+	<-d.stopped
+
+	d.restoreTerminal()
+	log.SetOutput(d.previous)
+}
+
+func (d *batchDashboard) restoreTerminal() {
+	fmt.Fprint(d.out, "\033[?25h\033[?1049l")
+}
+
+// Phase records the phase the model has entered
+func (d *batchDashboard) Phase(model *NonMemModel, phase string) {
+	if d == nil {
+		return
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	for _, e := range d.entries {
+		if e.Path != model.Path {
+			continue
+		}
+
+		now := time.Now()
+
+		if e.Phase == phaseQueued {
+			e.Started = now
+		}
+
+		e.Phase = phase
+		e.OutputDir = model.OutputDir
+
+		if phase == phaseCompleted || phase == phaseSubmitted {
+			e.Finished = now
+		}
+	}
+}
+
+// Failed records the error of the model identified as in the turnstile error list, either by model or file name
+func (d *batchDashboard) Failed(identifier string, err error) {
+	if d == nil {
+		return
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	for _, e := range d.entries {
+		if e.Model != identifier && e.FileName != identifier {
+			continue
+		}
+
+		e.Phase = phaseFailed
+		if errors.Is(err, errExecutionCancelled) {
+			e.Phase = phaseCancelled
+		}
+
+		if err != nil {
+			e.Error = err.Error()
+		}
+
+		e.Finished = time.Now()
+	}
+}
+
+// Write receives the log lines emitted while the dashboard is displayed
+func (d *batchDashboard) Write(p []byte) (int, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		d.messages = append(d.messages, line)
+	}
+
+	if len(d.messages) > dashboardMessages {
+		d.messages = d.messages[len(d.messages)-dashboardMessages:]
+	}
+
+	return len(p), nil
+}
+
+func (d *batchDashboard) refresh() {
+	width, height := terminalSize(d.out)
+
+	d.lock.Lock()
+	for _, e := range d.entries {
+		if e.Phase == phaseWork {
+			e.readProgress()
+		}
+	}
+	screen := d.render(time.Now(), width, height)
+	d.lock.Unlock()
+
+	fmt.Fprint(d.out, "\033[H\033[2J"+screen)
+}
+
+func (e *dashboardEntry) readProgress() {
+	if progress, err := readExtProgress(e.OutputDir, e.FileName); err == nil {
+		e.Progress = progress
+		e.HasExt = true
+	}
+}
+
+// render lays out the summary, the models which fit on the screen and the recent log messages. It must be called with the lock held
+func (d *batchDashboard) render(now time.Time, width int, height int) string {
+	counts := make(map[string]int)
+	for _, e := range d.entries {
+		counts[e.Phase]++
+	}
+
+	active := counts[phasePrepare] + counts[phaseWork] + counts[phaseCleanup]
+	finished := counts[phaseCompleted] + counts[phaseSubmitted] + counts[phaseFailed] + counts[phaseCancelled]
+	elapsed := now.Sub(d.started).Round(time.Second)
+
+	throughput := 0.0
+	if minutes := now.Sub(d.started).Minutes(); minutes > 0 {
+		throughput = float64(finished) / minutes
+	}
+
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "bbi  %d/%d finished  %d completed  %d submitted  %d failed  %d cancelled  %d running  %d queued\n",
+		finished, len(d.entries), counts[phaseCompleted], counts[phaseSubmitted], counts[phaseFailed], counts[phaseCancelled], active, counts[phaseQueued])
+	fmt.Fprintf(&buf, "elapsed %s  throughput %.2f models/min\n\n", elapsed, throughput)
+
+	//Space for the summary, the table header and the messages
+	rows := height - 5 - dashboardMessages - 2
+	if rows < 1 {
+		rows = 1
+	}
+
+	entries := d.orderedEntries()
+	hidden := 0
+	if len(entries) > rows {
+		hidden = len(entries) - rows
+		entries = entries[:rows]
+	}
+
+	table := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "MODEL\tPHASE\tELAPSED\tITERATION\tOFV\tERROR")
+
+	for _, e := range entries {
+		elapsed := ""
+		if !e.Started.IsZero() {
+			end := now
+			if !e.Finished.IsZero() {
+				end = e.Finished
+			}
+			elapsed = end.Sub(e.Started).Round(time.Second).String()
+		}
+
+		iteration, ofv := "", ""
+		if e.HasExt {
+			iteration = strconv.Itoa(e.Progress.Iteration)
+			ofv = strconv.FormatFloat(e.Progress.OFV, 'f', 3, 64)
+		}
+
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\t%s\n", e.Model, e.Phase, elapsed, iteration, ofv, e.Error)
+	}
+
+	table.Flush()
+
+	if hidden > 0 {
+		fmt.Fprintf(&buf, "... %d more\n", hidden)
+	}
+
+	buf.WriteString("\n")
+	for _, m := range d.messages {
+		buf.WriteString(m + "\n")
+	}
+
+	//Long lines would wrap and push the summary off the screen
+	var lines []string
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if width > 0 && len(line) > width {
+			line = line[:width]
+		}
+		lines = append(lines, line)
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// orderedEntries places running models first, then failures, queued models and finally finished models, most recent first
+func (d *batchDashboard) orderedEntries() []*dashboardEntry {
+	rank := map[string]int{
+		phasePrepare:   0,
+		phaseWork:      0,
+		phaseCleanup:   0,
+		phaseFailed:    1,
+		phaseCancelled: 1,
+		phaseQueued:    2,
+		phaseSubmitted: 3,
+		phaseCompleted: 3,
+	}
+
+	entries := make([]*dashboardEntry, len(d.entries))
+	copy(entries, d.entries)
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		if rank[entries[i].Phase] != rank[entries[j].Phase] {
+			return rank[entries[i].Phase] < rank[entries[j].Phase]
+		}
+
+		if rank[entries[i].Phase] == 0 {
+			return entries[i].Started.Before(entries[j].Started)
+		}
+
+		return entries[i].Finished.After(entries[j].Finished)
+	})
+
+	return entries
+}
@@ -0,0 +1,82 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_batchDashboard_render(t *testing.T) {
+	var models []*NonMemModel
+	for i := 1; i <= 4; i++ {
+		name := fmt.Sprintf("run00%d", i)
+		models = append(models, &NonMemModel{Path: "/data/" + name + ".mod", Model: name + ".mod", FileName: name})
+	}
+
+	d := newBatchDashboard(models)
+	d.Phase(models[0], phasePrepare)
+	d.Phase(models[0], phaseWork)
+	d.Phase(models[1], phasePrepare)
+	d.Failed("run002", errors.New("nmtran failed"))
+	d.Phase(models[2], phasePrepare)
+	d.Failed("run003.mod", errExecutionCancelled)
+
+	for i := 0; i < dashboardMessages+2; i++ {
+		fmt.Fprintf(d, "message %d\n", i)
+	}
+
+	screen := d.render(d.started.Add(time.Minute), 200, 40)
+
+	if !strings.Contains(screen, "2/4 finished") || !strings.Contains(screen, "1 failed  1 cancelled  1 running  1 queued") {
+		t.Errorf("render() summary is incorrect:\n%s", screen)
+	}
+
+	if !strings.Contains(screen, "throughput 2.00 models/min") {
+		t.Errorf("render() throughput is incorrect:\n%s", screen)
+	}
+
+	//Running models first, then failures, then queued models
+	order := []string{"run001.mod", "run002.mod", "run004.mod"}
+	last := 0
+	for _, m := range order {
+		i := strings.Index(screen, m)
+		if i < last {
+			t.Errorf("render() did not place %s after the preceding models:\n%s", m, screen)
+		}
+		last = i
+	}
+
+	if strings.Contains(screen, "message 0") || !strings.Contains(screen, fmt.Sprintf("message %d", dashboardMessages+1)) {
+		t.Errorf("render() did not keep only the latest %d messages:\n%s", dashboardMessages, screen)
+	}
+
+	//Models beyond the height of the terminal are summarised
+	screen = d.render(time.Now(), 30, 14)
+	if !strings.Contains(screen, "... 2 more") {
+		t.Errorf("render() did not summarise the models which do not fit:\n%s", screen)
+	}
+
+	for _, line := range strings.Split(screen, "\n") {
+		if len(line) > 30 {
+			t.Errorf("render() produced a line wider than the terminal: %s", line)
+		}
+	}
+}
+
+func Test_startDashboard(t *testing.T) {
+	defer func(enabled bool) { tuiEnabled = enabled }(tuiEnabled)
+
+	tuiEnabled = true
+
+	//Tests do not run with a terminal on stdout, so the dashboard falls back to plain logs
+	d := startDashboard([]*NonMemModel{{Path: "/data/run001.mod"}})
+	if d != nil {
+		t.Fatalf("startDashboard() returned a dashboard without a terminal")
+	}
+
+	d.Phase(&NonMemModel{Path: "/data/run001.mod"}, phaseWork)
+	d.Failed("run001", errors.New("failed"))
+	d.Stop()
+}
@@ -0,0 +1,30 @@
+//go:build !windows
+// +build !windows
+
+package cmd
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+
+	_, err = unix.IoctlGetWinsize(int(f.Fd()), unix.TIOCGWINSZ)
+
+	return err == nil
+}
+
+func terminalSize(f *os.File) (int, int) {
+	size, err := unix.IoctlGetWinsize(int(f.Fd()), unix.TIOCGWINSZ)
+	if err != nil {
+		return 0, 24
+	}
+
+	return int(size.Col), int(size.Row)
+}
@@ -0,0 +1,24 @@
+//go:build windows
+// +build windows
+
+package cmd
+
+import (
+	"os"
+)
+
+// The size of the console isn't looked up on windows, so the dashboard is drawn at a fixed size
+const (
+	windowsTerminalWidth  int = 80
+	windowsTerminalHeight int = 24
+)
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+func terminalSize(f *os.File) (int, int) {
+	return windowsTerminalWidth, windowsTerminalHeight
+}
@@ -0,0 +1,369 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"bbi/configlib"
+	"github.com/olekukonko/tablewriter"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/afero"
+	"github.com/spf13/cobra"
+)
+
+const (
+	checkPass string = "pass"
+	checkWarn string = "warn"
+	checkFail string = "fail"
+)
+
+// licenseWarningPeriod is how long before its expiry a nonmem license is reported as a warning
+const licenseWarningPeriod time.Duration = 30 * 24 * time.Hour
+
+const doctorLongDescription string = `check the environment bbi executes nonmem in, for example:
+bbi doctor
+bbi doctor --json
+
+Every nonmem installation in bbi.yaml is checked for a valid home, its nmfe executable, nmqual and the expiry of
+its license. The fortran compiler, mpiexec, qsub and the bbi binary used by grid jobs are also checked. Each check
+passes, warns or fails, and the command exits non-zero if any check fails.
+ `
+
+// doctorCmd represents the doctor command
+var doctorCmd = &cobra.Command{
+	Use:   "doctor",
+	Short: "diagnose the nonmem, compiler, mpi and grid environment",
+	Long:  doctorLongDescription,
+	Run:   doctor,
+}
+
+// diagnosticCheck is the outcome of a single check made by bbi doctor
+type diagnosticCheck struct {
+	Check   string `json:"check"`
+	Subject string `json:"subject,omitempty"`
+	Status  string `json:"status"`
+	Message string `json:"message"`
+}
+
+func passedCheck(check string, subject string, format string, args ...interface{}) diagnosticCheck {
+	return diagnosticCheck{Check: check, Subject: subject, Status: checkPass, Message: fmt.Sprintf(format, args...)}
+}
+
+func warnedCheck(check string, subject string, format string, args ...interface{}) diagnosticCheck {
+	return diagnosticCheck{Check: check, Subject: subject, Status: checkWarn, Message: fmt.Sprintf(format, args...)}
+}
+
+func failedCheck(check string, subject string, format string, args ...interface{}) diagnosticCheck {
+	return diagnosticCheck{Check: check, Subject: subject, Status: checkFail, Message: fmt.Sprintf(format, args...)}
+}
+
+func doctor(cmd *cobra.Command, args []string) {
+	config, err := configlib.LocateAndReadConfigFile()
+	if err != nil {
+		log.Fatalf("Failed to process configuration: %s", err)
+	}
+
+	logSetup(config)
+
+	checks := diagnoseEnvironment(config, time.Now())
+
+	if Json {
+		jsonRes, _ := json.MarshalIndent(checks, "", "\t")
+		fmt.Printf("%s\n", jsonRes)
+	} else {
+		printDiagnostics(os.Stdout, checks)
+	}
+
+	for _, c := range checks {
+		if c.Status == checkFail {
+			os.Exit(1)
+		}
+	}
+}
+
+func init() {
+	RootCmd.AddCommand(doctorCmd)
+}
+
+// diagnoseEnvironment runs every check against the configuration
+func diagnoseEnvironment(config configlib.Config, now time.Time) []diagnosticCheck {
+	var checks []diagnosticCheck
+
+	checks = append(checks, checkNonMemInstallations(config, now)...)
+	checks = append(checks, checkCompilers(config)...)
+	checks = append(checks, checkMpiExec(config))
+	checks = append(checks, checkQsub())
+	checks = append(checks, checkBbiBinary(config))
+
+	return checks
+}
+
+// checkNonMemInstallations checks the home, executable, nmqual and license of each configured nonmem installation
+func checkNonMemInstallations(config configlib.Config, now time.Time) []diagnosticCheck {
+	var checks []diagnosticCheck
+
+	if len(config.Nonmem) == 0 {
+		return append(checks, failedCheck("nonmem", "", "No nonmem installations are configured. Run bbi init --dir to locate them"))
+	}
+
+	if err := checkSelectedNonMem(config); err != nil {
+		checks = append(checks, failedCheck("nonmem", config.NMVersion, "%s", err))
+	} else {
+		selected, _ := effectiveNonMemVersion(config)
+		checks = append(checks, passedCheck("nonmem", selected, "Models are executed with %s", selected))
+	}
+
+	var names []string
+	for name := range config.Nonmem {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		detail := config.Nonmem[name]
+
+		if !isPathNonMemmy(detail.Home) {
+			checks = append(checks, failedCheck("nonmem_home", name, "%s does not contain a nonmem installation with a license and an executable nmfe script", detail.Home))
+			continue
+		}
+
+		checks = append(checks, passedCheck("nonmem_home", name, "%s is a nonmem installation", detail.Home))
+		checks = append(checks, checkNonMemExecutable(name, detail))
+
+		if detail.Nmqual {
+			if hasNMQual(detail.Home) {
+				checks = append(checks, passedCheck("nmqual", name, "nmqual is installed in %s", filepath.Join(detail.Home, "nmqual")))
+			} else {
+				checks = append(checks, failedCheck("nmqual", name, "nmqual is enabled, but %s does not exist", filepath.Join(detail.Home, "nmqual")))
+			}
+		}
+
+		checks = append(checks, checkLicense(name, filepath.Join(detail.Home, "license", "nonmem.lic"), now))
+	}
+
+	return checks
+}
+
+// checkNonMemExecutable ensures the configured nmfe script exists, reporting the one bbi init would find otherwise
+func checkNonMemExecutable(name string, detail configlib.NonMemDetail) diagnosticCheck {
+	located, err := findNonMemBinary(detail.Home)
+
+	if detail.Executable == "" {
+		if err != nil {
+			return failedCheck("nonmem_executable", name, "No executable is configured and %s", err)
+		}
+
+		return failedCheck("nonmem_executable", name, "No executable is configured. %s was located in %s", located, filepath.Join(detail.Home, "run"))
+	}
+
+	configured := filepath.Join(detail.Home, "run", detail.Executable)
+
+	info, err := os.Stat(configured)
+	if err != nil {
+		return failedCheck("nonmem_executable", name, "%s does not exist", configured)
+	}
+
+	if info.Mode()&0111 == 0 {
+		return failedCheck("nonmem_executable", name, "%s is not executable", configured)
+	}
+
+	if located != "" && located != detail.Executable {
+		return warnedCheck("nonmem_executable", name, "%s is configured, but %s was located in %s", detail.Executable, located, filepath.Join(detail.Home, "run"))
+	}
+
+	return passedCheck("nonmem_executable", name, "%s is executable", configured)
+}
+
+var licenseExpiryRegex = regexp.MustCompile(`(?i)expir\w*\s*(?:date)?\s*[:=]?\s*([0-9]{1,2}[ -][A-Za-z]{3}[ -][0-9]{4}|[0-9]{4}-[0-9]{2}-[0-9]{2}|[0-9]{1,2}/[0-9]{1,2}/[0-9]{4})`)
+
+var licenseDateLayouts = []string{
+	"2 Jan 2006",
+	"2-Jan-2006",
+	"2006-01-02",
+	"1/2/2006",
+}
+
+// parseLicenseExpiry locates the expiration date within the contents of a nonmem license
+func parseLicenseExpiry(contents string) (time.Time, error) {
+	matches := licenseExpiryRegex.FindStringSubmatch(contents)
+	if matches == nil {
+		return time.Time{}, fmt.Errorf("no expiration date could be located")
+	}
+
+	//Month abbreviations are often upper case, which time.Parse doesn't accept
+	date := strings.Title(strings.ToLower(matches[1]))
+
+	for _, layout := range licenseDateLayouts {
+		if expiry, err := time.Parse(layout, date); err == nil {
+			return expiry, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("the expiration date %s is not in a recognized format", matches[1])
+}
+
+// checkLicense reports licenses which have expired, or will within licenseWarningPeriod
+func checkLicense(name string, license string, now time.Time) diagnosticCheck {
+	contents, err := afero.ReadFile(afero.NewOsFs(), license)
+	if err != nil {
+		return failedCheck("license", name, "Unable to read %s: %s", license, err)
+	}
+
+	expiry, err := parseLicenseExpiry(string(contents))
+	if err != nil {
+		return warnedCheck("license", name, "Unable to determine when %s expires: %s", license, err)
+	}
+
+	//The license is valid through the day it expires
+	remaining := expiry.Add(24 * time.Hour).Sub(now)
+
+	switch {
+	case remaining <= 0:
+		return failedCheck("license", name, "The license expired on %s", expiry.Format("2006-01-02"))
+	case remaining < licenseWarningPeriod:
+		return warnedCheck("license", name, "The license expires on %s, in %d days", expiry.Format("2006-01-02"), int(remaining.Hours()/24))
+	}
+
+	return passedCheck("license", name, "The license expires on %s", expiry.Format("2006-01-02"))
+}
+
+var compilerRegex = regexp.MustCompile(`\b(gfortran|ifort|ifx|g95)\b`)
+
+// nonmemCompiler returns the fortran compiler the nmfe script of an installation invokes, defaulting to gfortran
+func nonmemCompiler(detail configlib.NonMemDetail) string {
+	contents, err := afero.ReadFile(afero.NewOsFs(), filepath.Join(detail.Home, "run", detail.Executable))
+	if err == nil {
+		if match := compilerRegex.FindString(string(contents)); match != "" {
+			return match
+		}
+	}
+
+	return "gfortran"
+}
+
+// checkCompilers ensures the compiler used by each nonmem installation is on the path
+func checkCompilers(config configlib.Config) []diagnosticCheck {
+	var checks []diagnosticCheck
+
+	compilers := make(map[string][]string)
+	for name, detail := range config.Nonmem {
+		compiler := nonmemCompiler(detail)
+		compilers[compiler] = append(compilers[compiler], name)
+	}
+
+	var names []string
+	for compiler := range compilers {
+		names = append(names, compiler)
+	}
+	sort.Strings(names)
+
+	for _, compiler := range names {
+		sort.Strings(compilers[compiler])
+		users := strings.Join(compilers[compiler], ", ")
+
+		located, err := exec.LookPath(compiler)
+		if err != nil {
+			checks = append(checks, failedCheck("compiler", compiler, "%s is used by %s, but is not on the path", compiler, users))
+			continue
+		}
+
+		checks = append(checks, passedCheck("compiler", compiler, "%s is used by %s and located at %s", compiler, users, located))
+	}
+
+	return checks
+}
+
+// checkMpiExec ensures mpiexec is at mpi_exec_path. Its absence only fails the check when models are run in parallel
+// with MPI
+func checkMpiExec(config configlib.Config) diagnosticCheck {
+	required := config.Parallel && strings.ToLower(config.ParallelMode) != parallelModeFPI
+	report := warnedCheck
+	if required {
+		report = failedCheck
+	}
+
+	if config.MPIExecPath != "" {
+		info, err := os.Stat(config.MPIExecPath)
+		if err == nil && info.Mode()&0111 != 0 {
+			return passedCheck("mpiexec", config.MPIExecPath, "mpiexec is located at mpi_exec_path")
+		}
+	}
+
+	located, err := exec.LookPath("mpiexec")
+	if err != nil {
+		return report("mpiexec", config.MPIExecPath, "mpiexec could not be located at mpi_exec_path or on the path")
+	}
+
+	if config.MPIExecPath != "" {
+		return warnedCheck("mpiexec", config.MPIExecPath, "mpiexec is not at mpi_exec_path, so %s on the path is used instead", located)
+	}
+
+	return passedCheck("mpiexec", located, "mpiexec is located on the path")
+}
+
+// checkQsub ensures qsub is on the path for run sge
+func checkQsub() diagnosticCheck {
+	located, err := exec.LookPath("qsub")
+	if err != nil {
+		return warnedCheck("qsub", "", "qsub is not on the path, so models can only be run locally")
+	}
+
+	return passedCheck("qsub", located, "qsub is located on the path")
+}
+
+// checkBbiBinary ensures the bbi binary grid jobs execute exists, and is referenced in a way other hosts can resolve
+func checkBbiBinary(config configlib.Config) diagnosticCheck {
+	binary := config.BbiBinary
+	if binary == "" {
+		binary, _ = os.Executable()
+	}
+
+	if !filepath.IsAbs(binary) {
+		return failedCheck("bbi_binary", binary, "bbi_binary must be an absolute path for grid jobs to locate it")
+	}
+
+	info, err := os.Stat(binary)
+	if err != nil {
+		return failedCheck("bbi_binary", binary, "%s does not exist", binary)
+	}
+
+	if info.Mode()&0111 == 0 {
+		return failedCheck("bbi_binary", binary, "%s is not executable", binary)
+	}
+
+	//Temporary directories are local to each host, so grid nodes cannot see binaries within them
+	if temporary, err := filepath.EvalSymlinks(os.TempDir()); err == nil {
+		if resolved, err := filepath.EvalSymlinks(binary); err == nil && strings.HasPrefix(resolved, temporary+string(filepath.Separator)) {
+			return warnedCheck("bbi_binary", binary, "%s is in the temporary directory, which grid nodes are unlikely to share", binary)
+		}
+	}
+
+	return passedCheck("bbi_binary", binary, "%s is executable", binary)
+}
+
+// printDiagnostics writes the checks as a table
+func printDiagnostics(out io.Writer, checks []diagnosticCheck) {
+	table := tablewriter.NewWriter(out)
+	table.SetAlignment(tablewriter.ALIGN_LEFT)
+	table.SetAutoWrapText(false)
+	table.SetHeader([]string{"Check", "Subject", "Status", "Message"})
+
+	counts := make(map[string]int)
+
+	for _, c := range checks {
+		table.Append([]string{c.Check, c.Subject, strings.ToUpper(c.Status), c.Message})
+		counts[c.Status]++
+	}
+
+	table.Render()
+
+	fmt.Fprintf(out, "%d passed, %d warnings, %d failed\n", counts[checkPass], counts[checkWarn], counts[checkFail])
+}
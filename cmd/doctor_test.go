@@ -0,0 +1,111 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"bbi/configlib"
+)
+
+func Test_parseLicenseExpiry(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string
+		want     string
+		wantErr  bool
+	}{
+		{
+			name:     "nonmem style",
+			contents: "License Registered to: Metrum Research Group\nExpiration Date:    14 JUL 2021\n",
+			want:     "2021-07-14",
+		},
+		{
+			name:     "iso date",
+			contents: "expires=2022-01-31",
+			want:     "2022-01-31",
+		},
+		{
+			name:     "us date",
+			contents: "Expiration: 3/9/2023",
+			want:     "2023-03-09",
+		},
+		{
+			name:     "encoded key only",
+			contents: "A8D2F0C1E93B",
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseLicenseExpiry(tt.contents)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseLicenseExpiry() error = %v, wantErr %t", err, tt.wantErr)
+			}
+
+			if !tt.wantErr && got.Format("2006-01-02") != tt.want {
+				t.Errorf("parseLicenseExpiry() = %s, want %s", got.Format("2006-01-02"), tt.want)
+			}
+		})
+	}
+}
+
+func Test_checkNonMemInstallations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bbi_doctor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	home := filepath.Join(dir, "nm74gf")
+	for _, d := range []string{"source", "run", "license", "util"} {
+		os.MkdirAll(filepath.Join(home, d), 0750)
+	}
+
+	ioutil.WriteFile(filepath.Join(home, "run", "nmfe74"), []byte("#!/bin/sh\nf=gfortran\n"), 0750)
+	ioutil.WriteFile(filepath.Join(home, "license", "nonmem.lic"), []byte("Expiration Date: 14 JUL 2021\n"), 0640)
+
+	config := configlib.Config{
+		Nonmem: map[string]configlib.NonMemDetail{
+			"nm74gf":  {Home: home, Executable: "nmfe74", Default: true, Nmqual: true},
+			"missing": {Home: filepath.Join(dir, "nm75"), Executable: "nmfe75"},
+		},
+	}
+
+	now := time.Date(2021, 7, 1, 12, 0, 0, 0, time.UTC)
+
+	statuses := make(map[string]string)
+	for _, c := range checkNonMemInstallations(config, now) {
+		statuses[c.Check+"/"+c.Subject] = c.Status
+	}
+
+	want := map[string]string{
+		"nonmem/nm74gf":            checkPass,
+		"nonmem_home/missing":      checkFail,
+		"nonmem_home/nm74gf":       checkPass,
+		"nonmem_executable/nm74gf": checkPass,
+		"nmqual/nm74gf":            checkFail,
+		"license/nm74gf":           checkWarn,
+	}
+
+	for check, status := range want {
+		if statuses[check] != status {
+			t.Errorf("%s = %s, want %s", check, statuses[check], status)
+		}
+	}
+
+	if c := checkLicense("nm74gf", filepath.Join(home, "license", "nonmem.lic"), now.AddDate(0, 1, 0)); c.Status != checkFail {
+		t.Errorf("checkLicense() after expiry = %+v, want a failure", c)
+	}
+
+	if compiler := nonmemCompiler(config.Nonmem["nm74gf"]); compiler != "gfortran" {
+		t.Errorf("nonmemCompiler() = %s, want gfortran", compiler)
+	}
+
+	if c := checkBbiBinary(configlib.Config{BbiBinary: "bbi"}); c.Status != checkFail {
+		t.Errorf("checkBbiBinary() with a relative path = %+v, want a failure", c)
+	}
+}
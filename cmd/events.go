@@ -0,0 +1,365 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	parser "bbi/parsers/nmparser"
+	"bbi/utils"
+	"github.com/metrumresearchgroup/turnstile"
+	log "github.com/sirupsen/logrus"
+)
+
+// eventSchemaVersion is incremented whenever fields of lifecycleEvent are removed or change meaning. Added fields do not
+// change the version
+const eventSchemaVersion int = 1
+
+const (
+	eventBatchStarted   string = "batch_started"
+	eventBatchFinished  string = "batch_finished"
+	eventModelQueued    string = "model_queued"
+	eventModelPrepared  string = "model_prepared"
+	eventModelSubmitted string = "model_submitted"
+	eventModelStarted   string = "model_started"
+	eventModelIteration string = "model_iteration"
+	eventModelCompleted string = "model_completed"
+	eventModelFailed    string = "model_failed"
+	eventModelCancelled string = "model_cancelled"
+	eventModelResubmitted string = "model_resubmitted"
+	eventCleanupDone      string = "model_cleanup_done"
+	eventPostHookResult   string = "post_hook_result"
+)
+
+// eventIterationInterval is how often the ext file of a running model is checked for new iterations
+var eventIterationInterval time.Duration = 5 * time.Second
+
+var eventsTarget string
+
+// events is the lifecycle event stream of the batch in progress. All of its methods are no-ops when it is nil, which is
+// the case unless --events was provided
+var events *eventStream
+
+var qsubJobIDRegex = regexp.MustCompile(`Your job(?:-array)? (\d+)`)
+
+// lifecycleEvent is a single line of the event stream
+type lifecycleEvent struct {
+	SchemaVersion int       `json:"schema_version"`
+	Event         string    `json:"event"`
+	Time          time.Time `json:"time"`
+	//Model is the fully qualified path to the control stream
+	Model     string `json:"model,omitempty"`
+	Name      string `json:"name,omitempty"`
+	OutputDir string `json:"output_dir,omitempty"`
+	JobID     string `json:"job_id,omitempty"`
+	Attempt   int    `json:"attempt,omitempty"`
+	Method    string `json:"method,omitempty"`
+	//Iteration and OFV are only present on model_iteration events
+	Iteration  *int     `json:"iteration,omitempty"`
+	OFV        *float64 `json:"ofv,omitempty"`
+	Successful *bool    `json:"successful,omitempty"`
+	Error      string   `json:"error,omitempty"`
+	Notes      string   `json:"notes,omitempty"`
+	Output     string   `json:"output,omitempty"`
+	//Hook, ExitCode and DurationSeconds are only present on post_hook_result events
+	Hook            string   `json:"hook,omitempty"`
+	ExitCode        *int     `json:"exit_code,omitempty"`
+	DurationSeconds *float64 `json:"duration_seconds,omitempty"`
+	//Models, Failed and Cancelled are only present on batch events
+	Models    int `json:"models,omitempty"`
+	Failed    int `json:"failed,omitempty"`
+	Cancelled int `json:"cancelled,omitempty"`
+}
+
+type eventStream struct {
+	lock   sync.Mutex
+	out    io.Writer
+	closer io.Closer
+	models []*NonMemModel
+}
+
+// consoleOutput is where logs and summaries meant for the user are written. It is stdout unless --events - has taken
+// stdout for the event stream, in which case stderr is used so the stream remains valid JSON lines
+func consoleOutput() io.Writer {
+	if eventsTarget == "-" {
+		return os.Stderr
+	}
+
+	return os.Stdout
+}
+
+// startEventStream opens the target of --events as the event stream of the command, exiting if it can't be opened
+func startEventStream() {
+	var err error
+
+	if events, err = openEventStream(eventsTarget); err != nil {
+		log.Fatalf("Unable to open the event stream: %s", err)
+	}
+}
+
+// openEventStream opens the target of --events. It is either a file, which is appended to, fd:N for an inherited file
+// descriptor, or - for stdout
+func openEventStream(target string) (*eventStream, error) {
+	if target == "" {
+		return nil, nil
+	}
+
+	if target == "-" {
+		return &eventStream{out: os.Stdout}, nil
+	}
+
+	if strings.HasPrefix(target, "fd:") {
+		fd, err := strconv.Atoi(strings.TrimPrefix(target, "fd:"))
+		if err != nil || fd < 0 {
+			return nil, fmt.Errorf("%s is not a valid file descriptor for --events", target)
+		}
+
+		f := os.NewFile(uintptr(fd), "events")
+		if _, err = f.Stat(); err != nil {
+			return nil, fmt.Errorf("file descriptor %d is not open: %s", fd, err)
+		}
+
+		return &eventStream{out: f, closer: f}, nil
+	}
+
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0640)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open the events file at %s: %s", target, err)
+	}
+
+	return &eventStream{out: f, closer: f}, nil
+}
+
+// Close closes the file the stream is written to, if bbi opened it
+func (e *eventStream) Close() {
+	if e == nil || e.closer == nil {
+		return
+	}
+
+	e.closer.Close()
+}
+
+func (e *eventStream) emit(event lifecycleEvent) {
+	if e == nil {
+		return
+	}
+
+	event.SchemaVersion = eventSchemaVersion
+	event.Time = time.Now()
+
+	line, err := json.Marshal(event)
+	if err != nil {
+		log.Errorf("Unable to serialize the %s event: %s", event.Event, err)
+		return
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if _, err = e.out.Write(append(line, '\n')); err != nil {
+		log.Errorf("Unable to write the %s event: %s", event.Event, err)
+	}
+}
+
+func modelEvent(name string, model *NonMemModel) lifecycleEvent {
+	return lifecycleEvent{
+		Event:     name,
+		Model:     model.Path,
+		Name:      model.FileName,
+		OutputDir: model.OutputDir,
+	}
+}
+
+// BatchStarted registers the models of the batch and emits a model_queued event for each
+func (e *eventStream) BatchStarted(models []*NonMemModel) {
+	if e == nil {
+		return
+	}
+
+	e.lock.Lock()
+	e.models = append(e.models, models...)
+	e.lock.Unlock()
+
+	e.emit(lifecycleEvent{Event: eventBatchStarted, Models: len(models)})
+
+	for _, m := range models {
+		e.emit(modelEvent(eventModelQueued, m))
+	}
+}
+
+// BatchFinished summarises the batch once all of its models are done, counting cancelled models apart from failures
+func (e *eventStream) BatchFinished(models int, errs []turnstile.ConcurrentError) {
+	failed, cancelled := partitionCancellations(errs)
+	e.emit(lifecycleEvent{Event: eventBatchFinished, Models: models, Failed: len(failed), Cancelled: len(cancelled)})
+}
+
+// Model emits an event which has no details beyond the identity of the model
+func (e *eventStream) Model(name string, model *NonMemModel) {
+	e.emit(modelEvent(name, model))
+}
+
+// Started is emitted as each attempt at executing the model begins
+func (e *eventStream) Started(model *NonMemModel) {
+	event := modelEvent(eventModelStarted, model)
+	event.Attempt = len(model.Attempts) + 1
+	if gridAttempt > event.Attempt {
+		event.Attempt = gridAttempt
+	}
+
+	e.emit(event)
+}
+
+// Resubmitted records the failure of a grid attempt along with the attempt it was resubmitted as
+func (e *eventStream) Resubmitted(model *NonMemModel, notes string, err error) {
+	event := modelEvent(eventModelResubmitted, model)
+	event.Notes = notes
+
+	if len(model.Attempts) > 0 {
+		event.Attempt = model.Attempts[len(model.Attempts)-1].Attempt + 1
+	}
+
+	if err != nil {
+		event.Error = err.Error()
+	}
+
+	e.emit(event)
+}
+
+// Submitted records the job id the grid engine assigned to the model from the qsub output
+func (e *eventStream) Submitted(model *NonMemModel, qsubOutput string) {
+	event := modelEvent(eventModelSubmitted, model)
+
+	if match := qsubJobIDRegex.FindStringSubmatch(qsubOutput); match != nil {
+		event.JobID = match[1]
+	}
+
+	e.emit(event)
+}
+
+// Failed is emitted for models placed on the turnstile error list, identified by model or file name. Cancelled models
+// are emitted as model_cancelled
+func (e *eventStream) Failed(identifier string, notes string, err error) {
+	if e == nil {
+		return
+	}
+
+	event := lifecycleEvent{
+		Event: eventModelFailed,
+		Name:  identifier,
+		Notes: notes,
+	}
+
+	if errors.Is(err, errExecutionCancelled) {
+		event.Event = eventModelCancelled
+	}
+
+	if err != nil {
+		event.Error = err.Error()
+	}
+
+	e.lock.Lock()
+	for _, m := range e.models {
+		if m.Model == identifier || m.FileName == identifier {
+			event.Model = m.Path
+			event.Name = m.FileName
+			event.OutputDir = m.OutputDir
+		}
+	}
+	e.lock.Unlock()
+
+	e.emit(event)
+}
+
+// PostHookResult records the outcome of a post work hook for a model
+func (e *eventStream) PostHookResult(hook *PostExecutionHookEnvironment, result hookResult) {
+	if e == nil || hook == nil {
+		return
+	}
+
+	successful := !result.Failed() && !result.Skipped
+	exitCode := result.ExitCode
+	duration := result.DurationSeconds
+
+	event := lifecycleEvent{
+		Event:           eventPostHookResult,
+		Model:           hook.ModelPath,
+		Name:            hook.Filename,
+		OutputDir:       hook.OutputDirectory,
+		Hook:            result.Name,
+		Successful:      &successful,
+		ExitCode:        &exitCode,
+		DurationSeconds: &duration,
+		Error:           result.Error,
+	}
+
+	if contents, err := ioutil.ReadFile(result.Stdout); err == nil {
+		event.Output = string(contents)
+	}
+
+	e.emit(event)
+}
+
+// FollowIterations emits a model_iteration event whenever a new iteration is written to the ext file of the model. The
+// returned function stops following the model
+func (e *eventStream) FollowIterations(model *NonMemModel) func() {
+	if e == nil {
+		return func() {}
+	}
+
+	done := make(chan bool)
+	stopped := make(chan bool)
+
+	go func() {
+		defer close(stopped)
+
+		var last parser.ExtProgress
+		ticker := time.NewTicker(eventIterationInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+
+			progress, err := readExtProgress(model.OutputDir, model.FileName)
+			if err != nil || (progress.Method == last.Method && progress.Iteration == last.Iteration) {
+				continue
+			}
+
+			last = progress
+
+			event := modelEvent(eventModelIteration, model)
+			event.Method = progress.Method
+			event.Iteration = &progress.Iteration
+			event.OFV = &progress.OFV
+
+			e.emit(event)
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// readExtProgress reads the latest iteration from the ext file of a model in its output directory
+func readExtProgress(outputDir string, fileName string) (parser.ExtProgress, error) {
+	lines, err := utils.ReadLines(filepath.Join(outputDir, fileName+".ext"))
+	if err != nil {
+		return parser.ExtProgress{}, err
+	}
+
+	return parser.ParseExtProgress(parser.ParseExtLines(lines))
+}
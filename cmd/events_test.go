@@ -0,0 +1,184 @@
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/metrumresearchgroup/turnstile"
+)
+
+func readEvents(t *testing.T, path string) []lifecycleEvent {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var events []lifecycleEvent
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e lifecycleEvent
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatalf("event line %s is not valid json: %s", scanner.Text(), err)
+		}
+		events = append(events, e)
+	}
+
+	return events
+}
+
+func Test_eventStream(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bbi_events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(interval time.Duration) { eventIterationInterval = interval }(eventIterationInterval)
+	eventIterationInterval = 10 * time.Millisecond
+
+	path := filepath.Join(dir, "events.jsonl")
+	stream, err := openEventStream(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	models := []*NonMemModel{
+		{Path: "/data/run001.mod", Model: "run001.mod", FileName: "run001", OutputDir: dir},
+		{Path: "/data/run002.mod", Model: "run002.mod", FileName: "run002", OutputDir: "/data/run002"},
+	}
+
+	stream.BatchStarted(models)
+	stream.Started(models[0])
+
+	ext := "TABLE NO.     1: First Order Conditional Estimation with Interaction: Goal Function=MINIMUM VALUE OF OBJECTIVE FUNCTION: Problem=1\n" +
+		" ITERATION    THETA1       OMEGA(1,1)   OBJ\n" +
+		"            5  2.10000E+00  6.00000E-02    2680.4\n"
+	ioutil.WriteFile(filepath.Join(dir, "run001.ext"), []byte(ext), 0640)
+
+	stop := stream.FollowIterations(models[0])
+	time.Sleep(100 * time.Millisecond)
+	stop()
+
+	stream.Submitted(models[1], `Your job 4512 ("Run_run002") has been submitted`)
+	stream.Failed("run002.mod", "Running the programmatic shell script caused an error", errors.New("exit status 1"))
+	stream.Failed("run001", "Execution was cancelled", errExecutionCancelled)
+	stdout := filepath.Join(dir, "post_processing.stdout")
+	ioutil.WriteFile(stdout, []byte("done"), 0640)
+	stream.PostHookResult(&PostExecutionHookEnvironment{ModelPath: "/data/run001.mod", Filename: "run001"}, hookResult{Name: legacyHookName, Stdout: stdout, DurationSeconds: 1.5})
+	stream.BatchFinished(2, []turnstile.ConcurrentError{
+		newConcurrentError("run002.mod", "Running the programmatic shell script caused an error", errors.New("exit status 1")),
+		newConcurrentError("run001", "Execution was cancelled", errExecutionCancelled),
+	})
+	stream.Close()
+
+	events := readEvents(t, path)
+
+	want := []string{eventBatchStarted, eventModelQueued, eventModelQueued, eventModelStarted, eventModelIteration, eventModelSubmitted, eventModelFailed, eventModelCancelled, eventPostHookResult, eventBatchFinished}
+	if len(events) != len(want) {
+		t.Fatalf("%d events were written, want %d: %+v", len(events), len(want), events)
+	}
+
+	for i, e := range events {
+		if e.Event != want[i] {
+			t.Errorf("event %d is %s, want %s", i, e.Event, want[i])
+		}
+
+		if e.SchemaVersion != eventSchemaVersion || e.Time.IsZero() {
+			t.Errorf("event %s is missing its schema version or timestamp", e.Event)
+		}
+	}
+
+	if e := events[3]; e.Attempt != 1 || e.Model != "/data/run001.mod" {
+		t.Errorf("model_started = %+v, want attempt 1 of /data/run001.mod", e)
+	}
+
+	if e := events[4]; e.Iteration == nil || *e.Iteration != 5 || e.OFV == nil || *e.OFV != 2680.4 {
+		t.Errorf("model_iteration = %+v, want iteration 5 with OFV 2680.4", e)
+	}
+
+	if e := events[5]; e.JobID != "4512" {
+		t.Errorf("model_submitted job id = %s, want 4512", e.JobID)
+	}
+
+	//Failures reported by model name are attributed to the queued model
+	if e := events[6]; e.Model != "/data/run002.mod" || e.OutputDir != "/data/run002" || e.Error != "exit status 1" {
+		t.Errorf("model_failed = %+v, want the error of /data/run002.mod", e)
+	}
+
+	if e := events[7]; e.Model != "/data/run001.mod" || e.Error != errExecutionCancelled.Error() {
+		t.Errorf("model_cancelled = %+v, want the cancellation of /data/run001.mod", e)
+	}
+
+	if e := events[8]; e.Successful == nil || !*e.Successful || e.Output != "done" || e.Hook != legacyHookName || e.ExitCode == nil || *e.ExitCode != 0 {
+		t.Errorf("post_hook_result = %+v, want a successful hook", e)
+	}
+
+	if e := events[9]; e.Models != 2 || e.Failed != 1 || e.Cancelled != 1 {
+		t.Errorf("batch_finished = %+v, want 1 failed and 1 cancelled of 2 models", e)
+	}
+
+	//The file is appended to by later batches
+	stream, _ = openEventStream(path)
+	stream.BatchFinished(0, nil)
+	stream.Close()
+
+	if events = readEvents(t, path); len(events) != len(want)+1 {
+		t.Errorf("reopening the events file did not append to it")
+	}
+}
+
+func Test_openEventStream(t *testing.T) {
+	tests := []struct {
+		target  string
+		wantNil bool
+		wantErr bool
+	}{
+		{target: "", wantNil: true},
+		{target: "-"},
+		{target: "fd:2"},
+		{target: "fd:x", wantErr: true},
+		{target: "fd:987", wantErr: true},
+		{target: "/nonexistent/directory/events.jsonl", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		stream, err := openEventStream(tt.target)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("openEventStream(%q) error = %v, wantErr %t", tt.target, err, tt.wantErr)
+			continue
+		}
+
+		if !tt.wantErr && (stream == nil) != tt.wantNil {
+			t.Errorf("openEventStream(%q) = %v, wantNil %t", tt.target, stream, tt.wantNil)
+		}
+	}
+
+	//A nil stream ignores every event
+	var stream *eventStream
+	stream.BatchStarted([]*NonMemModel{{Path: "/data/run001.mod"}})
+	stream.Failed("run001", "", errors.New("failed"))
+	stream.FollowIterations(&NonMemModel{})()
+	stream.Close()
+}
+
+func Test_consoleOutput(t *testing.T) {
+	defer func(target string) { eventsTarget = target }(eventsTarget)
+
+	eventsTarget = "events.jsonl"
+	if consoleOutput() != os.Stdout {
+		t.Errorf("consoleOutput() with an events file is not stdout")
+	}
+
+	//The event stream has stdout to itself
+	eventsTarget = "-"
+	if consoleOutput() != os.Stderr {
+		t.Errorf("consoleOutput() with events on stdout is not stderr")
+	}
+}
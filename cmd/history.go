@@ -0,0 +1,482 @@
+package cmd
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"bbi/configlib"
+	parser "bbi/parsers/nmparser"
+	"bbi/utils"
+	"github.com/olekukonko/tablewriter"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+const (
+	archiveFormatDir   string = "dir"
+	archiveFormatTarGz string = "tar.gz"
+	//historyDirName is the directory beside the models holding the archived executions of each of them
+	historyDirName string = ".bbi_history"
+	//historyIndexName is the file within the history of a model listing its archived executions
+	historyIndexName string = "history.json"
+	//historyLatestName is the file within the history of a model recording the output directory of its latest run, as
+	//templates using the sequence or time can't be rendered again to find it
+	historyLatestName string = "latest_output_dir"
+)
+
+const historyLongDescription string = `list the previous executions of a model archived by runs with --archive, along
+with their objective function value and the digests of their model and data
+
+ bbi nonmem history run001.mod
+ bbi nonmem history run001.mod --json
+`
+
+const restoreLongDescription string = `restore a previous execution of a model, as numbered by bbi nonmem history, into
+its output directory. The results currently in the output directory are archived first, so they can be restored later
+
+ bbi nonmem restore run001.mod 2
+`
+
+var historyCmd = &cobra.Command{
+	Use:   "history [model]",
+	Short: "list the archived executions of a model",
+	Long:  historyLongDescription,
+	Args:  cobra.ExactArgs(1),
+	Run:   history,
+}
+
+var restoreCmd = &cobra.Command{
+	Use:   "restore [model] [number]",
+	Short: "restore an archived execution of a model into its output directory",
+	Long:  restoreLongDescription,
+	Args:  cobra.ExactArgs(2),
+	Run:   restore,
+}
+
+func init() {
+	nonmemCmd.AddCommand(historyCmd)
+	nonmemCmd.AddCommand(restoreCmd)
+}
+
+// historyEntry is an archived execution of a model, recorded in the history.json of the model
+type historyEntry struct {
+	Number     int       `json:"number"`
+	ArchivedAt time.Time `json:"archived_at"`
+	//Location is the directory or tarball holding the execution, relative to the history of the model
+	Location   string   `json:"location"`
+	Format     string   `json:"format"`
+	OutputDir  string   `json:"output_dir"`
+	BBIVersion string   `json:"bbi_version,omitempty"`
+	ModelMD5   string   `json:"model_md5,omitempty"`
+	DataMD5    string   `json:"data_md5,omitempty"`
+	OFV        *float64 `json:"ofv,omitempty"`
+}
+
+func history(cmd *cobra.Command, args []string) {
+	historyDir, err := modelHistoryDir(args[0])
+	if err != nil {
+		log.Fatalf("Unable to locate the history of %s: %s", args[0], err)
+	}
+
+	entries, err := readModelHistory(historyDir)
+	if err != nil {
+		log.Fatalf("Unable to read the history of %s: %s", args[0], err)
+	}
+
+	if Json {
+		jsonRes, _ := json.MarshalIndent(entries, "", "\t")
+		fmt.Printf("%s\n", jsonRes)
+		return
+	}
+
+	if len(entries) == 0 {
+		log.Infof("No executions of %s have been archived", args[0])
+		return
+	}
+
+	printModelHistory(os.Stdout, entries)
+}
+
+func restore(cmd *cobra.Command, args []string) {
+	number, err := strconv.Atoi(args[1])
+	if err != nil {
+		log.Fatalf("%s is not the number of an entry in the history of %s", args[1], args[0])
+	}
+
+	modelPath, err := filepath.Abs(args[0])
+	if err != nil {
+		log.Fatalf("Unable to locate the history of %s: %s", args[0], err)
+	}
+
+	//The current results are archived as any other run would archive them
+	format := archiveFormatDir
+	if config, err := configlib.LocateAndReadConfigFile(); err == nil {
+		format = config.ArchiveFormat
+	} else {
+		log.Warnf("Unable to read the configuration. The current results will be archived as a %s: %s", archiveFormatDir, err)
+	}
+
+	entry, archived, err := restoreModelHistory(modelPath, number, format)
+	if err != nil {
+		log.Fatalf("Unable to restore entry %d of the history of %s: %s", number, args[0], err)
+	}
+
+	if archived != nil {
+		log.Infof("The previous results in %s were archived as entry %d", entry.OutputDir, archived.Number)
+	}
+
+	log.Infof("Restored entry %d, archived %s, into %s", entry.Number, entry.ArchivedAt.Format(time.RFC3339), entry.OutputDir)
+}
+
+// modelHistoryDir is the directory holding the archived executions of a model, beside the model itself
+func modelHistoryDir(modelPath string) (string, error) {
+	absolute, err := filepath.Abs(modelPath)
+	if err != nil {
+		return "", err
+	}
+
+	dir, file := filepath.Split(absolute)
+	name, _ := utils.FileAndExt(file)
+
+	return filepath.Join(dir, historyDirName, name), nil
+}
+
+func readModelHistory(historyDir string) ([]historyEntry, error) {
+	var entries []historyEntry
+
+	contents, err := ioutil.ReadFile(filepath.Join(historyDir, historyIndexName))
+	if os.IsNotExist(err) {
+		return entries, nil
+	}
+
+	if err != nil {
+		return entries, err
+	}
+
+	err = json.Unmarshal(contents, &entries)
+	return entries, err
+}
+
+func writeModelHistory(historyDir string, entries []historyEntry) error {
+	contents, err := json.MarshalIndent(entries, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filepath.Join(historyDir, historyIndexName), contents, 0640)
+}
+
+// archiveOutputDir moves the output directory of a model into its history, as a directory or a compressed tarball,
+// and records it in the index of the history
+func archiveOutputDir(historyDir string, outputDir string, fileName string, format string) (historyEntry, error) {
+	if format == "" {
+		format = archiveFormatDir
+	}
+
+	if format != archiveFormatDir && format != archiveFormatTarGz {
+		return historyEntry{}, fmt.Errorf("the archive format %s is not one of %s or %s", format, archiveFormatDir, archiveFormatTarGz)
+	}
+
+	if err := os.MkdirAll(historyDir, 0750); err != nil {
+		return historyEntry{}, err
+	}
+
+	entries, err := readModelHistory(historyDir)
+	if err != nil {
+		return historyEntry{}, err
+	}
+
+	entry := historyEntry{
+		Number:     1,
+		ArchivedAt: time.Now(),
+		Format:     format,
+		OutputDir:  outputDir,
+	}
+
+	if len(entries) > 0 {
+		entry.Number = entries[len(entries)-1].Number + 1
+	}
+
+	entry.Location = fmt.Sprintf("%03d-%s", entry.Number, entry.ArchivedAt.Format("20060102-150405"))
+
+	//The digests are those recorded by bbi when the model was executed
+	if contents, err := ioutil.ReadFile(filepath.Join(outputDir, "bbi_config.json")); err == nil {
+		var recorded struct {
+			BBIVersion string `json:"bbi_version"`
+			ModelMD5   string `json:"model_md5"`
+			DataMD5    string `json:"data_md5"`
+		}
+
+		if json.Unmarshal(contents, &recorded) == nil {
+			entry.BBIVersion = recorded.BBIVersion
+			entry.ModelMD5 = recorded.ModelMD5
+			entry.DataMD5 = recorded.DataMD5
+		}
+	}
+
+	if lines, err := utils.ReadParamsAndOutputFromExt(filepath.Join(outputDir, fileName+".ext")); err == nil {
+		if finals, err := parser.ExtLineValues(parser.ParseExtLines(lines), -1000000000); err == nil {
+			if ofv, ok := finals["OBJ"]; ok {
+				entry.OFV = &ofv
+			}
+		}
+	}
+
+	if format == archiveFormatTarGz {
+		entry.Location += ".tar.gz"
+
+		if err = tarDirectory(outputDir, filepath.Join(historyDir, entry.Location)); err != nil {
+			return historyEntry{}, err
+		}
+
+		if err = os.RemoveAll(outputDir); err != nil {
+			return historyEntry{}, err
+		}
+	} else if err = os.Rename(outputDir, filepath.Join(historyDir, entry.Location)); err != nil {
+		return historyEntry{}, err
+	}
+
+	return entry, writeModelHistory(historyDir, append(entries, entry))
+}
+
+// restoreModelHistory replaces the output directory of a model with an archived execution, archiving the results it
+// holds first in the configured format. The restored entry is kept in the history, and its output directory becomes
+// the one recorded as holding the latest results of the model
+func restoreModelHistory(modelPath string, number int, format string) (historyEntry, *historyEntry, error) {
+	historyDir, err := modelHistoryDir(modelPath)
+	if err != nil {
+		return historyEntry{}, nil, err
+	}
+
+	fileName, _ := utils.FileAndExt(filepath.Base(modelPath))
+
+	entries, err := readModelHistory(historyDir)
+	if err != nil {
+		return historyEntry{}, nil, err
+	}
+
+	var entry *historyEntry
+	for i := range entries {
+		if entries[i].Number == number {
+			entry = &entries[i]
+		}
+	}
+
+	if entry == nil {
+		return historyEntry{}, nil, fmt.Errorf("no entry %d exists in %s", number, filepath.Join(historyDir, historyIndexName))
+	}
+
+	var archived *historyEntry
+
+	if _, err := os.Stat(entry.OutputDir); err == nil {
+		current, err := archiveOutputDir(historyDir, entry.OutputDir, fileName, format)
+		if err != nil {
+			return *entry, nil, fmt.Errorf("unable to archive the current results: %w", err)
+		}
+		archived = &current
+	}
+
+	source := filepath.Join(historyDir, entry.Location)
+
+	if entry.Format == archiveFormatTarGz {
+		err = extractTarball(source, entry.OutputDir)
+	} else {
+		err = copyDirectory(source, entry.OutputDir)
+	}
+
+	if err != nil {
+		return *entry, archived, err
+	}
+
+	//Commands following the latest run of a sequenced output directory would otherwise read another run
+	return *entry, archived, recordOutputDir(modelPath, entry.OutputDir)
+}
+
+// tarDirectory writes the contents of a directory into a gzip compressed tarball
+func tarDirectory(source string, destination string) error {
+	out, err := os.Create(destination)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	gz := gzip.NewWriter(out)
+	tw := tar.NewWriter(gz)
+
+	err = filepath.Walk(source, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relative, err := filepath.Rel(source, file)
+		if err != nil || relative == "." {
+			return err
+		}
+
+		//Links, pipes and other special files aren't results
+		if !info.Mode().IsRegular() && !info.IsDir() {
+			return nil
+		}
+
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+
+		header.Name = filepath.ToSlash(relative)
+
+		if err = tw.WriteHeader(header); err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			return nil
+		}
+
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		_, err = io.Copy(tw, f)
+		return err
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if err = tw.Close(); err != nil {
+		return err
+	}
+
+	return gz.Close()
+}
+
+// extractTarball extracts a tarball written by tarDirectory into the destination directory
+func extractTarball(source string, destination string) error {
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	gz, err := gzip.NewReader(in)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+
+	if err = os.MkdirAll(destination, 0750); err != nil {
+		return err
+	}
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		target := filepath.Join(destination, filepath.FromSlash(header.Name))
+
+		//Entries must remain within the destination
+		if !strings.HasPrefix(target, filepath.Clean(destination)+string(os.PathSeparator)) {
+			return fmt.Errorf("the entry %s of %s is outside of the archive", header.Name, source)
+		}
+
+		if header.Typeflag == tar.TypeDir {
+			if err = os.MkdirAll(target, os.FileMode(header.Mode)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err = writeFileFromReader(target, tr, os.FileMode(header.Mode)); err != nil {
+			return err
+		}
+	}
+}
+
+// copyDirectory recursively copies a directory, preserving the modes of its files
+func copyDirectory(source string, destination string) error {
+	return filepath.Walk(source, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relative, err := filepath.Rel(source, file)
+		if err != nil {
+			return err
+		}
+
+		target := filepath.Join(destination, relative)
+
+		if info.IsDir() {
+			return os.MkdirAll(target, info.Mode())
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		return writeFileFromReader(target, f, info.Mode())
+	})
+}
+
+func writeFileFromReader(target string, in io.Reader, mode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0750); err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+	if err != nil {
+		return err
+	}
+
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
+
+func printModelHistory(out io.Writer, entries []historyEntry) {
+	table := tablewriter.NewWriter(out)
+	table.SetAlignment(tablewriter.ALIGN_LEFT)
+	table.SetAutoWrapText(false)
+	table.SetHeader([]string{"#", "Archived", "OFV", "Model MD5", "Data MD5", "Location"})
+
+	for _, e := range entries {
+		ofv := ""
+		if e.OFV != nil {
+			ofv = strconv.FormatFloat(*e.OFV, 'f', 3, 64)
+		}
+
+		table.Append([]string{strconv.Itoa(e.Number), e.ArchivedAt.Format("2006-01-02 15:04:05"), ofv, e.ModelMD5, e.DataMD5, e.Location})
+	}
+
+	table.Render()
+}
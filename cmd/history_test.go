@@ -0,0 +1,104 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_archiveOutputDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bbi_history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	historyDir, err := modelHistoryDir(filepath.Join(dir, "run001.mod"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if historyDir != filepath.Join(dir, historyDirName, "run001") {
+		t.Errorf("modelHistoryDir() = %s", historyDir)
+	}
+
+	outputDir := filepath.Join(dir, "run001")
+
+	writeRun := func(ofv string, lst string) {
+		os.MkdirAll(filepath.Join(outputDir, "OUTPUT"), 0750)
+		ioutil.WriteFile(filepath.Join(outputDir, "bbi_config.json"), []byte(`{"model_md5":"abc123","data_md5":"def456"}`), 0640)
+		ioutil.WriteFile(filepath.Join(outputDir, "run001.lst"), []byte(lst), 0640)
+		ioutil.WriteFile(filepath.Join(outputDir, "OUTPUT", "run001.tab"), []byte(lst), 0640)
+		ioutil.WriteFile(filepath.Join(outputDir, "run001.ext"), []byte("TABLE NO.     1: First Order Conditional Estimation with Interaction: Goal Function=MINIMUM VALUE OF OBJECTIVE FUNCTION: Problem=1\n"+
+			" ITERATION    THETA1       OMEGA(1,1)   OBJ\n"+
+			"            5  2.10000E+00  6.00000E-02    "+ofv+"\n"+
+			"  -1000000000  2.10000E+00  6.00000E-02    "+ofv+"\n"), 0640)
+	}
+
+	writeRun("2680.4", "first")
+	first, err := archiveOutputDir(historyDir, outputDir, "run001", archiveFormatTarGz)
+	if err != nil {
+		t.Fatalf("archiveOutputDir() error = %s", err)
+	}
+
+	writeRun("2675.2", "second")
+	second, err := archiveOutputDir(historyDir, outputDir, "run001", archiveFormatDir)
+	if err != nil {
+		t.Fatalf("archiveOutputDir() error = %s", err)
+	}
+
+	if _, err := os.Stat(outputDir); !os.IsNotExist(err) {
+		t.Errorf("the output directory was not moved into the history")
+	}
+
+	entries, err := readModelHistory(historyDir)
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("readModelHistory() = %+v, %v", entries, err)
+	}
+
+	if first.Number != 1 || second.Number != 2 || entries[0].ModelMD5 != "abc123" || entries[0].DataMD5 != "def456" {
+		t.Errorf("readModelHistory() = %+v", entries)
+	}
+
+	if entries[0].OFV == nil || *entries[0].OFV != 2680.4 || entries[1].OFV == nil || *entries[1].OFV != 2675.2 {
+		t.Errorf("the OFVs of the archived runs were not recorded: %+v", entries)
+	}
+
+	//Restoring the tarball archives the results currently in the output directory first
+	writeRun("2690.0", "third")
+
+	modelPath := filepath.Join(dir, "run001.mod")
+
+	restored, archived, err := restoreModelHistory(modelPath, 1, archiveFormatDir)
+	if err != nil {
+		t.Fatalf("restoreModelHistory() error = %s", err)
+	}
+
+	//The current results are archived in the configured format rather than that of the restored entry
+	if restored.Number != 1 || archived == nil || archived.Number != 3 || archived.Format != archiveFormatDir {
+		t.Errorf("restoreModelHistory() = %+v, %+v", restored, archived)
+	}
+
+	if recorded, err := readOutputDirRecord(modelPath); err != nil || recorded != outputDir {
+		t.Errorf("readOutputDirRecord() after restoring = %s, %v, want %s", recorded, err, outputDir)
+	}
+
+	for _, f := range []string{"run001.lst", filepath.Join("OUTPUT", "run001.tab")} {
+		if contents, _ := ioutil.ReadFile(filepath.Join(outputDir, f)); string(contents) != "first" {
+			t.Errorf("%s holds %q after restoring the first run", f, contents)
+		}
+	}
+
+	if _, _, err = restoreModelHistory(modelPath, 2, archiveFormatTarGz); err != nil {
+		t.Fatalf("restoreModelHistory() error = %s", err)
+	}
+
+	if contents, _ := ioutil.ReadFile(filepath.Join(outputDir, "run001.lst")); string(contents) != "second" {
+		t.Errorf("run001.lst holds %q after restoring the second run", contents)
+	}
+
+	if _, _, err = restoreModelHistory(modelPath, 9, archiveFormatDir); err == nil {
+		t.Errorf("restoreModelHistory() of a missing entry did not fail")
+	}
+}
@@ -0,0 +1,232 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"bbi/configlib"
+	log "github.com/sirupsen/logrus"
+)
+
+// legacyHookName is the name given to post_work_executable, which runs before any post_work_hooks. Its script keeps the
+// post_processing.sh name it has always had
+const legacyHookName string = "post_processing"
+
+// preWorkHookName is the name under which the outcome of pre_work_executable is recorded
+const preWorkHookName string = "pre_processing"
+
+// hookFilePrefix is prepended to the script and output files of named hooks in the output directory
+const hookFilePrefix string = "post_work_"
+
+var hookNameRegex = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+var errRequiredHookFailed = errors.New("a required post work hook failed")
+
+// hookResult is the outcome of a pre or post work hook, recorded in bbi_config.json
+type hookResult struct {
+	Name            string    `json:"name"`
+	Executable      string    `json:"executable"`
+	Required        bool      `json:"required,omitempty"`
+	Started         time.Time `json:"started,omitempty"`
+	DurationSeconds float64   `json:"duration_seconds"`
+	ExitCode        int       `json:"exit_code"`
+	TimedOut        bool      `json:"timed_out,omitempty"`
+	Skipped         bool      `json:"skipped,omitempty"`
+	Stdout          string    `json:"stdout,omitempty"`
+	Stderr          string    `json:"stderr,omitempty"`
+	Error           string    `json:"error,omitempty"`
+}
+
+// Failed indicates the hook ran and did not succeed
+func (r hookResult) Failed() bool {
+	return !r.Skipped && r.Error != ""
+}
+
+// postWorkHooks lists the hooks of the configuration in the order they run. Unnamed hooks are named after their executable
+func postWorkHooks(config configlib.Config) []configlib.PostWorkHook {
+	var hooks []configlib.PostWorkHook
+
+	if config.PostWorkExecutable != "" {
+		hooks = append(hooks, configlib.PostWorkHook{
+			Name:       legacyHookName,
+			Executable: config.PostWorkExecutable,
+		})
+	}
+
+	for _, h := range config.PostWorkHooks {
+		if h.Name == "" {
+			h.Name = strings.TrimSuffix(filepath.Base(h.Executable), filepath.Ext(h.Executable))
+		}
+
+		hooks = append(hooks, h)
+	}
+
+	return hooks
+}
+
+// validatePostWorkHooks ensures every hook has an executable and a unique name which can be used in file names
+func validatePostWorkHooks(config configlib.Config) error {
+	for i, h := range config.PostWorkHooks {
+		if h.Executable == "" {
+			return fmt.Errorf("post work hook %d does not have an executable", i+1)
+		}
+	}
+
+	if config.HookConcurrency < 0 {
+		return fmt.Errorf("post_work_concurrency must not be negative, but is %d", config.HookConcurrency)
+	}
+
+	names := make(map[string]bool)
+
+	for _, h := range postWorkHooks(config) {
+		if !hookNameRegex.MatchString(h.Name) {
+			return fmt.Errorf("post work hook name %s may only contain letters, numbers, _ and -", h.Name)
+		}
+
+		if names[h.Name] {
+			return fmt.Errorf("post work hook name %s is used more than once", h.Name)
+		}
+
+		if h.Timeout < 0 {
+			return fmt.Errorf("post work hook %s has a negative timeout", h.Name)
+		}
+
+		names[h.Name] = true
+	}
+
+	return nil
+}
+
+var postWorkSlots struct {
+	sync.Mutex
+	slots chan bool
+}
+
+// acquirePostWorkSlot blocks until fewer than limit hooks are running across the batch, returning the function which
+// releases the slot. A limit of 0 places no bound beyond the number of threads
+func acquirePostWorkSlot(limit int) func() {
+	if limit <= 0 {
+		return func() {}
+	}
+
+	postWorkSlots.Lock()
+	if postWorkSlots.slots == nil || cap(postWorkSlots.slots) != limit {
+		postWorkSlots.slots = make(chan bool, limit)
+	}
+	slots := postWorkSlots.slots
+	postWorkSlots.Unlock()
+
+	slots <- true
+
+	return func() {
+		<-slots
+	}
+}
+
+// runPostWorkHooks runs each hook in order. Once a required hook fails, the remaining hooks are skipped and the failure
+// is returned
+func runPostWorkHooks(job PostWorkExecutor) ([]hookResult, error) {
+	config := job.GetGlobalConfig()
+
+	var results []hookResult
+	var failure error
+
+	for _, h := range postWorkHooks(config) {
+		if failure != nil {
+			results = append(results, hookResult{
+				Name:       h.Name,
+				Executable: h.Executable,
+				Required:   h.Required,
+				Skipped:    true,
+				Error:      "skipped as a required hook failed",
+			})
+			continue
+		}
+
+		result := runPostWorkHook(job, h, config.HookConcurrency)
+		results = append(results, result)
+
+		if !result.Failed() {
+			continue
+		}
+
+		log.Errorf("Post work hook %s failed in %s: %s", h.Name, job.GetWorkingPath(), result.Error)
+
+		if h.Required {
+			failure = fmt.Errorf("%w: %s %s", errRequiredHookFailed, h.Name, result.Error)
+		}
+	}
+
+	return results, failure
+}
+
+// runPostWorkHook runs a single hook in the output directory of the model, capturing its stdout and stderr into files
+// alongside its script
+func runPostWorkHook(job PostWorkExecutor, hook configlib.PostWorkHook, limit int) hookResult {
+	base := filepath.Join(job.GetWorkingPath(), hookFilePrefix+hook.Name)
+	if hook.Name == legacyHookName {
+		base = filepath.Join(job.GetWorkingPath(), legacyHookName)
+	}
+
+	result := hookResult{
+		Name:       hook.Name,
+		Executable: hook.Executable,
+		Required:   hook.Required,
+		Stdout:     base + ".stdout",
+		Stderr:     base + ".stderr",
+	}
+
+	release := acquirePostWorkSlot(limit)
+	defer release()
+
+	stdout, err := os.Create(result.Stdout)
+	if err != nil {
+		result.ExitCode = -1
+		result.Error = err.Error()
+		return result
+	}
+	defer stdout.Close()
+
+	stderr, err := os.Create(result.Stderr)
+	if err != nil {
+		result.ExitCode = -1
+		result.Error = err.Error()
+		return result
+	}
+	defer stderr.Close()
+
+	result.Started = time.Now()
+	err = executeHookScript(job, hook.Executable, base+".sh", "post", hook.Timeout, stdout, stderr)
+	result.DurationSeconds = time.Since(result.Started).Seconds()
+
+	if err == nil {
+		return result
+	}
+
+	result.recordError(err)
+
+	if errors.Is(err, errMaxRuntimeExceeded) {
+		result.TimedOut = true
+		result.Error = fmt.Sprintf("timed out after %s", hook.Timeout)
+	}
+
+	return result
+}
+
+// recordError stores the error of a failed hook along with the exit code of its executable, or -1 if it didn't exit
+func (r *hookResult) recordError(err error) {
+	r.ExitCode = -1
+	r.Error = err.Error()
+
+	var exitError *exec.ExitError
+	if errors.As(err, &exitError) {
+		r.ExitCode = exitError.ExitCode()
+	}
+}
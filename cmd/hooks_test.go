@@ -0,0 +1,199 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"bbi/configlib"
+)
+
+func Test_PostWorkExecution(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bbi_hooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	scripts := map[string]string{
+		"legacy.sh":  "#!/bin/sh\necho \"$BBI_MODEL successful=$BBI_SUCCESSFUL\"\necho warning >&2\n",
+		"fails.sh":   "#!/bin/sh\necho upload failed >&2\nexit 4\n",
+		"slow.sh":    "#!/bin/sh\nsleep 5\n",
+		"skipped.sh": "#!/bin/sh\necho should not run\n",
+	}
+
+	for name, contents := range scripts {
+		ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0750)
+	}
+
+	outputDir := filepath.Join(dir, "run001")
+	os.Mkdir(outputDir, 0750)
+
+	model := &LocalModel{
+		Nonmem: &NonMemModel{
+			Model:        "run001.mod",
+			FileName:     "run001",
+			OutputDir:    outputDir,
+			OriginalPath: outputDir,
+			Configuration: configlib.Config{
+				PostWorkExecutable: filepath.Join(dir, "legacy.sh"),
+				PostWorkHooks: []configlib.PostWorkHook{
+					{Executable: filepath.Join(dir, "slow.sh"), Timeout: 100 * time.Millisecond},
+					{Name: "upload", Executable: filepath.Join(dir, "fails.sh"), Required: true},
+					{Executable: filepath.Join(dir, "skipped.sh")},
+				},
+			},
+		},
+	}
+
+	err = PostWorkExecution(model, true, nil)
+	if !errors.Is(err, errRequiredHookFailed) {
+		t.Fatalf("PostWorkExecution() error = %v, want the failure of the required hook", err)
+	}
+
+	results := model.Nonmem.PostWorkHooks
+	if len(results) != 4 {
+		t.Fatalf("PostWorkExecution() recorded %d hooks, want 4", len(results))
+	}
+
+	legacy := results[0]
+	if legacy.Name != legacyHookName || legacy.Failed() || legacy.Stdout != filepath.Join(outputDir, "post_processing.stdout") {
+		t.Errorf("post_work_executable result = %+v, want a successful post_processing hook", legacy)
+	}
+
+	if stdout, _ := ioutil.ReadFile(legacy.Stdout); strings.TrimSpace(string(stdout)) != "run001.mod successful=true" {
+		t.Errorf("post_processing.stdout = %s", stdout)
+	}
+
+	if stderr, _ := ioutil.ReadFile(legacy.Stderr); strings.TrimSpace(string(stderr)) != "warning" {
+		t.Errorf("post_processing.stderr = %s", stderr)
+	}
+
+	if slow := results[1]; slow.Name != "slow" || !slow.TimedOut || !slow.Failed() || slow.DurationSeconds > 4 {
+		t.Errorf("slow hook result = %+v, want it to time out", slow)
+	}
+
+	upload := results[2]
+	if upload.ExitCode != 4 || !upload.Required || upload.Stderr != filepath.Join(outputDir, "post_work_upload.stderr") {
+		t.Errorf("upload hook result = %+v, want exit code 4", upload)
+	}
+
+	if skipped := results[3]; !skipped.Skipped || skipped.Failed() {
+		t.Errorf("hook after the failed required hook = %+v, want it skipped", skipped)
+	}
+
+	if _, err := os.Stat(filepath.Join(outputDir, "post_work_skipped.stdout")); err == nil {
+		t.Errorf("the skipped hook was run")
+	}
+
+	//The results are recorded in bbi_config.json
+	contents, err := ioutil.ReadFile(filepath.Join(outputDir, "bbi_config.json"))
+	if err != nil {
+		t.Fatalf("bbi_config.json was not written: %s", err)
+	}
+
+	var recorded struct {
+		Hooks []hookResult `json:"post_work_hooks"`
+	}
+	json.Unmarshal(contents, &recorded)
+
+	if len(recorded.Hooks) != 4 || recorded.Hooks[2].ExitCode != 4 {
+		t.Errorf("bbi_config.json recorded hooks %+v", recorded.Hooks)
+	}
+
+	if current, reason := previousRunIsCurrent(model.Nonmem); current || !strings.Contains(reason, "upload") {
+		t.Errorf("previousRunIsCurrent() = %t, %s. Want the failed required hook to make the run out of date", current, reason)
+	}
+
+	//Models which fail before executing do not replace the record of an earlier run
+	os.Remove(filepath.Join(outputDir, "bbi_config.json"))
+	model.Nonmem.Configuration.PostWorkHooks = nil
+
+	if err = PostWorkExecution(model, false, errors.New("output directory exists")); err != nil {
+		t.Errorf("PostWorkExecution() returned an error without required hooks: %s", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(outputDir, "bbi_config.json")); err == nil {
+		t.Errorf("bbi_config.json was written for a model which never executed")
+	}
+}
+
+func Test_validatePostWorkHooks(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  configlib.Config
+		wantErr bool
+	}{
+		{
+			name:   "named after executables",
+			config: configlib.Config{PostWorkExecutable: "/scripts/post.sh", PostWorkHooks: []configlib.PostWorkHook{{Executable: "/scripts/upload.sh"}, {Executable: "/scripts/report.py"}}},
+		},
+		{
+			name:    "missing executable",
+			config:  configlib.Config{PostWorkHooks: []configlib.PostWorkHook{{Name: "upload"}}},
+			wantErr: true,
+		},
+		{
+			name:    "duplicate name",
+			config:  configlib.Config{PostWorkHooks: []configlib.PostWorkHook{{Executable: "/a/upload.sh"}, {Executable: "/b/upload.sh"}}},
+			wantErr: true,
+		},
+		{
+			name:    "name unusable in file names",
+			config:  configlib.Config{PostWorkHooks: []configlib.PostWorkHook{{Name: "upload results", Executable: "/scripts/upload.sh"}}},
+			wantErr: true,
+		},
+		{
+			name:    "negative concurrency",
+			config:  configlib.Config{HookConcurrency: -1},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validatePostWorkHooks(tt.config); (err != nil) != tt.wantErr {
+				t.Errorf("validatePostWorkHooks() error = %v, wantErr %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_acquirePostWorkSlot(t *testing.T) {
+	var running, most int32
+	var wg sync.WaitGroup
+
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			release := acquirePostWorkSlot(2)
+			defer release()
+
+			now := atomic.AddInt32(&running, 1)
+			for {
+				previous := atomic.LoadInt32(&most)
+				if now <= previous || atomic.CompareAndSwapInt32(&most, previous, now) {
+					break
+				}
+			}
+
+			time.Sleep(20 * time.Millisecond)
+			atomic.AddInt32(&running, -1)
+		}()
+	}
+
+	wg.Wait()
+
+	if most != 2 {
+		t.Errorf("%d hooks ran at once, want 2", most)
+	}
+}
@@ -0,0 +1,277 @@
+package cmd
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/metrumresearchgroup/turnstile"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/afero"
+)
+
+// journalFileName is the file, in the directory bbi was executed from, into which the plan of the last local batch is persisted
+const journalFileName string = "bbi_journal.json"
+
+const (
+	journalQueued    string = "queued"
+	journalRunning   string = "running"
+	journalCompleted string = "completed"
+	journalFailed    string = "failed"
+	journalCancelled string = "cancelled"
+	//journalSkipped models of a workflow were never run as a parent didn't succeed
+	journalSkipped string = "skipped"
+)
+
+var resumeBatch bool
+
+type journalEntry struct {
+	//Model is the fully qualified path to the control stream
+	Model     string     `json:"model"`
+	OutputDir string     `json:"output_dir"`
+	State     string     `json:"state"`
+	Error     string     `json:"error,omitempty"`
+	Started   *time.Time `json:"started,omitempty"`
+	Finished  *time.Time `json:"finished,omitempty"`
+}
+
+// batchJournal records the models of a batch and their progress so that an interrupted batch can be resumed
+type batchJournal struct {
+	Version int             `json:"version"`
+	Created time.Time       `json:"created"`
+	Updated time.Time       `json:"updated"`
+	Models  []*journalEntry `json:"models"`
+	path    string
+	lock    sync.Mutex
+}
+
+func newBatchJournal(path string, models []LocalModel) *batchJournal {
+	j := &batchJournal{
+		Version: 1,
+		Created: time.Now(),
+		path:    path,
+	}
+
+	for _, m := range models {
+		j.Models = append(j.Models, &journalEntry{
+			Model:     m.Nonmem.Path,
+			OutputDir: m.Nonmem.OutputDir,
+			State:     journalQueued,
+		})
+	}
+
+	return j
+}
+
+func readBatchJournal(path string) (*batchJournal, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the batch journal at %s: %w", path, err)
+	}
+
+	j := &batchJournal{}
+	err = json.Unmarshal(contents, j)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse the batch journal at %s: %w", path, err)
+	}
+
+	j.path = path
+
+	return j, nil
+}
+
+// ModelPaths returns the fully qualified paths of every model in the batch plan
+func (j *batchJournal) ModelPaths() []string {
+	var paths []string
+	for _, e := range j.Models {
+		paths = append(paths, e.Model)
+	}
+
+	return paths
+}
+
+func (j *batchJournal) entry(model *NonMemModel) *journalEntry {
+	for _, e := range j.Models {
+		if e.Model == model.Path {
+			return e
+		}
+	}
+
+	return nil
+}
+
+// Update records the new state of the model and persists the journal. A nil journal is a no-op
+func (j *batchJournal) Update(model *NonMemModel, state string, err error) {
+	if j == nil {
+		return
+	}
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	e := j.entry(model)
+	if e == nil {
+		return
+	}
+
+	now := time.Now()
+
+	e.State = state
+	e.OutputDir = model.OutputDir
+	e.Error = ""
+
+	if err != nil {
+		e.Error = err.Error()
+	}
+
+	switch state {
+	case journalRunning:
+		e.Started = &now
+		e.Finished = nil
+	case journalCompleted, journalFailed, journalCancelled:
+		e.Finished = &now
+	}
+
+	if werr := j.write(); werr != nil {
+		log.Errorf("Unable to persist the batch journal to %s: %s", j.path, werr)
+	}
+}
+
+// Finalize marks every model in the manager's error list as failed, along with any which never reached completion.
+// Cancelled and skipped models retain their state
+func (j *batchJournal) Finalize(models []LocalModel, m *turnstile.Manager) error {
+	for _, model := range models {
+		e := j.entry(model.Nonmem)
+		if e == nil || e.State == journalCompleted || e.State == journalCancelled || e.State == journalSkipped {
+			continue
+		}
+
+		err := fmt.Errorf("model did not complete")
+		for _, ce := range m.ErrorList {
+			if ce.RunIdentifier == model.Nonmem.Model || ce.RunIdentifier == model.Nonmem.FileName {
+				err = fmt.Errorf("%s: %v", ce.Notes, ce.Error)
+			}
+		}
+
+		j.Update(model.Nonmem, journalFailed, err)
+	}
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	return j.write()
+}
+
+// write must be called with the lock held. Journals without a path are not persisted
+func (j *batchJournal) write() error {
+	j.Updated = time.Now()
+
+	if j.path == "" {
+		return nil
+	}
+
+	contents, err := json.MarshalIndent(j, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	return afero.WriteFile(afero.NewOsFs(), j.path, contents, 0640)
+}
+
+// previousRunIsCurrent determines whether the bbi_config.json in the output directory of the model was produced by a
+// successful run using the same model, data and nonmem settings as are present now. The reason is populated when it was not.
+func previousRunIsCurrent(model *NonMemModel) (bool, string) {
+	outputDir := model.OutputDir
+	if !model.Configuration.Local.CreateChildDirs {
+		outputDir = model.OriginalPath
+	} else if recorded, err := readOutputDirRecord(filepath.Join(model.OriginalPath, model.OriginalModel)); err == nil {
+		//The output directory of a sequenced template is a new one, while the previous run is where it was recorded
+		outputDir = recorded
+	}
+
+	contents, err := ioutil.ReadFile(filepath.Join(outputDir, "bbi_config.json"))
+	if err != nil {
+		return false, "no bbi_config.json from a completed run was located"
+	}
+
+	var previous struct {
+		DataPath  string       `json:"data_path"`
+		DataMD5   string       `json:"data_md5"`
+		ModelMD5  string       `json:"model_md5"`
+		ConfigMD5 string       `json:"config_md5"`
+		OutputDir string       `json:"output_dir"`
+		Hooks     []hookResult `json:"post_work_hooks"`
+	}
+
+	if err = json.Unmarshal(contents, &previous); err != nil {
+		return false, fmt.Sprintf("bbi_config.json could not be parsed: %s", err)
+	}
+
+	for _, h := range previous.Hooks {
+		if h.Required && (h.Failed() || h.Skipped) {
+			return false, fmt.Sprintf("the required post work hook %s did not succeed in the previous run", h.Name)
+		}
+	}
+
+	if !modelMatchesHash(model, previous.ModelMD5) {
+		return false, "the model has changed since the previous run"
+	}
+
+	dataPath := previous.DataPath
+	if !filepath.IsAbs(dataPath) {
+		dataPath = filepath.Join(previous.OutputDir, dataPath)
+	}
+
+	dataMD5, err := hashFile(dataPath)
+	if err != nil || dataMD5 != previous.DataMD5 {
+		return false, "the data has changed since the previous run"
+	}
+
+	if nonmemSettingsHash(model.Configuration) != previous.ConfigMD5 {
+		return false, "the nonmem version or NMFE options have changed since the previous run"
+	}
+
+	return true, ""
+}
+
+// resumableModels removes models whose previous run is current from the batch, recording them as completed in the journal.
+// Models which will be re-queued are set to overwrite as they may have partial outputs from the interrupted run
+func resumableModels(models []LocalModel, journal *batchJournal) []LocalModel {
+	var output []LocalModel
+
+	for _, m := range models {
+		if current, reason := previousRunIsCurrent(m.Nonmem); !current {
+			log.Infof("%s Re-queueing model: %s", m.Nonmem.LogIdentifier(), reason)
+			m.Nonmem.Configuration.Overwrite = true
+			output = append(output, m)
+			continue
+		}
+
+		//Persisted now, as the batch is never finalized if every model is skipped
+		log.Infof("%s Outputs match the current model and data. Skipping", m.Nonmem.LogIdentifier())
+		journal.Update(m.Nonmem, journalCompleted, nil)
+	}
+
+	return output
+}
+
+func hashFile(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := md5.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
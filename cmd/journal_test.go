@@ -0,0 +1,199 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"bbi/configlib"
+	"github.com/metrumresearchgroup/turnstile"
+)
+
+func Test_batchJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bbi_journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var models []LocalModel
+	for _, name := range []string{"run001", "run002", "run003", "run004", "run005"} {
+		models = append(models, LocalModel{
+			Nonmem: &NonMemModel{
+				Path:      filepath.Join(dir, name+".mod"),
+				Model:     name + ".mod",
+				FileName:  name,
+				OutputDir: filepath.Join(dir, name),
+			},
+		})
+	}
+
+	path := filepath.Join(dir, journalFileName)
+	journal := newBatchJournal(path, models)
+
+	for _, e := range journal.Models {
+		if e.State != journalQueued {
+			t.Errorf("newBatchJournal() queued %s as %s, want %s", e.Model, e.State, journalQueued)
+		}
+	}
+
+	//Each update is persisted as it happens, so an interrupted batch can be resumed
+	journal.Update(models[0].Nonmem, journalRunning, nil)
+
+	written, err := readBatchJournal(path)
+	if err != nil {
+		t.Fatalf("readBatchJournal() error = %s", err)
+	}
+
+	if e := written.Models[0]; e.State != journalRunning || e.Started == nil || e.Finished != nil {
+		t.Errorf("readBatchJournal() after Update() = %+v, want run001 running", e)
+	}
+
+	journal.Update(models[0].Nonmem, journalCompleted, nil)
+	journal.Update(models[1].Nonmem, journalCancelled, errExecutionCancelled)
+	journal.Update(models[2].Nonmem, journalRunning, nil)
+	journal.Update(models[4].Nonmem, journalSkipped, errors.New("parent run003 failed"))
+
+	//Updates for models outside the batch, and on a nil journal, are ignored
+	journal.Update(&NonMemModel{Path: filepath.Join(dir, "other.mod")}, journalFailed, nil)
+	var missing *batchJournal
+	missing.Update(models[0].Nonmem, journalFailed, nil)
+
+	m := &turnstile.Manager{
+		ErrorList: []turnstile.ConcurrentError{
+			newConcurrentError("run003.mod", "nmtran failed", errors.New("exit status 1")),
+		},
+	}
+
+	if err = journal.Finalize(models, m); err != nil {
+		t.Fatalf("Finalize() error = %s", err)
+	}
+
+	finalized, err := readBatchJournal(path)
+	if err != nil {
+		t.Fatalf("readBatchJournal() error = %s", err)
+	}
+
+	want := map[string]string{
+		"run001": journalCompleted,
+		"run002": journalCancelled,
+		"run003": journalFailed,
+		//Models which never reached completion are failed along with those on the error list
+		"run004": journalFailed,
+		//Workflow models downstream of a failure were never run
+		"run005": journalSkipped,
+	}
+
+	for i, e := range finalized.Models {
+		name := models[i].Nonmem.FileName
+		if e.State != want[name] {
+			t.Errorf("Finalize() left %s %s, want %s", name, e.State, want[name])
+		}
+
+		if e.State != journalCompleted && e.Error == "" {
+			t.Errorf("Finalize() recorded no error for %s", name)
+		}
+	}
+
+	//Resuming re-plans every model of the previous batch
+	wantPaths := []string{models[0].Nonmem.Path, models[1].Nonmem.Path, models[2].Nonmem.Path, models[3].Nonmem.Path, models[4].Nonmem.Path}
+	if got := finalized.ModelPaths(); !reflect.DeepEqual(got, wantPaths) {
+		t.Errorf("ModelPaths() = %v, want %v", got, wantPaths)
+	}
+
+	if _, err = readBatchJournal(filepath.Join(dir, "missing.json")); err == nil {
+		t.Errorf("readBatchJournal() of a missing journal did not fail")
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "invalid.json"), []byte("{"), 0640)
+	if _, err = readBatchJournal(filepath.Join(dir, "invalid.json")); err == nil {
+		t.Errorf("readBatchJournal() of an invalid journal did not fail")
+	}
+
+	//The journals of grid jobs are kept in memory rather than written into the output directory
+	os.Remove(path)
+	unpersisted := newBatchJournal("", models)
+	unpersisted.Update(models[0].Nonmem, journalCompleted, nil)
+
+	if err = unpersisted.Finalize(models, m); err != nil {
+		t.Errorf("Finalize() of a journal without a path error = %s", err)
+	}
+
+	if files, _ := filepath.Glob(filepath.Join(dir, "*.json")); len(files) != 1 {
+		t.Errorf("a journal without a path was written: %v", files)
+	}
+}
+
+func Test_previousRunIsCurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bbi_journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	modelPath := filepath.Join(dir, "run001.mod")
+	dataPath := filepath.Join(dir, "data.csv")
+	outputDir := filepath.Join(dir, "run001")
+
+	ioutil.WriteFile(modelPath, []byte("$DATA ../data.csv\n"), 0644)
+	ioutil.WriteFile(dataPath, []byte("ID,TIME,DV\n"), 0644)
+	os.Mkdir(outputDir, 0755)
+
+	model := &NonMemModel{
+		Path:          modelPath,
+		OriginalPath:  dir,
+		OutputDir:     outputDir,
+		Configuration: configlib.Config{Local: configlib.LocalDetail{CreateChildDirs: true}},
+	}
+
+	if current, _ := previousRunIsCurrent(model); current {
+		t.Errorf("previousRunIsCurrent() = true without a bbi_config.json")
+	}
+
+	modelMD5, _ := hashFile(modelPath)
+	dataMD5, _ := hashFile(dataPath)
+
+	writeConfig := func(modelHash string) {
+		contents, _ := json.Marshal(map[string]string{
+			"data_path":  "../data.csv",
+			"data_md5":   dataMD5,
+			"model_md5":  modelHash,
+			"config_md5": nonmemSettingsHash(model.Configuration),
+			"output_dir": outputDir,
+		})
+		ioutil.WriteFile(filepath.Join(outputDir, "bbi_config.json"), contents, 0644)
+	}
+
+	writeConfig(modelMD5)
+
+	if current, reason := previousRunIsCurrent(model); !current {
+		t.Errorf("previousRunIsCurrent() = false for unchanged inputs: %s", reason)
+	}
+
+	//A resumed batch whose models are all current persists them as completed, as nothing executes to finalize it
+	path := filepath.Join(dir, journalFileName)
+	models := []LocalModel{{Nonmem: model}}
+
+	if queued := resumableModels(models, newBatchJournal(path, models)); len(queued) != 0 {
+		t.Errorf("resumableModels() re-queued %d current models", len(queued))
+	}
+
+	written, err := readBatchJournal(path)
+	if err != nil {
+		t.Fatalf("readBatchJournal() error = %s", err)
+	}
+
+	if written.Models[0].State != journalCompleted {
+		t.Errorf("resumableModels() journaled %s, want %s", written.Models[0].State, journalCompleted)
+	}
+
+	writeConfig("stale")
+
+	if current, _ := previousRunIsCurrent(model); current {
+		t.Errorf("previousRunIsCurrent() = true for a changed model")
+	}
+}
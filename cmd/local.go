@@ -3,6 +3,7 @@ package cmd
 import (
 	"bbi/configlib"
 	"crypto/md5"
+	"crypto/sha256"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -34,6 +35,7 @@ type localOperation struct {
 type LocalModel struct {
 	Nonmem               *NonMemModel
 	Cancel               chan bool
+	Journal              *batchJournal
 	postworkInstructions *PostExecutionHookEnvironment
 }
 
@@ -54,8 +56,8 @@ func (l *LocalModel) GetPostWorkConfig() *PostExecutionHookEnvironment {
 	return l.postworkInstructions
 }
 
-func (l *LocalModel) GetPostWorkExecutablePath() string {
-	return l.Nonmem.Configuration.PostWorkExecutable
+func (l *LocalModel) GetModel() *NonMemModel {
+	return l.Nonmem
 }
 
 func (l *LocalModel) GetGlobalConfig() configlib.Config {
@@ -78,6 +80,18 @@ func (l LocalModel) Prepare(channels *turnstile.ChannelMap) {
 
 	log.Debugf("%s Beginning local preparation phase", l.Nonmem.LogIdentifier())
 
+	//Once interrupted, models which haven't started are cancelled rather than executed
+	if executionInterrupted() {
+		p := &l
+		p.BuildExecutionEnvironment(false, errExecutionCancelled)
+		l.Journal.Update(l.Nonmem, journalCancelled, errExecutionCancelled)
+		RecordConcurrentError(p.Nonmem.FileName, "Execution was cancelled", errExecutionCancelled, channels, p.Cancel, p)
+		return
+	}
+
+	l.Journal.Update(l.Nonmem, journalRunning, nil)
+	dashboard.Phase(l.Nonmem, phasePrepare)
+
 	//Check for invalid selected versions of Nonmem if NMQual selected
 	if l.Nonmem.Configuration.NMQual {
 
@@ -139,6 +153,12 @@ func (l LocalModel) Prepare(channels *turnstile.ChannelMap) {
 
 	}
 
+	//Copy in a previously compiled executable if the cache has one for this model
+	if err := useCachedExecutable(l.Nonmem); err != nil {
+		log.Warnf("%s Unable to use a cached executable. Nonmem will be compiled: %s", l.Nonmem.LogIdentifier(), err)
+		l.Nonmem.CachedExecutable = ""
+	}
+
 	//Create Execution Script
 	log.Debugf("%s Creating local execution script", l.Nonmem.LogIdentifier())
 	scriptContents, err := generateScript(nonMemExecutionTemplate, l.Nonmem)
@@ -161,17 +181,63 @@ func (l LocalModel) Prepare(channels *turnstile.ChannelMap) {
 	if l.Nonmem.Configuration.Parallel {
 		err = writeParaFile(l.Nonmem)
 		if err != nil {
-			log.Fatalf("%s Configuration requires parallel operation, but generation or writing of the parafile has failed: %s", l.Nonmem.LogIdentifier(), err)
+			p := &l
+			p.BuildExecutionEnvironment(false, err)
+			RecordConcurrentError(p.Nonmem.FileName, "Configuration requires parallel operation, but generation or writing of the parafile has failed", err, channels, p.Cancel, p)
+			return
+		}
+	}
+
+	//The pre work executable runs once everything nmfe needs is in place
+	if l.Nonmem.Configuration.PreWorkExecutable != "" {
+		log.Debugf("%s Running the pre work executable %s", l.Nonmem.LogIdentifier(), l.Nonmem.Configuration.PreWorkExecutable)
+
+		p := &l
+		p.BuildExecutionEnvironment(false, nil)
+
+		if _, err := ExecutePreWorkDirectivesWithEnvironment(p); err != nil {
+			err = fmt.Errorf("the pre work executable failed: %w", err)
+
+			//nmfe never starts, so the failure of the pre work executable is the only record of this run
+			if werr := writeNonmemConfig(p.Nonmem); werr != nil {
+				log.Errorf("%s Unable to record the failure of the pre work executable: %s", p.Nonmem.LogIdentifier(), werr)
+			}
+
+			p.BuildExecutionEnvironment(false, err)
+			RecordConcurrentError(p.Nonmem.FileName, "The pre work executable exited with an error. Its output is in pre_processing.out", err, channels, p.Cancel, p)
+			return
 		}
 	}
 
+	events.Model(eventModelPrepared, l.Nonmem)
 }
 
 //Work describes the Turnstile execution phase -> IE What heavy lifting should be done
 func (l LocalModel) Work(channels *turnstile.ChannelMap) {
-	cerr := executeNonMemJob(executeLocalJob, l.Nonmem)
+	dashboard.Phase(l.Nonmem, phaseWork)
+
+	stopFollowing := events.FollowIterations(l.Nonmem)
+	cerr := executeWithRetries(executeLocalJob, l.Nonmem)
+	stopFollowing()
+
+	if cerr.Error == nil {
+		events.Model(eventModelCompleted, l.Nonmem)
+	}
+
+	//The resubmitted job reports the outcome of the model, including its notifications and post work hooks. This job
+	//only stops before its outputs are cleaned up
+	if errors.Is(cerr.Error, errExecutionResubmitted) {
+		events.Resubmitted(l.Nonmem, cerr.Notes, cerr.Error)
+		l.Cancel <- true
+		channels.Errors <- cerr
+		return
+	}
 
 	if cerr.Error != nil {
+		if errors.Is(cerr.Error, errExecutionCancelled) {
+			l.Journal.Update(l.Nonmem, journalCancelled, cerr.Error)
+		}
+
 		p := &l
 		p.BuildExecutionEnvironment(false, cerr.Error)
 		RecordConcurrentError(p.Nonmem.Model, cerr.Notes, cerr.Error, channels, p.Cancel, p)
@@ -188,7 +254,14 @@ func (l LocalModel) Monitor(channels *turnstile.ChannelMap) {
 func (l LocalModel) Cleanup(channels *turnstile.ChannelMap) {
 	time.Sleep(10 * time.Millisecond)
 	log.Printf("%s Beginning cleanup phase", l.Nonmem.LogIdentifier())
+	dashboard.Phase(l.Nonmem, phaseCleanup)
 	fs := afero.NewOsFs()
+
+	//Store the compiled executable before the temporary files are cleaned up
+	//The model has already run, so a failure to cache its executable is no reason to fail it
+	if err := cacheCompiledExecutable(l.Nonmem); err != nil {
+		log.Warnf("%s Unable to store the compiled executable in the cache: %s", l.Nonmem.LogIdentifier(), err)
+	}
 	// while the rest of the cleanup is happening, lets also hash the data in the background
 	// so don't have to wait extra time if its on the larger end
 	//Get the lines of the file
@@ -208,10 +281,10 @@ func (l LocalModel) Cleanup(channels *turnstile.ChannelMap) {
 		}
 	}
 
-	dataHashChan := make(chan string)
-	go HashFileOnChannel(dataHashChan, l.Nonmem.DataPath, l.Nonmem.FileName)
+	dataHashChan := make(chan fileDigest)
+	go HashFileOnChannel(dataHashChan, hashableDataFile(l.Nonmem), l.Nonmem.FileName)
 
-	modelHashChan := make(chan string)
+	modelHashChan := make(chan fileDigest)
 	go HashFileOnChannel(modelHashChan, path.Join(l.Nonmem.OriginalPath, l.Nonmem.OriginalModel), l.Nonmem.FileName)
 
 	log.Debugf("%s Beginning selection of cleanable / copiable files", l.Nonmem.LogIdentifier())
@@ -262,6 +335,12 @@ func (l LocalModel) Cleanup(channels *turnstile.ChannelMap) {
 		afero.WriteFile(fs, path.Join(l.Nonmem.OriginalPath, l.Nonmem.FileName+"_copied.json"), copiedJSON, 0750)
 	}
 
+	//The compiled executable is recorded in the provenance of the model before the clean level can remove it
+	var executable *provenanceFile
+	if f, err := hashProvenanceFile(provenanceExecutable, l.Nonmem.OutputDir, filepath.Join(l.Nonmem.OutputDir, nonmemExecutableName())); err == nil {
+		executable = &f
+	}
+
 	//Clean Up
 	log.Debugf("%s Beginning local cleanup operations", l.Nonmem.LogIdentifier())
 	for _, v := range pwi.FilesToClean.FilesToRemove {
@@ -289,8 +368,24 @@ func (l LocalModel) Cleanup(channels *turnstile.ChannelMap) {
 
 	// this should have been either completed well before, or must at least wait now to complete the hash
 	// before writing out the config
-	l.Nonmem.DataMD5 = <-dataHashChan
-	l.Nonmem.ModelMD5 = <-modelHashChan
+	dataDigest := <-dataHashChan
+	modelDigest := <-modelHashChan
+
+	l.Nonmem.DataMD5 = dataDigest.MD5
+	l.Nonmem.ModelMD5 = modelDigest.MD5
+	l.Nonmem.ConfigMD5 = nonmemSettingsHash(l.Nonmem.Configuration)
+
+	log.Debugf("%s Writing out the provenance manifest into %s", l.Nonmem.LogIdentifier(), l.Nonmem.OutputDir)
+	manifest, err := newProvenanceManifest(l.Nonmem, modelDigest, dataDigest, executable)
+
+	if err == nil {
+		err = writeProvenanceManifest(l.Nonmem.OutputDir, manifest)
+	}
+
+	//The results are already in place, so the model still completes without its manifest
+	if err != nil {
+		log.Errorf("%s Unable to write the provenance manifest: %s", l.Nonmem.LogIdentifier(), err)
+	}
 
 	//Serialize and Write the Config down to a file
 	log.Debugf("%s Writing out configuration as json into %s", l.Nonmem.LogIdentifier(), l.Nonmem.OutputDir)
@@ -311,9 +406,17 @@ func (l LocalModel) Cleanup(channels *turnstile.ChannelMap) {
 
 	*/
 
-	//PostWorkExecution phase if the script value is not empty
+	//Run the post work hooks, failing the model if a required hook fails
+	if err = PostWorkExecution(&l, true, nil); err != nil {
+		p := &l
+		p.BuildExecutionEnvironment(false, err)
+		recordFailure(p.Nonmem.FileName, "A required post work hook failed", err, channels, p.Cancel, p)
+		return
+	}
 
-	PostWorkExecution(&l, l.Nonmem.FileName, channels, l.Cancel, true, nil)
+	l.Journal.Update(l.Nonmem, journalCompleted, nil)
+	dashboard.Phase(l.Nonmem, phaseCompleted)
+	events.Model(eventCleanupDone, l.Nonmem)
 
 	log.Infof("%s Cleanup completed", l.Nonmem.LogIdentifier())
 	channels.Completed <- 1
@@ -336,6 +439,19 @@ func init() {
 	localCmd.PersistentFlags().Bool(childDirIdentifier, true, "Indicates whether or not local branch execution"+
 		"should create a new subdirectory with the output_dir variable as its name and execute in that directory")
 	viper.BindPFlag("local."+childDirIdentifier, localCmd.PersistentFlags().Lookup(childDirIdentifier))
+
+	localCmd.PersistentFlags().StringVar(&workflowFile, "workflow", "", "A YAML workflow file declaring models and the models they are based_on. "+
+		"Models are executed once their parents succeed, and are skipped if any parent fails")
+
+	localCmd.PersistentFlags().IntVar(&gridAttempt, "grid_attempt", 0, "Attempt number of a grid job. Set by the grid script so that transient failures are resubmitted to the grid")
+	localCmd.PersistentFlags().MarkHidden("grid_attempt")
+
+	localCmd.PersistentFlags().BoolVar(&gridJob, "grid_job", false, "Set by the grid script so that only run sge notifies of the finished batch, "+
+		"and no batch journal is written into the output directory")
+	localCmd.PersistentFlags().MarkHidden("grid_job")
+
+	localCmd.PersistentFlags().BoolVar(&resumeBatch, "resume", false, "Resume the batch recorded in "+journalFileName+". Models whose outputs "+
+		"match the current model and data hashes are skipped, and failed or unfinished models are re-queued")
 }
 
 func local(cmd *cobra.Command, args []string) {
@@ -350,8 +466,83 @@ func local(cmd *cobra.Command, args []string) {
 
 	logSetup(config)
 
+	if err := validatePostWorkHooks(config); err != nil {
+		log.Fatal(err)
+	}
+
+	currentDir, err := os.Getwd()
+	if err != nil {
+		log.Fatalf("Unable to determine the current directory for the batch journal: %s", err)
+	}
+
+	journalPath := filepath.Join(currentDir, journalFileName)
+
+	//Grid jobs execute within the output directory of their model, where a journal would end up in its archives and
+	//bundles. Their journal is kept in memory only
+	if gridJob {
+		journalPath = ""
+	}
+
+	if workflowFile != "" {
+		if len(args) > 0 {
+			log.Fatal("Models cannot be provided as arguments alongside a workflow file")
+		}
+
+		if preview {
+			if err := previewWorkflow(workflowFile, config); err != nil {
+				log.Fatalf("An error occurred processing the workflow: %s", err)
+			}
+
+			return
+		}
+
+		now := time.Now()
+
+		startEventStream()
+
+		nodes, m, err := executeWorkflow(workflowFile, config, journalPath, resumeBatch)
+		if err != nil {
+			log.Fatalf("An error occurred processing the workflow: %s", err)
+		}
+
+		events.Close()
+
+		postWorkNotice(m, now)
+		workflowSummary(nodes)
+
+		notifyBatch(config, "local", phaseCompleted, executedWorkflowModels(nodes), m, now)
+
+		//Models which failed to have $MSFI wired never reach the turnstile, so their status is checked as well
+		code := batchExitCode(m)
+		for _, n := range nodes {
+			if n.Status == workflowFailed {
+				code = 1
+			}
+		}
+
+		if code != 0 {
+			os.Exit(code)
+		}
+
+		return
+	}
+
+	if err := validateConfiguredParaFile(config); err != nil {
+		log.Fatal(err)
+	}
+
 	lo := localOperation{}
 
+	//Without any models, resume the plan of the previous batch
+	if resumeBatch && len(args) == 0 {
+		previous, err := readBatchJournal(journalPath)
+		if err != nil {
+			log.Fatalf("Unable to resume the previous batch: %s", err)
+		}
+
+		args = previous.ModelPaths()
+	}
+
 	log.Debug("Locating models from arguments")
 	localmodels, err := localModelsFromArguments(args, config)
 
@@ -359,27 +550,96 @@ func local(cmd *cobra.Command, args []string) {
 		log.Fatalf("An error occurred during model processing: %s", err)
 	}
 
+	if len(localmodels) == 0 {
+		log.Fatal("No models were located or loaded. Please verify the arguments provided and try again")
+	}
+
+	if preview {
+		var planned []*NonMemModel
+		for _, m := range localmodels {
+			planned = append(planned, m.Nonmem)
+		}
+
+		previewExecution("local", planned, viper.GetBool("json"))
+		return
+	}
+
+	//Resubmitted grid jobs continue the attempts recorded by the previous job
+	if gridAttempt > 1 {
+		for _, m := range localmodels {
+			m.Nonmem.Attempts = previousAttempts(m.Nonmem)
+		}
+	}
+
+	journal := newBatchJournal(journalPath, localmodels)
+	//Resuming completes the interrupted batch, so models it completed aren't re-run even when forced
+	if resumeBatch {
+		localmodels = resumableModels(localmodels, journal)
+	} else {
+		localmodels = skipUnchangedModels(localmodels, journal)
+	}
+
+	for i := range localmodels {
+		localmodels[i].Journal = journal
+	}
+
 	lo.Models = localmodels
 
 	if len(lo.Models) == 0 {
-		log.Fatal("No models were located or loaded. Please verify the arguments provided and try again")
+		log.Info("All models in the batch are unchanged since their last successful run. Use --force to execute them anyway")
+		return
 	}
 
 	//Models Added
 	log.Infof("A total of %d models have completed the initial preparation phase", len(lo.Models))
 
+	now := time.Now()
+
+	var dashboardModels []*NonMemModel
+	for _, v := range lo.Models {
+		dashboardModels = append(dashboardModels, v.Nonmem)
+	}
+
+	dashboard = startDashboard(dashboardModels)
+
+	startEventStream()
+	events.BatchStarted(dashboardModels)
+
+	m := executeLocalModels(lo.Models, viper.GetInt("threads"))
+
+	dashboard.Stop()
+
+	events.BatchFinished(len(lo.Models), m.ErrorList)
+	events.Close()
+
+	postWorkNotice(m, now)
+
+	notifyBatch(config, "local", phaseCompleted, dashboardModels, m, now)
+
+	if err = journal.Finalize(lo.Models, m); err != nil {
+		log.Errorf("Unable to persist the batch journal to %s: %s", journalPath, err)
+	}
+
+	if code := batchExitCode(m); code != 0 {
+		os.Exit(code)
+	}
+}
+
+//executeLocalModels runs the provided models through a turnstile manager and blocks until all of them have completed
+func executeLocalModels(models []LocalModel, concurrency int) *turnstile.Manager {
 	//Create signature safe slice for manager
 	var scalables []turnstile.Scalable
 
-	for _, v := range lo.Models {
+	for _, v := range models {
 		scalables = append(scalables, v)
 	}
 
 	//Begin Execution
-	log.Debug("Building turnstile manager")
-	m := turnstile.NewManager(scalables, uint64(viper.GetInt("threads")))
+	//Running models are terminated, and the remainder cancelled, on interrupt
+	handleInterrupts()
 
-	now := time.Now()
+	log.Debug("Building turnstile manager")
+	m := turnstile.NewManager(scalables, uint64(concurrency))
 
 	log.Debug("Beginning turnstile execution")
 	go m.Execute()
@@ -399,11 +659,7 @@ func local(cmd *cobra.Command, args []string) {
 		time.Sleep(5 * time.Millisecond)
 	}
 
-	postWorkNotice(m, now)
-
-	if len(m.ErrorList) > 0 {
-		os.Exit(1)
-	}
+	return m
 }
 
 //WriteGitIgnoreFile takes a provided path and does best attempt work to write a "Exclude all" gitignore file in the location
@@ -427,7 +683,26 @@ func executeLocalJob(model *NonMemModel) turnstile.ConcurrentError {
 
 	log.Debugf("%s Generated command was: %s", model.LogIdentifier(), command.String())
 
-	output, err := command.CombinedOutput()
+	//Stream the output into the .out file as it is produced so progress can be followed while the model runs
+	outFile, err := fs.OpenFile(path.Join(model.OutputDir, model.Model+".out"), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0750)
+	if err != nil {
+		return newConcurrentError(model.Model, "Unable to create the output file for the model", err)
+	}
+	defer outFile.Close()
+
+	events.Started(model)
+	model.executed = true
+
+	output, err := runTrackedCommand(model.LogIdentifier(), model.OutputDir, command, model.Configuration.MaxRuntime, outFile)
+
+	if errors.Is(err, errExecutionCancelled) {
+		log.Warnf("%s Execution was cancelled", model.LogIdentifier())
+		return newConcurrentError(model.Model, "Execution was cancelled", err)
+	}
+
+	if errors.Is(err, errMaxRuntimeExceeded) {
+		return newConcurrentError(model.Model, "Execution was terminated after exceeding the max_runtime", err)
+	}
 
 	if err != nil && !strings.Contains(string(output), "not well-formed (invalid token)") {
 		log.Debug(err)
@@ -438,12 +713,11 @@ func executeLocalJob(model *NonMemModel) turnstile.ConcurrentError {
 			log.Errorf("%s Exit code was %d, details were %s", model.LogIdentifier(), code, details)
 			log.Errorf("%s output details were: %s", model.LogIdentifier(), string(output))
 		}
+
 		return newConcurrentError(model.Model, "Running the programmatic shell script caused an error", err)
 
 	}
 
-	afero.WriteFile(fs, path.Join(model.OutputDir, model.Model+".out"), output, 0750)
-
 	return turnstile.ConcurrentError{}
 }
 
@@ -499,19 +773,45 @@ func writeNonmemConfig(model *NonMemModel) error {
 	return afero.WriteFile(afero.NewOsFs(), path.Join(model.OutputDir, "bbi_config.json"), outBytes, 0750)
 }
 
-func HashFileOnChannel(ch chan string, file string, identifier string) {
+//fileDigest holds the digests of a file, computed in a single read. Both are empty when the file couldn't be read
+type fileDigest struct {
+	MD5    string
+	SHA256 string
+	Size   int64
+}
+
+//hashableDataFile locates the data file of the model. The data path in the control stream is relative to the output directory it's executed in
+func hashableDataFile(model *NonMemModel) string {
+	if filepath.IsAbs(model.DataPath) {
+		return model.DataPath
+	}
+
+	return filepath.Join(model.OutputDir, model.DataPath)
+}
+
+func HashFileOnChannel(ch chan fileDigest, file string, identifier string) {
 	f, err := os.Open(file)
 	if err != nil {
 		log.Debugf("File requested was %s, Identifier is %s", file, identifier)
 		log.Errorf("%s error reading data to hash: %s", identifier, err)
-		ch <- ""
+		ch <- fileDigest{}
+		return
 	}
 	defer f.Close()
 
-	h := md5.New()
-	if _, err := io.Copy(h, f); err != nil {
+	md5Hash := md5.New()
+	sha256Hash := sha256.New()
+
+	size, err := io.Copy(io.MultiWriter(md5Hash, sha256Hash), f)
+	if err != nil {
 		log.Errorf("%s error hashing data: %s", identifier, err)
-		ch <- ""
+		ch <- fileDigest{}
+		return
+	}
+
+	ch <- fileDigest{
+		MD5:    fmt.Sprintf("%x", md5Hash.Sum(nil)),
+		SHA256: fmt.Sprintf("%x", sha256Hash.Sum(nil)),
+		Size:   size,
 	}
-	ch <- fmt.Sprintf("%x", h.Sum(nil))
 }
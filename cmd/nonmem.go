@@ -55,10 +55,21 @@ const nonMemExecutionTemplate string = `#!/bin/bash
 const nonmemParaFiletemplate string = `$GENERAL
 NODES={{ .TotalNodes }} PARSE_TYPE=2 TIMEOUTI=100 TIMEOUT={{ .CompletionTimeout }} PARAPRINT=0 TRANSFER_TYPE=1
 $COMMANDS
-1: {{ .MpiExecPath }} -wdir "$PWD" -n {{ .HeadNodes }} ./nonmem $*
+1: {{ .MpiExecPath }} -wdir "$PWD"{{ if .HostFile }} -f {{ .HostFile }}{{ end }} -n {{ .HeadNodes }} ./nonmem $*
 2:-wdir "$PWD" -n {{ .WorkerNodes }} ./nonmem -wnf
 $DIRECTORIES
 1:NONE
+{{ .WorkerDirectories }}`
+
+//nonmemFPIParaFileTemplate is used for file based parallelization (TRANSFER_TYPE=0) on machines without MPI.
+//Workers are launched in the background and communicate with the manager through files in their worker directories
+const nonmemFPIParaFileTemplate string = `$GENERAL
+NODES={{ .TotalNodes }} PARSE_TYPE=2 TIMEOUTI=100 TIMEOUT={{ .CompletionTimeout }} PARAPRINT=0 TRANSFER_TYPE=0
+$COMMANDS
+1:NONE
+2-[nodes]:./nonmem -wnf &
+$DIRECTORIES
+1:NONE
 2-[nodes]:worker{#-1}`
 
 type nonmemParallelDirective struct {
@@ -67,6 +78,8 @@ type nonmemParallelDirective struct {
 	MpiExecPath       string
 	HeadNodes         int
 	WorkerNodes       int
+	HostFile          string
+	WorkerDirectories string
 }
 
 var controlStreamExtensions []string = []string{
@@ -153,6 +166,8 @@ type NonMemModel struct {
 	DataMD5 string `json:"data_md5"`
 	//ModelMD5 is the digest of the executing model file
 	ModelMD5 string `json:"model_md5"`
+	//ConfigMD5 is the digest of the effective nonmem installation and NMFE options used for execution
+	ConfigMD5 string `json:"config_md5"`
 	//FileName is the Filename component (sans extension)
 	FileName string `json:"model_filename"`
 	//Extension is the extension of the file
@@ -161,10 +176,26 @@ type NonMemModel struct {
 	OriginalPath string `json:"original_path"`
 	//OutputDir is the directory into which the copied models and work will be located
 	OutputDir string `json:"output_dir"`
+	//MSFI is the fully qualified path to a model specification file from a parent run which any $MSFI record will be pointed at
+	MSFI string `json:"msfi,omitempty"`
+	//CachedExecutable is the cache entry (or named executable) copied in place of compiling nonmem for this model
+	CachedExecutable string `json:"cached_executable,omitempty"`
+	//Attempts records each execution of the model when transient failures are retried
+	Attempts []executionAttempt `json:"attempts,omitempty"`
+	//PreWork records the outcome of the pre work executable
+	PreWork *hookResult `json:"pre_work,omitempty"`
+	//PostWorkHooks records the outcome of each post work hook run for the model
+	PostWorkHooks []hookResult `json:"post_work_hooks,omitempty"`
+	//Annotations are the settings from the ;; bbi: comments of the control stream, merged into Configuration
+	Annotations map[string]string `json:"annotations,omitempty"`
 	//Settings are basically the cobra definitions / requirements for the iteration
 	Configuration configlib.Config `json:"configuration"`
 	//Whether or not the model had an error on generation or execution
 	Error error `json:"error"`
+	//cacheKey is the digest of the code NM-TRAN generated for the model, used to locate a cached executable
+	cacheKey string
+	//executed is set once nonmem has been started in the output directory of the model
+	executed bool
 }
 
 var nonmemLongDescription string = fmt.Sprintf("\n%s\n\n%s\n\n%s\n", runLongDescription, summaryLongDescription, covcorLongDescription)
@@ -206,6 +237,14 @@ func init() {
 	nonmemCmd.PersistentFlags().String(parafileIdentifier, "", "Location of a user-provided parafile to use for parallel execution")
 	viper.BindPFlag(parafileIdentifier, nonmemCmd.PersistentFlags().Lookup(parafileIdentifier))
 
+	const parallelModeIdentifier string = "parallel_mode"
+	nonmemCmd.PersistentFlags().String(parallelModeIdentifier, parallelModeMPI, "Type of parafile to generate for parallel execution: mpi, or fpi (file based) for machines without MPI")
+	viper.BindPFlag(parallelModeIdentifier, nonmemCmd.PersistentFlags().Lookup(parallelModeIdentifier))
+
+	const hostfileIdentifier string = "hostfile"
+	nonmemCmd.PersistentFlags().String(hostfileIdentifier, "", "Hostfile listing the hosts and slots allocated for parallel execution. Defaults to $PE_HOSTFILE when it is set")
+	viper.BindPFlag(hostfileIdentifier, nonmemCmd.PersistentFlags().Lookup(hostfileIdentifier))
+
 	const nmQualIdentifier string = "nmqual"
 	nonmemCmd.PersistentFlags().Bool(nmQualIdentifier, false, "Whether or not to execute with nmqual (autolog.pl")
 	viper.BindPFlag(nmQualIdentifier, nonmemCmd.PersistentFlags().Lookup(nmQualIdentifier))
@@ -260,27 +299,18 @@ func copyFileToDestination(l *NonMemModel, modifyPath bool) error {
 		return err
 	}
 
-	if modifyPath {
+	if modifyPath || l.MSFI != "" {
 		// this is going to break the hashing so it doesn't matter anyway, but this implementation will strip
 		// trailing newlines, so for a file that doesn't modify the path, it will unnecessarily invalidate a hash check
 		// hence we'll use an alternate implementation of ioutils to make sure hashes match if no modification is needed
-		sourceLines, err := utils.ReadLines(l.Path)
+		fileContents, err := modifiedModelContents(l, modifyPath)
 
 		if err != nil {
-			return errors.New("Unable to read the contents of " + l.Path)
+			return err
 		}
 
 		//We'll use stats for setting the mode of the target file to make sure perms are the same
-
-		for k, line := range sourceLines {
-			if strings.Contains(line, "$DATA") {
-				sourceLines[k] = parser.AddPathLevelToData(line)
-			}
-		}
-
-		//Write the file contents
-		fileContents := strings.Join(sourceLines, "\n")
-		afero.WriteFile(fs, path.Join(l.OutputDir, filename), []byte(fileContents), stats.Mode())
+		afero.WriteFile(fs, path.Join(l.OutputDir, filename), fileContents, stats.Mode())
 
 	} else {
 		input, err := ioutil.ReadFile(l.Path)
@@ -297,6 +327,33 @@ func copyFileToDestination(l *NonMemModel, modifyPath bool) error {
 	return nil
 }
 
+//modifiedModelContents renders the control stream as it will be written into the output directory, adding a level to the
+//$DATA path if requested and pointing $MSFI at the configured model specification file
+func modifiedModelContents(l *NonMemModel, modifyPath bool) ([]byte, error) {
+	sourceLines, err := utils.ReadLines(l.Path)
+
+	if err != nil {
+		return []byte{}, errors.New("Unable to read the contents of " + l.Path)
+	}
+
+	for k, line := range sourceLines {
+		if modifyPath && strings.Contains(line, "$DATA") {
+			sourceLines[k] = parser.AddPathLevelToData(line)
+		}
+	}
+
+	//Point $MSFI at the outputs of the parent run, relative to where this copy will execute
+	if l.MSFI != "" {
+		msfi, err := filepath.Rel(l.OutputDir, l.MSFI)
+		if err != nil {
+			msfi = l.MSFI
+		}
+		sourceLines = parser.ReplaceModelSpecificationFileInput(sourceLines, msfi)
+	}
+
+	return []byte(strings.Join(sourceLines, "\n")), nil
+}
+
 //processes any template (including the const one here) to create a byte slice of the entire file
 func generateScript(fileTemplate string, l *NonMemModel) ([]byte, error) {
 	log.Debugf("%s beginning script command generation. NMQual is set to %t", l.LogIdentifier(), l.Configuration.NMQual)
@@ -336,24 +393,38 @@ func generateScript(fileTemplate string, l *NonMemModel) ([]byte, error) {
 
 func writeParaFile(l *NonMemModel) error {
 
-	contentBytes, err := generateParaFile(l)
-
-	log.Debugf("Parafile used has contents of : %s", string(contentBytes))
-
-	//Something failed during generation
-	if err != nil {
-		return err
-	}
-
 	var contentLines []string
 
 	//If no parafile is provided, generate one
 	if l.Configuration.Parafile == "" {
+		contentBytes, err := generateParaFile(l)
+
+		//Something failed during generation
+		if err != nil {
+			return err
+		}
+
+		log.Debugf("Parafile used has contents of : %s", string(contentBytes))
+
 		contentLines = strings.Split(string(contentBytes), "\n")
+
+		//When spanning several hosts, mpiexec is given the hosts through a hostfile next to the parafile
+		hosts, _ := parallelHosts(l.Configuration)
+		if len(hosts) > 1 {
+			err = utils.WriteLines(mpiHostFileContents(hosts), path.Join(l.OutputDir, l.FileName+".hosts"))
+			if err != nil {
+				return fmt.Errorf("unable to write the hostfile for mpiexec: %s", err)
+			}
+		}
 	} else {
+		var err error
 		contentLines, err = utils.ReadLines(l.Configuration.Parafile)
 		if err != nil {
-			log.Fatalf("Unable to read the contents of the parafile provided: %s, Error is %s ", l.Configuration.Parafile, err)
+			return fmt.Errorf("unable to read the contents of the parafile provided: %s, Error is %s ", l.Configuration.Parafile, err)
+		}
+
+		if err = validateParaFile(contentLines); err != nil {
+			return fmt.Errorf("the parafile provided at %s is invalid: %s", l.Configuration.Parafile, err)
 		}
 	}
 
@@ -362,18 +433,59 @@ func writeParaFile(l *NonMemModel) error {
 }
 
 func generateParaFile(l *NonMemModel) ([]byte, error) {
+	nodes := parallelNodes(l.Configuration)
+
+	hosts, err := parallelHosts(l.Configuration)
+	if err != nil {
+		return []byte{}, err
+	}
+
+	//The hostfile describes exactly what was allocated, so it takes precedence when spanning several hosts
+	if len(hosts) > 1 {
+		nodes = totalSlots(hosts)
+	} else {
+		hosts = nil
+	}
+
+	if nodes < 2 {
+		return []byte{}, fmt.Errorf("parallel execution requires at least 2 nodes, but only %d are available", nodes)
+	}
+
 	nmp := nonmemParallelDirective{
-		TotalNodes:        l.Configuration.Threads,
+		TotalNodes:        nodes,
 		HeadNodes:         1,
-		WorkerNodes:       l.Configuration.Threads - 1,
+		WorkerNodes:       nodes - 1,
 		CompletionTimeout: l.Configuration.ParallelTimeout,
 		MpiExecPath:       l.Configuration.MPIExecPath,
+		WorkerDirectories: workerDirectories(hosts),
+	}
+
+	if hosts != nil {
+		nmp.HostFile = path.Join(l.OutputDir, l.FileName+".hosts")
+	}
+
+	parafileTemplate := nonmemParaFiletemplate
+
+	switch strings.ToLower(l.Configuration.ParallelMode) {
+	case "", parallelModeMPI:
+		mpiExecPath, err := locateMpiExec(l.Configuration.MPIExecPath)
+		if err != nil {
+			return []byte{}, err
+		}
+		nmp.MpiExecPath = mpiExecPath
+	case parallelModeFPI:
+		if hosts != nil {
+			return []byte{}, fmt.Errorf("parallel_mode %s can only use a single host, but %d hosts were allocated", parallelModeFPI, len(hosts))
+		}
+		parafileTemplate = nonmemFPIParaFileTemplate
+	default:
+		return []byte{}, fmt.Errorf("parallel_mode must be one of %s or %s, not %s", parallelModeMPI, parallelModeFPI, l.Configuration.ParallelMode)
 	}
 
 	buf := new(bytes.Buffer)
 
 	t := template.New("parafile")
-	parsed, err := t.Parse(nonmemParaFiletemplate)
+	parsed, err := t.Parse(parafileTemplate)
 
 	if err != nil {
 		return []byte{}, err
@@ -416,12 +528,16 @@ func buildNonMemCommandString(l *NonMemModel) string {
 		log.Fatal("No version was supplied and no default value exists in the configset")
 	}
 
-	// TODO: Implement cache
 	nmExecutable := path.Join(nmHome, "run", nmBinary)
 
 	//Are values present for raw options?
 	nmfeOptions := processNMFEOptions(l.Configuration)
 
+	//A compiled executable was copied from the cache into the output directory, so nmfe should not rebuild it
+	if l.CachedExecutable != "" && !l.Configuration.NMFEOptions.NoBuild {
+		nmfeOptions = append(nmfeOptions, "-nobuild")
+	}
+
 	var cmdArgs []string
 
 	cmdArgs = append(cmdArgs, []string{
@@ -434,6 +550,11 @@ func buildNonMemCommandString(l *NonMemModel) string {
 	//Section for Appending the parafile command
 	if l.Configuration.Parallel {
 		cmdArgs = append(cmdArgs, "-parafile="+l.FileName+".pnm")
+
+		//Generated parafiles are written with the number of nodes, while those provided may use the [nodes] placeholder
+		if l.Configuration.Parafile != "" {
+			cmdArgs = append(cmdArgs, nodesArgument(l.Configuration))
+		}
 	}
 
 	if len(nmfeOptions) > 0 {
@@ -672,18 +793,63 @@ func postWorkNotice(m *turnstile.Manager, t time.Time) {
 	executionWaitGroup.Wait()
 
 	log.Debug("Work has completed. Beginning detail display via console")
-	if m.Errors > 0 {
-		log.Errorf("%d errors were experienced during the run", m.Errors)
+	failed, cancelled := partitionCancellations(m.ErrorList)
+
+	if len(failed) > 0 {
+		log.Errorf("%d errors were experienced during the run", len(failed))
 
-		for _, v := range m.ErrorList {
+		for _, v := range failed {
 			log.Errorf("Errors were experienced while running model %s. Details are %s", v.RunIdentifier, v.Notes)
 		}
 	}
 
+	if len(cancelled) > 0 {
+		log.Warnf("%d models were cancelled", len(cancelled))
+
+		for _, v := range cancelled {
+			log.Warnf("Model %s was cancelled", v.RunIdentifier)
+		}
+	}
+
 	log.Infof("\r%d models completed in %s", m.Completed, time.Since(t))
 	println("")
 }
 
+//partitionCancellations separates the models cancelled through an interrupt or bbi nonmem stop from those which failed.
+//Grid attempts which were resubmitted are in neither, as the resubmitted job reports their outcome
+func partitionCancellations(errs []turnstile.ConcurrentError) ([]turnstile.ConcurrentError, []turnstile.ConcurrentError) {
+	var failed, cancelled []turnstile.ConcurrentError
+
+	for _, e := range errs {
+		if errors.Is(e.Error, errExecutionResubmitted) {
+			continue
+		}
+
+		if errors.Is(e.Error, errExecutionCancelled) {
+			cancelled = append(cancelled, e)
+		} else {
+			failed = append(failed, e)
+		}
+	}
+
+	return failed, cancelled
+}
+
+//batchExitCode is 1 if any model failed, cancelledExitCode if models were only cancelled and 0 otherwise
+func batchExitCode(m *turnstile.Manager) int {
+	failed, cancelled := partitionCancellations(m.ErrorList)
+
+	if len(failed) > 0 {
+		return 1
+	}
+
+	if len(cancelled) > 0 {
+		return cancelledExitCode
+	}
+
+	return 0
+}
+
 //NewNonMemModel creates the core nonmem dataset from the passed arguments
 func NewNonMemModel(modelname string, config configlib.Config) (NonMemModel, error) {
 
@@ -699,8 +865,15 @@ func NewNonMemModel(modelname string, config configlib.Config) (NonMemModel, err
 		return NonMemModel{}, err
 	}
 
+	//Settings annotated in the control stream apply to this model alone
+	config, annotations, err := annotatedConfig(modelLines, config)
+	if err != nil {
+		return NonMemModel{}, fmt.Errorf("%s: %w", modelname, err)
+	}
+
 	lm := NonMemModel{
-		BBIVersion: VERSION,
+		BBIVersion:  VERSION,
+		Annotations: annotations,
 	}
 	fs := afero.NewOsFs()
 
@@ -780,28 +953,14 @@ func NewNonMemModel(modelname string, config configlib.Config) (NonMemModel, err
 	lm.Configuration = config
 
 	//Process The template from the viper content for output Dir
-	t, err := template.New("output").Parse(config.OutputDir)
-	buf := new(bytes.Buffer)
-
-	if err != nil {
-		return NonMemModel{}, err
-	}
-
-	type outputName struct {
-		Name string
-	}
-
-	//Make sure to only use the filename for the output dir
-	err = t.Execute(buf, outputName{
-		Name: lm.FileName,
-	})
+	outputDir, err := renderOutputDir(lm, config)
 
 	if err != nil {
-		return NonMemModel{}, err
+		return NonMemModel{}, fmt.Errorf("unable to render the output_dir template for %s: %w", modelname, err)
 	}
 
 	//Use the template content plus the original path
-	lm.OutputDir = path.Join(lm.OriginalPath, buf.String())
+	lm.OutputDir = path.Join(lm.OriginalPath, outputDir)
 
 	if err != nil {
 		return NonMemModel{}, err
@@ -934,16 +1093,27 @@ func createChildDirectories(l *NonMemModel, cancel chan bool, channels *turnstil
 	log.Debugf("%s Overwrite is currently set to %t", l.LogIdentifier(), viper.GetBool("debug"))
 	//Does output directory exist?
 	if ok, _ := afero.DirExists(fs, l.OutputDir); ok {
-		//If so are we configured to overwrite?
-		if l.Configuration.Overwrite {
+		//Archiving keeps the previous results in the history of the model rather than removing them
+		if l.Configuration.Archive && doesDirectoryContainOutputFiles(l.OutputDir, l.Model) {
+			historyDir, err := modelHistoryDir(l.Path)
+			if err != nil {
+				return err
+			}
+
+			entry, err := archiveOutputDir(historyDir, l.OutputDir, l.FileName, l.Configuration.ArchiveFormat)
+			if err != nil {
+				return fmt.Errorf("unable to archive the previous results in %s: %w", l.OutputDir, err)
+			}
+
+			log.Infof("%s Archived the previous results in %s as entry %d of its history", l.LogIdentifier(), l.OutputDir, entry.Number)
+		} else if l.Configuration.Overwrite {
+			//If so are we configured to overwrite?
 			log.Debugf("%s Removing directory %s", l.LogIdentifier(), l.OutputDir)
 			err := fs.RemoveAll(l.OutputDir)
 			if err != nil {
 				return err
 			}
-		}
-
-		if !l.Configuration.Overwrite {
+		} else {
 			//If not, we only want to panic if there are nonmem output files in the directory
 			if !doesDirectoryContainOutputFiles(l.OutputDir, l.Model) {
 				//Continue along if we find no relevant content
@@ -951,7 +1121,7 @@ func createChildDirectories(l *NonMemModel, cancel chan bool, channels *turnstil
 			} else {
 				//Or panic because we're in a scenario where we shouldn't purge, but there's content in the directory from previous runs
 				log.Debugf("%s Configuration for overwrite was %t, but %s had Nonmem outputs. As such, we will hault operations", l.LogIdentifier(), viper.GetBool("debug"), l.OutputDir)
-				return fmt.Errorf("The target directory, %s already exist, but we are configured not to overwrite. Invalid configuration / run state", l.OutputDir)
+				return outputDirectoryConflict(l.OutputDir)
 			}
 		}
 	}
@@ -977,9 +1147,19 @@ func createChildDirectories(l *NonMemModel, cancel chan bool, channels *turnstil
 		return err
 	}
 
+	//Record where this run lives so stop, watch and friends don't need to render output_dir again
+	if err = writeOutputDirRecord(l); err != nil {
+		log.Warnf("%s Unable to record the output directory beside the model: %s", l.LogIdentifier(), err)
+	}
+
 	return nil
 }
 
+//outputDirectoryConflict is the error raised when the output directory holds nonmem outputs and overwrite is disabled
+func outputDirectoryConflict(outputDir string) error {
+	return fmt.Errorf("The target directory, %s already exist, but we are configured not to overwrite. Invalid configuration / run state", outputDir)
+}
+
 func processNMFEOptions(config configlib.Config) []string {
 	var output []string
 
@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"errors"
 	"os"
 	"path"
 	"path/filepath"
@@ -9,6 +10,7 @@ import (
 
 	"bbi/configlib"
 	"github.com/google/uuid"
+	"github.com/metrumresearchgroup/turnstile"
 	"github.com/spf13/afero"
 )
 
@@ -251,3 +253,27 @@ func Test_dataFileIsPresent(t *testing.T) {
 		})
 	}
 }
+
+func Test_batchExitCode(t *testing.T) {
+	failed := newConcurrentError("run001.mod", "nmtran failed", errors.New("exit status 1"))
+	cancelled := newConcurrentError("run002.mod", "Execution was cancelled", errExecutionCancelled)
+
+	tests := []struct {
+		name   string
+		errors []turnstile.ConcurrentError
+		want   int
+	}{
+		{name: "successful", want: 0},
+		{name: "cancelled", errors: []turnstile.ConcurrentError{cancelled}, want: cancelledExitCode},
+		{name: "failed", errors: []turnstile.ConcurrentError{failed}, want: 1},
+		{name: "failed and cancelled", errors: []turnstile.ConcurrentError{cancelled, failed}, want: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := batchExitCode(&turnstile.Manager{ErrorList: tt.errors}); got != tt.want {
+				t.Errorf("batchExitCode() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
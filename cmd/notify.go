@@ -0,0 +1,315 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"bbi/configlib"
+	parser "bbi/parsers/nmparser"
+	"github.com/metrumresearchgroup/turnstile"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	notifyBatchFinished string = "batch_finished"
+	notifyModelFailed   string = "model_failed"
+)
+
+// notificationEventVariable tells notification commands which event they are receiving
+const notificationEventVariable string = "BBI_NOTIFICATION_EVENT"
+
+var defaultNotificationTimeout time.Duration = 30 * time.Second
+
+// gridJob is set on the grid side of sge execution. The batch was submitted, and is notified, by run sge, so each job
+// only notifies of its own failure and keeps no journal of its own
+var gridJob bool
+
+// notificationWaitGroup tracks model failure notifications still being delivered when the batch finishes
+var notificationWaitGroup sync.WaitGroup
+
+// batchNotification is the payload delivered to each notification sink
+type batchNotification struct {
+	Event   string               `json:"event"`
+	Time    time.Time            `json:"time"`
+	Host    string               `json:"host,omitempty"`
+	Summary *notificationSummary `json:"summary,omitempty"`
+	Models  []notificationModel  `json:"models,omitempty"`
+	//Model is only present on model_failed notifications
+	Model *notificationModel `json:"model,omitempty"`
+}
+
+// notificationSummary is the summary logged by postWorkNotice at the end of the batch
+type notificationSummary struct {
+	Mode            string              `json:"mode"`
+	Models          int                 `json:"models"`
+	Completed       int                 `json:"completed"`
+	Errors          int                 `json:"errors"`
+	Cancelled       int                 `json:"cancelled"`
+	Started         time.Time           `json:"started"`
+	Duration        string              `json:"duration"`
+	DurationSeconds float64             `json:"duration_seconds"`
+	ErrorDetails    []notificationError `json:"error_details,omitempty"`
+}
+
+type notificationError struct {
+	Model string `json:"model"`
+	Notes string `json:"notes,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+type notificationModel struct {
+	Model     string `json:"model"`
+	Name      string `json:"name,omitempty"`
+	OutputDir string `json:"output_dir,omitempty"`
+	Status    string `json:"status"`
+	Notes     string `json:"notes,omitempty"`
+	Error     string `json:"error,omitempty"`
+	//Heuristics are read from the lst file of models which completed locally
+	Heuristics        *parser.RunHeuristics `json:"heuristics,omitempty"`
+	HeuristicsFlagged bool                  `json:"heuristics_flagged,omitempty"`
+}
+
+// notifiesOf reports whether the sink is subscribed to the event. Sinks without any events listed are only notified of
+// finished batches
+func notifiesOf(n configlib.Notification, event string) bool {
+	if len(n.On) == 0 {
+		return event == notifyBatchFinished
+	}
+
+	for _, e := range n.On {
+		if e == event {
+			return true
+		}
+	}
+
+	return false
+}
+
+// notify delivers the payload to every sink subscribed to its event. Failures are logged rather than failing the batch
+func notify(notifications []configlib.Notification, payload batchNotification) {
+	payload.Time = time.Now()
+	payload.Host, _ = os.Hostname()
+
+	var body []byte
+
+	for _, n := range notifications {
+		if !notifiesOf(n, payload.Event) {
+			continue
+		}
+
+		if body == nil {
+			var err error
+			body, err = json.Marshal(payload)
+			if err != nil {
+				log.Errorf("Unable to serialize the %s notification: %s", payload.Event, err)
+				return
+			}
+		}
+
+		//Commands notified of a failed model run from its output directory, if it was created
+		dir := ""
+		if payload.Model != nil && payload.Model.OutputDir != "" {
+			if info, err := os.Stat(payload.Model.OutputDir); err == nil && info.IsDir() {
+				dir = payload.Model.OutputDir
+			}
+		}
+
+		if err := sendNotification(n, payload.Event, dir, body); err != nil {
+			log.Errorf("Unable to deliver the %s notification: %s", payload.Event, err)
+		}
+	}
+}
+
+// sendNotification posts the body to the URL of the sink, or runs its command with the body on stdin. Commands run
+// through the shell, as the hooks do, so they may include arguments. An empty dir runs them in the current directory
+func sendNotification(n configlib.Notification, event string, dir string, body []byte) error {
+	timeout := n.Timeout
+	if timeout <= 0 {
+		timeout = defaultNotificationTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if n.URL != "" {
+		request, err := http.NewRequestWithContext(ctx, http.MethodPost, n.URL, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+
+		request.Header.Set("Content-Type", "application/json")
+		for k, v := range n.Headers {
+			//Tokens are usually kept out of bbi.yaml
+			request.Header.Set(k, os.ExpandEnv(v))
+		}
+
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			return err
+		}
+		defer response.Body.Close()
+
+		if response.StatusCode < 200 || response.StatusCode > 299 {
+			details, _ := ioutil.ReadAll(response.Body)
+			return fmt.Errorf("%s responded with %s: %s", n.URL, response.Status, bytes.TrimSpace(details))
+		}
+
+		return nil
+	}
+
+	if n.Command != "" {
+		command := exec.CommandContext(ctx, "/bin/sh", "-c", n.Command)
+		command.Dir = dir
+		command.Env = append(os.Environ(), notificationEventVariable+"="+event)
+		command.Stdin = bytes.NewReader(body)
+
+		output, err := command.CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("%s failed: %s. Output was %s", n.Command, err, bytes.TrimSpace(output))
+		}
+
+		log.Debugf("Notification command %s output was %s", n.Command, output)
+
+		return nil
+	}
+
+	return errors.New("a notification requires either a url or a command")
+}
+
+// notifyFailure notifies sinks subscribed to model_failed in the background. notifyBatch waits for them to be delivered
+func notifyFailure(config configlib.Config, hook *PostExecutionHookEnvironment, identifier string, notes string, err error) {
+	if len(config.Notifications) == 0 {
+		return
+	}
+
+	model := notificationModel{
+		Model:  identifier,
+		Status: phaseFailed,
+		Notes:  notes,
+	}
+
+	if hook != nil {
+		model.Model = hook.ModelPath
+		model.Name = hook.Filename
+		model.OutputDir = hook.OutputDirectory
+	}
+
+	if errors.Is(err, errExecutionCancelled) {
+		model.Status = phaseCancelled
+	}
+
+	if err != nil {
+		model.Error = err.Error()
+	}
+
+	notificationWaitGroup.Add(1)
+
+	go func() {
+		defer notificationWaitGroup.Done()
+		notify(config.Notifications, batchNotification{Event: notifyModelFailed, Model: &model})
+	}()
+}
+
+// notifyBatch notifies sinks once the batch has finished with the summary of the batch and the outcome of each model.
+// success is the status of models which did not fail, completed for local execution or submitted for the grid
+func notifyBatch(config configlib.Config, mode string, success string, models []*NonMemModel, m *turnstile.Manager, started time.Time) {
+	notificationWaitGroup.Wait()
+
+	if len(config.Notifications) == 0 || gridJob {
+		return
+	}
+
+	notify(config.Notifications, batchNotification{
+		Event:   notifyBatchFinished,
+		Summary: batchSummary(mode, len(models), m, started),
+		Models:  notificationModels(models, m.ErrorList, success),
+	})
+}
+
+func batchSummary(mode string, models int, m *turnstile.Manager, started time.Time) *notificationSummary {
+	elapsed := time.Since(started)
+
+	summary := &notificationSummary{
+		Mode:            mode,
+		Models:          models,
+		Completed:       int(m.Completed),
+		Started:         started,
+		Duration:        elapsed.Round(time.Second).String(),
+		DurationSeconds: elapsed.Seconds(),
+	}
+
+	failed, cancelled := partitionCancellations(m.ErrorList)
+	summary.Errors = len(failed)
+	summary.Cancelled = len(cancelled)
+
+	for _, e := range failed {
+		detail := notificationError{
+			Model: e.RunIdentifier,
+			Notes: e.Notes,
+		}
+
+		if e.Error != nil {
+			detail.Error = e.Error.Error()
+		}
+
+		summary.ErrorDetails = append(summary.ErrorDetails, detail)
+	}
+
+	return summary
+}
+
+// notificationModels matches the models of the batch against the errors recorded for them, which identify them by
+// model or file name. The heuristics of completed models are read from their lst files
+func notificationModels(models []*NonMemModel, failures []turnstile.ConcurrentError, success string) []notificationModel {
+	var output []notificationModel
+
+	for _, m := range models {
+		model := notificationModel{
+			Model:     m.Path,
+			Name:      m.FileName,
+			OutputDir: m.OutputDir,
+			Status:    success,
+		}
+
+		for _, f := range failures {
+			if f.RunIdentifier != m.Model && f.RunIdentifier != m.FileName {
+				continue
+			}
+
+			model.Status = phaseFailed
+			if errors.Is(f.Error, errExecutionCancelled) {
+				model.Status = phaseCancelled
+			}
+
+			model.Notes = f.Notes
+			if f.Error != nil {
+				model.Error = f.Error.Error()
+			}
+		}
+
+		if model.Status == phaseCompleted {
+			lst := filepath.Join(m.OutputDir, m.FileName+".lst")
+
+			if results, err := parser.GetModelOutput(lst, parser.NewModelOutputFile("", false), true, true); err == nil {
+				model.Heuristics = &results.RunHeuristics
+				model.HeuristicsFlagged = results.RunHeuristics.AnyTrue()
+			} else {
+				log.Debugf("Unable to read the heuristics of %s for notification: %s", m.Model, err)
+			}
+		}
+
+		output = append(output, model)
+	}
+
+	return output
+}
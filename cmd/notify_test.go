@@ -0,0 +1,158 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"bbi/configlib"
+	"github.com/metrumresearchgroup/turnstile"
+)
+
+func Test_notify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bbi_notify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dir, _ = filepath.EvalSymlinks(dir)
+
+	outputDir := filepath.Join(dir, "run002")
+	os.Mkdir(outputDir, 0750)
+
+	os.Setenv("BBI_TEST_TOKEN", "secret")
+	defer os.Unsetenv("BBI_TEST_TOKEN")
+
+	received := make(chan batchNotification, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		var payload batchNotification
+		json.NewDecoder(r.Body).Decode(&payload)
+		received <- payload
+	}))
+	defer server.Close()
+
+	script := filepath.Join(dir, "notify.sh")
+	event := filepath.Join(dir, "$"+notificationEventVariable)
+	ioutil.WriteFile(script, []byte("#!/bin/sh\ncat > "+event+".json\npwd > "+event+".pwd\necho \"$1\" > "+event+".args\n"), 0750)
+
+	config := configlib.Config{
+		Notifications: []configlib.Notification{
+			{URL: server.URL, Headers: map[string]string{"Authorization": "Bearer ${BBI_TEST_TOKEN}"}},
+			{Command: script + " --quiet", On: []string{notifyBatchFinished, notifyModelFailed}},
+		},
+	}
+
+	models := []*NonMemModel{
+		{Path: "/data/run001.mod", Model: "run001.mod", FileName: "run001", OutputDir: "/data/run001"},
+		{Path: "/data/run002.mod", Model: "run002.mod", FileName: "run002", OutputDir: "/data/run002"},
+	}
+
+	failure := errors.New("exit status 1")
+	notifyFailure(config, &PostExecutionHookEnvironment{ModelPath: "/data/run002.mod", Filename: "run002", OutputDirectory: outputDir}, "run002.mod", "nmtran failed", failure)
+
+	m := &turnstile.Manager{
+		Completed: 1,
+		Errors:    1,
+		ErrorList: []turnstile.ConcurrentError{{RunIdentifier: "run002.mod", Notes: "nmtran failed", Error: failure}},
+	}
+
+	//Cancelled models are summarised apart from the failures
+	summary := batchSummary("local", 3, &turnstile.Manager{ErrorList: append(m.ErrorList, newConcurrentError("run003.mod", "Execution was cancelled", errExecutionCancelled))}, time.Now())
+	if summary.Errors != 1 || summary.Cancelled != 1 || len(summary.ErrorDetails) != 1 {
+		t.Errorf("batchSummary() = %+v, want 1 error and 1 cancellation", summary)
+	}
+
+	notifyBatch(config, "sge", phaseSubmitted, models, m, time.Now().Add(-time.Minute))
+
+	//The webhook is only subscribed to the finished batch
+	select {
+	case payload := <-received:
+		if payload.Event != notifyBatchFinished || payload.Summary == nil || payload.Summary.Errors != 1 || payload.Summary.Mode != "sge" {
+			t.Errorf("webhook received %+v, want the summary of the sge batch", payload)
+		}
+
+		if len(payload.Models) != 2 || payload.Models[0].Status != phaseSubmitted || payload.Models[1].Status != phaseFailed || payload.Models[1].Error != "exit status 1" {
+			t.Errorf("webhook received models %+v, want run001 submitted and run002 failed", payload.Models)
+		}
+	default:
+		t.Fatal("webhook did not receive the batch notification")
+	}
+
+	if len(received) > 0 {
+		t.Errorf("webhook received a model_failed notification it was not subscribed to")
+	}
+
+	var failed batchNotification
+	contents, err := ioutil.ReadFile(filepath.Join(dir, notifyModelFailed+".json"))
+	if err != nil {
+		t.Fatalf("command did not receive the model_failed notification: %s", err)
+	}
+	json.Unmarshal(contents, &failed)
+
+	if failed.Model == nil || failed.Model.Model != "/data/run002.mod" || failed.Model.Notes != "nmtran failed" {
+		t.Errorf("command received %+v, want the failure of /data/run002.mod", failed.Model)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, notifyBatchFinished+".json")); err != nil {
+		t.Errorf("command did not receive the batch_finished notification")
+	}
+
+	//Commands run through the shell, from the output directory of the failed model
+	if wd, _ := ioutil.ReadFile(filepath.Join(dir, notifyModelFailed+".pwd")); strings.TrimSpace(string(wd)) != outputDir {
+		t.Errorf("command notified of the failure ran in %s, want %s", wd, outputDir)
+	}
+
+	if arguments, _ := ioutil.ReadFile(filepath.Join(dir, notifyModelFailed+".args")); strings.TrimSpace(string(arguments)) != "--quiet" {
+		t.Errorf("command received arguments %s, want --quiet", arguments)
+	}
+
+	//Grid jobs leave the batch notification to run sge
+	defer func(grid bool) { gridJob = grid }(gridJob)
+	gridJob = true
+	notifyBatch(config, "local", phaseCompleted, models, m, time.Now())
+
+	if len(received) > 0 {
+		t.Errorf("a grid job notified of the batch")
+	}
+}
+
+func Test_sendNotification(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name         string
+		notification configlib.Notification
+	}{
+		{name: "error status", notification: configlib.Notification{URL: server.URL}},
+		{name: "timeout", notification: configlib.Notification{URL: server.URL + "/slow", Timeout: 50 * time.Millisecond}},
+		{name: "failed command", notification: configlib.Notification{Command: "false"}},
+		{name: "no sink", notification: configlib.Notification{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := sendNotification(tt.notification, notifyBatchFinished, "", []byte("{}")); err == nil {
+				t.Errorf("sendNotification() did not return an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,273 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"bbi/configlib"
+)
+
+// maxOutputSequence bounds the search for an unused sequence number in the output directory of a model
+const maxOutputSequence int = 9999
+
+// outputTemplateTime is the time rendered by the date and time fields of output_dir, shared by every model of the batch
+var outputTemplateTime = time.Now()
+
+// reservedOutputDirs are the sequenced output directories already handed to models of the batch, which won't exist
+// until the models are prepared
+var reservedOutputDirs = struct {
+	sync.Mutex
+	dirs map[string]bool
+}{dirs: make(map[string]bool)}
+
+// outputDirFuncs are the functions available to the output_dir template
+var outputDirFuncs = template.FuncMap{
+	"date": func(layout string) string {
+		return outputTemplateTime.Format(layout)
+	},
+	"lower":      strings.ToLower,
+	"upper":      strings.ToUpper,
+	"replace":    strings.ReplaceAll,
+	"trimPrefix": strings.TrimPrefix,
+	"trimSuffix": strings.TrimSuffix,
+}
+
+// outputDirFields are the values available to the output_dir template
+type outputDirFields struct {
+	//Name is the file name of the model without its extension
+	Name string
+	//Extension is the extension of the model without the leading period
+	Extension string
+	//Parent is the name of the directory holding the model
+	Parent string
+	//Date is the date the batch started, such as 2021-03-04
+	Date string
+	//Time is the time the batch started, such as 101502
+	Time string
+	//NMVersion is the name of the nonmem installation the model runs with
+	NMVersion string
+	//Profile is the configuration profile selected for the batch
+	Profile string
+
+	modelPath string
+	seq       int
+	sequenced bool
+	//git and hash hold the commit and digest once computed, as the template is rendered for each sequence number tried
+	git  memoizedField
+	hash memoizedField
+}
+
+// memoizedField is a template field computed on its first use
+type memoizedField struct {
+	done  bool
+	value string
+	err   error
+}
+
+// get computes the field the first time it is used, returning the same value and error afterwards
+func (m *memoizedField) get(compute func() (string, error)) (string, error) {
+	if !m.done {
+		m.value, m.err = compute()
+		m.done = true
+	}
+
+	return m.value, m.err
+}
+
+// Seq is the lowest sequence number, starting at 1, for which the output directory doesn't exist yet
+func (o *outputDirFields) Seq() int {
+	o.sequenced = true
+	return o.seq
+}
+
+// Next is the same as Seq
+func (o *outputDirFields) Next() int {
+	return o.Seq()
+}
+
+// Git is the short SHA of the commit checked out in the repository holding the model
+func (o *outputDirFields) Git() (string, error) {
+	return o.git.get(func() (string, error) {
+		output, err := exec.Command("git", "-C", filepath.Dir(o.modelPath), "rev-parse", "--short", "HEAD").Output()
+		if err != nil {
+			return "", fmt.Errorf("unable to determine the git commit of %s: %s", filepath.Dir(o.modelPath), err)
+		}
+
+		return strings.TrimSpace(string(output)), nil
+	})
+}
+
+// Hash is the first eight characters of the md5 digest of the model, as recorded in model_md5
+func (o *outputDirFields) Hash() (string, error) {
+	return o.hash.get(func() (string, error) {
+		contents, err := ioutil.ReadFile(o.modelPath)
+		if err != nil {
+			return "", err
+		}
+
+		return fmt.Sprintf("%x", md5.Sum(contents))[:8], nil
+	})
+}
+
+// render executes the template with the current sequence number
+func (o *outputDirFields) render(t *template.Template) (string, error) {
+	buf := new(bytes.Buffer)
+
+	if err := t.Execute(buf, o); err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
+
+// renderOutputDir executes the output_dir template for a model, returning the output directory relative to the
+// directory of the model. Templates using Seq or Next are given the first sequence number whose directory is unused
+func renderOutputDir(model NonMemModel, config configlib.Config) (string, error) {
+	t, fields, err := outputDirTemplate(model, config)
+	if err != nil {
+		return "", err
+	}
+
+	//The first rendering computes the git commit and hash outside the lock, and is all templates without Seq need
+	fields.seq = 1
+	rendered, err := fields.render(t)
+	if err != nil || !fields.sequenced {
+		return rendered, err
+	}
+
+	reservedOutputDirs.Lock()
+	defer reservedOutputDirs.Unlock()
+
+	for ; fields.seq <= maxOutputSequence; fields.seq++ {
+		if rendered, err = fields.render(t); err != nil {
+			return "", err
+		}
+
+		candidate := path.Join(model.OriginalPath, rendered)
+
+		if _, err := os.Stat(candidate); os.IsNotExist(err) && !reservedOutputDirs.dirs[candidate] {
+			reservedOutputDirs.dirs[candidate] = true
+			return rendered, nil
+		}
+	}
+
+	return "", fmt.Errorf("no unused output directory was found for sequence numbers up to %d", maxOutputSequence)
+}
+
+// existingOutputDir executes the output_dir template for a model without allocating a sequence number. Templates
+// using Seq or Next resolve to the directory with the highest sequence number which exists
+func existingOutputDir(model NonMemModel, config configlib.Config) (string, error) {
+	t, fields, err := outputDirTemplate(model, config)
+	if err != nil {
+		return "", err
+	}
+
+	latest := ""
+
+	for fields.seq = 1; fields.seq <= maxOutputSequence; fields.seq++ {
+		rendered, err := fields.render(t)
+		if err != nil {
+			return "", err
+		}
+
+		if !fields.sequenced {
+			return rendered, nil
+		}
+
+		if _, err := os.Stat(path.Join(model.OriginalPath, rendered)); err != nil {
+			break
+		}
+
+		latest = rendered
+	}
+
+	if latest == "" {
+		return "", fmt.Errorf("no output directory of %s exists yet", model.OriginalModel)
+	}
+
+	return latest, nil
+}
+
+func outputDirTemplate(model NonMemModel, config configlib.Config) (*template.Template, *outputDirFields, error) {
+	t, err := template.New("output").Funcs(outputDirFuncs).Parse(config.OutputDir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	nmVersion, _ := effectiveNonMemVersion(config)
+
+	return t, &outputDirFields{
+		Name:      model.FileName,
+		Extension: model.Extension,
+		Parent:    filepath.Base(model.OriginalPath),
+		Date:      outputTemplateTime.Format("2006-01-02"),
+		Time:      outputTemplateTime.Format("150405"),
+		NMVersion: nmVersion,
+		Profile:   config.Profile,
+		modelPath: model.Path,
+	}, nil
+}
+
+// outputDirRecordPath is the file within the history of the model recording the output directory of its latest run
+func outputDirRecordPath(modelPath string) (string, error) {
+	historyDir, err := modelHistoryDir(modelPath)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(historyDir, historyLatestName), nil
+}
+
+// writeOutputDirRecord records the output directory the model is executing in, relative to the directory of the model
+func writeOutputDirRecord(model *NonMemModel) error {
+	return recordOutputDir(filepath.Join(model.OriginalPath, model.OriginalModel), model.OutputDir)
+}
+
+// recordOutputDir records the output directory holding the latest results of the model at modelPath
+func recordOutputDir(modelPath string, outputDir string) error {
+	relative, err := filepath.Rel(filepath.Dir(modelPath), outputDir)
+	if err != nil {
+		relative = outputDir
+	}
+
+	record, err := outputDirRecordPath(modelPath)
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(record), 0750); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(record, []byte(filepath.ToSlash(relative)+"\n"), 0640)
+}
+
+// readOutputDirRecord returns the output directory of the latest run of the model, if one was recorded
+func readOutputDirRecord(modelPath string) (string, error) {
+	record, err := outputDirRecordPath(modelPath)
+	if err != nil {
+		return "", err
+	}
+
+	contents, err := ioutil.ReadFile(record)
+	if err != nil {
+		return "", err
+	}
+
+	dir := filepath.FromSlash(strings.TrimSpace(string(contents)))
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(filepath.Dir(modelPath), dir)
+	}
+
+	return filepath.Abs(dir)
+}
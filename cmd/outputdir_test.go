@@ -0,0 +1,174 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"bbi/configlib"
+)
+
+func Test_renderOutputDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bbi_output_dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	modelPath := filepath.Join(dir, "run001.mod")
+	ioutil.WriteFile(modelPath, []byte("$PROBLEM run001\n"), 0640)
+
+	model := NonMemModel{
+		Path:         modelPath,
+		OriginalPath: dir,
+		FileName:     "run001",
+		Extension:    "mod",
+	}
+
+	config := configlib.Config{
+		NMVersion: "nm75",
+		Profile:   "cluster",
+	}
+
+	date := outputTemplateTime.Format("2006-01-02")
+
+	tests := []struct {
+		name     string
+		template string
+		want     string
+	}{
+		{
+			name:     "name",
+			template: "{{ .Name }}",
+			want:     "run001",
+		},
+		{
+			name:     "model fields",
+			template: "{{ .Parent }}-{{ .Name }}.{{ .Extension }}",
+			want:     filepath.Base(dir) + "-run001.mod",
+		},
+		{
+			name:     "configuration fields",
+			template: "{{ .NMVersion }}/{{ .Profile | upper }}",
+			want:     "nm75/CLUSTER",
+		},
+		{
+			name:     "dates",
+			template: "{{ .Date }}_{{ date \"20060102\" }}",
+			want:     date + "_" + outputTemplateTime.Format("20060102"),
+		},
+		{
+			name:     "hash",
+			template: "{{ .Name }}-{{ .Hash }}",
+			want:     "run001-be4ecdda",
+		},
+		{
+			name:     "first sequence",
+			template: "runs/{{ .Name }}/{{ printf \"%03d\" .Seq }}",
+			want:     "runs/run001/001",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.OutputDir = tt.template
+
+			got, err := renderOutputDir(model, config)
+			if err != nil {
+				t.Fatalf("renderOutputDir() error = %s", err)
+			}
+
+			if got != tt.want {
+				t.Errorf("renderOutputDir() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	//Sequence numbers skip existing directories and those already given to other models
+	os.MkdirAll(filepath.Join(dir, "again", "run001-1"), 0750)
+	config.OutputDir = "again/{{ .Name }}-{{ .Next }}"
+
+	for _, want := range []string{"again/run001-2", "again/run001-3"} {
+		got, err := renderOutputDir(model, config)
+		if err != nil {
+			t.Fatalf("renderOutputDir() error = %s", err)
+		}
+
+		if got != want {
+			t.Errorf("renderOutputDir() = %s, want %s", got, want)
+		}
+	}
+
+	//The hash is computed once per model rather than for each sequence number tried
+	fields := &outputDirFields{modelPath: modelPath}
+	first, _ := fields.Hash()
+	ioutil.WriteFile(modelPath, []byte("$PROBLEM changed\n"), 0640)
+
+	if second, _ := fields.Hash(); second != first {
+		t.Errorf("Hash() = %s after the model changed, want the %s computed first", second, first)
+	}
+
+	config.OutputDir = "{{ .Name }}-{{ .Missing }}"
+	if _, err := renderOutputDir(model, config); err == nil {
+		t.Errorf("renderOutputDir() of an unknown field did not fail")
+	}
+}
+
+func Test_existingOutputDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bbi_output_dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	model := NonMemModel{
+		Path:          filepath.Join(dir, "run001.mod"),
+		OriginalPath:  dir,
+		OriginalModel: "run001.mod",
+		FileName:      "run001",
+		Extension:     "mod",
+	}
+
+	config := configlib.Config{OutputDir: "{{ .Name }}-{{ .Seq }}"}
+
+	if _, err := existingOutputDir(model, config); err == nil {
+		t.Errorf("existingOutputDir() without any runs did not fail")
+	}
+
+	os.MkdirAll(filepath.Join(dir, "run001-1"), 0750)
+	os.MkdirAll(filepath.Join(dir, "run001-2"), 0750)
+
+	got, err := existingOutputDir(model, config)
+	if err != nil {
+		t.Fatalf("existingOutputDir() error = %s", err)
+	}
+
+	if got != "run001-2" {
+		t.Errorf("existingOutputDir() = %s, want run001-2", got)
+	}
+
+	//Looking up the run must not use up a sequence number
+	if got, _ := renderOutputDir(model, config); got != "run001-3" {
+		t.Errorf("renderOutputDir() after existingOutputDir() = %s, want run001-3", got)
+	}
+
+	model.OutputDir = filepath.Join(dir, "run001-2")
+	if err := writeOutputDirRecord(&model); err != nil {
+		t.Fatalf("writeOutputDirRecord() error = %s", err)
+	}
+
+	recorded, err := readOutputDirRecord(model.Path)
+	if err != nil {
+		t.Fatalf("readOutputDirRecord() error = %s", err)
+	}
+
+	if recorded != model.OutputDir {
+		t.Errorf("readOutputDirRecord() = %s, want %s", recorded, model.OutputDir)
+	}
+
+	//The record is kept in the history of the model rather than beside it
+	if _, err := os.Stat(filepath.Join(dir, historyDirName, "run001", historyLatestName)); err != nil {
+		t.Errorf("the output directory wasn't recorded in the history of the model: %s", err)
+	}
+}
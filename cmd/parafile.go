@@ -0,0 +1,303 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"bbi/configlib"
+	"bbi/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	parallelModeMPI string = "mpi"
+	parallelModeFPI string = "fpi"
+)
+
+// schedulerSlotVariables are populated by the grid engines with the number of slots allocated to the job
+var schedulerSlotVariables []string = []string{
+	"NSLOTS",       //SGE / UGE
+	"SLURM_NTASKS", //Slurm
+}
+
+// hostFileVariable is populated by SGE with the hosts and slots allocated to a parallel job
+const hostFileVariable string = "PE_HOSTFILE"
+
+// nodesPlaceholder stands for the number of nodes in a parafile, and is given its value on the nmfe command line
+const nodesPlaceholder string = "[nodes]"
+
+var paraFileCommandRegex = regexp.MustCompile(`^\d+(-(\d+|\[nodes\]))?:`)
+
+// parallelHost is a single host from a hostfile along with the number of slots allocated on it
+type parallelHost struct {
+	Name  string
+	Slots int
+}
+
+// parallelNodes determines the number of nodes for the parafile. Slots allocated by a scheduler to the running job take
+// precedence over the configured threads, so that the parafile matches what the job actually received
+func parallelNodes(config configlib.Config) int {
+	for _, v := range schedulerSlotVariables {
+		value := os.Getenv(v)
+		if value == "" {
+			continue
+		}
+
+		slots, err := strconv.Atoi(value)
+		if err != nil || slots < 1 {
+			log.Warnf("The value of %s (%s) is not a valid number of slots and will be ignored", v, value)
+			continue
+		}
+
+		log.Debugf("Sizing parafile from %s=%d", v, slots)
+		return slots
+	}
+
+	return config.Threads
+}
+
+// nodesArgument gives nmfe the value of [nodes] for a user supplied parafile, quoted so the shell doesn't expand it
+func nodesArgument(config configlib.Config) string {
+	return fmt.Sprintf(`"%s=%d"`, nodesPlaceholder, parallelNodes(config))
+}
+
+// locateMpiExec returns the configured mpiexec if it exists, or otherwise the mpiexec available on the path
+func locateMpiExec(configured string) (string, error) {
+	if configured != "" {
+		if _, err := os.Stat(configured); err == nil {
+			return configured, nil
+		}
+	}
+
+	located, err := exec.LookPath("mpiexec")
+	if err != nil {
+		return "", fmt.Errorf("mpiexec could not be located at %s or on the path. Please set mpi_exec_path, or use parallel_mode=%s on machines without MPI", configured, parallelModeFPI)
+	}
+
+	log.Debugf("mpiexec was not located at %s. Using %s instead", configured, located)
+
+	return located, nil
+}
+
+// validateConfiguredParaFile checks a user supplied parafile so problems are reported before any models are executed
+func validateConfiguredParaFile(config configlib.Config) error {
+	if !config.Parallel || config.Parafile == "" {
+		return nil
+	}
+
+	lines, err := utils.ReadLines(config.Parafile)
+	if err != nil {
+		return fmt.Errorf("unable to read the parafile at %s: %s", config.Parafile, err)
+	}
+
+	if err = validateParaFile(lines); err != nil {
+		return fmt.Errorf("the parafile provided at %s is invalid: %s", config.Parafile, err)
+	}
+
+	return nil
+}
+
+// validateParaFile verifies the structure of a parafile: the $GENERAL options nonmem requires and the node ranges of the $COMMANDS
+func validateParaFile(lines []string) error {
+	sections := make(map[string][]string)
+	current := ""
+
+	for i, line := range lines {
+		content := strings.TrimSpace(strings.SplitN(line, ";", 2)[0])
+		if content == "" {
+			continue
+		}
+
+		if strings.HasPrefix(content, "$") {
+			fields := strings.Fields(content)
+			current = strings.ToUpper(fields[0])
+
+			switch current {
+			case "$GENERAL", "$COMMANDS", "$DIRECTORIES":
+			default:
+				return fmt.Errorf("line %d: unknown section %s", i+1, fields[0])
+			}
+
+			sections[current] = append(sections[current], fields[1:]...)
+			continue
+		}
+
+		if current == "" {
+			return fmt.Errorf("line %d: content appears before any section", i+1)
+		}
+
+		if current == "$GENERAL" {
+			sections[current] = append(sections[current], strings.Fields(content)...)
+			continue
+		}
+
+		if !paraFileCommandRegex.MatchString(content) {
+			return fmt.Errorf("line %d: %s entries must start with a node or node range such as 1: or 2-[nodes]:", i+1, current)
+		}
+
+		sections[current] = append(sections[current], content)
+	}
+
+	if _, ok := sections["$GENERAL"]; !ok {
+		return errors.New("no $GENERAL section was found")
+	}
+
+	if len(sections["$COMMANDS"]) == 0 {
+		return errors.New("no $COMMANDS were found")
+	}
+
+	options := make(map[string]string)
+	for _, o := range sections["$GENERAL"] {
+		kv := strings.SplitN(o, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("$GENERAL option %s is not of the form KEY=VALUE", o)
+		}
+		options[strings.ToUpper(kv[0])] = kv[1]
+	}
+
+	nodes, ok := options["NODES"]
+	if !ok {
+		return errors.New("$GENERAL does not specify NODES")
+	}
+
+	//The parafiles distributed with nonmem leave the number of nodes to be given to nmfe as [nodes]=N
+	if n, err := strconv.Atoi(nodes); nodes != nodesPlaceholder && (err != nil || n < 1) {
+		return fmt.Errorf("NODES must be a positive integer or %s, not %s", nodesPlaceholder, nodes)
+	}
+
+	if transfer, ok := options["TRANSFER_TYPE"]; ok && transfer != "0" && transfer != "1" {
+		return fmt.Errorf("TRANSFER_TYPE must be 0 (FPI) or 1 (MPI), not %s", transfer)
+	}
+
+	for _, numeric := range []string{"PARSE_TYPE", "PARSE_NUM", "TIMEOUTI", "TIMEOUT", "PARAPRINT"} {
+		if value, ok := options[numeric]; ok {
+			if _, err := strconv.Atoi(value); err != nil {
+				return fmt.Errorf("%s must be an integer, not %s", numeric, value)
+			}
+		}
+	}
+
+	return nil
+}
+
+// parallelHostFile returns the configured hostfile or, when running in an SGE parallel environment, $PE_HOSTFILE
+func parallelHostFile(config configlib.Config) string {
+	if config.Hostfile != "" {
+		return config.Hostfile
+	}
+
+	return os.Getenv(hostFileVariable)
+}
+
+// readHostFile parses the hosts and slots from a hostfile. SGE (host slots queue processors), MPICH (host:slots) and
+// OpenMPI (host slots=N) formats are accepted. Hosts without a slot count are given a single slot
+func readHostFile(file string) ([]parallelHost, error) {
+	lines, err := utils.ReadLines(file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the hostfile at %s: %s", file, err)
+	}
+
+	var hosts []parallelHost
+
+	for i, line := range lines {
+		fields := strings.Fields(strings.SplitN(line, "#", 2)[0])
+		if len(fields) == 0 {
+			continue
+		}
+
+		host := parallelHost{
+			Name:  fields[0],
+			Slots: 1,
+		}
+
+		slots := ""
+
+		if components := strings.SplitN(fields[0], ":", 2); len(components) == 2 {
+			host.Name = components[0]
+			slots = components[1]
+		} else if len(fields) > 1 {
+			slots = strings.TrimPrefix(fields[1], "slots=")
+		}
+
+		if slots != "" {
+			host.Slots, err = strconv.Atoi(slots)
+			if err != nil || host.Slots < 1 {
+				return nil, fmt.Errorf("line %d of the hostfile at %s does not have a valid number of slots: %s", i+1, file, line)
+			}
+		}
+
+		hosts = append(hosts, host)
+	}
+
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("no hosts were found in the hostfile at %s", file)
+	}
+
+	return hosts, nil
+}
+
+// parallelHosts returns the hosts allocated for parallel execution, or nil when no hostfile is available
+func parallelHosts(config configlib.Config) ([]parallelHost, error) {
+	file := parallelHostFile(config)
+	if file == "" {
+		return nil, nil
+	}
+
+	return readHostFile(file)
+}
+
+// mpiHostFileContents renders the hosts in the MPICH hostfile format provided to mpiexec -f
+func mpiHostFileContents(hosts []parallelHost) []string {
+	var lines []string
+
+	for _, h := range hosts {
+		lines = append(lines, fmt.Sprintf("%s:%d", h.Name, h.Slots))
+	}
+
+	return lines
+}
+
+// workerDirectories assigns the parafile nodes to the hosts in order, as mpiexec fills the slots of each host before
+// moving on to the next, and names the worker directories after the host they run on. The first node is the manager
+func workerDirectories(hosts []parallelHost) string {
+	if len(hosts) < 2 {
+		return "2-[nodes]:worker{#-1}"
+	}
+
+	var lines []string
+	start := 1
+
+	for _, h := range hosts {
+		end := start + h.Slots - 1
+		first := start
+
+		if first == 1 {
+			first = 2
+		}
+
+		if first <= end {
+			name := strings.SplitN(h.Name, ".", 2)[0]
+			lines = append(lines, fmt.Sprintf("%d-%d:worker_%s_{#-1}", first, end, name))
+		}
+
+		start = end + 1
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// totalSlots is the number of nodes available across all hosts
+func totalSlots(hosts []parallelHost) int {
+	total := 0
+
+	for _, h := range hosts {
+		total += h.Slots
+	}
+
+	return total
+}
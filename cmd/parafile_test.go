@@ -0,0 +1,238 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"bbi/configlib"
+)
+
+func Test_validateParaFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr bool
+	}{
+		{
+			name:    "Generated MPI parafile",
+			content: strings.NewReplacer("{{ .TotalNodes }}", "4", "{{ .WorkerDirectories }}", workerDirectories(nil)).Replace(nonmemParaFiletemplate),
+			wantErr: false,
+		},
+		{
+			name:    "FPI parafile with comments",
+			content: "$GENERAL\nNODES=4 PARSE_TYPE=2 TRANSFER_TYPE=0 ; file based\n$COMMANDS\n1:NONE\n2-[nodes]:./nonmem -wnf &\n$DIRECTORIES\n1:NONE\n2-[nodes]:worker{#-1}",
+			wantErr: false,
+		},
+		{
+			name:    "Generated multiple host MPI parafile",
+			content: strings.NewReplacer("{{ .TotalNodes }}", "12", "{{ .WorkerDirectories }}", workerDirectories([]parallelHost{{"a", 4}, {"b", 8}})).Replace(nonmemParaFiletemplate),
+			wantErr: false,
+		},
+		{
+			name:    "Parafile distributed with nonmem",
+			content: "$GENERAL\nNODES=[nodes] PARSE_TYPE=2 TIMEOUTI=600 TIMEOUT=10000 PARAPRINT=0 TRANSFER_TYPE=1\n$COMMANDS\n1:mpiexec -wdir \"$PWD\" -n 1 ./nonmem  $*\n2-[nodes]:-wdir \"$PWD/worker{#-1}\" -n 1 ./nonmem -wnf\n$DIRECTORIES\n1:NONE\n2-[nodes]:worker{#-1}",
+			wantErr: false,
+		},
+		{
+			name:    "Invalid NODES",
+			content: "$GENERAL\nNODES=many\n$COMMANDS\n1:mpiexec ./nonmem",
+			wantErr: true,
+		},
+		{
+			name:    "Missing NODES",
+			content: "$GENERAL\nPARSE_TYPE=2 TRANSFER_TYPE=1\n$COMMANDS\n1:mpiexec ./nonmem",
+			wantErr: true,
+		},
+		{
+			name:    "Unknown transfer type",
+			content: "$GENERAL\nNODES=4 TRANSFER_TYPE=3\n$COMMANDS\n1:mpiexec ./nonmem",
+			wantErr: true,
+		},
+		{
+			name:    "Command without node range",
+			content: "$GENERAL\nNODES=4\n$COMMANDS\nmpiexec ./nonmem",
+			wantErr: true,
+		},
+		{
+			name:    "Unknown section",
+			content: "$GENERAL\nNODES=4\n$COMMAND\n1:mpiexec ./nonmem",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content := strings.Replace(tt.content, "{{ .CompletionTimeout }}", "10", 1)
+			if err := validateParaFile(strings.Split(content, "\n")); (err != nil) != tt.wantErr {
+				t.Errorf("validateParaFile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_generateParaFile(t *testing.T) {
+	for _, v := range append(schedulerSlotVariables, hostFileVariable) {
+		defer os.Setenv(v, os.Getenv(v))
+		os.Unsetenv(v)
+	}
+
+	model := &NonMemModel{
+		Configuration: configlib.Config{
+			Threads:         4,
+			ParallelTimeout: 10,
+			ParallelMode:    parallelModeFPI,
+		},
+	}
+
+	contents, err := generateParaFile(model)
+	if err != nil {
+		t.Fatalf("generateParaFile() error = %v", err)
+	}
+
+	if !strings.Contains(string(contents), "NODES=4 ") || !strings.Contains(string(contents), "TRANSFER_TYPE=0") {
+		t.Errorf("generateParaFile() did not produce a 4 node FPI parafile: %s", contents)
+	}
+
+	if err = validateParaFile(strings.Split(string(contents), "\n")); err != nil {
+		t.Errorf("generateParaFile() produced an invalid parafile: %s", err)
+	}
+
+	//Allocated slots take precedence over the configured threads
+	os.Setenv("SLURM_NTASKS", "16")
+
+	contents, _ = generateParaFile(model)
+	if !strings.Contains(string(contents), "NODES=16 ") {
+		t.Errorf("generateParaFile() did not size NODES from SLURM_NTASKS: %s", contents)
+	}
+
+	//File based parallelization cannot reach workers on other hosts
+	hostfile := filepath.Join(os.TempDir(), "bbi_fpi_hosts")
+	ioutil.WriteFile(hostfile, []byte("node1 4\nnode2 4\n"), 0644)
+	defer os.Remove(hostfile)
+
+	model.Configuration.Hostfile = hostfile
+	if _, err = generateParaFile(model); err == nil {
+		t.Errorf("generateParaFile() accepted several hosts for %s", parallelModeFPI)
+	}
+	model.Configuration.Hostfile = ""
+
+	model.Configuration.ParallelMode = "pvm"
+	if _, err = generateParaFile(model); err == nil {
+		t.Errorf("generateParaFile() accepted an unknown parallel_mode")
+	}
+}
+
+func Test_readHostFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bbi_hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name    string
+		content string
+		want    []parallelHost
+		wantErr bool
+	}{
+		{
+			name:    "SGE PE_HOSTFILE",
+			content: "node1.cluster 16 all.q@node1.cluster UNDEFINED\nnode2.cluster 8 all.q@node2.cluster UNDEFINED\n",
+			want:    []parallelHost{{"node1.cluster", 16}, {"node2.cluster", 8}},
+		},
+		{
+			name:    "MPICH hostfile",
+			content: "# allocated hosts\nnode1:4\nnode2\n",
+			want:    []parallelHost{{"node1", 4}, {"node2", 1}},
+		},
+		{
+			name:    "OpenMPI hostfile",
+			content: "node1 slots=2\n",
+			want:    []parallelHost{{"node1", 2}},
+		},
+		{
+			name:    "Invalid slots",
+			content: "node1 many\n",
+			wantErr: true,
+		},
+		{
+			name:    "Empty",
+			content: "\n",
+			wantErr: true,
+		},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(dir, strconv.Itoa(i))
+			ioutil.WriteFile(file, []byte(tt.content), 0644)
+
+			got, err := readHostFile(file)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readHostFile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("readHostFile() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_workerDirectories(t *testing.T) {
+	tests := []struct {
+		name  string
+		hosts []parallelHost
+		want  string
+	}{
+		{
+			name:  "Single host",
+			hosts: []parallelHost{{"node1", 8}},
+			want:  "2-[nodes]:worker{#-1}",
+		},
+		{
+			name:  "Several hosts",
+			hosts: []parallelHost{{"node1.cluster", 4}, {"node2.cluster", 8}},
+			want:  "2-4:worker_node1_{#-1}\n5-12:worker_node2_{#-1}",
+		},
+		{
+			name:  "Manager alone on the first host",
+			hosts: []parallelHost{{"node1", 1}, {"node2", 3}},
+			want:  "2-4:worker_node2_{#-1}",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := workerDirectories(tt.hosts); got != tt.want {
+				t.Errorf("workerDirectories() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_buildNonMemCommandString_parafile(t *testing.T) {
+	model := &NonMemModel{
+		Model:    "run001.mod",
+		FileName: "run001",
+		Configuration: configlib.Config{
+			Parallel: true,
+			Threads:  4,
+			Nonmem: map[string]configlib.NonMemDetail{
+				"nm75": {Home: "/opt/NONMEM/nm75", Executable: "nmfe75", Default: true},
+			},
+		},
+	}
+
+	//Generated parafiles already contain the number of nodes
+	if command := buildNonMemCommandString(model); strings.Contains(command, "[nodes]") {
+		t.Errorf("buildNonMemCommandString() with a generated parafile = %s", command)
+	}
+
+	//Provided parafiles may use the [nodes] placeholder, which nmfe is given the value of
+	model.Configuration.Parafile = "/opt/NONMEM/nm75/run/mpilinux8.pnm"
+	if command := buildNonMemCommandString(model); !strings.Contains(command, `-parafile=run001.pnm "[nodes]=4"`) {
+		t.Errorf("buildNonMemCommandString() with a provided parafile = %s, want [nodes]=4", command)
+	}
+}
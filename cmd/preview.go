@@ -0,0 +1,254 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"bbi/configlib"
+	"bbi/utils"
+	"github.com/spf13/afero"
+)
+
+// modelPlan describes what execution of a single model would do, without any of it being done
+type modelPlan struct {
+	Model           string   `json:"model"`
+	ModelPath       string   `json:"model_path"`
+	OutputDir       string   `json:"output_dir"`
+	OutputDirExists bool     `json:"output_dir_exists"`
+	Overwrite       bool     `json:"overwrite"`
+	Archive         bool     `json:"archive,omitempty"`
+	DataPath        string   `json:"data_path,omitempty"`
+	DataExists      bool     `json:"data_exists"`
+	Command         string   `json:"command,omitempty"`
+	Parafile        string   `json:"parafile,omitempty"`
+	ParafileSource  string   `json:"parafile_source,omitempty"`
+	Qsub            []string `json:"qsub,omitempty"`
+	PreWork         string   `json:"pre_work_executable,omitempty"`
+	PostWorkHooks   []string `json:"post_work_hooks,omitempty"`
+	Skipped         string   `json:"skipped,omitempty"`
+	Conflicts       []string `json:"conflicts,omitempty"`
+}
+
+// executionPlan is the output of run local or run sge with --preview
+type executionPlan struct {
+	Mode   string      `json:"mode"`
+	Models []modelPlan `json:"models"`
+}
+
+// Conflicted indicates whether any model of the plan would fail before execution
+func (p executionPlan) Conflicted() bool {
+	for _, m := range p.Models {
+		if len(m.Conflicts) > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// planModel resolves everything that running the model would use, reading but never writing to disk
+func planModel(mode string, model NonMemModel) modelPlan {
+	//Work on a copy so that the plan leaves the model as it was located
+	l := model
+	fs := afero.NewOsFs()
+	childDirs := mode == "sge" || l.Configuration.Local.CreateChildDirs
+
+	if !childDirs {
+		l.OutputDir = l.OriginalPath
+	}
+
+	plan := modelPlan{
+		Model:     l.Model,
+		ModelPath: l.Path,
+		OutputDir: l.OutputDir,
+		Overwrite: l.Configuration.Overwrite,
+		Archive:   l.Configuration.Archive,
+	}
+
+	plan.OutputDirExists, _ = afero.DirExists(fs, l.OutputDir)
+
+	if current, _ := previousRunIsCurrent(&l); current && !l.Configuration.Force {
+		plan.Skipped = "outputs match the current model, data and nonmem settings"
+	}
+
+	if childDirs && plan.OutputDirExists && !l.Configuration.Overwrite && !l.Configuration.Archive && doesDirectoryContainOutputFiles(l.OutputDir, l.Model) {
+		plan.Conflicts = append(plan.Conflicts, outputDirectoryConflict(l.OutputDir).Error())
+	}
+
+	if lines, err := utils.ReadLines(l.Path); err != nil {
+		plan.Conflicts = append(plan.Conflicts, fmt.Sprintf("unable to read the model: %s", err))
+	} else if data, err := modelDataFile(lines); err != nil {
+		plan.Conflicts = append(plan.Conflicts, err.Error())
+	} else {
+		plan.DataPath = data
+		if !filepath.IsAbs(data) {
+			plan.DataPath = filepath.Join(filepath.Dir(l.Path), data)
+		}
+
+		plan.DataExists, _ = afero.Exists(fs, plan.DataPath)
+		if !plan.DataExists {
+			plan.Conflicts = append(plan.Conflicts, fmt.Sprintf("the data file %s does not exist", plan.DataPath))
+		}
+	}
+
+	if l.Configuration.NMQual {
+		l.Configuration.Parallel = true
+		l.Model = l.FileName + ".ctl"
+	}
+
+	if err := checkSelectedNonMem(l.Configuration); err != nil {
+		plan.Conflicts = append(plan.Conflicts, err.Error())
+	} else if l.Configuration.NMQual {
+		plan.Command = buildAutologCommandString(&l)
+	} else {
+		plan.Command = buildNonMemCommandString(&l)
+	}
+
+	if l.Configuration.Parallel {
+		plan.Parafile = filepath.Join(l.OutputDir, l.FileName+".pnm")
+		plan.ParafileSource = l.Configuration.Parafile
+
+		if l.Configuration.Parafile == "" {
+			if _, err := generateParaFile(&l); err != nil {
+				plan.Conflicts = append(plan.Conflicts, fmt.Sprintf("unable to generate the parafile: %s", err))
+			}
+		}
+	}
+
+	if mode == "sge" {
+		qsub, err := qsubArguments(&l, filepath.Join(l.OutputDir, "grid.sh"))
+		if err != nil {
+			plan.Conflicts = append(plan.Conflicts, fmt.Sprintf("unable to build the qsub arguments: %s", err))
+		}
+		plan.Qsub = qsub
+	}
+
+	plan.PreWork = l.Configuration.PreWorkExecutable
+
+	for _, h := range postWorkHooks(l.Configuration) {
+		plan.PostWorkHooks = append(plan.PostWorkHooks, h.Name)
+	}
+
+	return plan
+}
+
+// checkSelectedNonMem reports the problems with the selected nonmem version which buildNonMemCommandString would otherwise
+// treat as fatal
+func checkSelectedNonMem(config configlib.Config) error {
+	if config.NMVersion != "" {
+		selected, ok := config.Nonmem[config.NMVersion]
+		if !ok {
+			return fmt.Errorf("nmVersion of %s was provided but has no configurations in bbi.yaml", config.NMVersion)
+		}
+
+		if config.NMQual && !selected.Nmqual {
+			return fmt.Errorf("NMQual was selected, but the selected nmversion does not support nmqual")
+		}
+
+		return nil
+	}
+
+	if config.NMQual {
+		return fmt.Errorf("NMQual was selected, but no nmversion was provided")
+	}
+
+	if _, detail := effectiveNonMemVersion(config); detail.Home == "" {
+		return fmt.Errorf("no version was supplied and no default value exists in the configset")
+	}
+
+	return nil
+}
+
+// printExecutionPlan writes the plan as JSON when requested, otherwise as a readable listing
+func printExecutionPlan(out io.Writer, plan executionPlan, asJSON bool) error {
+	if asJSON {
+		contents, err := json.MarshalIndent(plan, "", "\t")
+		if err != nil {
+			return err
+		}
+
+		_, err = fmt.Fprintf(out, "%s\n", contents)
+		return err
+	}
+
+	fmt.Fprintf(out, "Execution plan for %d models on %s\n", len(plan.Models), plan.Mode)
+
+	for _, m := range plan.Models {
+		fmt.Fprintf(out, "\n%s\n", m.ModelPath)
+
+		if m.Skipped != "" {
+			fmt.Fprintf(out, "  skipped:     %s. Use --force to execute it anyway\n", m.Skipped)
+		}
+
+		existence := "will be created"
+		if m.OutputDirExists {
+			existence = "exists"
+			if m.Overwrite {
+				existence = "exists and will be replaced"
+			}
+			if m.Archive {
+				existence = "exists and will be archived"
+			}
+		}
+
+		fmt.Fprintf(out, "  output dir:  %s (%s)\n", m.OutputDir, existence)
+
+		if m.DataPath != "" {
+			fmt.Fprintf(out, "  data:        %s\n", m.DataPath)
+		}
+
+		if m.Command != "" {
+			fmt.Fprintf(out, "  command:     %s\n", m.Command)
+		}
+
+		if m.Parafile != "" {
+			source := "generated"
+			if m.ParafileSource != "" {
+				source = "copied from " + m.ParafileSource
+			}
+			fmt.Fprintf(out, "  parafile:    %s (%s)\n", m.Parafile, source)
+		}
+
+		if len(m.Qsub) > 0 {
+			fmt.Fprintf(out, "  qsub:        %s\n", strings.Join(m.Qsub, " "))
+		}
+
+		if m.PreWork != "" {
+			fmt.Fprintf(out, "  pre work:    %s\n", m.PreWork)
+		}
+
+		if len(m.PostWorkHooks) > 0 {
+			fmt.Fprintf(out, "  post work:   %s\n", strings.Join(m.PostWorkHooks, ", "))
+		}
+
+		for _, c := range m.Conflicts {
+			fmt.Fprintf(out, "  CONFLICT:    %s\n", c)
+		}
+	}
+
+	return nil
+}
+
+// previewExecution prints the plan for the models and exits non-zero if any of them would fail before execution
+func previewExecution(mode string, models []*NonMemModel, asJSON bool) {
+	plan := executionPlan{
+		Mode: mode,
+	}
+
+	for _, m := range models {
+		plan.Models = append(plan.Models, planModel(mode, *m))
+	}
+
+	if err := printExecutionPlan(os.Stdout, plan, asJSON); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to print the execution plan: %s\n", err)
+		os.Exit(1)
+	}
+
+	if plan.Conflicted() {
+		os.Exit(1)
+	}
+}
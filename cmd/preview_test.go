@@ -0,0 +1,107 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"bbi/configlib"
+)
+
+func Test_planModel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bbi_preview")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "run001.mod"), []byte("$PROBLEM preview\n$DATA data.csv IGNORE=@\n"), 0640)
+	ioutil.WriteFile(filepath.Join(dir, "data.csv"), []byte("ID,TIME,DV\n"), 0640)
+
+	//The output directory of an earlier run without overwrite enabled
+	outputDir := filepath.Join(dir, "run001")
+	os.Mkdir(outputDir, 0750)
+	ioutil.WriteFile(filepath.Join(outputDir, "run001.lst"), []byte("previous"), 0640)
+
+	model := NonMemModel{
+		Model:        "run001.mod",
+		FileName:     "run001",
+		Extension:    "mod",
+		Path:         filepath.Join(dir, "run001.mod"),
+		OriginalPath: dir,
+		OutputDir:    outputDir,
+		Configuration: configlib.Config{
+			Threads:  4,
+			Parallel: true,
+			Parafile: "/shared/custom.pnm",
+			Nonmem: map[string]configlib.NonMemDetail{
+				"nm74gf": {Home: "/opt/NONMEM/nm74gf", Executable: "nmfe74", Default: true},
+			},
+			PostWorkHooks: []configlib.PostWorkHook{{Executable: "/scripts/upload.sh"}},
+		},
+	}
+
+	plan := planModel("sge", model)
+
+	if plan.OutputDir != outputDir || !plan.OutputDirExists {
+		t.Errorf("planModel() output dir = %s, exists %t", plan.OutputDir, plan.OutputDirExists)
+	}
+
+	if plan.DataPath != filepath.Join(dir, "data.csv") || !plan.DataExists {
+		t.Errorf("planModel() data path = %s, exists %t", plan.DataPath, plan.DataExists)
+	}
+
+	if want := "/opt/NONMEM/nm74gf/run/nmfe74 run001.mod  run001.lst  -parafile=run001.pnm"; !strings.HasPrefix(plan.Command, want) {
+		t.Errorf("planModel() command = %s, want %s", plan.Command, want)
+	}
+
+	if plan.Parafile != filepath.Join(outputDir, "run001.pnm") || plan.ParafileSource != "/shared/custom.pnm" {
+		t.Errorf("planModel() parafile = %s from %s", plan.Parafile, plan.ParafileSource)
+	}
+
+	if want := []string{"-V", "-j", "y", "-N", "Run_run001", "-pe", "orte", "4", filepath.Join(outputDir, "grid.sh")}; strings.Join(plan.Qsub, " ") != strings.Join(want, " ") {
+		t.Errorf("planModel() qsub = %v, want %v", plan.Qsub, want)
+	}
+
+	if len(plan.Conflicts) != 1 || plan.Conflicts[0] != outputDirectoryConflict(outputDir).Error() {
+		t.Errorf("planModel() conflicts = %v, want the overwrite conflict", plan.Conflicts)
+	}
+
+	if len(plan.PostWorkHooks) != 1 || plan.PostWorkHooks[0] != "upload" {
+		t.Errorf("planModel() post work hooks = %v", plan.PostWorkHooks)
+	}
+
+	//Nothing was written into the output directory
+	if files, _ := ioutil.ReadDir(outputDir); len(files) != 1 {
+		t.Errorf("planModel() wrote %d files into the output directory", len(files)-1)
+	}
+
+	//Local execution without child directories runs beside the model, where there is nothing to overwrite
+	model.Configuration.Local.CreateChildDirs = false
+	model.Configuration.Parallel = false
+	model.Configuration.NMVersion = "nm75"
+
+	plan = planModel("local", model)
+
+	if plan.OutputDir != dir || len(plan.Qsub) > 0 || plan.Parafile != "" {
+		t.Errorf("planModel() local plan = %+v", plan)
+	}
+
+	if len(plan.Conflicts) != 1 || !strings.Contains(plan.Conflicts[0], "nm75") {
+		t.Errorf("planModel() conflicts = %v, want the unknown nonmem version", plan.Conflicts)
+	}
+
+	var out bytes.Buffer
+	if err := printExecutionPlan(&out, executionPlan{Mode: "local", Models: []modelPlan{plan}}, true); err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded executionPlan
+	if err := json.Unmarshal(out.Bytes(), &decoded); err != nil || len(decoded.Models) != 1 || !decoded.Conflicted() {
+		t.Errorf("printExecutionPlan() JSON = %s", out.String())
+	}
+}
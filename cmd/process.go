@@ -0,0 +1,347 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// pidFileName is written into the output directory of a model while nonmem is executing
+const pidFileName string = "bbi.pid"
+
+// pidRecord is the content of the pid file. Output directories are often shared between the hosts of a grid, and pids
+// are reused once a process exits, so the pid is only meaningful on the host that wrote it, and only while the process
+// started at the recorded time is the one holding it
+type pidRecord struct {
+	Pid     int    `json:"pid"`
+	Host    string `json:"host"`
+	Started string `json:"started,omitempty"`
+}
+
+// stopFileName is written into the output directory by bbi nonmem stop so the executing bbi records the model as cancelled
+const stopFileName string = "bbi.stop"
+
+// terminationGracePeriod is how long a process group has to exit after SIGTERM before it is killed
+const terminationGracePeriod time.Duration = 10 * time.Second
+
+// cancelledExitCode is the exit status of a batch whose models were cancelled, but where none failed. It follows the
+// shell convention for processes terminated by SIGINT
+const cancelledExitCode int = 130
+
+var errExecutionCancelled = errors.New("execution was cancelled")
+
+var errMaxRuntimeExceeded = errors.New("execution exceeded max_runtime")
+
+// runningProcesses tracks the process groups of the nonmem executions in progress so they can be terminated on interrupt
+var runningProcesses = struct {
+	sync.Mutex
+	commands    map[string]*exec.Cmd
+	interrupted bool
+}{
+	commands: make(map[string]*exec.Cmd),
+}
+
+// executionInterrupted indicates whether bbi has received an interrupt, in which case no further models should be started
+func executionInterrupted() bool {
+	runningProcesses.Lock()
+	defer runningProcesses.Unlock()
+
+	return runningProcesses.interrupted
+}
+
+// runningHooks tracks the process groups of the pre and post work executables. Hooks aren't stopped by the first interrupt,
+// so that the hooks of cancelled models still run, and are only terminated when bbi exits on a second interrupt
+var runningHooks = struct {
+	sync.Mutex
+	commands map[string]*exec.Cmd
+}{
+	commands: make(map[string]*exec.Cmd),
+}
+
+var interruptHandler sync.Once
+
+// handleInterrupts forwards SIGINT and SIGTERM to every running nonmem process group. Models which have not started yet
+// are cancelled rather than executed. The handler is only installed once per process
+func handleInterrupts() {
+	interruptHandler.Do(installInterruptHandler)
+}
+
+func installInterruptHandler() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		for s := range signals {
+			runningProcesses.Lock()
+			if runningProcesses.interrupted {
+				//A second interrupt while waiting on the running models exits immediately
+				runningProcesses.Unlock()
+				terminateHooks()
+				log.Fatalf("Received %s again. Exiting without waiting for running models", s)
+			}
+
+			runningProcesses.interrupted = true
+			log.Warnf("Received %s. Terminating %d running models and cancelling the rest of the batch", s, len(runningProcesses.commands))
+
+			for identifier, command := range runningProcesses.commands {
+				log.Debugf("Terminating process group %d for %s", command.Process.Pid, identifier)
+				terminateProcessGroup(command.Process.Pid)
+			}
+			runningProcesses.Unlock()
+		}
+	}()
+}
+
+// startTrackedCommand starts the command in its own process group, records it for interrupt handling and writes its
+// pid file into the output directory
+func startTrackedCommand(identifier string, outputDir string, command *exec.Cmd) error {
+	setProcessGroup(command)
+
+	runningProcesses.Lock()
+	defer runningProcesses.Unlock()
+
+	if runningProcesses.interrupted {
+		return errExecutionCancelled
+	}
+
+	os.Remove(filepath.Join(outputDir, stopFileName))
+
+	if err := command.Start(); err != nil {
+		return err
+	}
+
+	runningProcesses.commands[identifier] = command
+
+	if err := writePidFile(outputDir, command.Process.Pid); err != nil {
+		log.Warnf("%s Unable to write the pid file. bbi nonmem stop will not be able to signal this model: %s", identifier, err)
+	}
+
+	return nil
+}
+
+// releaseTrackedCommand removes a finished command from interrupt handling along with its pid file. It returns
+// errExecutionCancelled if the command was stopped through an interrupt or bbi nonmem stop
+func releaseTrackedCommand(identifier string, outputDir string) error {
+	runningProcesses.Lock()
+	defer runningProcesses.Unlock()
+
+	delete(runningProcesses.commands, identifier)
+	os.Remove(filepath.Join(outputDir, pidFileName))
+
+	stopped := filepath.Join(outputDir, stopFileName)
+	if _, err := os.Stat(stopped); err == nil {
+		os.Remove(stopped)
+		return errExecutionCancelled
+	}
+
+	if runningProcesses.interrupted {
+		return errExecutionCancelled
+	}
+
+	return nil
+}
+
+// runTrackedCommand executes the command to completion, terminating it if it runs longer than maxRuntime. A maxRuntime
+// of 0 places no limit on execution. The combined output is returned and, if a stream is provided, written to it as it
+// is produced
+func runTrackedCommand(identifier string, outputDir string, command *exec.Cmd, maxRuntime time.Duration, stream io.Writer) ([]byte, error) {
+	var output bytes.Buffer
+	var w io.Writer = &output
+
+	if stream != nil {
+		w = io.MultiWriter(&output, stream)
+	}
+
+	command.Stdout = w
+	command.Stderr = w
+
+	err := waitTrackedCommand(identifier, outputDir, command, maxRuntime)
+
+	return output.Bytes(), err
+}
+
+// waitTrackedCommand starts the command with its output already directed, and waits for it to complete, terminating it
+// if it runs longer than maxRuntime
+func waitTrackedCommand(identifier string, outputDir string, command *exec.Cmd, maxRuntime time.Duration) error {
+	if err := startTrackedCommand(identifier, outputDir, command); err != nil {
+		return err
+	}
+
+	err := waitWithMaxRuntime(identifier, command, maxRuntime)
+
+	if cerr := releaseTrackedCommand(identifier, outputDir); cerr != nil {
+		return cerr
+	}
+
+	return err
+}
+
+// waitHookCommand starts a pre or post work executable in its own process group and waits for it to complete,
+// terminating it if it runs longer than maxRuntime. Hooks leave the pid and stop files of the model alone, and run even
+// once bbi has been interrupted
+func waitHookCommand(identifier string, command *exec.Cmd, maxRuntime time.Duration) error {
+	setProcessGroup(command)
+
+	if err := command.Start(); err != nil {
+		return err
+	}
+
+	runningHooks.Lock()
+	runningHooks.commands[identifier] = command
+	runningHooks.Unlock()
+
+	defer func() {
+		runningHooks.Lock()
+		delete(runningHooks.commands, identifier)
+		runningHooks.Unlock()
+	}()
+
+	return waitWithMaxRuntime(identifier, command, maxRuntime)
+}
+
+// terminateHooks signals the process groups of every running hook
+func terminateHooks() {
+	runningHooks.Lock()
+	defer runningHooks.Unlock()
+
+	for identifier, command := range runningHooks.commands {
+		log.Debugf("Terminating process group %d for %s", command.Process.Pid, identifier)
+		signalProcessGroup(command.Process.Pid)
+	}
+}
+
+// waitWithMaxRuntime waits for a started command, terminating its process group if it runs longer than maxRuntime
+func waitWithMaxRuntime(identifier string, command *exec.Cmd, maxRuntime time.Duration) error {
+	var timedOut int32
+	var timer *time.Timer
+
+	if maxRuntime > 0 {
+		timer = time.AfterFunc(maxRuntime, func() {
+			log.Errorf("%s Execution exceeded its limit of %s and is being terminated", identifier, maxRuntime)
+			atomic.StoreInt32(&timedOut, 1)
+			terminateProcessGroup(command.Process.Pid)
+		})
+	}
+
+	err := command.Wait()
+
+	if timer != nil {
+		timer.Stop()
+	}
+
+	if atomic.LoadInt32(&timedOut) == 1 {
+		return fmt.Errorf("%w (%s)", errMaxRuntimeExceeded, maxRuntime)
+	}
+
+	return err
+}
+
+// writePidFile records the process group along with the host it is running on and the time it started
+func writePidFile(outputDir string, pid int) error {
+	host, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+
+	record := pidRecord{
+		Pid:  pid,
+		Host: host,
+	}
+
+	//Without a start time the pid can't be checked for reuse, but the model can still be stopped while it is running
+	if record.Started, err = processStartTime(pid); err != nil {
+		log.Debugf("Unable to determine the start time of process %d: %s", pid, err)
+	}
+
+	contents, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filepath.Join(outputDir, pidFileName), contents, 0640)
+}
+
+// readPidFile returns the process group recorded in the pid file of the output directory
+func readPidFile(outputDir string) (pidRecord, error) {
+	var record pidRecord
+
+	contents, err := ioutil.ReadFile(filepath.Join(outputDir, pidFileName))
+	if err != nil {
+		return record, fmt.Errorf("no running model was found in %s: %w", outputDir, err)
+	}
+
+	if err = json.Unmarshal(contents, &record); err != nil || record.Pid <= 0 {
+		return record, fmt.Errorf("the pid file in %s is not valid: %v", outputDir, err)
+	}
+
+	return record, nil
+}
+
+// isLocal indicates whether the process was started on this host
+func (p pidRecord) isLocal() bool {
+	host, err := os.Hostname()
+
+	return err == nil && host == p.Host
+}
+
+// isSameProcess checks that the process now holding the pid is the one which was recorded. If no start time could be
+// recorded, the pid is trusted
+func (p pidRecord) isSameProcess() bool {
+	if p.Started == "" {
+		return true
+	}
+
+	started, err := processStartTime(p.Pid)
+
+	return err == nil && started == p.Started
+}
+
+// modelIsRunning checks whether the process group in the pid file of the output directory is alive on this host
+func modelIsRunning(outputDir string) bool {
+	record, err := readPidFile(outputDir)
+
+	return err == nil && record.isLocal() && processGroupAlive(record.Pid) && record.isSameProcess()
+}
+
+// stopRunningModel asks the process group recorded in the output directory's pid file to terminate. Process groups
+// on other hosts, or whose pid now belongs to a different process, are never signalled
+func stopRunningModel(outputDir string) (int, error) {
+	record, err := readPidFile(outputDir)
+	if err != nil {
+		return 0, err
+	}
+
+	pid := record.Pid
+
+	if !record.isLocal() {
+		return pid, fmt.Errorf("the model in %s is executing on %s. Run bbi nonmem stop on that host", outputDir, record.Host)
+	}
+
+	if !processGroupAlive(pid) || !record.isSameProcess() {
+		os.Remove(filepath.Join(outputDir, pidFileName))
+		return pid, fmt.Errorf("the model in %s is no longer running, and process %d was not signalled. Removed the stale pid file", outputDir, pid)
+	}
+
+	if err = ioutil.WriteFile(filepath.Join(outputDir, stopFileName), []byte(time.Now().Format(time.RFC3339)), 0640); err != nil {
+		return pid, fmt.Errorf("unable to mark the model in %s as stopped: %w", outputDir, err)
+	}
+
+	if err = signalProcessGroup(pid); err != nil {
+		return pid, fmt.Errorf("unable to signal process group %d: %w", pid, err)
+	}
+
+	return pid, nil
+}
@@ -0,0 +1,163 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_runTrackedCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bbi_process")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	output, err := runTrackedCommand("completes", dir, exec.Command("sh", "-c", "echo done"), time.Minute, nil)
+	if err != nil || strings.TrimSpace(string(output)) != "done" {
+		t.Errorf("runTrackedCommand() = %s, %v. Want done", output, err)
+	}
+
+	//Output is written to the stream as it is produced
+	var streamed strings.Builder
+	_, err = runTrackedCommand("streams", dir, exec.Command("sh", "-c", "echo first; echo second 1>&2"), 0, &streamed)
+	if err != nil || streamed.String() != "first\nsecond\n" {
+		t.Errorf("runTrackedCommand() streamed %q, %v. Want both stdout and stderr", streamed.String(), err)
+	}
+
+	if _, err = os.Stat(filepath.Join(dir, pidFileName)); !os.IsNotExist(err) {
+		t.Errorf("runTrackedCommand() left the pid file behind")
+	}
+
+	started := time.Now()
+	_, err = runTrackedCommand("times out", dir, exec.Command("sh", "-c", "sleep 30"), 100*time.Millisecond, nil)
+	if !errors.Is(err, errMaxRuntimeExceeded) {
+		t.Errorf("runTrackedCommand() error = %v, want %v", err, errMaxRuntimeExceeded)
+	}
+
+	if time.Since(started) > 10*time.Second {
+		t.Errorf("runTrackedCommand() did not terminate the command at max_runtime")
+	}
+
+	//Stop the command through its pid file once it has started
+	go func() {
+		for i := 0; i < 100; i++ {
+			time.Sleep(50 * time.Millisecond)
+			if _, err := stopRunningModel(dir); err == nil {
+				return
+			}
+		}
+	}()
+
+	_, err = runTrackedCommand("stopped", dir, exec.Command("sh", "-c", "sleep 30"), 0, nil)
+	if !errors.Is(err, errExecutionCancelled) {
+		t.Errorf("runTrackedCommand() stopped through the pid file error = %v, want %v", err, errExecutionCancelled)
+	}
+
+	if _, err = stopRunningModel(dir); err == nil {
+		t.Errorf("stopRunningModel() succeeded without a running model")
+	}
+}
+
+func Test_stopRunningModel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bbi_process")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	command := exec.Command("sh", "-c", "sleep 30")
+	setProcessGroup(command)
+	if err = command.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer terminateProcessGroup(command.Process.Pid)
+
+	host, _ := os.Hostname()
+	started, err := processStartTime(command.Process.Pid)
+	if err != nil {
+		t.Skipf("the start time of processes can't be determined: %s", err)
+	}
+
+	//A process group on another host of the grid, or one whose pid has since been reused, is never signalled
+	for _, record := range []pidRecord{
+		{Pid: command.Process.Pid, Host: host + ".elsewhere", Started: started},
+		{Pid: command.Process.Pid, Host: host, Started: started + "1"},
+	} {
+		contents, _ := json.Marshal(record)
+		ioutil.WriteFile(filepath.Join(dir, pidFileName), contents, 0640)
+
+		if _, err = stopRunningModel(dir); err == nil {
+			t.Errorf("stopRunningModel() signalled %+v", record)
+		}
+
+		if modelIsRunning(dir) {
+			t.Errorf("modelIsRunning() = true for %+v", record)
+		}
+	}
+
+	if _, err = os.Stat(filepath.Join(dir, stopFileName)); !os.IsNotExist(err) {
+		t.Errorf("stopRunningModel() marked a model it didn't signal as stopped")
+	}
+
+	if !processGroupAlive(command.Process.Pid) {
+		t.Fatalf("stopRunningModel() signalled a process group it should have refused")
+	}
+
+	if err = writePidFile(dir, command.Process.Pid); err != nil {
+		t.Fatal(err)
+	}
+
+	if !modelIsRunning(dir) {
+		t.Errorf("modelIsRunning() = false for the pid file of a running process")
+	}
+}
+
+func Test_waitHookCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bbi_process")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	//The pid and stop files belong to the model, which a hook must leave alone
+	ioutil.WriteFile(filepath.Join(dir, pidFileName), []byte("12345"), 0640)
+	ioutil.WriteFile(filepath.Join(dir, stopFileName), []byte("stopped"), 0640)
+
+	runningProcesses.Lock()
+	runningProcesses.interrupted = true
+	runningProcesses.Unlock()
+
+	defer func() {
+		runningProcesses.Lock()
+		runningProcesses.interrupted = false
+		runningProcesses.Unlock()
+	}()
+
+	command := exec.Command("sh", "-c", "echo hooked > hook.out")
+	command.Dir = dir
+
+	if err = waitHookCommand("hook", command, time.Minute); err != nil {
+		t.Errorf("waitHookCommand() after an interrupt error = %v", err)
+	}
+
+	if contents, _ := ioutil.ReadFile(filepath.Join(dir, "hook.out")); strings.TrimSpace(string(contents)) != "hooked" {
+		t.Errorf("waitHookCommand() did not run the hook after an interrupt")
+	}
+
+	for _, f := range []string{pidFileName, stopFileName} {
+		if _, err = os.Stat(filepath.Join(dir, f)); err != nil {
+			t.Errorf("waitHookCommand() removed %s", f)
+		}
+	}
+
+	if err = waitHookCommand("slow hook", exec.Command("sh", "-c", "sleep 30"), 100*time.Millisecond); !errors.Is(err, errMaxRuntimeExceeded) {
+		t.Errorf("waitHookCommand() error = %v, want %v", err, errMaxRuntimeExceeded)
+	}
+}
@@ -0,0 +1,68 @@
+//go:build !windows
+// +build !windows
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// setProcessGroup places the command in a process group of its own, so that everything nonmem spawns is signalled with it
+func setProcessGroup(command *exec.Cmd) {
+	command.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// terminateProcessGroup sends SIGTERM to the process group, followed by SIGKILL if it is still running after the grace period
+func terminateProcessGroup(pgid int) {
+	syscall.Kill(-pgid, syscall.SIGTERM)
+
+	time.AfterFunc(terminationGracePeriod, func() {
+		if processGroupAlive(pgid) {
+			syscall.Kill(-pgid, syscall.SIGKILL)
+		}
+	})
+}
+
+// processGroupAlive checks whether any process of the group is still running
+func processGroupAlive(pgid int) bool {
+	return syscall.Kill(-pgid, 0) == nil
+}
+
+// signalProcessGroup asks every process of the group to terminate
+func signalProcessGroup(pgid int) error {
+	return syscall.Kill(-pgid, syscall.SIGTERM)
+}
+
+// processStartTime identifies when the process started, in a form only compared against itself. Linux reports the
+// start time in clock ticks since boot through /proc, while other systems are asked through ps
+func processStartTime(pid int) (string, error) {
+	if contents, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid)); err == nil {
+		//The command name may contain spaces, so fields are counted from the parenthesis closing it. The start time is
+		//the 22nd field of the file
+		fields := strings.Fields(string(contents[strings.LastIndexByte(string(contents), ')')+1:]))
+		if len(fields) < 20 {
+			return "", errors.New("unexpected format of /proc stat file")
+		}
+
+		return fields[19], nil
+	}
+
+	output, err := exec.Command("ps", "-o", "lstart=", "-p", strconv.Itoa(pid)).Output()
+	if err != nil {
+		return "", err
+	}
+
+	started := strings.TrimSpace(string(output))
+	if started == "" {
+		return "", fmt.Errorf("process %d was not found", pid)
+	}
+
+	return started, nil
+}
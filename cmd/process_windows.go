@@ -0,0 +1,59 @@
+//go:build windows
+// +build windows
+
+package cmd
+
+import (
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+)
+
+// setProcessGroup is a no-op on windows, where there are no process groups to signal
+func setProcessGroup(command *exec.Cmd) {}
+
+// terminateProcessGroup kills the process. Windows has no equivalent of SIGTERM, so there is no grace period
+func terminateProcessGroup(pid int) {
+	if process, err := os.FindProcess(pid); err == nil {
+		process.Kill()
+	}
+}
+
+// processGroupAlive checks whether the process is still running. FindProcess opens the process on windows, failing if
+// it has exited
+func processGroupAlive(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+
+	process.Release()
+	return true
+}
+
+// signalProcessGroup kills the process
+func signalProcessGroup(pid int) error {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+
+	return process.Kill()
+}
+
+// processStartTime identifies when the process started, as its creation time in nanoseconds
+func processStartTime(pid int) (string, error) {
+	handle, err := syscall.OpenProcess(syscall.PROCESS_QUERY_INFORMATION, false, uint32(pid))
+	if err != nil {
+		return "", err
+	}
+	defer syscall.CloseHandle(handle)
+
+	var created, exited, kernel, user syscall.Filetime
+	if err = syscall.GetProcessTimes(handle, &created, &exited, &kernel, &user); err != nil {
+		return "", err
+	}
+
+	return strconv.FormatInt(created.Nanoseconds(), 10), nil
+}
@@ -0,0 +1,404 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"bbi/configlib"
+	parser "bbi/parsers/nmparser"
+	"bbi/utils"
+	"github.com/olekukonko/tablewriter"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/afero"
+	"github.com/spf13/cobra"
+)
+
+var (
+	profileParameter string
+	profilePoints    int
+	profileWidth     float64
+	profileRefine    int
+	profileThreshold float64
+)
+
+const profileLongDescription string = `generate a log-likelihood profile for a single parameter of a completed model, for example:
+bbi nonmem profile run001.mod --param THETA3
+bbi nonmem profile run001.mod --param THETA3 --points 12 --width 4
+bbi nonmem profile run001.mod --param "OMEGA(1,1)" --refine 3
+
+The parameter is FIXed at values on a grid around its final estimate and each variant is executed locally.
+The values at which the change in objective function value crosses the threshold (3.84 by default, the
+95% quantile of a chi-square distribution with one degree of freedom) are located by interpolation and
+refined with additional runs. Models are written into <model>_profile_<param> next to the original model.
+ `
+
+// profileCmd represents the profile command
+var profileCmd = &cobra.Command{
+	Use:   "profile",
+	Short: "profile the likelihood of a parameter to compute confidence intervals",
+	Long:  profileLongDescription,
+	Run:   profile,
+}
+
+type profilePoint struct {
+	Value    float64 `json:"value"`
+	OFV      float64 `json:"ofv"`
+	DeltaOFV float64 `json:"delta_ofv"`
+	Model    string  `json:"model,omitempty"`
+}
+
+type profileResult struct {
+	Model      string         `json:"model"`
+	Parameter  string         `json:"parameter"`
+	Estimate   float64        `json:"estimate"`
+	StdErr     float64        `json:"std_err,omitempty"`
+	OFV        float64        `json:"ofv"`
+	Threshold  float64        `json:"threshold"`
+	Lower      float64        `json:"lower"`
+	LowerFound bool           `json:"lower_found"`
+	Upper      float64        `json:"upper"`
+	UpperFound bool           `json:"upper_found"`
+	Points     []profilePoint `json:"points"`
+}
+
+func profile(cmd *cobra.Command, args []string) {
+	if len(args) != 1 {
+		log.Fatal("Exactly one model must be provided for profiling")
+	}
+
+	if profileParameter == "" {
+		log.Fatal("A parameter to profile must be provided with --param, such as THETA3")
+	}
+
+	config, err := configlib.LocateAndReadConfigFile()
+	if err != nil {
+		log.Fatalf("Failed to process configuration: %s", err)
+	}
+
+	logSetup(config)
+
+	//Every variant executed for the analysis is reported to the same event stream
+	startEventStream()
+
+	now := time.Now()
+
+	result, err := profileModel(args[0], strings.ToUpper(profileParameter), config)
+	if err != nil {
+		log.Fatalf("Unable to complete the profile for %s: %s", args[0], err)
+	}
+
+	events.Close()
+
+	log.Infof("Profile of %s completed in %s", result.Parameter, time.Since(now))
+
+	if Json {
+		jsonRes, _ := json.MarshalIndent(result, "", "\t")
+		fmt.Fprintf(consoleOutput(), "%s\n", jsonRes)
+		return
+	}
+
+	result.Summary()
+}
+
+func init() {
+	nonmemCmd.AddCommand(profileCmd)
+	profileCmd.Flags().StringVar(&eventsTarget, "events", "", "Write JSON lines lifecycle events for each executed model to a file, an inherited file descriptor (fd:3) or stdout (-)")
+	profileCmd.Flags().StringVar(&profileParameter, "param", "", "Parameter to profile, named as in the ext file (THETA3, OMEGA(1,1))")
+	profileCmd.Flags().IntVar(&profilePoints, "points", 10, "Number of grid points at which the parameter will be fixed")
+	profileCmd.Flags().Float64Var(&profileWidth, "width", 3, "Number of standard errors the grid spans on each side of the estimate")
+	profileCmd.Flags().IntVar(&profileRefine, "refine", 2, "Number of refinement rounds run at the interpolated crossings")
+	profileCmd.Flags().Float64Var(&profileThreshold, "threshold", 3.84, "Change in objective function value defining the confidence bounds")
+}
+
+func profileModel(modelPath string, param string, config configlib.Config) (profileResult, error) {
+	result := profileResult{
+		Parameter: param,
+		Threshold: profileThreshold,
+	}
+
+	base, err := NewNonMemModel(modelPath, config)
+	if err != nil {
+		return result, err
+	}
+
+	result.Model = base.Model
+
+	finals, stdErrs, err := finalValuesForLatestRun(base)
+	if err != nil {
+		return result, fmt.Errorf("unable to read the results of %s. Has it been executed? %s", base.Model, err)
+	}
+
+	estimate, ok := finals[param]
+	if !ok {
+		return result, fmt.Errorf("no parameter named %s was reported for %s", param, base.Model)
+	}
+
+	result.Estimate = estimate
+	result.StdErr = stdErrs[param]
+	result.OFV = finals["OBJ"]
+
+	modelLines, err := utils.ReadLines(base.Path)
+	if err != nil {
+		return result, err
+	}
+
+	lower, upper := math.Inf(-1), math.Inf(1)
+	for _, e := range parser.ParseControlStreamEstimates(modelLines) {
+		if e.Name != param {
+			continue
+		}
+		if e.Fixed {
+			return result, fmt.Errorf("%s is fixed in %s and cannot be profiled", param, base.Model)
+		}
+		if e.Record == "THETA" {
+			lower, upper = e.Bounds()
+		} else if e.Diagonal {
+			lower = 0
+		}
+	}
+
+	grid := profileGrid(estimate, result.StdErr, profileWidth, profilePoints, lower, upper)
+	if len(grid) == 0 {
+		return result, errors.New("no grid values could be generated within the parameter boundaries")
+	}
+
+	profileDir := filepath.Join(base.OriginalPath, base.FileName+"_profile_"+safeParameterName(param))
+
+	if err = prepareVariantDirectory(profileDir, config.Overwrite); err != nil {
+		return result, err
+	}
+
+	// The profile directory is owned by this operation, so the children are always free to replace their outputs
+	config.Overwrite = true
+
+	profiler := modelProfiler{
+		base:         base,
+		lines:        modelLines,
+		param:        param,
+		directory:    profileDir,
+		config:       config,
+		referenceOFV: result.OFV,
+	}
+
+	points, err := profiler.run(grid)
+	if err != nil {
+		return result, err
+	}
+
+	points = append(points, profilePoint{Value: estimate, OFV: result.OFV, DeltaOFV: 0, Model: base.Model})
+
+	for round := 0; round < profileRefine; round++ {
+		var refinements []float64
+
+		sortProfilePoints(points)
+		if v, found := profileCrossing(points, estimate, profileThreshold, true); found && !isGridValue(points, v) {
+			refinements = append(refinements, v)
+		}
+		if v, found := profileCrossing(points, estimate, profileThreshold, false); found && !isGridValue(points, v) {
+			refinements = append(refinements, v)
+		}
+
+		if len(refinements) == 0 {
+			break
+		}
+
+		log.Infof("Refinement round %d: evaluating %s at %v", round+1, param, refinements)
+
+		refined, err := profiler.run(refinements)
+		if err != nil {
+			return result, err
+		}
+
+		points = append(points, refined...)
+	}
+
+	sortProfilePoints(points)
+	result.Points = points
+	result.Lower, result.LowerFound = profileCrossing(points, estimate, profileThreshold, true)
+	result.Upper, result.UpperFound = profileCrossing(points, estimate, profileThreshold, false)
+
+	resultJSON, _ := json.MarshalIndent(result, "", "    ")
+	err = afero.WriteFile(afero.NewOsFs(), filepath.Join(profileDir, "profile.json"), resultJSON, 0750)
+
+	return result, err
+}
+
+type modelProfiler struct {
+	base         NonMemModel
+	lines        []string
+	param        string
+	directory    string
+	config       configlib.Config
+	referenceOFV float64
+	generated    int
+}
+
+// run executes a variant of the model for each provided value and reports the objective function value of those that succeeded
+func (p *modelProfiler) run(values []float64) ([]profilePoint, error) {
+	var files []string
+
+	for _, v := range values {
+		p.generated++
+		name := fmt.Sprintf("%s_%s_%03d", p.base.FileName, safeParameterName(p.param), p.generated)
+
+		modelFile, err := writeModelVariant(p.lines, p.directory, name, p.base.Extension, map[string]parser.EstimateUpdate{
+			p.param: {Value: v, Fix: true},
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		files = append(files, modelFile)
+	}
+
+	results, err := executeModelVariants(files, p.config)
+	if err != nil {
+		return nil, err
+	}
+
+	var points []profilePoint
+	for i, r := range results {
+		if r.Err != nil {
+			log.Warnf("%s No objective function value could be read for %s = %f and it will be excluded from the profile: %s", r.Model.LogIdentifier(), p.param, values[i], r.Err)
+			continue
+		}
+
+		points = append(points, profilePoint{
+			Value:    values[i],
+			OFV:      r.Finals["OBJ"],
+			DeltaOFV: r.Finals["OBJ"] - p.referenceOFV,
+			Model:    r.Model.Model,
+		})
+	}
+
+	return points, nil
+}
+
+// profileGrid generates points on both sides of the estimate spanning width standard errors, or half the estimate when
+// no standard error is available. Values outside of the parameter boundaries are excluded
+func profileGrid(estimate float64, stdErr float64, width float64, points int, lower float64, upper float64) []float64 {
+	var grid []float64
+
+	if points < 2 {
+		points = 2
+	}
+
+	span := width * stdErr
+	if stdErr <= 0 || math.IsNaN(stdErr) {
+		span = 0.5 * math.Abs(estimate)
+		if span == 0 {
+			span = 1
+		}
+	}
+
+	below := points / 2
+	above := points - below
+
+	for i := below; i >= 1; i-- {
+		v := estimate - span*float64(i)/float64(below)
+		if v > lower {
+			grid = append(grid, v)
+		}
+	}
+
+	for i := 1; i <= above; i++ {
+		v := estimate + span*float64(i)/float64(above)
+		if v < upper {
+			grid = append(grid, v)
+		}
+	}
+
+	return grid
+}
+
+// profileCrossing walks outward from the estimate on one side of the profile and linearly interpolates the value at which
+// the change in objective function value first reaches the threshold
+func profileCrossing(points []profilePoint, estimate float64, threshold float64, lowerSide bool) (float64, bool) {
+	var side []profilePoint
+
+	for _, p := range points {
+		if (lowerSide && p.Value <= estimate) || (!lowerSide && p.Value >= estimate) {
+			side = append(side, p)
+		}
+	}
+
+	sort.Slice(side, func(i, j int) bool {
+		if lowerSide {
+			return side[i].Value > side[j].Value
+		}
+		return side[i].Value < side[j].Value
+	})
+
+	for i := 1; i < len(side); i++ {
+		inner := side[i-1]
+		outer := side[i]
+
+		if inner.DeltaOFV < threshold && outer.DeltaOFV >= threshold {
+			if outer.DeltaOFV == inner.DeltaOFV {
+				return outer.Value, true
+			}
+			fraction := (threshold - inner.DeltaOFV) / (outer.DeltaOFV - inner.DeltaOFV)
+			return inner.Value + fraction*(outer.Value-inner.Value), true
+		}
+	}
+
+	return 0, false
+}
+
+func sortProfilePoints(points []profilePoint) {
+	sort.Slice(points, func(i, j int) bool {
+		return points[i].Value < points[j].Value
+	})
+}
+
+func isGridValue(points []profilePoint, value float64) bool {
+	for _, p := range points {
+		if math.Abs(p.Value-value) <= 1e-8*math.Max(1, math.Abs(value)) {
+			return true
+		}
+	}
+	return false
+}
+
+// safeParameterName converts ext style names such as OMEGA(2,1) into a form suitable for file names (OMEGA2_1)
+func safeParameterName(param string) string {
+	return strings.NewReplacer("(", "", ")", "", ",", "_").Replace(param)
+}
+
+// Summary prints the profile points and resulting confidence interval
+func (r profileResult) Summary() {
+	table := tablewriter.NewWriter(consoleOutput())
+	table.SetAlignment(tablewriter.ALIGN_LEFT)
+	table.SetHeader([]string{r.Parameter, "OFV", "dOFV", "Model"})
+
+	for _, p := range r.Points {
+		table.Append([]string{
+			strconv.FormatFloat(p.Value, 'g', 6, 64),
+			strconv.FormatFloat(p.OFV, 'f', 3, 64),
+			strconv.FormatFloat(p.DeltaOFV, 'f', 3, 64),
+			p.Model,
+		})
+	}
+	table.Render()
+
+	bound := func(value float64, found bool, side string) string {
+		if !found {
+			return fmt.Sprintf("not reached (%s of profiled range)", side)
+		}
+		return strconv.FormatFloat(value, 'g', 6, 64)
+	}
+
+	fmt.Fprintf(consoleOutput(), "\n%s estimate: %s (OFV %.3f)\n", r.Parameter, strconv.FormatFloat(r.Estimate, 'g', 6, 64), r.OFV)
+	fmt.Fprintf(consoleOutput(), "Profile likelihood interval (dOFV = %.2f): [%s, %s]\n", r.Threshold, bound(r.Lower, r.LowerFound, "below"), bound(r.Upper, r.UpperFound, "above"))
+	if r.LowerFound && r.UpperFound {
+		fmt.Fprintf(consoleOutput(), "Distance from estimate: -%s / +%s\n", strconv.FormatFloat(r.Estimate-r.Lower, 'g', 4, 64), strconv.FormatFloat(r.Upper-r.Estimate, 'g', 4, 64))
+	}
+}
@@ -0,0 +1,164 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"bbi/configlib"
+)
+
+func Test_profileGrid(t *testing.T) {
+	type args struct {
+		estimate float64
+		stdErr   float64
+		width    float64
+		points   int
+		lower    float64
+		upper    float64
+	}
+	tests := []struct {
+		name string
+		args args
+		want []float64
+	}{
+		{
+			name: "Symmetric grid from standard error",
+			args: args{
+				estimate: 10,
+				stdErr:   1,
+				width:    2,
+				points:   4,
+				lower:    math.Inf(-1),
+				upper:    math.Inf(1),
+			},
+			want: []float64{8, 9, 11, 12},
+		},
+		{
+			name: "No standard error uses half the estimate",
+			args: args{
+				estimate: 4,
+				stdErr:   0,
+				width:    3,
+				points:   2,
+				lower:    math.Inf(-1),
+				upper:    math.Inf(1),
+			},
+			want: []float64{2, 6},
+		},
+		{
+			name: "Values outside of bounds are excluded",
+			args: args{
+				estimate: 1,
+				stdErr:   1,
+				width:    2,
+				points:   4,
+				lower:    0,
+				upper:    math.Inf(1),
+			},
+			want: []float64{2, 3},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := profileGrid(tt.args.estimate, tt.args.stdErr, tt.args.width, tt.args.points, tt.args.lower, tt.args.upper); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("profileGrid() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_profileCrossing(t *testing.T) {
+	points := []profilePoint{
+		{Value: 6, DeltaOFV: 8},
+		{Value: 8, DeltaOFV: 2},
+		{Value: 10, DeltaOFV: 0},
+		{Value: 12, DeltaOFV: 1},
+		{Value: 14, DeltaOFV: 3},
+	}
+
+	type args struct {
+		lowerSide bool
+	}
+	tests := []struct {
+		name      string
+		args      args
+		want      float64
+		wantFound bool
+	}{
+		{
+			name:      "Lower crossing is interpolated",
+			args:      args{lowerSide: true},
+			want:      22.0 / 3,
+			wantFound: true,
+		},
+		{
+			name:      "Upper crossing is not reached",
+			args:      args{lowerSide: false},
+			want:      0,
+			wantFound: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, found := profileCrossing(points, 10, 4, tt.args.lowerSide)
+			if found != tt.wantFound {
+				t.Errorf("profileCrossing() found = %v, want %v", found, tt.wantFound)
+			}
+			if math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("profileCrossing() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_profileModel_sequencedOutputDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bbi_profile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "acop.csv"), []byte("ID,TIME,DV\n"), 0640)
+	ioutil.WriteFile(filepath.Join(dir, "run001.mod"), []byte("$PROBLEM run001\n$DATA acop.csv\n$THETA 2\n"), 0640)
+
+	//The base model was executed into the first directory of the sequenced template
+	os.Mkdir(filepath.Join(dir, "run001-1"), 0750)
+	ioutil.WriteFile(filepath.Join(dir, "run001-1", "run001.ext"), []byte("TABLE NO.     1: First Order Conditional Estimation with Interaction: Goal Function=MINIMUM VALUE OF OBJECTIVE FUNCTION: Problem=1\n"+
+		" ITERATION    THETA1       OBJ\n"+
+		"  -1000000000  2.31000E+00    2636.5\n"+
+		"  -1000000001  1.10000E-01    0.0\n"), 0640)
+
+	config := configlib.Config{
+		OutputDir: "{{ .Name }}-{{ .Seq }}",
+		Local:     configlib.LocalDetail{CreateChildDirs: true},
+	}
+
+	base, err := NewNonMemModel(filepath.Join(dir, "run001.mod"), config)
+	if err != nil {
+		t.Fatalf("NewNonMemModel() error = %s", err)
+	}
+
+	//The next run of the model is given a new directory, while its results are in the latest existing one
+	if base.OutputDir != filepath.Join(dir, "run001-2") {
+		t.Fatalf("NewNonMemModel() output directory = %s, want run001-2", base.OutputDir)
+	}
+
+	finals, stdErrs, err := finalValuesForLatestRun(base)
+	if err != nil {
+		t.Fatalf("finalValuesForLatestRun() error = %s", err)
+	}
+
+	if finals["THETA1"] != 2.31 || finals["OBJ"] != 2636.5 || stdErrs["THETA1"] != 0.11 {
+		t.Errorf("finalValuesForLatestRun() = %v, %v", finals, stdErrs)
+	}
+
+	//Profiling an unreported parameter fails only once the results of the base model have been read
+	if _, err = profileModel(filepath.Join(dir, "run001.mod"), "THETA9", config); err == nil || !strings.Contains(err.Error(), "no parameter named THETA9") {
+		t.Errorf("profileModel() error = %v, want the base model's results to be read", err)
+	}
+}
@@ -0,0 +1,382 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"time"
+
+	"bbi/utils"
+	"github.com/olekukonko/tablewriter"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+const (
+	//provenanceManifestName is the file in the output directory of each model recording its provenance
+	provenanceManifestName string = "bbi_manifest.json"
+	//provenanceVersion is incremented when the structure of the manifest changes
+	provenanceVersion int = 1
+)
+
+// The roles of the files recorded in a provenance manifest
+const (
+	provenanceModel      string = "model"
+	provenanceData       string = "data"
+	provenanceInclude    string = "include"
+	provenanceExecutable string = "executable"
+	provenanceOutput     string = "output"
+)
+
+// The outcomes of verifying a file against its provenance
+const (
+	provenanceMatched string = "ok"
+	provenanceChanged string = "changed"
+	provenanceMissing string = "missing"
+	//provenanceCleaned is a nonmem executable removed by the clean level, which isn't drift
+	provenanceCleaned string = "cleaned"
+)
+
+// includeRegex matches the $INCLUDE records of a control stream along with the file they include
+var includeRegex = regexp.MustCompile(`(?i)^\s*\$INCLUDE\s+['"]?([^'"\s]+)`)
+
+const verifyProvenanceLongDescription string = `re-hash the files recorded in the bbi_manifest.json of executed models and
+report any drift from the recorded SHA-256 checksums. Models may be provided as control streams, which are resolved to
+their output directory through bbi.yaml, or as the output directories themselves. Exits non-zero if any file has
+changed or is missing
+
+ bbi nonmem verify-provenance run001.mod
+ bbi nonmem verify-provenance run001 run002 --json
+`
+
+var verifyProvenanceCmd = &cobra.Command{
+	Use:   "verify-provenance [models]",
+	Short: "report drift of executed models from their provenance manifest",
+	Long:  verifyProvenanceLongDescription,
+	Args:  cobra.MinimumNArgs(1),
+	Run:   verifyProvenanceCommand,
+}
+
+func init() {
+	nonmemCmd.AddCommand(verifyProvenanceCmd)
+}
+
+// provenanceManifest records the inputs, outputs and environment of an execution, written as bbi_manifest.json
+type provenanceManifest struct {
+	ManifestVersion int                   `json:"manifest_version"`
+	CreatedAt       time.Time             `json:"created_at"`
+	Model           string                `json:"model"`
+	Environment     provenanceEnvironment `json:"environment"`
+	//Files are named relative to the output directory holding the manifest
+	Files []provenanceFile `json:"files"`
+}
+
+// provenanceEnvironment describes where and with what the model was executed
+type provenanceEnvironment struct {
+	Hostname   string `json:"hostname"`
+	User       string `json:"user"`
+	BBIVersion string `json:"bbi_version"`
+	NMVersion  string `json:"nm_version"`
+	NonMemHome string `json:"nonmem_home,omitempty"`
+	Compiler   string `json:"compiler,omitempty"`
+	OS         string `json:"os"`
+	Arch       string `json:"arch"`
+}
+
+type provenanceFile struct {
+	Role   string `json:"role"`
+	Path   string `json:"path"`
+	SHA256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+}
+
+// provenanceResult is the outcome of verifying a single file of a manifest
+type provenanceResult struct {
+	Role    string `json:"role"`
+	Path    string `json:"path"`
+	Status  string `json:"status"`
+	Current string `json:"current_sha256,omitempty"`
+}
+
+func verifyProvenanceCommand(cmd *cobra.Command, args []string) {
+	type modelResults struct {
+		Model     string             `json:"model"`
+		OutputDir string             `json:"output_dir"`
+		Drifted   bool               `json:"drifted"`
+		Files     []provenanceResult `json:"files"`
+	}
+
+	var all []modelResults
+	failed := false
+
+	for _, arg := range args {
+		outputDir, _, err := modelRunDirectory(arg)
+		if err != nil {
+			log.Errorf("Unable to locate the output directory for %s: %s", arg, err)
+			failed = true
+			continue
+		}
+
+		results, err := verifyProvenance(outputDir)
+		if err != nil {
+			log.Errorf("Unable to verify the provenance of %s: %s", arg, err)
+			failed = true
+			continue
+		}
+
+		m := modelResults{Model: arg, OutputDir: outputDir, Files: results, Drifted: provenanceDrifted(results)}
+		failed = failed || m.Drifted
+		all = append(all, m)
+	}
+
+	if Json {
+		jsonRes, _ := json.MarshalIndent(all, "", "\t")
+		fmt.Printf("%s\n", jsonRes)
+	} else {
+		for _, m := range all {
+			fmt.Printf("%s (%s)\n", m.Model, m.OutputDir)
+			printProvenanceResults(os.Stdout, m.Files)
+		}
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// newProvenanceManifest records the provenance of a model executed in its output directory. The model and data have
+// already been hashed during cleanup, and the executable is hashed before the clean level can remove it
+func newProvenanceManifest(model *NonMemModel, modelDigest fileDigest, dataDigest fileDigest, executable *provenanceFile) (provenanceManifest, error) {
+	manifest := provenanceManifest{
+		ManifestVersion: provenanceVersion,
+		CreatedAt:       time.Now(),
+		Model:           model.OriginalModel,
+		Environment:     currentProvenanceEnvironment(model),
+	}
+
+	outputDir := model.OutputDir
+	originalModel := filepath.Join(model.OriginalPath, model.OriginalModel)
+
+	manifest.Files = append(manifest.Files, provenanceFile{
+		Role:   provenanceModel,
+		Path:   relativeProvenancePath(outputDir, originalModel),
+		SHA256: modelDigest.SHA256,
+		Size:   modelDigest.Size,
+	})
+
+	//A data file which couldn't be hashed has no digest to record, and would otherwise always be reported as changed
+	if model.DataPath != "" && dataDigest.SHA256 == "" {
+		log.Warnf("%s The data file %s could not be hashed and is left out of the provenance manifest", model.LogIdentifier(), model.DataPath)
+	} else if model.DataPath != "" {
+		manifest.Files = append(manifest.Files, provenanceFile{
+			Role:   provenanceData,
+			Path:   relativeProvenancePath(outputDir, model.DataPath),
+			SHA256: dataDigest.SHA256,
+			Size:   dataDigest.Size,
+		})
+	}
+
+	lines, err := utils.ReadLines(filepath.Join(outputDir, model.Model))
+	if err != nil {
+		return manifest, err
+	}
+
+	for _, include := range modelIncludes(lines) {
+		//nmtran resolves includes from the directory it runs in, while the original may sit beside the model
+		located := include
+		if !filepath.IsAbs(include) {
+			located = filepath.Join(outputDir, include)
+			if _, err := os.Stat(located); err != nil {
+				located = filepath.Join(model.OriginalPath, include)
+			}
+		}
+
+		f, err := hashProvenanceFile(provenanceInclude, outputDir, located)
+		if err != nil {
+			return manifest, fmt.Errorf("unable to hash the included file %s: %w", include, err)
+		}
+
+		manifest.Files = append(manifest.Files, f)
+	}
+
+	if executable != nil {
+		manifest.Files = append(manifest.Files, *executable)
+	}
+
+	outputs := make(map[string]bool)
+	for _, f := range getCopiableFileList(model.Model, 3, outputDir) {
+		outputs[f] = true
+	}
+
+	var names []string
+	for f := range outputs {
+		names = append(names, f)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if info, err := os.Stat(filepath.Join(outputDir, name)); err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+
+		f, err := hashProvenanceFile(provenanceOutput, outputDir, filepath.Join(outputDir, name))
+		if err != nil {
+			return manifest, err
+		}
+
+		manifest.Files = append(manifest.Files, f)
+	}
+
+	return manifest, nil
+}
+
+func writeProvenanceManifest(outputDir string, manifest provenanceManifest) error {
+	contents, err := json.MarshalIndent(manifest, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filepath.Join(outputDir, provenanceManifestName), contents, 0640)
+}
+
+func currentProvenanceEnvironment(model *NonMemModel) provenanceEnvironment {
+	env := provenanceEnvironment{
+		BBIVersion: VERSION,
+		OS:         runtime.GOOS,
+		Arch:       runtime.GOARCH,
+	}
+
+	env.Hostname, _ = os.Hostname()
+
+	if u, err := user.Current(); err == nil {
+		env.User = u.Username
+	} else {
+		env.User = os.Getenv("USER")
+	}
+
+	nmVersion, detail := effectiveNonMemVersion(model.Configuration)
+	env.NMVersion = nmVersion
+
+	if detail.Home != "" {
+		env.NonMemHome = detail.Home
+		env.Compiler = nonmemCompiler(detail)
+	}
+
+	return env
+}
+
+// modelIncludes lists the files included into a control stream with $INCLUDE
+func modelIncludes(lines []string) []string {
+	var includes []string
+
+	for _, line := range lines {
+		if matches := includeRegex.FindStringSubmatch(line); matches != nil {
+			includes = append(includes, matches[1])
+		}
+	}
+
+	return includes
+}
+
+// hashProvenanceFile hashes a file, naming it relative to the output directory
+func hashProvenanceFile(role string, outputDir string, file string) (provenanceFile, error) {
+	sum, size, err := sha256File(file)
+	if err != nil {
+		return provenanceFile{}, err
+	}
+
+	return provenanceFile{
+		Role:   role,
+		Path:   relativeProvenancePath(outputDir, file),
+		SHA256: sum,
+		Size:   size,
+	}, nil
+}
+
+// relativeProvenancePath names files relative to the output directory, so that the manifest still applies when the
+// project is moved
+func relativeProvenancePath(outputDir string, file string) string {
+	if !filepath.IsAbs(file) {
+		return filepath.ToSlash(file)
+	}
+
+	if relative, err := filepath.Rel(outputDir, file); err == nil {
+		return filepath.ToSlash(relative)
+	}
+
+	return file
+}
+
+// verifyProvenance re-hashes each file recorded in the manifest of an output directory
+func verifyProvenance(outputDir string) ([]provenanceResult, error) {
+	contents, err := ioutil.ReadFile(filepath.Join(outputDir, provenanceManifestName))
+	if err != nil {
+		return nil, fmt.Errorf("no %s was found in %s. Was the model executed with this version of bbi? %s", provenanceManifestName, outputDir, err)
+	}
+
+	var manifest provenanceManifest
+	if err = json.Unmarshal(contents, &manifest); err != nil {
+		return nil, fmt.Errorf("unable to read %s: %s", filepath.Join(outputDir, provenanceManifestName), err)
+	}
+
+	var results []provenanceResult
+
+	for _, f := range manifest.Files {
+		result := provenanceResult{Role: f.Role, Path: f.Path}
+
+		file := filepath.FromSlash(f.Path)
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(outputDir, file)
+		}
+
+		current, err := hashProvenanceFile(f.Role, outputDir, file)
+
+		switch {
+		case os.IsNotExist(err) && f.Role == provenanceExecutable:
+			result.Status = provenanceCleaned
+		case os.IsNotExist(err):
+			result.Status = provenanceMissing
+		case err != nil:
+			return results, err
+		case current.SHA256 != f.SHA256:
+			result.Status = provenanceChanged
+			result.Current = current.SHA256
+		default:
+			result.Status = provenanceMatched
+		}
+
+		results = append(results, result)
+	}
+
+	return results, nil
+}
+
+func provenanceDrifted(results []provenanceResult) bool {
+	for _, r := range results {
+		if r.Status == provenanceChanged || r.Status == provenanceMissing {
+			return true
+		}
+	}
+
+	return false
+}
+
+func printProvenanceResults(out io.Writer, results []provenanceResult) {
+	table := tablewriter.NewWriter(out)
+	table.SetAlignment(tablewriter.ALIGN_LEFT)
+	table.SetAutoWrapText(false)
+	table.SetHeader([]string{"Role", "Path", "Status"})
+
+	for _, r := range results {
+		table.Append([]string{r.Role, r.Path, r.Status})
+	}
+
+	table.Render()
+}
@@ -0,0 +1,179 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"bbi/configlib"
+)
+
+func TestHashFileOnChannel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bbi_hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "acop.csv")
+	ioutil.WriteFile(file, []byte("ID,TIME,DV\n"), 0640)
+
+	ch := make(chan fileDigest)
+	go HashFileOnChannel(ch, file, "acop")
+
+	digest := <-ch
+	if digest.MD5 != "428aa57d88b11983b8ff99e35dc32495" || digest.SHA256 != "d7d003280264497d997d8d337c566669f56ced77e253c541eb4eb5f60a0ff4ff" || digest.Size != 11 {
+		t.Errorf("HashFileOnChannel() = %+v", digest)
+	}
+
+	//A file which can't be read sends a single empty digest, leaving the channel free for the next
+	go HashFileOnChannel(ch, filepath.Join(dir, "missing.csv"), "missing")
+	if digest = <-ch; digest != (fileDigest{}) {
+		t.Errorf("HashFileOnChannel() of a missing file = %+v", digest)
+	}
+
+	go HashFileOnChannel(ch, file, "acop")
+	select {
+	case digest = <-ch:
+		if digest.Size != 11 {
+			t.Errorf("HashFileOnChannel() after a failure = %+v", digest)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("HashFileOnChannel() after a failure never sent its digest")
+	}
+}
+
+func Test_modelIncludes(t *testing.T) {
+	lines := []string{
+		"$PROBLEM run001",
+		"$INCLUDE covariates.inc",
+		"  $include 'priors.inc' ; priors",
+		"; $INCLUDE commented.inc",
+		"$PK",
+	}
+
+	want := []string{"covariates.inc", "priors.inc"}
+	if got := modelIncludes(lines); !reflect.DeepEqual(got, want) {
+		t.Errorf("modelIncludes() = %v, want %v", got, want)
+	}
+}
+
+func Test_verifyProvenance(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bbi_provenance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	outputDir := filepath.Join(dir, "run001")
+	os.MkdirAll(outputDir, 0750)
+
+	model := "$PROBLEM run001\n$INPUT ID TIME DV\n$DATA ../acop.csv\n$INCLUDE covariates.inc\n"
+	ioutil.WriteFile(filepath.Join(dir, "run001.mod"), []byte(model), 0640)
+	ioutil.WriteFile(filepath.Join(outputDir, "run001.mod"), []byte(model), 0640)
+	ioutil.WriteFile(filepath.Join(dir, "acop.csv"), []byte("ID,TIME,DV\n"), 0640)
+	ioutil.WriteFile(filepath.Join(dir, "covariates.inc"), []byte("WT = 70\n"), 0640)
+	ioutil.WriteFile(filepath.Join(outputDir, "run001.lst"), []byte("MINIMIZATION SUCCESSFUL\n"), 0640)
+	ioutil.WriteFile(filepath.Join(outputDir, "run001.ext"), []byte("TABLE NO. 1\n"), 0640)
+	ioutil.WriteFile(filepath.Join(outputDir, nonmemExecutableName()), []byte("compiled"), 0750)
+
+	m := &NonMemModel{
+		Model:         "run001.mod",
+		OriginalModel: "run001.mod",
+		FileName:      "run001",
+		OriginalPath:  dir,
+		OutputDir:     outputDir,
+		DataPath:      "../acop.csv",
+		Configuration: configlib.Config{NMVersion: "nm74gf"},
+	}
+
+	digests := make(chan fileDigest)
+	go HashFileOnChannel(digests, filepath.Join(dir, "run001.mod"), "run001")
+	modelDigest := <-digests
+	go HashFileOnChannel(digests, hashableDataFile(m), "run001")
+	dataDigest := <-digests
+
+	executable, err := hashProvenanceFile(provenanceExecutable, outputDir, filepath.Join(outputDir, nonmemExecutableName()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifest, err := newProvenanceManifest(m, modelDigest, dataDigest, &executable)
+	if err != nil {
+		t.Fatalf("newProvenanceManifest() error = %s", err)
+	}
+
+	roles := make(map[string]string)
+	for _, f := range manifest.Files {
+		roles[f.Path] = f.Role
+	}
+
+	want := map[string]string{
+		"../run001.mod":        provenanceModel,
+		"../acop.csv":          provenanceData,
+		"../covariates.inc":    provenanceInclude,
+		nonmemExecutableName(): provenanceExecutable,
+		"run001.lst":           provenanceOutput,
+		"run001.ext":           provenanceOutput,
+	}
+
+	if !reflect.DeepEqual(roles, want) {
+		t.Errorf("newProvenanceManifest() recorded %v, want %v", roles, want)
+	}
+
+	//A data file which couldn't be hashed is left out rather than recorded without a digest
+	unhashed, err := newProvenanceManifest(m, modelDigest, fileDigest{}, &executable)
+	if err != nil {
+		t.Fatalf("newProvenanceManifest() error = %s", err)
+	}
+
+	for _, f := range unhashed.Files {
+		if f.Role == provenanceData {
+			t.Errorf("newProvenanceManifest() recorded the unhashed data file %+v", f)
+		}
+	}
+
+	if manifest.Environment.NMVersion != "nm74gf" || manifest.Environment.BBIVersion != VERSION || manifest.Environment.Hostname == "" {
+		t.Errorf("the environment was recorded as %+v", manifest.Environment)
+	}
+
+	if err = writeProvenanceManifest(outputDir, manifest); err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := verifyProvenance(outputDir)
+	if err != nil || provenanceDrifted(results) {
+		t.Fatalf("verifyProvenance() = %+v, %v", results, err)
+	}
+
+	//Removing the executable is left to the clean level, while changes to the inputs and outputs are drift
+	os.Remove(filepath.Join(outputDir, nonmemExecutableName()))
+	ioutil.WriteFile(filepath.Join(dir, "covariates.inc"), []byte("WT = 75\n"), 0640)
+	os.Remove(filepath.Join(outputDir, "run001.ext"))
+
+	results, err = verifyProvenance(outputDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	statuses := make(map[string]string)
+	for _, r := range results {
+		statuses[r.Path] = r.Status
+	}
+
+	wantStatuses := map[string]string{
+		"../run001.mod":        provenanceMatched,
+		"../acop.csv":          provenanceMatched,
+		"../covariates.inc":    provenanceChanged,
+		nonmemExecutableName(): provenanceCleaned,
+		"run001.lst":           provenanceMatched,
+		"run001.ext":           provenanceMissing,
+	}
+
+	if !reflect.DeepEqual(statuses, wantStatuses) || !provenanceDrifted(results) {
+		t.Errorf("verifyProvenance() = %v, want %v", statuses, wantStatuses)
+	}
+}
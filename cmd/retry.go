@@ -0,0 +1,238 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"time"
+
+	"bbi/configlib"
+	"github.com/metrumresearchgroup/turnstile"
+	log "github.com/sirupsen/logrus"
+)
+
+// gridAttemptVariable carries the attempt number into resubmitted grid jobs
+const gridAttemptVariable string = "BBI_ATTEMPT"
+
+// gridAttempt is set on the grid side of sge execution, where retries are resubmitted through the scheduler
+var gridAttempt int
+
+// errExecutionResubmitted is the outcome of a grid attempt whose retry was resubmitted. The model has neither failed nor
+// completed, as its outcome is that of the resubmitted job
+var errExecutionResubmitted = errors.New("the attempt failed transiently and was resubmitted to the grid")
+
+// defaultRetryPatterns are the transient signatures retried when retries are enabled without any retry_on patterns.
+// They are mostly NMTRAN failing to open or close files which are in use by another model
+var defaultRetryPatterns []string = []string{
+	`(?i)(unable|could not|cannot|can't) (to )?(open|read|close|access) (the )?file`,
+	`(?i)text file busy`,
+	`(?i)resource temporarily unavailable`,
+	`(?i)stale (nfs )?file handle`,
+}
+
+// executionAttempt records a single execution of a model for bbi_config.json
+type executionAttempt struct {
+	Attempt    int       `json:"attempt"`
+	Host       string    `json:"host,omitempty"`
+	Started    time.Time `json:"started"`
+	Finished   time.Time `json:"finished"`
+	Successful bool      `json:"successful"`
+	Error      string    `json:"error,omitempty"`
+	//Transient is the retry_on pattern matched by the output of a failed attempt
+	Transient string `json:"transient,omitempty"`
+	//Resubmitted is set on a grid attempt whose retry was submitted as a new job
+	Resubmitted bool `json:"resubmitted,omitempty"`
+}
+
+// retryPatterns compiles the retry_on patterns of the configuration, or the defaults if none are set
+func retryPatterns(config configlib.Config) ([]*regexp.Regexp, error) {
+	patterns := config.RetryOn
+
+	if len(patterns) == 0 {
+		patterns = defaultRetryPatterns
+	}
+
+	var compiled []*regexp.Regexp
+
+	for _, p := range patterns {
+		r, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("retry_on pattern %s is not a valid regular expression: %s", p, err)
+		}
+
+		compiled = append(compiled, r)
+	}
+
+	return compiled, nil
+}
+
+// transientFailure returns the first pattern matched by the output, or an empty string if the failure is not transient
+func transientFailure(output []byte, patterns []*regexp.Regexp) string {
+	for _, p := range patterns {
+		if p.Match(output) {
+			return p.String()
+		}
+	}
+
+	return ""
+}
+
+// retryDelay doubles the backoff for each attempt which has already failed
+func retryDelay(backoff time.Duration, attempt int) time.Duration {
+	if backoff <= 0 || attempt < 1 {
+		return 0
+	}
+
+	return backoff * time.Duration(1<<uint(attempt-1))
+}
+
+// executeWithRetries runs the executor, re-executing the model while its failures match a transient signature and
+// retries remain. On the grid side of sge execution the retry is resubmitted through the scheduler instead, and
+// errExecutionResubmitted is returned once it has been
+func executeWithRetries(executor func(model *NonMemModel) turnstile.ConcurrentError, model *NonMemModel) turnstile.ConcurrentError {
+	patterns, err := retryPatterns(model.Configuration)
+	if err != nil {
+		return newConcurrentError(model.Model, "Invalid retry policy", err)
+	}
+
+	host, _ := os.Hostname()
+
+	for {
+		attempt := len(model.Attempts) + 1
+		if gridAttempt > attempt {
+			attempt = gridAttempt
+		}
+
+		record := executionAttempt{
+			Attempt: attempt,
+			Host:    host,
+			Started: time.Now(),
+		}
+
+		cerr := executeNonMemJob(executor, model)
+
+		record.Finished = time.Now()
+		record.Successful = cerr.Error == nil
+
+		if cerr.Error == nil {
+			model.Attempts = append(model.Attempts, record)
+			return cerr
+		}
+
+		record.Error = cerr.Error.Error()
+
+		//Cancellations and timeouts are deliberate, so they are never retried
+		if !errors.Is(cerr.Error, errExecutionCancelled) && !errors.Is(cerr.Error, errMaxRuntimeExceeded) {
+			output, _ := ioutil.ReadFile(path.Join(model.OutputDir, model.Model+".out"))
+			record.Transient = transientFailure(output, patterns)
+		}
+
+		model.Attempts = append(model.Attempts, record)
+
+		if record.Transient == "" || attempt > model.Configuration.Retries {
+			if model.Configuration.Retries > 0 {
+				recordFailedAttempts(model)
+			}
+
+			return cerr
+		}
+
+		delay := retryDelay(model.Configuration.RetryBackoff, attempt)
+
+		if gridAttempt > 0 {
+			//The attempts are recorded before the new job can start and read them
+			model.Attempts[len(model.Attempts)-1].Resubmitted = true
+			recordFailedAttempts(model)
+
+			if err = resubmitGridJob(model, attempt+1, delay); err != nil {
+				model.Attempts[len(model.Attempts)-1].Resubmitted = false
+				recordFailedAttempts(model)
+
+				return newConcurrentError(model.Model, "The transient failure could not be resubmitted to the grid", err)
+			}
+
+			log.Warnf("%s Attempt %d failed transiently. Resubmitted to the grid as attempt %d", model.LogIdentifier(), attempt, attempt+1)
+
+			return newConcurrentError(model.Model, fmt.Sprintf("Attempt %d failed transiently and was resubmitted to the grid as attempt %d", attempt, attempt+1), fmt.Errorf("%w: %s", errExecutionResubmitted, cerr.Error))
+		}
+
+		log.Warnf("%s Attempt %d failed with output matching %s. Retrying in %s", model.LogIdentifier(), attempt, record.Transient, delay)
+
+		time.Sleep(delay)
+
+		if executionInterrupted() {
+			return newConcurrentError(model.Model, "Execution was cancelled", errExecutionCancelled)
+		}
+	}
+}
+
+// recordFailedAttempts writes bbi_config.json for a model which has not completed so its attempts are retained
+func recordFailedAttempts(model *NonMemModel) {
+	if err := writeNonmemConfig(model); err != nil {
+		log.Errorf("%s Unable to record the execution attempts: %s", model.LogIdentifier(), err)
+	}
+}
+
+// previousAttempts reads the attempts recorded in the bbi_config.json of an earlier grid attempt of the model
+func previousAttempts(model *NonMemModel) []executionAttempt {
+	outputDir := model.OutputDir
+	if !model.Configuration.Local.CreateChildDirs {
+		outputDir = model.OriginalPath
+	}
+
+	contents, err := ioutil.ReadFile(filepath.Join(outputDir, "bbi_config.json"))
+	if err != nil {
+		return nil
+	}
+
+	var previous struct {
+		Attempts []executionAttempt `json:"attempts"`
+	}
+
+	if err = json.Unmarshal(contents, &previous); err != nil {
+		return nil
+	}
+
+	return previous.Attempts
+}
+
+// resubmitGridJob submits the grid.sh of the model again as the provided attempt, held until the delay has passed
+func resubmitGridJob(model *NonMemModel, attempt int, delay time.Duration) error {
+	binary, err := exec.LookPath("qsub")
+	if err != nil {
+		return err
+	}
+
+	additional := []string{
+		"-v",
+		gridAttemptVariable + "=" + strconv.Itoa(attempt),
+	}
+
+	if delay > 0 {
+		additional = append(additional, "-a", time.Now().Add(delay).Format("200601021504.05"))
+	}
+
+	arguments, err := qsubArguments(model, filepath.Join(model.OriginalPath, "grid.sh"), additional...)
+	if err != nil {
+		return err
+	}
+
+	command := exec.Command(binary, arguments...)
+	command.Env = os.Environ()
+
+	log.Debugf("%s Resubmission command is: %s", model.LogIdentifier(), command.String())
+
+	output, err := command.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %s", err, output)
+	}
+
+	return nil
+}
@@ -0,0 +1,130 @@
+package cmd
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"bbi/configlib"
+	"github.com/metrumresearchgroup/turnstile"
+)
+
+func Test_retryDelay(t *testing.T) {
+	tests := []struct {
+		backoff time.Duration
+		attempt int
+		want    time.Duration
+	}{
+		{30 * time.Second, 1, 30 * time.Second},
+		{30 * time.Second, 3, 2 * time.Minute},
+		{0, 2, 0},
+	}
+	for _, tt := range tests {
+		if got := retryDelay(tt.backoff, tt.attempt); got != tt.want {
+			t.Errorf("retryDelay(%s, %d) = %s, want %s", tt.backoff, tt.attempt, got, tt.want)
+		}
+	}
+}
+
+func Test_transientFailure(t *testing.T) {
+	patterns, err := retryPatterns(configlib.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if transientFailure([]byte("AN ERROR WAS FOUND IN THE CONTROL STATEMENTS.\n UNABLE TO OPEN FILE FDATA"), patterns) == "" {
+		t.Errorf("transientFailure() did not match an NMTRAN file access error with the default patterns")
+	}
+
+	if transientFailure([]byte("AN ERROR WAS FOUND IN THE CONTROL STATEMENTS.\n THETA(3) IS NOT DEFINED"), patterns) != "" {
+		t.Errorf("transientFailure() matched a model error")
+	}
+
+	if _, err = retryPatterns(configlib.Config{RetryOn: []string{"("}}); err == nil {
+		t.Errorf("retryPatterns() accepted an invalid regular expression")
+	}
+}
+
+func Test_executeWithRetries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bbi_retry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	//Fails with the provided outputs in order, then succeeds
+	failing := func(outputs ...string) func(model *NonMemModel) turnstile.ConcurrentError {
+		return func(model *NonMemModel) turnstile.ConcurrentError {
+			if len(outputs) == 0 {
+				return turnstile.ConcurrentError{}
+			}
+
+			ioutil.WriteFile(filepath.Join(model.OutputDir, model.Model+".out"), []byte(outputs[0]), 0640)
+			outputs = outputs[1:]
+
+			return newConcurrentError(model.Model, "failed", errors.New("exit status 1"))
+		}
+	}
+
+	model := func(retries int) *NonMemModel {
+		return &NonMemModel{
+			Model:        "run001.mod",
+			OutputDir:    dir,
+			OriginalPath: dir,
+			Configuration: configlib.Config{
+				Retries: retries,
+			},
+		}
+	}
+
+	m := model(2)
+	cerr := executeWithRetries(failing("text file busy", "Text file busy"), m)
+	if cerr.Error != nil || len(m.Attempts) != 3 || !m.Attempts[2].Successful || m.Attempts[0].Transient == "" {
+		t.Errorf("executeWithRetries() = %v with attempts %+v. Want success on the third attempt", cerr.Error, m.Attempts)
+	}
+
+	m = model(1)
+	cerr = executeWithRetries(failing("text file busy", "text file busy"), m)
+	if cerr.Error == nil || len(m.Attempts) != 2 {
+		t.Errorf("executeWithRetries() = %v with %d attempts. Want failure after 2 attempts", cerr.Error, len(m.Attempts))
+	}
+
+	if previous := previousAttempts(m); len(previous) != 2 {
+		t.Errorf("previousAttempts() = %+v. Want the 2 failed attempts recorded in bbi_config.json", previous)
+	}
+
+	m = model(3)
+	cerr = executeWithRetries(failing("THETA(3) IS NOT DEFINED"), m)
+	if cerr.Error == nil || len(m.Attempts) != 1 {
+		t.Errorf("executeWithRetries() retried a failure which is not transient: %d attempts", len(m.Attempts))
+	}
+
+	//On the grid, the retry is submitted as a new job which reports the outcome of the model
+	submitted := filepath.Join(dir, "submitted")
+	ioutil.WriteFile(filepath.Join(dir, "qsub"), []byte("#!/bin/sh\necho \"$@\" > "+submitted+"\n"), 0750)
+
+	previousPath := os.Getenv("PATH")
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+previousPath)
+	defer os.Setenv("PATH", previousPath)
+
+	gridAttempt = 1
+	defer func() { gridAttempt = 0 }()
+
+	m = model(2)
+	cerr = executeWithRetries(failing("text file busy"), m)
+	if !errors.Is(cerr.Error, errExecutionResubmitted) || len(m.Attempts) != 1 || !m.Attempts[0].Resubmitted {
+		t.Errorf("executeWithRetries() = %v with attempts %+v. Want the first attempt resubmitted", cerr.Error, m.Attempts)
+	}
+
+	if arguments, _ := ioutil.ReadFile(submitted); !strings.Contains(string(arguments), gridAttemptVariable+"=2") {
+		t.Errorf("executeWithRetries() submitted %s, want attempt 2", arguments)
+	}
+
+	if failed, cancelled := partitionCancellations([]turnstile.ConcurrentError{cerr}); len(failed) != 0 || len(cancelled) != 0 {
+		t.Errorf("partitionCancellations() counted the resubmitted attempt as failed or cancelled")
+	}
+}
@@ -48,6 +48,8 @@ var (
 	Json               bool
 	preview            bool
 	executionWaitGroup sync.WaitGroup
+	//logFileOutput is the log file configured through log_file, if any
+	logFileOutput io.Writer
 )
 
 // RootCmd represents the base command when called without any subcommands
@@ -64,6 +66,12 @@ func Execute(build string) {
 		VERSION = fmt.Sprintf("%s-%s", VERSION, build)
 	}
 	RootCmd.Long = fmt.Sprintf("bbi cli version %s", VERSION)
+
+	//Flags for renamed settings are still accepted under their former names, such as --cacheDir
+	RootCmd.SetGlobalNormalizationFunc(func(f *flag.FlagSet, name string) flag.NormalizedName {
+		return flag.NormalizedName(configlib.RenamedKey(name))
+	})
+
 	if err := RootCmd.Execute(); err != nil {
 		fmt.Println(err)
 		os.Exit(-1)
@@ -92,6 +100,10 @@ func init() {
 	RootCmd.PersistentFlags().BoolVar(&Json, "json", false, "json tree of output, if possible")
 	viper.BindPFlag("json", RootCmd.PersistentFlags().Lookup("json")) //Bind to viper
 	RootCmd.PersistentFlags().BoolVarP(&preview, "preview", "p", false, "preview action, but don't actually run command")
+	RootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "Path (relative or absolute) to another bbi.yaml to load over the system, user and project configuration")
+	viper.BindPFlag("config", RootCmd.PersistentFlags().Lookup("config"))
+	RootCmd.PersistentFlags().String("profile", "", "Name of a profile from the profiles of bbi.yaml to apply over the configuration files")
+	viper.BindPFlag("profile", RootCmd.PersistentFlags().Lookup("profile"))
 }
 
 // initConfig reads in config file and ENV variables if set.
@@ -128,7 +140,8 @@ func logSetup(config configlib.Config) {
 		log.SetFormatter(&log.JSONFormatter{})
 	}
 
-	if len(config.Logfile) > 0 {
+	//Previews leave the disk untouched, so nothing is written to the logfile
+	if len(config.Logfile) > 0 && !preview {
 		log.Debugf("A logfile has been specified at %s", config.Logfile)
 		logfile := config.Logfile
 
@@ -163,15 +176,31 @@ func logSetup(config configlib.Config) {
 			outfile = of
 		}
 
-		tee := io.MultiWriter(outfile, os.Stdout)
+		logFileOutput = outfile
+		tee := io.MultiWriter(outfile, consoleOutput())
 		log.SetOutput(tee)
 	}
 }
 
 //RecordConcurrentError handles the processing of cancellation messages as well placing concurrent errors onto the stack
 func RecordConcurrentError(model string, notes string, err error, channels *turnstile.ChannelMap, cancel chan bool, executor PostWorkExecutor) {
+	//The batch may be considered complete as soon as the error is recorded, so it must wait on the hooks from here
+	executionWaitGroup.Add(1)
+	defer executionWaitGroup.Done()
+
+	recordFailure(model, notes, err, channels, cancel, executor)
+
+	//The model has already failed, so a failed required hook changes nothing
+	PostWorkExecution(executor, false, err)
+}
+
+//recordFailure places the error onto the stack without running the post work hooks, which have either run already or
+//are run by the caller
+func recordFailure(model string, notes string, err error, channels *turnstile.ChannelMap, cancel chan bool, executor PostWorkExecutor) {
 	cancel <- true
 	channels.Errors <- newConcurrentError(model, notes, err)
 
-	PostWorkExecution(executor, model, channels, cancel, false, err)
+	dashboard.Failed(model, err)
+	events.Failed(model, notes, err)
+	notifyFailure(executor.GetGlobalConfig(), executor.GetPostWorkConfig(), model, notes, err)
 }
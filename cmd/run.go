@@ -3,10 +3,10 @@ package cmd
 import (
 	"bbi/configlib"
 	"bytes"
-	"github.com/metrumresearchgroup/turnstile"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
@@ -14,6 +14,7 @@ import (
 	"strconv"
 	"strings"
 	"text/template"
+	"time"
 )
 
 const runLongDescription string = `run nonmem model(s), for example: 
@@ -21,13 +22,14 @@ bbi nonmem run <local|sge> run001.mod
 bbi nonmem run  --clean_lvl=1 <local|sge> run001.mod run002.mod
 bbi nonmem run <local|sge> run[001:006].mod // expand to run001.mod run002.mod ... run006.mod local
 bbi nonmem run <local|sge> .// run all models in directory
+bbi nonmem run local --workflow pipeline.yaml // run models in dependency order
  `
 
 const postProcessingScriptTemplate string = `#!/bin/bash
 
 ###################
 #
-# bbi post-processing script
+# bbi {{ .Stage }}-processing script
 # 
 # Please note that the environment variables written here
 # do not represent all used during execution. Private variables,
@@ -46,7 +48,7 @@ const postProcessingScriptTemplate string = `#!/bin/bash
 
 ###################
 #
-# Below is the actual post execution target.
+# Below is the actual {{ .Stage }} execution target.
 #
 ###################
 {{ .Script }}
@@ -67,14 +69,17 @@ func run(cmd *cobra.Command, args []string) {
 func init() {
 
 	//String Variables
-	// runCmd.PersistentFlags().String("cacheDir", "", "directory path for cache of nonmem executables for NM7.4+")
-	// viper.BindPFlag("cacheDir", runCmd.PersistentFlags().Lookup("cacheDir"))
+	runCmd.PersistentFlags().String("cache_dir", "", "directory path for cache of nonmem executables for NM7.4+")
+	viper.BindPFlag("cache_dir", runCmd.PersistentFlags().Lookup("cache_dir"))
 
-	// runCmd.PersistentFlags().String("cacheExe", "", "name of executable stored in cache")
-	// viper.BindPFlag("cacheExe", runCmd.PersistentFlags().Lookup("cacheExe"))
+	runCmd.PersistentFlags().String("cache_exe", "", "name of executable stored in cache")
+	viper.BindPFlag("cache_exe", runCmd.PersistentFlags().Lookup("cache_exe"))
 
-	// runCmd.PersistentFlags().String("saveExe", "", "what to name the executable when stored in cache")
-	// viper.BindPFlag("saveExe", runCmd.PersistentFlags().Lookup("saveExe"))
+	runCmd.PersistentFlags().String("save_exe", "", "what to name the executable when stored in cache")
+	viper.BindPFlag("save_exe", runCmd.PersistentFlags().Lookup("save_exe"))
+
+	runCmd.PersistentFlags().Int("cache_max_entries", 50, "maximum number of compiled executables to keep in the cache. The least recently used are evicted first. 0 disables eviction")
+	viper.BindPFlag("cache_max_entries", runCmd.PersistentFlags().Lookup("cache_max_entries"))
 
 	runCmd.PersistentFlags().String("output_dir", "{{ .Name }}", "Go template for the output directory to use for storging details of each executed model")
 	viper.BindPFlag("output_dir", runCmd.PersistentFlags().Lookup("output_dir"))
@@ -103,9 +108,15 @@ func init() {
 	viper.BindPFlag("overwrite", runCmd.PersistentFlags().Lookup("overwrite"))
 	viper.SetDefault("overwrite", false)
 
-	const configIdentifier string = "config"
-	runCmd.PersistentFlags().String(configIdentifier, "", "Path (relative or absolute) to another bbi.yaml to load")
-	viper.BindPFlag(configIdentifier, runCmd.PersistentFlags().Lookup(configIdentifier))
+	runCmd.PersistentFlags().Bool("archive", false, "Whether or not to move existing output directories into the history of their model before re-running it. Takes precedence over overwrite")
+	viper.BindPFlag("archive", runCmd.PersistentFlags().Lookup("archive"))
+
+	runCmd.PersistentFlags().String("archive_format", archiveFormatDir, "How archived output directories are stored: dir to move them as they are, or tar.gz for a compressed tarball")
+	viper.BindPFlag("archive_format", runCmd.PersistentFlags().Lookup("archive_format"))
+
+	const forceIdentifier string = "force"
+	runCmd.PersistentFlags().Bool(forceIdentifier, false, "Execute models even if their model, data and nonmem settings are unchanged since their last successful run")
+	viper.BindPFlag(forceIdentifier, runCmd.PersistentFlags().Lookup(forceIdentifier))
 
 	const saveconfig string = "save_config"
 	runCmd.PersistentFlags().Bool(saveconfig, true, "Whether or not to save the existing configuration to a file with the model")
@@ -115,6 +126,25 @@ func init() {
 	runCmd.PersistentFlags().Int(delayIdentifier, 0, "Selects a random number of seconds between 1 and this value to stagger / jitter job execution. Assists in dealing with large volumes of work dealing with the same data set. May avoid NMTRAN issues about not being able read / close files")
 	viper.BindPFlag(delayIdentifier, runCmd.PersistentFlags().Lookup(delayIdentifier))
 
+	const maxRuntimeIdentifier string = "max_runtime"
+	runCmd.PersistentFlags().Duration(maxRuntimeIdentifier, 0, "Maximum wall clock time for the execution of each model (ie 36h). Models still running are terminated and recorded as failed. 0 is unlimited")
+	viper.BindPFlag(maxRuntimeIdentifier, runCmd.PersistentFlags().Lookup(maxRuntimeIdentifier))
+
+	const retriesIdentifier string = "retries"
+	runCmd.PersistentFlags().Int(retriesIdentifier, 0, "Number of times to re-execute a model whose failure output matches a retry_on pattern")
+	viper.BindPFlag(retriesIdentifier, runCmd.PersistentFlags().Lookup(retriesIdentifier))
+
+	const retryBackoffIdentifier string = "retry_backoff"
+	runCmd.PersistentFlags().Duration(retryBackoffIdentifier, 30*time.Second, "Time to wait before the first retry. Doubled for each subsequent retry")
+	viper.BindPFlag(retryBackoffIdentifier, runCmd.PersistentFlags().Lookup(retryBackoffIdentifier))
+
+	const retryOnIdentifier string = "retry_on"
+	runCmd.PersistentFlags().StringSlice(retryOnIdentifier, []string{}, "Regular expressions matched against the output of a failed model to identify transient failures. Defaults to common NMTRAN file access errors")
+	viper.BindPFlag(retryOnIdentifier, runCmd.PersistentFlags().Lookup(retryOnIdentifier))
+
+	runCmd.PersistentFlags().BoolVar(&tuiEnabled, "tui", false, "Display a full screen dashboard of the phase, elapsed time and latest OFV of each model. Plain logs are used when stdout is not a terminal")
+	runCmd.PersistentFlags().StringVar(&eventsTarget, "events", "", "Write JSON lines lifecycle events for each model to a file, an inherited file descriptor (fd:3) or stdout (-)")
+
 	const logFileIdentifier string = "log_file"
 	runCmd.PersistentFlags().String(logFileIdentifier, "", "If populated, specifies the file into which to store the output / logging details from bbi")
 	viper.BindPFlag(logFileIdentifier, runCmd.PersistentFlags().Lookup(logFileIdentifier))
@@ -123,6 +153,14 @@ func init() {
 	runCmd.PersistentFlags().String(postExecutionHookIdentifier, "", "A script or binary to run when job execution completes or fails")
 	viper.BindPFlag(postExecutionHookIdentifier, runCmd.PersistentFlags().Lookup(postExecutionHookIdentifier))
 
+	const hookConcurrencyIdentifier string = "post_work_concurrency"
+	runCmd.PersistentFlags().Int(hookConcurrencyIdentifier, 0, "Maximum number of post work hooks running at once across the batch. 0 is bounded only by the threads")
+	viper.BindPFlag(hookConcurrencyIdentifier, runCmd.PersistentFlags().Lookup(hookConcurrencyIdentifier))
+
+	const preExecutionHookIdentifier string = "pre_work_executable"
+	runCmd.PersistentFlags().String(preExecutionHookIdentifier, "", "A script or binary to run in the output directory before nmfe. A non-zero exit fails the model")
+	viper.BindPFlag(preExecutionHookIdentifier, runCmd.PersistentFlags().Lookup(preExecutionHookIdentifier))
+
 	const additionalEnvIdentifier string = "additional_post_work_envs"
 	runCmd.PersistentFlags().StringSlice(additionalEnvIdentifier, []string{}, "Any additional values (as ENV KEY=VALUE) to provide for the post execution environment")
 	viper.BindPFlag(additionalEnvIdentifier, runCmd.PersistentFlags().Lookup(additionalEnvIdentifier))
@@ -134,9 +172,9 @@ func init() {
 type PostWorkExecutor interface {
 	BuildExecutionEnvironment(completed bool, err error) //Sets the Struct content for the PostExecutionHookEnvironment
 	GetPostWorkConfig() *PostExecutionHookEnvironment
-	GetPostWorkExecutablePath() string
 	GetGlobalConfig() configlib.Config
 	GetWorkingPath() string
+	GetModel() *NonMemModel
 }
 
 type PostExecutionHookEnvironment struct {
@@ -185,52 +223,78 @@ func PostExecutionEnvironment(directive *PostExecutionHookEnvironment, additiona
 	return executionEnvironment, nil
 }
 
-func PostWorkExecution(job PostWorkExecutor, filename string, channels *turnstile.ChannelMap, cancel chan bool, successful bool, err error) {
-	config := job.GetGlobalConfig()
-	if config.PostWorkExecutable != "" {
-		log.Debug("Beginning execution of post work hooks")
-		executionWaitGroup.Add(1)
-		job.BuildExecutionEnvironment(successful, err)
+// PostWorkExecution runs the post work hooks of the model in order once it has completed or failed. Their results are
+// recorded in the bbi_config.json of models which began executing, and an error is returned if a required hook failed
+func PostWorkExecution(job PostWorkExecutor, successful bool, err error) error {
+	if len(postWorkHooks(job.GetGlobalConfig())) == 0 {
+		return nil
+	}
+
+	log.Debug("Beginning execution of post work hooks")
+	job.BuildExecutionEnvironment(successful, err)
+
+	results, herr := runPostWorkHooks(job)
+
+	model := job.GetModel()
+	model.PostWorkHooks = results
+
+	for _, r := range results {
+		events.PostHookResult(job.GetPostWorkConfig(), r)
+	}
 
-		type executionStatus struct {
-			output string
-			err    error
+	//Models which failed before executing may share their output directory with an earlier run, whose record is kept.
+	//The pre work executable only runs once the output directory has been prepared for this run
+	if successful || model.executed || model.PreWork != nil {
+		if werr := writeNonmemConfig(model); werr != nil {
+			log.Errorf("%s Unable to record the results of the post work hooks: %s", model.LogIdentifier(), werr)
 		}
+	}
+
+	return herr
+}
+
+// ExecutePreWorkDirectivesWithEnvironment runs the pre work executable in the output directory of the model before nmfe,
+// with the same environment as the post work executable. Its output is captured into pre_processing.out, and its
+// outcome is recorded on the model
+func ExecutePreWorkDirectivesWithEnvironment(worker PostWorkExecutor) (string, error) {
+	log.Debug("Beginning Execution of pre work scripts")
 
-		executionChannel := make(chan executionStatus, 1)
-
-		go func() {
-			for {
-				select {
-				//Failure processing
-				case status := <-executionChannel:
-					if status.err != nil {
-						job.BuildExecutionEnvironment(false, status.err)
-					}
-
-					executionWaitGroup.Done()
-				default:
-					//
-				}
-			}
-		}()
-
-		go func() {
-			output, err := ExecutePostWorkDirectivesWithEnvironment(job)
-			es := executionStatus{
-				output: output,
-				err:    err,
-			}
-			executionChannel <- es
-		}()
+	//Models are no longer started once bbi has been interrupted
+	if executionInterrupted() {
+		return "", errExecutionCancelled
 	}
+
+	var output bytes.Buffer
+
+	result := &hookResult{
+		Name:       preWorkHookName,
+		Executable: worker.GetGlobalConfig().PreWorkExecutable,
+		Required:   true,
+		Started:    time.Now(),
+		Stdout:     filepath.Join(worker.GetWorkingPath(), "pre_processing.out"),
+	}
+
+	script := filepath.Join(worker.GetWorkingPath(), "pre_processing.sh")
+	err := executeHookScript(worker, result.Executable, script, "pre", 0, &output, &output)
+
+	result.DurationSeconds = time.Since(result.Started).Seconds()
+	if err != nil {
+		result.recordError(err)
+	}
+	worker.GetModel().PreWork = result
+
+	if werr := ioutil.WriteFile(result.Stdout, output.Bytes(), 0640); werr != nil {
+		log.Errorf("Unable to write the output of the pre work executable into %s: %s", worker.GetWorkingPath(), werr)
+	}
+
+	return output.String(), err
 }
 
-func ExecutePostWorkDirectivesWithEnvironment(worker PostWorkExecutor) (string, error) {
-	log.Debug("Beginning Execution of post work scripts")
+// executeHookScript writes a script exporting the BBI_ environment of the model, which then runs the executable in the
+// output directory. A timeout of 0 places no limit on its execution
+func executeHookScript(worker PostWorkExecutor, toExecute string, script string, stage string, timeout time.Duration, stdout io.Writer, stderr io.Writer) error {
 	var outBytesBuffer = new(bytes.Buffer)
 
-	toExecute := worker.GetPostWorkExecutablePath()
 	config := worker.GetGlobalConfig()
 	postworkConfig := worker.GetPostWorkConfig()
 	postWorkEnv := config.GetPostWorkExecEnvs()
@@ -251,25 +315,27 @@ func ExecutePostWorkDirectivesWithEnvironment(worker PostWorkExecutor) (string,
 	environmentToPersist := onlyBbiVariables(environment)
 
 	if err != nil {
-		return "", err
+		return err
 	}
 
 	log.Debug("Beginning template operations")
 
-	tmpl, err := template.New("post_processing").Parse(postProcessingScriptTemplate)
+	tmpl, err := template.New(stage + "_processing").Parse(postProcessingScriptTemplate)
 
 	if err != nil {
-		return "", err
+		return err
 	}
 
 	type postProcessingDetails struct {
 		EnvironmentVariables []string
 		Script               string
+		Stage                string
 	}
 
 	ppd := postProcessingDetails{
 		EnvironmentVariables: environmentToPersist,
 		Script:               toExecute,
+		Stage:                stage,
 	}
 
 	log.Debugf("Fully qualified path to executable is %s", toExecute)
@@ -281,7 +347,7 @@ func ExecutePostWorkDirectivesWithEnvironment(worker PostWorkExecutor) (string,
 	err = tmpl.Execute(outBytesBuffer, ppd)
 
 	if err != nil {
-		return "", err
+		return err
 	}
 
 	processedBytes := outBytesBuffer.Bytes()
@@ -290,14 +356,17 @@ func ExecutePostWorkDirectivesWithEnvironment(worker PostWorkExecutor) (string,
 		"rendered": string(processedBytes),
 	}).Debug("Writing contents to file in output directory")
 
-	err = ioutil.WriteFile(filepath.Join(worker.GetWorkingPath(), "post_processing.sh"), processedBytes, 0755)
+	err = ioutil.WriteFile(script, processedBytes, 0755)
 
 	if err != nil {
-		return "", err
+		return err
 	}
 
 	//Needs to be the processed value, not the config template.
-	cmd := exec.Command(filepath.Join(worker.GetWorkingPath(), "post_processing.sh"))
+	cmd := exec.Command(script)
+	cmd.Dir = worker.GetWorkingPath()
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
 
 	//Set the environment for the binary.
 	cmd.Env = environment
@@ -308,9 +377,8 @@ func ExecutePostWorkDirectivesWithEnvironment(worker PostWorkExecutor) (string,
 
 	log.Debugf("Command will be %s", cmd.String())
 
-	outputBytes, err := cmd.CombinedOutput()
-
-	log.Debugf("Output from command was %s", string(outputBytes))
+	//Hooks run in their own process group, tracked apart from the models so that they still run for cancelled models
+	err = waitHookCommand(script, cmd, timeout)
 
 	if err != nil {
 		if exitError, ok := err.(*exec.ExitError); ok {
@@ -318,11 +386,10 @@ func ExecutePostWorkDirectivesWithEnvironment(worker PostWorkExecutor) (string,
 			details := exitError.String()
 
 			log.Errorf("Exit code was %d, details were %s", code, details)
-			log.Errorf("output details were: %s", string(outputBytes))
 		}
 	}
 
-	return string(outputBytes), err
+	return err
 }
 
 func onlyBbiVariables(provided []string) []string {
@@ -0,0 +1,73 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"bbi/configlib"
+)
+
+func Test_ExecutePreWorkDirectivesWithEnvironment(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bbi_prework")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dir, _ = filepath.EvalSymlinks(dir)
+
+	succeeds := filepath.Join(dir, "extract.sh")
+	ioutil.WriteFile(succeeds, []byte("#!/bin/sh\necho \"$BBI_MODEL in $(pwd)\"\n"), 0750)
+
+	fails := filepath.Join(dir, "validate.sh")
+	ioutil.WriteFile(fails, []byte("#!/bin/sh\necho invalid data\nexit 3\n"), 0750)
+
+	outputDir := filepath.Join(dir, "run001")
+	os.Mkdir(outputDir, 0750)
+
+	model := &LocalModel{
+		Nonmem: &NonMemModel{
+			Model:         "run001.mod",
+			FileName:      "run001",
+			OutputDir:     outputDir,
+			Configuration: configlib.Config{PreWorkExecutable: succeeds},
+		},
+	}
+	model.BuildExecutionEnvironment(false, nil)
+
+	output, err := ExecutePreWorkDirectivesWithEnvironment(model)
+	if err != nil {
+		t.Fatalf("ExecutePreWorkDirectivesWithEnvironment() returned an error: %s", err)
+	}
+
+	if r := model.Nonmem.PreWork; r == nil || r.Failed() || r.Name != preWorkHookName {
+		t.Errorf("ExecutePreWorkDirectivesWithEnvironment() recorded %+v, want a successful pre work executable", r)
+	}
+
+	if want := "run001.mod in " + outputDir; strings.TrimSpace(output) != want {
+		t.Errorf("ExecutePreWorkDirectivesWithEnvironment() output = %s, want %s", output, want)
+	}
+
+	for _, f := range []string{"pre_processing.sh", "pre_processing.out"} {
+		if _, err := os.Stat(filepath.Join(outputDir, f)); err != nil {
+			t.Errorf("%s was not written into the output directory", f)
+		}
+	}
+
+	model.Nonmem.Configuration.PreWorkExecutable = fails
+
+	if _, err := ExecutePreWorkDirectivesWithEnvironment(model); err == nil {
+		t.Errorf("ExecutePreWorkDirectivesWithEnvironment() did not return the non-zero exit of the executable")
+	}
+
+	if captured, _ := ioutil.ReadFile(filepath.Join(outputDir, "pre_processing.out")); strings.TrimSpace(string(captured)) != "invalid data" {
+		t.Errorf("pre_processing.out = %s, want the output of the failed executable", captured)
+	}
+
+	if r := model.Nonmem.PreWork; r == nil || r.ExitCode != 3 || !r.Failed() || r.Executable != fails {
+		t.Errorf("ExecutePreWorkDirectivesWithEnvironment() recorded %+v, want the exit of the failed executable", r)
+	}
+}
@@ -30,9 +30,9 @@ var scaffoldCmd = &cobra.Command{
 	Use:   "scaffold",
 	Short: "scaffold directory structures",
 	Long: `
-	nmu scaffold --cacheDir=nmcache
+	nmu scaffold --cache_dir=nmcache
 
-	nmu scaffold --cacheDir=../nmcache --preview // show where the cache dir would be created
+	nmu scaffold --cache_dir=../nmcache --preview // show where the cache dir would be created
  `,
 	RunE: scaffold,
 }
@@ -46,8 +46,14 @@ func scaffold(cmd *cobra.Command, args []string) error {
 
 	dir, _ := filepath.Abs(".")
 
-	if viper.GetString("cacheDir") != "" {
-		cache := filepath.Clean(filepath.Join(dir, viper.GetString("cacheDir")))
+	//cache_dir is bound to the run flags, so prefer the value provided here if there is one
+	cacheDir := viper.GetString("cache_dir")
+	if flagChanged(cmd.Flags(), "cache_dir") {
+		cacheDir, _ = cmd.Flags().GetString("cache_dir")
+	}
+
+	if cacheDir != "" {
+		cache := filepath.Clean(filepath.Join(dir, cacheDir))
 		if preview {
 			fmt.Println(fmt.Sprintf("would create cache dir at: %s", cache))
 			return nil
@@ -79,6 +85,5 @@ func scaffold(cmd *cobra.Command, args []string) error {
 }
 func init() {
 	nonmemCmd.AddCommand(scaffoldCmd)
-	scaffoldCmd.Flags().String("cacheDir", "", "create cache directory at path/name")
-	viper.BindPFlag("cacheDir", scaffoldCmd.Flags().Lookup("cacheDir"))
+	scaffoldCmd.Flags().String("cache_dir", "", "create cache directory at path/name")
 }
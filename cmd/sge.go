@@ -50,8 +50,8 @@ func (s *SGEModel) GetPostWorkConfig() *PostExecutionHookEnvironment {
 	return s.postworkInstructions
 }
 
-func (s *SGEModel) GetPostWorkExecutablePath() string {
-	return s.Nonmem.Configuration.PostWorkExecutable
+func (s *SGEModel) GetModel() *NonMemModel {
+	return s.Nonmem
 }
 
 func (s *SGEModel) GetGlobalConfig() configlib.Config {
@@ -74,6 +74,8 @@ func (l SGEModel) Prepare(channels *turnstile.ChannelMap) {
 	//Mark the model as started some work
 	channels.Working <- 1
 
+	dashboard.Phase(l.Nonmem, phasePrepare)
+
 	fs := afero.NewOsFs()
 
 	log.Debugf("%s Overwrite is currrently set to %t", l.Nonmem.LogIdentifier(), l.Nonmem.Configuration.Overwrite)
@@ -113,11 +115,16 @@ func (l SGEModel) Prepare(channels *turnstile.ChannelMap) {
 		p := &l
 		p.BuildExecutionEnvironment(false, err)
 		RecordConcurrentError(p.Nonmem.Model, "There was an issue writing the executable file", err, channels, p.Cancel, p)
+		return
 	}
+
+	events.Model(eventModelPrepared, l.Nonmem)
 }
 
 //Work describes the Turnstile execution phase -> IE What heavy lifting should be done
 func (l SGEModel) Work(channels *turnstile.ChannelMap) {
+	dashboard.Phase(l.Nonmem, phaseWork)
+
 	cerr := executeNonMemJob(executeSGEJob, l.Nonmem)
 
 	if cerr.Error != nil {
@@ -129,6 +136,7 @@ func (l SGEModel) Work(channels *turnstile.ChannelMap) {
 
 	log.Debugf("%s Work is completed. Updating turnstile channels", l.Nonmem.LogIdentifier())
 	log.Debugf("%s No monitor or cleanup phases currently exist for SGE Job. Work completed", l.Nonmem.LogIdentifier())
+	dashboard.Phase(l.Nonmem, phaseSubmitted)
 	channels.Completed <- 1
 }
 
@@ -172,6 +180,10 @@ func init() {
 	const gridNamePrefixIdentifier string = "grid_name_prefix"
 	sgeCMD.PersistentFlags().String(gridNamePrefixIdentifier, "", "Any prefix you wish to add to the name of jobs being submitted to the grid")
 	viper.BindPFlag(gridNamePrefixIdentifier, sgeCMD.PersistentFlags().Lookup(gridNamePrefixIdentifier))
+
+	const parallelEnvironmentIdentifier string = "parallel_environment"
+	sgeCMD.PersistentFlags().String(parallelEnvironmentIdentifier, "orte", "Parallel environment to request for parallel jobs. Use one whose allocation rule spans hosts to run on several nodes")
+	viper.BindPFlag(parallelEnvironmentIdentifier, sgeCMD.PersistentFlags().Lookup(parallelEnvironmentIdentifier))
 }
 
 func sge(cmd *cobra.Command, args []string) {
@@ -187,16 +199,46 @@ func sge(cmd *cobra.Command, args []string) {
 
 	logSetup(config)
 
+	if err := validateConfiguredParaFile(config); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := validatePostWorkHooks(config); err != nil {
+		log.Fatal(err)
+	}
+
 	log.Debug("Searching for models based on arguments")
 	lomodels, err := sgeModelsFromArguments(args, config)
 	if err != nil {
 		log.Fatalf("An error occurred during model processing: %s", err)
 	}
 
-	lo.Models = lomodels
+	if len(lomodels) == 0 {
+		log.Fatal("No models were located or loaded. Please verify the arguments provided and try again")
+	}
+
+	if preview {
+		var planned []*NonMemModel
+		for _, m := range lomodels {
+			planned = append(planned, m.Nonmem)
+		}
+
+		previewExecution("sge", planned, viper.GetBool("json"))
+		return
+	}
+
+	for _, m := range lomodels {
+		if current, _ := previousRunIsCurrent(m.Nonmem); current && !m.Nonmem.Configuration.Force {
+			log.Infof("%s Outputs match the current model, data and nonmem settings. Skipping", m.Nonmem.LogIdentifier())
+			continue
+		}
+
+		lo.Models = append(lo.Models, m)
+	}
 
 	if len(lo.Models) == 0 {
-		log.Fatal("No models were located or loaded. Please verify the arguments provided and try again")
+		log.Info("All models are unchanged since their last successful run. Use --force to execute them anyway")
+		return
 	}
 
 	//Models Added
@@ -215,6 +257,17 @@ func sge(cmd *cobra.Command, args []string) {
 
 	now := time.Now()
 
+	var dashboardModels []*NonMemModel
+	for _, v := range lo.Models {
+		dashboardModels = append(dashboardModels, v.Nonmem)
+	}
+
+	dashboard = startDashboard(dashboardModels)
+
+	startEventStream()
+
+	events.BatchStarted(dashboardModels)
+
 	log.Debug("Beginning execution")
 	go m.Execute()
 
@@ -233,6 +286,11 @@ func sge(cmd *cobra.Command, args []string) {
 		time.Sleep(5 * time.Millisecond)
 	}
 
+	dashboard.Stop()
+
+	events.BatchFinished(len(lo.Models), m.ErrorList)
+	events.Close()
+
 	//Double check to make sure nothing has been read in before trying to write to a file
 	if len(lo.Models) > 0 && viper.ConfigFileUsed() != "" {
 		configlib.SaveConfig(lo.Models[0].Nonmem.OriginalPath)
@@ -240,8 +298,10 @@ func sge(cmd *cobra.Command, args []string) {
 
 	postWorkNotice(m, now)
 
-	if len(m.ErrorList) > 0 {
-		os.Exit(1)
+	notifyBatch(config, "sge", phaseSubmitted, dashboardModels, m, now)
+
+	if code := batchExitCode(m); code != 0 {
+		os.Exit(code)
 	}
 }
 
@@ -258,40 +318,17 @@ func executeSGEJob(model *NonMemModel) turnstile.ConcurrentError {
 	fs := afero.NewOsFs()
 	//Execute the script we created
 
-	//Compute the grid name for submission
-	submittedName, err := gridengineJobName(model)
-
-	if err != nil {
-		return newConcurrentError(model.FileName, "Failed to template out name for job submission", err)
-	}
-
-	scriptName := "grid.sh"
-
 	//Find Qsub
 	binary, err := exec.LookPath("qsub")
 
-	qsubArguments := []string{}
-
-	qsubArguments = append(qsubArguments, []string{
-		"-V",
-		"-j",
-		"y",
-		"-N",
-		submittedName,
-	}...)
-
-	if model.Configuration.Parallel {
-		qsubArguments = append(qsubArguments, []string{
-			"-pe",  // Parallel execution
-			"orte", // Parallel environment name for the grid (Namespace for mpi messages)
-			strconv.Itoa(model.Configuration.Threads),
-		}...)
+	if err != nil {
+		return newConcurrentError(model.Model, "Could not locate qsub binary in path", err)
 	}
 
-	qsubArguments = append(qsubArguments, filepath.Join(model.OutputDir, scriptName))
+	qsubArguments, err := qsubArguments(model, filepath.Join(model.OutputDir, "grid.sh"))
 
 	if err != nil {
-		return newConcurrentError(model.Model, "Could not locate qsub binary in path", err)
+		return newConcurrentError(model.FileName, "Failed to template out name for job submission", err)
 	}
 
 	command := exec.Command(binary, qsubArguments...)
@@ -319,6 +356,8 @@ func executeSGEJob(model *NonMemModel) turnstile.ConcurrentError {
 		}
 	}
 
+	events.Submitted(model, string(output))
+
 	err = afero.WriteFile(fs, path.Join(model.OutputDir, model.Model+".out"), output, 0750)
 
 	if err != nil {
@@ -328,6 +367,45 @@ func executeSGEJob(model *NonMemModel) turnstile.ConcurrentError {
 	return turnstile.ConcurrentError{}
 }
 
+//qsubArguments builds the arguments with which the script of the model is submitted to the grid. Additional arguments are
+//placed before the script
+func qsubArguments(model *NonMemModel, script string, additional ...string) ([]string, error) {
+	//Compute the grid name for submission
+	submittedName, err := gridengineJobName(model)
+
+	if err != nil {
+		return []string{}, err
+	}
+
+	qsubArguments := []string{}
+
+	qsubArguments = append(qsubArguments, []string{
+		"-V",
+		"-j",
+		"y",
+		"-N",
+		submittedName,
+	}...)
+
+	if model.Configuration.Parallel {
+		parallelEnvironment := model.Configuration.ParallelEnv
+
+		if parallelEnvironment == "" {
+			parallelEnvironment = "orte"
+		}
+
+		qsubArguments = append(qsubArguments, []string{
+			"-pe",               // Parallel execution
+			parallelEnvironment, // Parallel environment name for the grid (Namespace for mpi messages)
+			strconv.Itoa(model.Configuration.Threads),
+		}...)
+	}
+
+	qsubArguments = append(qsubArguments, additional...)
+
+	return append(qsubArguments, script), nil
+}
+
 func sgeModelsFromArguments(args []string, config configlib.Config) ([]SGEModel, error) {
 	var output []SGEModel
 	nonmemmodels, err := nonmemModelsFromArguments(args, config)
@@ -373,9 +451,11 @@ func generateBbiScript(fileTemplate string, l NonMemModel) ([]byte, error) {
 		"run",
 	}
 
+	//Whether the model needed to be executed was decided at submission
 	commandComponents = append(commandComponents, []string{
 		"local",
 		filename,
+		"--force",
 	}...)
 
 	if !l.Configuration.Local.CreateChildDirs {
@@ -384,6 +464,32 @@ func generateBbiScript(fileTemplate string, l NonMemModel) ([]byte, error) {
 		}...)
 	}
 
+	if l.Configuration.MaxRuntime > 0 {
+		commandComponents = append(commandComponents, []string{
+			"--max_runtime=" + l.Configuration.MaxRuntime.String(),
+		}...)
+	}
+
+	//Transient failures are resubmitted by the job itself, so it needs to know which attempt it is
+	if l.Configuration.Retries > 0 {
+		commandComponents = append(commandComponents, []string{
+			"--grid_attempt=${" + gridAttemptVariable + ":-1}",
+		}...)
+	}
+
+	//The batch is notified, and journaled, by run sge rather than by each of its jobs
+	commandComponents = append(commandComponents, []string{
+		"--grid_job",
+	}...)
+
+	//The hosts allocated to the job are only known once it is running, so they are resolved by the script
+	if l.Configuration.Parallel {
+		commandComponents = append(commandComponents, []string{
+			"--hostfile",
+			"\"$" + hostFileVariable + "\"",
+		}...)
+	}
+
 	generatedCommand := strings.TrimSpace(strings.Join(commandComponents, " "))
 	log.Debugf("Generated command is %s", generatedCommand)
 
@@ -0,0 +1,436 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"bbi/configlib"
+	parser "bbi/parsers/nmparser"
+	"bbi/utils"
+	"github.com/olekukonko/tablewriter"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/afero"
+	"github.com/spf13/cobra"
+)
+
+var (
+	stabilitySamples          int
+	stabilityPerturbation     float64
+	stabilitySeed             int64
+	stabilityOFVTolerance     float64
+	stabilityParamTolerance   float64
+	stabilityRequiredFraction float64
+)
+
+const stabilityLongDescription string = `evaluate the stability of a model's minimum by re-estimating it from perturbed initial estimates, for example:
+bbi nonmem stability run001.mod --n 20
+bbi nonmem stability run001.mod --n 50 --perturbation 0.3 --seed 1234
+
+Each copy has the non-fixed $THETA, $OMEGA and $SIGMA initial estimates perturbed by up to the perturbation
+fraction, respecting THETA boundaries and preserving the correlations within OMEGA / SIGMA blocks. The copies
+are executed locally from <model>_stability, and the final objective function values and parameter vectors are
+clustered to determine whether the global minimum is reproducible.
+ `
+
+// stabilityCmd represents the stability command
+var stabilityCmd = &cobra.Command{
+	Use:   "stability",
+	Short: "re-estimate a model from perturbed initial estimates to check the reproducibility of its minimum",
+	Long:  stabilityLongDescription,
+	Run:   stability,
+}
+
+type stabilityRun struct {
+	Model      string             `json:"model"`
+	OFV        float64            `json:"ofv"`
+	Parameters map[string]float64 `json:"parameters"`
+}
+
+type stabilityCluster struct {
+	MinimumOFV float64        `json:"minimum_ofv"`
+	MaximumOFV float64        `json:"maximum_ofv"`
+	Runs       []stabilityRun `json:"runs"`
+	// ParameterSets is the number of distinct parameter vectors among the runs reaching this objective function value
+	ParameterSets int `json:"parameter_sets"`
+}
+
+type stabilityResult struct {
+	Model             string             `json:"model"`
+	Seed              int64              `json:"seed"`
+	Samples           int                `json:"samples"`
+	Successful        int                `json:"successful"`
+	Perturbation      float64            `json:"perturbation"`
+	ReferenceOFV      float64            `json:"reference_ofv,omitempty"`
+	GlobalMinimumOFV  float64            `json:"global_minimum_ofv"`
+	LowerMinimumFound bool               `json:"lower_minimum_found"`
+	MinimumFraction   float64            `json:"minimum_fraction"`
+	Reproducible      bool               `json:"reproducible"`
+	Clusters          []stabilityCluster `json:"clusters"`
+	Failed            []string           `json:"failed,omitempty"`
+}
+
+func stability(cmd *cobra.Command, args []string) {
+	if len(args) != 1 {
+		log.Fatal("Exactly one model must be provided for the stability analysis")
+	}
+
+	if stabilitySamples < 2 {
+		log.Fatal("At least two perturbed copies must be requested with --n")
+	}
+
+	config, err := configlib.LocateAndReadConfigFile()
+	if err != nil {
+		log.Fatalf("Failed to process configuration: %s", err)
+	}
+
+	logSetup(config)
+
+	//Every variant executed for the analysis is reported to the same event stream
+	startEventStream()
+
+	if stabilitySeed == 0 {
+		stabilitySeed = time.Now().UnixNano()
+	}
+
+	now := time.Now()
+
+	result, err := stabilityAnalysis(args[0], config)
+	if err != nil {
+		log.Fatalf("Unable to complete the stability analysis for %s: %s", args[0], err)
+	}
+
+	events.Close()
+
+	log.Infof("Stability analysis of %s completed in %s", result.Model, time.Since(now))
+
+	if Json {
+		jsonRes, _ := json.MarshalIndent(result, "", "\t")
+		fmt.Fprintf(consoleOutput(), "%s\n", jsonRes)
+	} else {
+		result.Summary()
+	}
+
+	if !result.Reproducible {
+		os.Exit(1)
+	}
+}
+
+func init() {
+	nonmemCmd.AddCommand(stabilityCmd)
+	stabilityCmd.Flags().StringVar(&eventsTarget, "events", "", "Write JSON lines lifecycle events for each executed model to a file, an inherited file descriptor (fd:3) or stdout (-)")
+	stabilityCmd.Flags().IntVar(&stabilitySamples, "n", 10, "Number of perturbed copies of the model to execute")
+	stabilityCmd.Flags().Float64Var(&stabilityPerturbation, "perturbation", 0.2, "Maximum relative change applied to each initial estimate")
+	stabilityCmd.Flags().Int64Var(&stabilitySeed, "seed", 0, "Seed for the random perturbations. Defaults to a time based seed, which is reported for reproducibility")
+	stabilityCmd.Flags().Float64Var(&stabilityOFVTolerance, "ofv_tolerance", 0.1, "Objective function values within this distance of each other are considered the same minimum")
+	stabilityCmd.Flags().Float64Var(&stabilityParamTolerance, "param_tolerance", 0.05, "Maximum relative difference for parameter estimates to be considered the same")
+	stabilityCmd.Flags().Float64Var(&stabilityRequiredFraction, "required_fraction", 0.5, "Fraction of successful perturbed runs which must reach the global minimum for it to be considered reproducible")
+}
+
+func stabilityAnalysis(modelPath string, config configlib.Config) (stabilityResult, error) {
+	result := stabilityResult{
+		Seed:         stabilitySeed,
+		Samples:      stabilitySamples,
+		Perturbation: stabilityPerturbation,
+	}
+
+	base, err := NewNonMemModel(modelPath, config)
+	if err != nil {
+		return result, err
+	}
+
+	result.Model = base.Model
+
+	modelLines, err := utils.ReadLines(base.Path)
+	if err != nil {
+		return result, err
+	}
+
+	estimates := parser.ParseControlStreamEstimates(modelLines)
+	if len(estimates) == 0 {
+		return result, errors.New("no initial estimates could be located in the control stream")
+	}
+
+	var runs []stabilityRun
+
+	//The original fit, if present, serves as the reference the perturbed runs are compared against
+	referenceFinals, _, err := finalValuesForLatestRun(base)
+	if err == nil {
+		result.ReferenceOFV = referenceFinals["OBJ"]
+		runs = append(runs, newStabilityRun(base.Model, referenceFinals))
+	} else {
+		log.Infof("%s No completed run of the original model was located. Only perturbed runs will be compared", base.LogIdentifier())
+	}
+
+	stabilityDir := filepath.Join(base.OriginalPath, base.FileName+"_stability")
+
+	if err = prepareVariantDirectory(stabilityDir, config.Overwrite); err != nil {
+		return result, err
+	}
+
+	config.Overwrite = true
+
+	random := rand.New(rand.NewSource(stabilitySeed))
+	var files []string
+
+	for i := 1; i <= stabilitySamples; i++ {
+		updates := perturbEstimates(estimates, stabilityPerturbation, random)
+		name := fmt.Sprintf("%s_stab_%03d", base.FileName, i)
+
+		modelFile, err := writeModelVariant(modelLines, stabilityDir, name, base.Extension, updates)
+		if err != nil {
+			return result, err
+		}
+
+		files = append(files, modelFile)
+	}
+
+	variants, err := executeModelVariants(files, config)
+	if err != nil {
+		return result, err
+	}
+
+	for _, v := range variants {
+		if v.Err != nil {
+			log.Warnf("%s No final estimates could be read and the run will be excluded: %s", v.Model.LogIdentifier(), v.Err)
+			result.Failed = append(result.Failed, v.Model.Model)
+			continue
+		}
+
+		result.Successful++
+		runs = append(runs, newStabilityRun(v.Model.Model, v.Finals))
+	}
+
+	if result.Successful == 0 {
+		return result, errors.New("none of the perturbed models completed successfully")
+	}
+
+	for _, c := range clusterByOFV(runs, stabilityOFVTolerance) {
+		result.Clusters = append(result.Clusters, stabilityCluster{
+			MinimumOFV:    c[0].OFV,
+			MaximumOFV:    c[len(c)-1].OFV,
+			Runs:          c,
+			ParameterSets: len(clusterByParameters(c, stabilityParamTolerance)),
+		})
+	}
+
+	minimum := result.Clusters[0]
+	result.GlobalMinimumOFV = minimum.MinimumOFV
+	result.MinimumFraction = perturbedMinimumFraction(minimum, base.Model, result.Successful)
+	result.LowerMinimumFound = referenceFinals != nil && result.ReferenceOFV-result.GlobalMinimumOFV > stabilityOFVTolerance
+	result.Reproducible = !result.LowerMinimumFound && minimum.ParameterSets == 1 && result.MinimumFraction >= stabilityRequiredFraction
+
+	resultJSON, _ := json.MarshalIndent(result, "", "    ")
+	err = afero.WriteFile(afero.NewOsFs(), filepath.Join(stabilityDir, "stability.json"), resultJSON, 0750)
+
+	return result, err
+}
+
+// perturbedMinimumFraction is the fraction of the successful perturbed runs within the cluster. The reference run,
+// which is clustered alongside them, is not counted
+func perturbedMinimumFraction(cluster stabilityCluster, reference string, perturbed int) float64 {
+	reached := 0
+	for _, r := range cluster.Runs {
+		if r.Model != reference {
+			reached++
+		}
+	}
+
+	return float64(reached) / float64(perturbed)
+}
+
+func newStabilityRun(model string, finals map[string]float64) stabilityRun {
+	parameters := make(map[string]float64)
+	for k, v := range finals {
+		if k != "OBJ" {
+			parameters[k] = v
+		}
+	}
+
+	return stabilityRun{
+		Model:      model,
+		OFV:        finals["OBJ"],
+		Parameters: parameters,
+	}
+}
+
+var randomEffectNameRegex = regexp.MustCompile(`^(OMEGA|SIGMA)\((\d+),(\d+)\)$`)
+
+// perturbEstimates generates new initial estimates for every non-fixed parameter. THETAs stay within their boundaries,
+// variances remain positive and covariances are scaled with their variances so the correlation is unchanged
+func perturbEstimates(estimates []parser.ControlStreamEstimate, fraction float64, random *rand.Rand) map[string]parser.EstimateUpdate {
+	updates := make(map[string]parser.EstimateUpdate)
+	// ratio of new to old variance, used to scale the covariances
+	scales := make(map[string]float64)
+
+	jitter := func() float64 {
+		return 1 + fraction*(2*random.Float64()-1)
+	}
+
+	for _, e := range estimates {
+		if e.Fixed {
+			continue
+		}
+
+		value, err := e.Value()
+		if err != nil {
+			continue
+		}
+
+		switch {
+		case e.Record == "THETA":
+			lower, upper := e.Bounds()
+			for attempt := 0; attempt < 20; attempt++ {
+				candidate := value * jitter()
+				if value == 0 {
+					candidate = fraction * (2*random.Float64() - 1)
+				}
+				if candidate > lower && candidate < upper {
+					updates[e.Name] = parser.EstimateUpdate{Value: candidate}
+					break
+				}
+			}
+		case e.Diagonal && value > 0:
+			scale := jitter()
+			scales[e.Name] = scale
+			updates[e.Name] = parser.EstimateUpdate{Value: value * scale}
+		}
+	}
+
+	//Covariances depend on the variances above, so they are handled once all of those are known
+	for _, e := range estimates {
+		if e.Fixed || e.Diagonal || e.Record == "THETA" {
+			continue
+		}
+
+		value, err := e.Value()
+		if err != nil || value == 0 {
+			continue
+		}
+
+		matches := randomEffectNameRegex.FindStringSubmatch(e.Name)
+		if matches == nil {
+			continue
+		}
+
+		row, okRow := scales[fmt.Sprintf("%s(%s,%s)", matches[1], matches[2], matches[2])]
+		col, okCol := scales[fmt.Sprintf("%s(%s,%s)", matches[1], matches[3], matches[3])]
+
+		if okRow && okCol {
+			updates[e.Name] = parser.EstimateUpdate{Value: value * math.Sqrt(row*col)}
+		}
+	}
+
+	return updates
+}
+
+// clusterByOFV sorts the runs by objective function value and groups those whose consecutive values are within tolerance.
+// The first cluster therefore holds the lowest minimum located
+func clusterByOFV(runs []stabilityRun, tolerance float64) [][]stabilityRun {
+	sorted := make([]stabilityRun, len(runs))
+	copy(sorted, runs)
+
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].OFV < sorted[j].OFV
+	})
+
+	var clusters [][]stabilityRun
+
+	for i, r := range sorted {
+		if i == 0 || r.OFV-sorted[i-1].OFV > tolerance {
+			clusters = append(clusters, []stabilityRun{})
+		}
+		clusters[len(clusters)-1] = append(clusters[len(clusters)-1], r)
+	}
+
+	return clusters
+}
+
+// clusterByParameters groups runs whose parameter estimates all agree within the relative tolerance of the first run of the group
+func clusterByParameters(runs []stabilityRun, tolerance float64) [][]stabilityRun {
+	var clusters [][]stabilityRun
+
+	for _, r := range runs {
+		placed := false
+		for i, c := range clusters {
+			if parametersAgree(c[0].Parameters, r.Parameters, tolerance) {
+				clusters[i] = append(clusters[i], r)
+				placed = true
+				break
+			}
+		}
+
+		if !placed {
+			clusters = append(clusters, []stabilityRun{r})
+		}
+	}
+
+	return clusters
+}
+
+func parametersAgree(reference map[string]float64, candidate map[string]float64, tolerance float64) bool {
+	for name, ref := range reference {
+		value, ok := candidate[name]
+		if !ok {
+			return false
+		}
+
+		difference := math.Abs(value - ref)
+		if difference > tolerance*math.Max(math.Abs(ref), 1e-6) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Summary prints the located minima and whether the global minimum was reproduced
+func (r stabilityResult) Summary() {
+	table := tablewriter.NewWriter(consoleOutput())
+	table.SetAlignment(tablewriter.ALIGN_LEFT)
+	table.SetColWidth(100)
+	table.SetHeader([]string{"Minimum", "OFV", "Runs", "Parameter Sets", "Models"})
+
+	for i, c := range r.Clusters {
+		var models []string
+		for _, run := range c.Runs {
+			models = append(models, run.Model)
+		}
+
+		ofv := strconv.FormatFloat(c.MinimumOFV, 'f', 3, 64)
+		if c.MaximumOFV != c.MinimumOFV {
+			ofv = fmt.Sprintf("%s - %s", ofv, strconv.FormatFloat(c.MaximumOFV, 'f', 3, 64))
+		}
+
+		table.Append([]string{
+			strconv.Itoa(i + 1),
+			ofv,
+			strconv.Itoa(len(c.Runs)),
+			strconv.Itoa(c.ParameterSets),
+			strings.Join(models, ", "),
+		})
+	}
+	table.Render()
+
+	fmt.Fprintf(consoleOutput(), "\n%d of %d perturbed runs completed (seed %d)\n", r.Successful, r.Samples, r.Seed)
+	fmt.Fprintf(consoleOutput(), "Global minimum OFV %.3f reached by %.0f%% of perturbed runs\n", r.GlobalMinimumOFV, r.MinimumFraction*100)
+
+	if r.LowerMinimumFound {
+		fmt.Fprintf(consoleOutput(), "A lower minimum than the original fit (%.3f) was located\n", r.ReferenceOFV)
+	}
+
+	if r.Reproducible {
+		fmt.Fprintln(consoleOutput(), "The global minimum is reproducible")
+	} else {
+		fmt.Fprintln(consoleOutput(), "The global minimum is NOT reproducible")
+	}
+}
@@ -0,0 +1,104 @@
+package cmd
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	parser "bbi/parsers/nmparser"
+)
+
+func Test_perturbEstimates(t *testing.T) {
+	lines := []string{
+		"$THETA",
+		"(0, 2)  ; KA",
+		"(0, 3, 3.5)  ; CL",
+		"1 FIX",
+		"$OMEGA BLOCK(2)",
+		"0.04",
+		"0.01 0.09",
+		"$SIGMA 0.1",
+	}
+
+	estimates := parser.ParseControlStreamEstimates(lines)
+	random := rand.New(rand.NewSource(42))
+
+	for i := 0; i < 50; i++ {
+		updates := perturbEstimates(estimates, 0.5, random)
+
+		if _, ok := updates["THETA3"]; ok {
+			t.Fatalf("perturbEstimates() updated a fixed THETA")
+		}
+
+		if v := updates["THETA2"].Value; v <= 0 || v >= 3.5 {
+			t.Errorf("perturbEstimates() THETA2 = %v, outside of boundaries", v)
+		}
+
+		if v := updates["SIGMA(1,1)"].Value; v <= 0 {
+			t.Errorf("perturbEstimates() SIGMA(1,1) = %v, want positive", v)
+		}
+
+		correlation := updates["OMEGA(2,1)"].Value / math.Sqrt(updates["OMEGA(1,1)"].Value*updates["OMEGA(2,2)"].Value)
+		if math.Abs(correlation-0.01/math.Sqrt(0.04*0.09)) > 1e-9 {
+			t.Errorf("perturbEstimates() correlation of OMEGA block changed to %v", correlation)
+		}
+	}
+}
+
+func Test_clusterByOFV(t *testing.T) {
+	runs := []stabilityRun{
+		{Model: "a", OFV: 100.05},
+		{Model: "b", OFV: 120},
+		{Model: "c", OFV: 100},
+		{Model: "d", OFV: 100.5},
+	}
+
+	clusters := clusterByOFV(runs, 0.1)
+
+	if len(clusters) != 3 {
+		t.Fatalf("clusterByOFV() produced %d clusters, want 3", len(clusters))
+	}
+
+	if len(clusters[0]) != 2 || clusters[0][0].Model != "c" || clusters[0][1].Model != "a" {
+		t.Errorf("clusterByOFV() first cluster = %v, want models c and a", clusters[0])
+	}
+
+	if clusters[2][0].Model != "b" {
+		t.Errorf("clusterByOFV() last cluster = %v, want model b", clusters[2])
+	}
+}
+
+func Test_clusterByParameters(t *testing.T) {
+	runs := []stabilityRun{
+		{Model: "a", Parameters: map[string]float64{"THETA1": 2, "THETA2": 10}},
+		{Model: "b", Parameters: map[string]float64{"THETA1": 2.01, "THETA2": 10.1}},
+		{Model: "c", Parameters: map[string]float64{"THETA1": 4, "THETA2": 10}},
+	}
+
+	if got := len(clusterByParameters(runs, 0.05)); got != 2 {
+		t.Errorf("clusterByParameters() produced %d clusters, want 2", got)
+	}
+
+	if got := len(clusterByParameters(runs, 2)); got != 1 {
+		t.Errorf("clusterByParameters() produced %d clusters, want 1", got)
+	}
+}
+
+func Test_perturbedMinimumFraction(t *testing.T) {
+	cluster := stabilityCluster{
+		Runs: []stabilityRun{
+			{Model: "run001.mod", OFV: 100},
+			{Model: "run001_stab_001.mod", OFV: 100},
+			{Model: "run001_stab_003.mod", OFV: 100.01},
+		},
+	}
+
+	//The reference run reaching the minimum doesn't count towards the fraction of perturbed runs
+	if got := perturbedMinimumFraction(cluster, "run001.mod", 4); got != 0.5 {
+		t.Errorf("perturbedMinimumFraction() = %f, want 0.5", got)
+	}
+
+	if got := perturbedMinimumFraction(cluster, "run000.mod", 4); got != 0.75 {
+		t.Errorf("perturbedMinimumFraction() without the reference = %f, want 0.75", got)
+	}
+}
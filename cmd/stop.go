@@ -0,0 +1,101 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+
+	"bbi/configlib"
+	"bbi/utils"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/afero"
+	"github.com/spf13/cobra"
+)
+
+const stopLongDescription string = `stop a model being executed locally by bbi. The process group recorded in the
+bbi.pid file of the model's output directory is sent SIGTERM, and the bbi executing it records the model as cancelled.
+Only models executing on this host can be stopped, and a pid file whose process has since exited is removed instead.
+Models may be provided as control streams, which are resolved to their output directory through bbi.yaml, or as the
+output directories themselves
+
+ bbi nonmem stop run001.mod
+ bbi nonmem stop run001 run002
+`
+
+var stopCmd = &cobra.Command{
+	Use:   "stop",
+	Short: "stop a model being executed locally",
+	Long:  stopLongDescription,
+	Args:  cobra.MinimumNArgs(1),
+	Run:   stop,
+}
+
+func init() {
+	nonmemCmd.AddCommand(stopCmd)
+}
+
+func stop(cmd *cobra.Command, args []string) {
+	failed := false
+
+	for _, arg := range args {
+		outputDir, _, err := modelRunDirectory(arg)
+		if err != nil {
+			log.Errorf("Unable to locate the output directory for %s: %s", arg, err)
+			failed = true
+			continue
+		}
+
+		pid, err := stopRunningModel(outputDir)
+		if err != nil {
+			log.Errorf("Unable to stop %s: %s", arg, err)
+			failed = true
+			continue
+		}
+
+		log.Infof("Sent SIGTERM to process group %d for %s", pid, arg)
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// modelRunDirectory resolves the argument to the output directory of a model and the file name of the model within it.
+// Directories are used as they are, with the file name left empty, while control streams are resolved through the
+// output directory recorded by their latest run, falling back to the output_dir of the configuration
+func modelRunDirectory(arg string) (string, string, error) {
+	if isDir, _ := utils.IsDir(arg, afero.NewOsFs()); isDir {
+		dir, err := filepath.Abs(arg)
+		return dir, "", err
+	}
+
+	fileName, _ := utils.FileAndExt(filepath.Base(arg))
+
+	if dir, err := readOutputDirRecord(arg); err == nil {
+		return dir, fileName, nil
+	}
+
+	config, err := configlib.LocateAndReadConfigFile()
+	if err != nil {
+		return "", "", err
+	}
+
+	models, err := nonmemModelsFromArguments([]string{arg}, config)
+	if err != nil {
+		return "", "", err
+	}
+
+	if len(models) == 0 {
+		return "", "", os.ErrNotExist
+	}
+
+	if !models[0].Configuration.Local.CreateChildDirs {
+		return models[0].OriginalPath, models[0].FileName, nil
+	}
+
+	outputDir, err := existingOutputDir(models[0], models[0].Configuration)
+	if err != nil {
+		return "", "", err
+	}
+
+	return filepath.Join(models[0].OriginalPath, outputDir), models[0].FileName, nil
+}
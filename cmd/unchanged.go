@@ -0,0 +1,86 @@
+package cmd
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"bbi/configlib"
+	log "github.com/sirupsen/logrus"
+)
+
+// effectiveNonMemVersion returns the name and details of the nonmem installation that will be used for execution
+func effectiveNonMemVersion(config configlib.Config) (string, configlib.NonMemDetail) {
+	if config.NMVersion != "" {
+		return config.NMVersion, config.Nonmem[config.NMVersion]
+	}
+
+	for k, v := range config.Nonmem {
+		if v.Default {
+			return k, v
+		}
+	}
+
+	return "", configlib.NonMemDetail{}
+}
+
+// nonmemSettingsHash digests the settings which influence the results of an estimation beyond the model and data
+func nonmemSettingsHash(config configlib.Config) string {
+	version, detail := effectiveNonMemVersion(config)
+
+	settings := struct {
+		Version     string                `json:"version"`
+		Home        string                `json:"home"`
+		Executable  string                `json:"executable"`
+		NMQual      bool                  `json:"nmqual"`
+		NMFEOptions configlib.NMFEOptions `json:"nmfe_options"`
+	}{
+		Version:     version,
+		Home:        detail.Home,
+		Executable:  detail.Executable,
+		NMQual:      config.NMQual,
+		NMFEOptions: config.NMFEOptions,
+	}
+
+	contents, _ := json.Marshal(settings)
+
+	return fmt.Sprintf("%x", md5.Sum(contents))
+}
+
+// modelMatchesHash compares the digest against the original model and, as grid executions hash the copy in the output
+// directory, against the copy that would be written for execution
+func modelMatchesHash(model *NonMemModel, digest string) bool {
+	if digest == "" {
+		return false
+	}
+
+	if original, err := hashFile(model.Path); err == nil && original == digest {
+		return true
+	}
+
+	copied, err := modifiedModelContents(model, strings.ToLower(model.Extension) == "mod")
+	if err != nil {
+		return false
+	}
+
+	return fmt.Sprintf("%x", md5.Sum(copied)) == digest
+}
+
+// skipUnchangedModels removes models whose previous run is current from the batch, unless forced through the force setting,
+// recording them as completed in the journal
+func skipUnchangedModels(models []LocalModel, journal *batchJournal) []LocalModel {
+	var output []LocalModel
+
+	for _, m := range models {
+		if current, _ := previousRunIsCurrent(m.Nonmem); current && !m.Nonmem.Configuration.Force {
+			log.Infof("%s Outputs match the current model, data and nonmem settings. Skipping", m.Nonmem.LogIdentifier())
+			journal.Update(m.Nonmem, journalCompleted, nil)
+			continue
+		}
+
+		output = append(output, m)
+	}
+
+	return output
+}
@@ -0,0 +1,74 @@
+package cmd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"bbi/configlib"
+)
+
+func Test_skipUnchangedModels(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bbi_unchanged")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "data.csv"), []byte("ID,TIME,DV\n"), 0644)
+	dataMD5, _ := hashFile(filepath.Join(dir, "data.csv"))
+
+	var models []LocalModel
+	for _, name := range []string{"run001", "run002", "run003"} {
+		modelPath := filepath.Join(dir, name+".mod")
+		outputDir := filepath.Join(dir, name)
+
+		ioutil.WriteFile(modelPath, []byte("$DATA ../data.csv\n"), 0644)
+		os.Mkdir(outputDir, 0755)
+
+		model := &NonMemModel{
+			Path:          modelPath,
+			FileName:      name,
+			OriginalPath:  dir,
+			OutputDir:     outputDir,
+			Configuration: configlib.Config{Local: configlib.LocalDetail{CreateChildDirs: true}},
+		}
+
+		modelMD5, _ := hashFile(modelPath)
+		contents, _ := json.Marshal(map[string]string{
+			"data_path":  "../data.csv",
+			"data_md5":   dataMD5,
+			"model_md5":  modelMD5,
+			"config_md5": nonmemSettingsHash(model.Configuration),
+			"output_dir": outputDir,
+		})
+		ioutil.WriteFile(filepath.Join(outputDir, "bbi_config.json"), contents, 0644)
+
+		models = append(models, LocalModel{Nonmem: model})
+	}
+
+	//run002 is forced and run003 changes its NMFE options, so only run001 is unchanged
+	models[1].Nonmem.Configuration.Force = true
+	models[2].Nonmem.Configuration.NMFEOptions.MaxLim = 2
+
+	path := filepath.Join(dir, journalFileName)
+	journal := newBatchJournal(path, models)
+
+	queued := skipUnchangedModels(models, journal)
+
+	if len(queued) != 2 || queued[0].Nonmem.FileName != "run002" || queued[1].Nonmem.FileName != "run003" {
+		t.Fatalf("skipUnchangedModels() queued %d models, want run002 and run003", len(queued))
+	}
+
+	//The skipped model is persisted, even though the batch may not execute anything
+	written, err := readBatchJournal(path)
+	if err != nil {
+		t.Fatalf("readBatchJournal() error = %s", err)
+	}
+
+	if written.Models[0].State != journalCompleted || written.Models[1].State != journalQueued {
+		t.Errorf("skipUnchangedModels() journaled %s and %s, want run001 completed and run002 queued", written.Models[0].State, written.Models[1].State)
+	}
+}
@@ -0,0 +1,180 @@
+package cmd
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"bbi/configlib"
+	parser "bbi/parsers/nmparser"
+	"bbi/utils"
+	"github.com/metrumresearchgroup/turnstile"
+	"github.com/spf13/afero"
+	"github.com/spf13/viper"
+)
+
+// modelVariantResult holds the outcome of executing a generated variant of a model
+type modelVariantResult struct {
+	Model   NonMemModel
+	Finals  map[string]float64
+	StdErrs map[string]float64
+	Err     error
+}
+
+// prepareVariantDirectory creates the directory that will hold generated model variants, removing any previous
+// contents only when overwriting is permitted
+func prepareVariantDirectory(directory string, overwrite bool) error {
+	fs := afero.NewOsFs()
+
+	if ok, _ := afero.DirExists(fs, directory); ok {
+		if !overwrite {
+			return fmt.Errorf("the directory %s already exists, but we are configured not to overwrite", directory)
+		}
+		if err := fs.RemoveAll(directory); err != nil {
+			return err
+		}
+	}
+
+	return fs.MkdirAll(directory, 0750)
+}
+
+// writeModelVariant writes a copy of the control stream into the directory with the provided initial estimates replaced.
+// The data path receives an additional level because the copy lives one directory below the original
+func writeModelVariant(lines []string, directory string, name string, extension string, updates map[string]parser.EstimateUpdate) (string, error) {
+	updated, err := parser.UpdateInitialEstimates(lines, updates)
+
+	if err != nil {
+		return "", err
+	}
+
+	for i, line := range updated {
+		if strings.Contains(line, "$DATA") {
+			updated[i] = parser.AddPathLevelToData(line)
+		}
+	}
+
+	target := filepath.Join(directory, name+"."+extension)
+
+	return target, utils.WriteLines(updated, target)
+}
+
+// executeModelVariants runs the provided model files locally and collects the final estimates of each
+func executeModelVariants(files []string, config configlib.Config) ([]modelVariantResult, error) {
+	var models []LocalModel
+
+	for _, f := range files {
+		nm, err := NewNonMemModel(f, config)
+		if err != nil {
+			return nil, err
+		}
+
+		models = append(models, LocalModel{
+			Nonmem: &nm,
+			Cancel: turnstile.CancellationChannel(),
+		})
+	}
+
+	var batch []*NonMemModel
+	for _, model := range models {
+		batch = append(batch, model.Nonmem)
+	}
+
+	events.BatchStarted(batch)
+
+	now := time.Now()
+	m := executeLocalModels(models, viper.GetInt("threads"))
+
+	events.BatchFinished(len(models), m.ErrorList)
+	postWorkNotice(m, now)
+
+	var results []modelVariantResult
+	for _, model := range models {
+		r := modelVariantResult{
+			Model: *model.Nonmem,
+		}
+
+		//The ext file of a variant which failed or was cancelled may be partial, or left from an earlier execution
+		if r.Err = variantExecutionError(m, model.Nonmem); r.Err == nil {
+			r.Finals, r.StdErrs, r.Err = finalValuesForModel(*model.Nonmem)
+		}
+
+		results = append(results, r)
+	}
+
+	return results, nil
+}
+
+// variantExecutionError returns the error recorded by the manager for the model, if it failed or was cancelled
+func variantExecutionError(m *turnstile.Manager, model *NonMemModel) error {
+	for _, e := range m.ErrorList {
+		if e.RunIdentifier == model.Model || e.RunIdentifier == model.FileName {
+			return fmt.Errorf("%s: %w", e.Notes, e.Error)
+		}
+	}
+
+	return nil
+}
+
+// finalValuesForModel reads the final estimates and standard errors from the ext file of an executed model
+func finalValuesForModel(model NonMemModel) (map[string]float64, map[string]float64, error) {
+	outputDir := model.OutputDir
+	if !model.Configuration.Local.CreateChildDirs {
+		outputDir = model.OriginalPath
+	}
+
+	return finalValuesInDirectory(outputDir, model.FileName)
+}
+
+// finalValuesForLatestRun reads the final estimates and standard errors of the latest run of a model. The output
+// directory of a model which hasn't executed in this batch is that of its next run, which won't exist yet when the
+// output_dir template is sequenced
+func finalValuesForLatestRun(model NonMemModel) (map[string]float64, map[string]float64, error) {
+	outputDir, err := latestRunOutputDir(model)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return finalValuesInDirectory(outputDir, model.FileName)
+}
+
+// latestRunOutputDir resolves the output directory of the latest run of the model through the record it left, falling
+// back to the latest existing directory of the output_dir template
+func latestRunOutputDir(model NonMemModel) (string, error) {
+	if !model.Configuration.Local.CreateChildDirs {
+		return model.OriginalPath, nil
+	}
+
+	if recorded, err := readOutputDirRecord(filepath.Join(model.OriginalPath, model.OriginalModel)); err == nil {
+		return recorded, nil
+	}
+
+	outputDir, err := existingOutputDir(model, model.Configuration)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(model.OriginalPath, outputDir), nil
+}
+
+func finalValuesInDirectory(outputDir string, fileName string) (map[string]float64, map[string]float64, error) {
+	lines, err := utils.ReadParamsAndOutputFromExt(filepath.Join(outputDir, fileName+".ext"))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ed := parser.ParseExtLines(lines)
+
+	finals, err := parser.ExtLineValues(ed, -1000000000)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	//Standard errors are only present if the covariance step was successful
+	stdErrs, err := parser.ExtLineValues(ed, -1000000001)
+	if err != nil {
+		stdErrs = map[string]float64{}
+	}
+
+	return finals, stdErrs, nil
+}
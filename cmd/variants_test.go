@@ -0,0 +1,29 @@
+package cmd
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/metrumresearchgroup/turnstile"
+)
+
+func Test_variantExecutionError(t *testing.T) {
+	m := &turnstile.Manager{
+		ErrorList: []turnstile.ConcurrentError{
+			newConcurrentError("run002.mod", "Execution was cancelled", errExecutionCancelled),
+			newConcurrentError("run003", "nmtran failed", errors.New("exit status 1")),
+		},
+	}
+
+	if err := variantExecutionError(m, &NonMemModel{Model: "run001.mod", FileName: "run001"}); err != nil {
+		t.Errorf("variantExecutionError() for a completed variant = %s", err)
+	}
+
+	if err := variantExecutionError(m, &NonMemModel{Model: "run002.mod", FileName: "run002"}); !errors.Is(err, errExecutionCancelled) {
+		t.Errorf("variantExecutionError() for a cancelled variant = %v, want %v", err, errExecutionCancelled)
+	}
+
+	if err := variantExecutionError(m, &NonMemModel{Model: "run003.mod", FileName: "run003"}); err == nil {
+		t.Errorf("variantExecutionError() for a failed variant returned no error")
+	}
+}
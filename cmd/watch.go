@@ -0,0 +1,198 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	parser "bbi/parsers/nmparser"
+	"bbi/utils"
+	"github.com/olekukonko/tablewriter"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+const watchLongDescription string = `watch the progress of one or more running models. The .ext file of each model is
+read at every interval to report the estimation method, the latest iteration, its objective function value and the
+time since nonmem last wrote to it. Models without a pid file which haven't recorded their results yet are queued,
+and those executing on another host, such as a node of the grid, are taken as running. Watching ends once none of the
+models are running or queued
+
+ bbi nonmem watch run001.mod
+ bbi nonmem watch run001.mod run002.mod --interval 30s
+ bbi nonmem watch run001 --once
+`
+
+var watchInterval time.Duration
+var watchOnce bool
+
+var watchCmd = &cobra.Command{
+	Use:   "watch",
+	Short: "follow the iterations of running models",
+	Long:  watchLongDescription,
+	Args:  cobra.MinimumNArgs(1),
+	Run:   watch,
+}
+
+func init() {
+	nonmemCmd.AddCommand(watchCmd)
+
+	watchCmd.Flags().DurationVar(&watchInterval, "interval", 5*time.Second, "How often to read the .ext files of the models")
+	watchCmd.Flags().BoolVar(&watchOnce, "once", false, "Report the progress of the models once and exit")
+}
+
+// watchedModel is a model being followed by bbi nonmem watch
+type watchedModel struct {
+	Name      string
+	OutputDir string
+	FileName  string
+}
+
+// modelProgress is the state of a watched model at a point in time
+type modelProgress struct {
+	Model string
+	State string
+	//Active models are running or still waiting to start, and keep being watched
+	Active    bool
+	Progress  parser.ExtProgress
+	HasExt    bool
+	SinceLast time.Duration
+}
+
+func watch(cmd *cobra.Command, args []string) {
+	var models []watchedModel
+
+	for _, arg := range args {
+		outputDir, fileName, err := modelRunDirectory(arg)
+		if err != nil {
+			log.Fatalf("Unable to locate the output directory for %s: %s", arg, err)
+		}
+
+		models = append(models, watchedModel{
+			Name:      arg,
+			OutputDir: outputDir,
+			FileName:  fileName,
+		})
+	}
+
+	for {
+		var progress []modelProgress
+		running := false
+
+		for _, m := range models {
+			p := m.progress(time.Now())
+			running = running || p.Active
+			progress = append(progress, p)
+		}
+
+		fmt.Printf("\n%s\n", time.Now().Format("15:04:05"))
+		writeProgressTable(os.Stdout, progress)
+
+		if watchOnce || !running {
+			return
+		}
+
+		time.Sleep(watchInterval)
+	}
+}
+
+// progress reads the current state of the model from its pid and ext files
+func (w watchedModel) progress(now time.Time) modelProgress {
+	p := modelProgress{
+		Model: w.Name,
+		State: "not running",
+	}
+
+	record, err := readPidFile(w.OutputDir)
+
+	switch {
+	case err == nil && !record.isLocal():
+		//Models executing on the nodes of a grid can't be checked from here, so their pid file is taken as running
+		p.State = "running on " + record.Host
+		p.Active = true
+	case err == nil:
+		if modelIsRunning(w.OutputDir) {
+			p.State = "running"
+			p.Active = true
+		}
+	default:
+		//Without a pid file, a model which hasn't recorded its results is yet to start, such as one queued on the grid
+		if _, err := os.Stat(filepath.Join(w.OutputDir, "bbi_config.json")); os.IsNotExist(err) {
+			p.State = "queued"
+			p.Active = true
+		}
+	}
+
+	extFile := w.extFile()
+	if extFile == "" {
+		return p
+	}
+
+	lines, err := utils.ReadLines(extFile)
+	if err != nil {
+		return p
+	}
+
+	p.Progress, err = parser.ParseExtProgress(parser.ParseExtLines(lines))
+	p.HasExt = err == nil
+
+	if p.Progress.Complete && (p.State == "not running" || p.State == "queued") {
+		p.State = "complete"
+		p.Active = false
+	}
+
+	if info, err := os.Stat(extFile); err == nil {
+		p.SinceLast = now.Sub(info.ModTime()).Round(time.Second)
+	}
+
+	return p
+}
+
+// extFile locates the ext file of the model. When only the output directory is known, the most recently written ext
+// file within it is used
+func (w watchedModel) extFile() string {
+	if w.FileName != "" {
+		return filepath.Join(w.OutputDir, w.FileName+".ext")
+	}
+
+	matches, _ := filepath.Glob(filepath.Join(w.OutputDir, "*.ext"))
+
+	latest := ""
+	var latestTime time.Time
+
+	for _, m := range matches {
+		if info, err := os.Stat(m); err == nil && info.ModTime().After(latestTime) {
+			latest = m
+			latestTime = info.ModTime()
+		}
+	}
+
+	return latest
+}
+
+func writeProgressTable(w io.Writer, progress []modelProgress) {
+	table := tablewriter.NewWriter(w)
+	table.SetAlignment(tablewriter.ALIGN_LEFT)
+	table.SetHeader([]string{"Model", "State", "Method", "Iteration", "OFV", "Last Update"})
+
+	for _, p := range progress {
+		if !p.HasExt {
+			table.Append([]string{p.Model, p.State, "", "", "", ""})
+			continue
+		}
+
+		table.Append([]string{
+			p.Model,
+			p.State,
+			p.Progress.Method,
+			strconv.Itoa(p.Progress.Iteration),
+			strconv.FormatFloat(p.Progress.OFV, 'f', 3, 64),
+			p.SinceLast.String() + " ago",
+		})
+	}
+
+	table.Render()
+}
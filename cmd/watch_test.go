@@ -0,0 +1,73 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_watchedModel_progress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bbi_watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ext := "TABLE NO.     1: First Order Conditional Estimation with Interaction: Goal Function=MINIMUM VALUE OF OBJECTIVE FUNCTION: Problem=1\n" +
+		" ITERATION    THETA1       OMEGA(1,1)   OBJ\n" +
+		"            0  2.00000E+00  5.00000E-02    2700.1\n" +
+		"            5  2.10000E+00  6.00000E-02    2680.4\n"
+
+	ioutil.WriteFile(filepath.Join(dir, "run001.ext"), []byte(ext), 0640)
+
+	//A pid file for a process which has exited is not running
+	writePidFile(dir, 1<<22+1)
+
+	for _, m := range []watchedModel{{Name: "run001.mod", OutputDir: dir, FileName: "run001"}, {Name: "run001", OutputDir: dir}} {
+		p := m.progress(time.Now().Add(time.Minute))
+
+		if !p.HasExt || p.Progress.Iteration != 5 || p.Progress.OFV != 2680.4 {
+			t.Errorf("progress() for %s = %+v. Want iteration 5 with OFV 2680.4", m.Name, p)
+		}
+
+		if p.State != "not running" || p.SinceLast < 59*time.Second {
+			t.Errorf("progress() for %s reported state %s, %s since the last update", m.Name, p.State, p.SinceLast)
+		}
+	}
+
+	ext += "  -1000000000  2.31000E+00  9.00000E-02    2636.5\n"
+	ioutil.WriteFile(filepath.Join(dir, "run001.ext"), []byte(ext), 0640)
+
+	if p := (watchedModel{Name: "run001", OutputDir: dir, FileName: "run001"}).progress(time.Now()); p.State != "complete" {
+		t.Errorf("progress() after the final estimates were written reported state %s, want complete", p.State)
+	}
+
+	if p := (watchedModel{Name: "run002", OutputDir: dir, FileName: "run002"}).progress(time.Now()); p.HasExt {
+		t.Errorf("progress() reported iterations for a model without an ext file")
+	}
+
+	//Models executing on another host of the grid are running, and those which haven't started yet are queued
+	queued := watchedModel{Name: "run003", OutputDir: filepath.Join(dir, "run003"), FileName: "run003"}
+	os.Mkdir(queued.OutputDir, 0750)
+
+	if p := queued.progress(time.Now()); p.State != "queued" || !p.Active {
+		t.Errorf("progress() for a model without a pid file reported state %s, want queued", p.State)
+	}
+
+	host, _ := os.Hostname()
+	ioutil.WriteFile(filepath.Join(queued.OutputDir, pidFileName), []byte(`{"pid": 4194305, "host": "`+host+`.elsewhere"}`), 0640)
+
+	if p := queued.progress(time.Now()); !p.Active {
+		t.Errorf("progress() for a model executing on another host reported state %s, want running", p.State)
+	}
+
+	//Once the results are recorded, a model without a pid file has finished
+	os.Remove(filepath.Join(queued.OutputDir, pidFileName))
+	ioutil.WriteFile(filepath.Join(queued.OutputDir, "bbi_config.json"), []byte("{}"), 0640)
+
+	if p := queued.progress(time.Now()); p.State != "not running" || p.Active {
+		t.Errorf("progress() for a model which recorded its results reported state %s, want not running", p.State)
+	}
+}
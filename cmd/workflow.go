@@ -0,0 +1,489 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"bbi/configlib"
+	parser "bbi/parsers/nmparser"
+	"bbi/utils"
+	"github.com/metrumresearchgroup/turnstile"
+	"github.com/olekukonko/tablewriter"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v2"
+)
+
+var workflowFile string
+
+const (
+	workflowPending   string = "pending"
+	workflowSucceeded string = "succeeded"
+	workflowFailed    string = "failed"
+	workflowSkipped   string = "skipped"
+	workflowCancelled string = "cancelled"
+)
+
+// workflowModel is a single entry of a workflow file. Parents are referenced by their filename sans extension (run001)
+type workflowModel struct {
+	Model   string   `yaml:"model" json:"model"`
+	BasedOn []string `yaml:"based_on" json:"based_on,omitempty"`
+	//MSFI is the parent whose MSFO output should be wired into the $MSFI record of this model
+	MSFI string `yaml:"msfi" json:"msfi,omitempty"`
+}
+
+// workflowDefinition is the structure of the YAML workflow file provided with --workflow
+type workflowDefinition struct {
+	Models []workflowModel `yaml:"models"`
+}
+
+type workflowNode struct {
+	Definition workflowModel `json:"definition"`
+	Name       string        `json:"name"`
+	Status     string        `json:"status"`
+	Reason     string        `json:"reason,omitempty"`
+	model      *NonMemModel
+	//executed is set once the model is handed to the turnstile, which skipped models and those whose $MSFI couldn't be
+	//wired never are
+	executed bool
+}
+
+// workflowOutcome is the result of executing a node
+type workflowOutcome struct {
+	Status   string
+	Reason   string
+	Executed bool
+}
+
+func readWorkflowDefinition(file string) (workflowDefinition, error) {
+	var definition workflowDefinition
+
+	contents, err := ioutil.ReadFile(file)
+	if err != nil {
+		return definition, err
+	}
+
+	err = yaml.Unmarshal(contents, &definition)
+	if err != nil {
+		return definition, fmt.Errorf("unable to parse workflow file %s: %w", file, err)
+	}
+
+	if len(definition.Models) == 0 {
+		return definition, fmt.Errorf("no models were declared in workflow file %s", file)
+	}
+
+	return definition, nil
+}
+
+func workflowModelName(model string) string {
+	name, _ := utils.FileAndExt(filepath.Base(model))
+	return name
+}
+
+// workflowOrder validates the parent references of the workflow and returns the model names in a dependency respecting order
+func workflowOrder(models []workflowModel) ([]string, error) {
+	parents := make(map[string][]string)
+	var declared []string
+
+	for _, m := range models {
+		name := workflowModelName(m.Model)
+		if _, ok := parents[name]; ok {
+			return nil, fmt.Errorf("model %s is declared more than once in the workflow", name)
+		}
+
+		parents[name] = []string{}
+		declared = append(declared, name)
+	}
+
+	for _, m := range models {
+		name := workflowModelName(m.Model)
+		for _, p := range m.BasedOn {
+			parent := workflowModelName(p)
+			if _, ok := parents[parent]; !ok {
+				return nil, fmt.Errorf("model %s is based on %s, which is not declared in the workflow", name, parent)
+			}
+			parents[name] = append(parents[name], parent)
+		}
+
+		if m.MSFI != "" && !stringInSlice(workflowModelName(m.MSFI), parents[name]) {
+			return nil, fmt.Errorf("model %s reads the MSFO of %s, which must also be listed in based_on", name, m.MSFI)
+		}
+	}
+
+	var order []string
+	placed := make(map[string]bool)
+
+	for len(order) < len(declared) {
+		progressed := false
+
+		for _, name := range declared {
+			if placed[name] {
+				continue
+			}
+
+			ready := true
+			for _, p := range parents[name] {
+				if !placed[p] {
+					ready = false
+				}
+			}
+
+			if ready {
+				order = append(order, name)
+				placed[name] = true
+				progressed = true
+			}
+		}
+
+		if !progressed {
+			var cyclic []string
+			for _, name := range declared {
+				if !placed[name] {
+					cyclic = append(cyclic, name)
+				}
+			}
+			return nil, fmt.Errorf("the workflow contains a dependency cycle between %v", cyclic)
+		}
+	}
+
+	return order, nil
+}
+
+func stringInSlice(needle string, haystack []string) bool {
+	for _, v := range haystack {
+		if v == needle {
+			return true
+		}
+	}
+
+	return false
+}
+
+// loadWorkflow reads the workflow file and builds a node for each of its models, returned in dependency order along with
+// the nodes keyed by model name
+func loadWorkflow(file string, config configlib.Config) ([]*workflowNode, map[string]*workflowNode, error) {
+	definition, err := readWorkflowDefinition(file)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	order, err := workflowOrder(definition.Models)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	//Models are relative to the workflow file
+	base := filepath.Dir(file)
+	nodes := make(map[string]*workflowNode)
+
+	for _, m := range definition.Models {
+		modelPath := m.Model
+		if !filepath.IsAbs(modelPath) {
+			modelPath = filepath.Join(base, modelPath)
+		}
+
+		model, err := NewNonMemModel(modelPath, config)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		name := workflowModelName(m.Model)
+		nodes[name] = &workflowNode{
+			Definition: m,
+			Name:       name,
+			Status:     workflowPending,
+			model:      &model,
+		}
+	}
+
+	var ordered []*workflowNode
+	for _, name := range order {
+		ordered = append(ordered, nodes[name])
+	}
+
+	return ordered, nodes, nil
+}
+
+// executeWorkflow runs the workflow on top of the turnstile manager. Each model starts as soon as all of its parents have
+// succeeded, and models downstream of a failure are skipped rather than executed. Models are queued as in any other local
+// batch, so that they are recorded in the journal, skipped when their outputs are current and shown on the dashboard.
+// The results of every executed model are collected into a single manager for the summary of the batch
+func executeWorkflow(file string, config configlib.Config, journalPath string, resume bool) ([]*workflowNode, *turnstile.Manager, error) {
+	ordered, nodes, err := loadWorkflow(file, config)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var models []*NonMemModel
+	var localModels []LocalModel
+	for _, n := range ordered {
+		models = append(models, n.model)
+		localModels = append(localModels, LocalModel{Nonmem: n.model})
+	}
+
+	journal := newBatchJournal(journalPath, localModels)
+
+	dashboard = startDashboard(models)
+	events.BatchStarted(models)
+
+	results := &turnstile.Manager{}
+	var lock sync.Mutex
+
+	scheduleWorkflow(ordered, nodes, viper.GetInt("threads"), func(node *workflowNode) workflowOutcome {
+		if err := wireModelSpecificationFile(node, nodes); err != nil {
+			log.Errorf("%s Unable to wire $MSFI: %s", node.model.LogIdentifier(), err)
+			return workflowOutcome{Status: workflowFailed, Reason: err.Error()}
+		}
+
+		queued := []LocalModel{{
+			Nonmem:  node.model,
+			Cancel:  turnstile.CancellationChannel(),
+			Journal: journal,
+		}}
+
+		//The outputs of a model are only reused if none of its parents executed, as its inputs may have changed with them
+		if !workflowParentExecuted(node, nodes) {
+			if resume {
+				queued = resumableModels(queued, journal)
+			} else {
+				queued = skipUnchangedModels(queued, journal)
+			}
+		}
+
+		if len(queued) == 0 {
+			dashboard.Phase(node.model, phaseCompleted)
+			return workflowOutcome{Status: workflowSucceeded, Reason: "outputs are current"}
+		}
+
+		log.Infof("%s Parents of the model have succeeded. Beginning workflow execution", node.model.LogIdentifier())
+
+		m := executeLocalModels(queued, 1)
+
+		outcome := workflowOutcome{Status: workflowSucceeded, Executed: true}
+
+		for _, e := range m.ErrorList {
+			if e.RunIdentifier == node.model.Model || e.RunIdentifier == node.model.FileName {
+				outcome.Status = workflowFailed
+				if errors.Is(e.Error, errExecutionCancelled) {
+					outcome.Status = workflowCancelled
+				}
+				outcome.Reason = e.Notes
+			}
+		}
+
+		lock.Lock()
+		defer lock.Unlock()
+
+		results.Iterations += m.Iterations
+		results.Completed += m.Completed
+		results.Errors += m.Errors
+		results.ErrorList = append(results.ErrorList, m.ErrorList...)
+
+		return outcome
+	})
+
+	dashboard.Stop()
+	events.BatchFinished(len(ordered), results.ErrorList)
+
+	//Skipped models never ran, so they are neither failed in the journal nor considered by a resumed batch as having run
+	for _, n := range ordered {
+		if n.Status == workflowSkipped {
+			journal.Update(n.model, journalSkipped, errors.New(n.Reason))
+		}
+	}
+
+	if err = journal.Finalize(localModels, results); err != nil {
+		log.Errorf("Unable to persist the batch journal to %s: %s", journalPath, err)
+	}
+
+	return ordered, results, nil
+}
+
+// workflowParentExecuted indicates whether any parent of the node was executed rather than reusing its outputs
+func workflowParentExecuted(node *workflowNode, nodes map[string]*workflowNode) bool {
+	for _, p := range node.Definition.BasedOn {
+		if nodes[workflowModelName(p)].executed {
+			return true
+		}
+	}
+
+	return false
+}
+
+// scheduleWorkflow calls execute for each node once all of its parents have finished, with at most concurrency nodes
+// executing at once. Nodes with a parent which failed or was skipped are marked as skipped instead. The status of every
+// node is only written here, by the goroutine of the node before it signals that it has finished, so execute reads the
+// status of parents safely but must not modify nodes itself
+func scheduleWorkflow(ordered []*workflowNode, nodes map[string]*workflowNode, concurrency int, execute func(node *workflowNode) workflowOutcome) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	slots := make(chan bool, concurrency)
+	finished := make(map[string]chan bool)
+
+	for _, node := range ordered {
+		finished[node.Name] = make(chan bool)
+	}
+
+	var wg sync.WaitGroup
+
+	for _, node := range ordered {
+		wg.Add(1)
+
+		go func(node *workflowNode) {
+			defer wg.Done()
+			defer close(finished[node.Name])
+
+			//The status of a parent is final once it has finished
+			for _, p := range node.Definition.BasedOn {
+				parent := nodes[workflowModelName(p)]
+				<-finished[parent.Name]
+
+				if parent.Status != workflowSucceeded && node.Status == workflowPending {
+					node.Status = workflowSkipped
+					node.Reason = fmt.Sprintf("parent %s %s", parent.Name, parent.Status)
+				}
+			}
+
+			if node.Status != workflowPending {
+				return
+			}
+
+			slots <- true
+			outcome := execute(node)
+			<-slots
+
+			node.Status = outcome.Status
+			node.Reason = outcome.Reason
+			node.executed = outcome.Executed
+		}(node)
+	}
+
+	wg.Wait()
+}
+
+// wireModelSpecificationFile locates the MSFO output of the appropriate parent and records it on the model so that the
+// $MSFI record of the copied control stream references it. If no parent is named, the model is wired automatically when
+// exactly one parent writes an MSFO file
+func wireModelSpecificationFile(node *workflowNode, nodes map[string]*workflowNode) error {
+	lines, err := utils.ReadLines(node.model.Path)
+	if err != nil {
+		return err
+	}
+
+	if !parser.HasModelSpecificationFileInput(lines) {
+		if node.Definition.MSFI != "" {
+			return fmt.Errorf("msfi was set to %s but the model has no $MSFI record", node.Definition.MSFI)
+		}
+		return nil
+	}
+
+	var candidates []string
+	if node.Definition.MSFI != "" {
+		candidates = []string{node.Definition.MSFI}
+	} else {
+		candidates = node.Definition.BasedOn
+	}
+
+	var located []string
+
+	for _, c := range candidates {
+		parent := nodes[workflowModelName(c)]
+
+		parentLines, err := utils.ReadLines(parent.model.Path)
+		if err != nil {
+			return err
+		}
+
+		msfo := parser.ModelSpecificationFileOutput(parentLines)
+		if msfo == "" {
+			continue
+		}
+
+		located = append(located, filepath.Join(parent.model.OutputDir, msfo))
+	}
+
+	if len(located) == 0 {
+		if node.Definition.MSFI != "" {
+			return fmt.Errorf("parent %s does not declare MSFO on its $ESTIMATION record", node.Definition.MSFI)
+		}
+		//Nothing to wire from the parents. Leave the model to resolve its own $MSFI
+		return nil
+	}
+
+	if len(located) > 1 {
+		return errors.New("multiple parents write an MSFO file. Please select one with msfi")
+	}
+
+	if _, err := os.Stat(located[0]); err != nil {
+		return fmt.Errorf("the model specification file %s from the parent could not be located", located[0])
+	}
+
+	if !node.model.Configuration.Local.CreateChildDirs {
+		return errors.New("$MSFI wiring requires create_child_dirs so that the control stream can be copied and updated")
+	}
+
+	node.model.MSFI = located[0]
+
+	return nil
+}
+
+// previewWorkflow plans every model of the workflow in dependency order without executing any of them
+func previewWorkflow(file string, config configlib.Config) error {
+	ordered, _, err := loadWorkflow(file, config)
+	if err != nil {
+		return err
+	}
+
+	var planned []*NonMemModel
+	for _, n := range ordered {
+		planned = append(planned, n.model)
+	}
+
+	previewExecution("local", planned, viper.GetBool("json"))
+
+	return nil
+}
+
+// executedWorkflowModels are the models of the workflow which were executed, whose outcomes are in the turnstile results
+func executedWorkflowModels(nodes []*workflowNode) []*NonMemModel {
+	var models []*NonMemModel
+
+	for _, n := range nodes {
+		if n.executed {
+			models = append(models, n.model)
+		}
+	}
+
+	return models
+}
+
+func workflowSummary(nodes []*workflowNode) {
+	if Json {
+		jsonRes, _ := json.MarshalIndent(nodes, "", "\t")
+		fmt.Fprintf(consoleOutput(), "%s\n", jsonRes)
+		return
+	}
+
+	table := tablewriter.NewWriter(consoleOutput())
+	table.SetAlignment(tablewriter.ALIGN_LEFT)
+	table.SetColWidth(100)
+	table.SetHeader([]string{"Model", "Based On", "Status", "Details"})
+
+	for _, n := range nodes {
+		var parents []string
+		for _, p := range n.Definition.BasedOn {
+			parents = append(parents, workflowModelName(p))
+		}
+
+		table.Append([]string{n.Name, fmt.Sprintf("%v", parents), n.Status, n.Reason})
+	}
+
+	table.Render()
+}
@@ -0,0 +1,151 @@
+package cmd
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_workflowOrder(t *testing.T) {
+	tests := []struct {
+		name    string
+		models  []workflowModel
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "Children follow their parents",
+			models: []workflowModel{
+				{Model: "run004.mod", BasedOn: []string{"run002", "run003.mod"}, MSFI: "run002"},
+				{Model: "run002.mod", BasedOn: []string{"run001"}},
+				{Model: "run001.mod"},
+				{Model: "run003.mod", BasedOn: []string{"run001"}},
+			},
+			want: []string{"run001", "run003", "run002", "run004"},
+		},
+		{
+			name: "Unknown parent",
+			models: []workflowModel{
+				{Model: "run002.mod", BasedOn: []string{"run001"}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "MSFI parent must be listed in based_on",
+			models: []workflowModel{
+				{Model: "run001.mod"},
+				{Model: "run002.mod", MSFI: "run001"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "Cycle",
+			models: []workflowModel{
+				{Model: "run001.mod", BasedOn: []string{"run002"}},
+				{Model: "run002.mod", BasedOn: []string{"run001"}},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := workflowOrder(tt.models)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("workflowOrder() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("workflowOrder() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_scheduleWorkflow(t *testing.T) {
+	models := []workflowModel{
+		{Model: "slow.mod"},
+		{Model: "fast.mod"},
+		{Model: "child.mod", BasedOn: []string{"fast"}},
+		{Model: "broken.mod"},
+		{Model: "orphan.mod", BasedOn: []string{"broken"}},
+		{Model: "grandchild.mod", BasedOn: []string{"orphan", "child"}},
+	}
+
+	nodes := make(map[string]*workflowNode)
+	var ordered []*workflowNode
+
+	for _, m := range models {
+		node := &workflowNode{Definition: m, Name: workflowModelName(m.Model), Status: workflowPending}
+		nodes[node.Name] = node
+		ordered = append(ordered, node)
+	}
+
+	var lock sync.Mutex
+	finished := make(map[string]time.Time)
+	started := make(map[string]time.Time)
+
+	scheduleWorkflow(ordered, nodes, 3, func(node *workflowNode) workflowOutcome {
+		lock.Lock()
+		started[node.Name] = time.Now()
+		lock.Unlock()
+
+		if node.Name == "slow" {
+			time.Sleep(300 * time.Millisecond)
+		}
+
+		outcome := workflowOutcome{Status: workflowSucceeded, Executed: true}
+		if node.Name == "broken" {
+			outcome.Status = workflowFailed
+		}
+
+		lock.Lock()
+		finished[node.Name] = time.Now()
+		lock.Unlock()
+
+		return outcome
+	})
+
+	//The child of the fast model doesn't wait on the slow model, which shares no dependency with it
+	if !started["child"].Before(finished["slow"]) {
+		t.Errorf("scheduleWorkflow() waited on an unrelated model before starting child")
+	}
+
+	want := map[string]string{
+		"slow":       workflowSucceeded,
+		"fast":       workflowSucceeded,
+		"child":      workflowSucceeded,
+		"broken":     workflowFailed,
+		"orphan":     workflowSkipped,
+		"grandchild": workflowSkipped,
+	}
+
+	for name, status := range want {
+		if nodes[name].Status != status {
+			t.Errorf("scheduleWorkflow() left %s %s, want %s", name, nodes[name].Status, status)
+		}
+	}
+
+	if !nodes["child"].executed || nodes["orphan"].executed {
+		t.Errorf("scheduleWorkflow() recorded child executed = %t and orphan executed = %t", nodes["child"].executed, nodes["orphan"].executed)
+	}
+
+	if _, ok := started["orphan"]; ok {
+		t.Errorf("scheduleWorkflow() executed a model whose parent failed")
+	}
+}
+
+func Test_workflowParentExecuted(t *testing.T) {
+	nodes := map[string]*workflowNode{
+		"run001": {Name: "run001", executed: true},
+		"run002": {Name: "run002"},
+	}
+
+	if !workflowParentExecuted(&workflowNode{Definition: workflowModel{BasedOn: []string{"run002", "run001"}}}, nodes) {
+		t.Errorf("workflowParentExecuted() = false with an executed parent")
+	}
+
+	if workflowParentExecuted(&workflowNode{Definition: workflowModel{BasedOn: []string{"run002"}}}, nodes) {
+		t.Errorf("workflowParentExecuted() = true when the parent reused its outputs")
+	}
+}
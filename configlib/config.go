@@ -1,10 +1,16 @@
 package configlib
 
 import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
 	"runtime"
+	"sort"
+	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/afero"
@@ -15,6 +21,9 @@ import (
 type Config struct {
 	NMVersion          string                  `mapstructure:"nm_version" yaml:"nm_version" json:"nm_version,omitempty"`
 	Overwrite          bool                    `mapstructure:"overwrite" yaml:"overwrite" json:"overwrite,omitempty"`
+	Archive            bool                    `mapstructure:"archive" yaml:"archive" json:"archive,omitempty"`
+	ArchiveFormat      string                  `mapstructure:"archive_format" yaml:"archive_format" json:"archive_format,omitempty"`
+	Force              bool                    `mapstructure:"force" yaml:"force" json:"force,omitempty"`
 	CleanLvl           int                     `mapstructure:"clean_lvl" yaml:"clean_lvl" json:"clean_lvl,omitempty"`
 	CopyLvl            int                     `mapstructure:"copy_lvl" yaml:"copy_lvl" json:"copy_lvl,omitempty"`
 	Git                bool                    `mapstructure:"git" yaml:"git" json:"git,omitempty"`
@@ -27,6 +36,10 @@ type Config struct {
 	Nonmem             map[string]NonMemDetail `mapstructure:"nonmem" json:"nonmem,omitempty" yaml:"nonmem"`
 	Parallel           bool                    `mapstructure:"parallel" json:"parallel" yaml:"parallel"`
 	Delay              int                     `mapstructure:"delay" yaml:"delay" json:"delay,omitempty" yaml:"delay"`
+	MaxRuntime         time.Duration           `mapstructure:"max_runtime" yaml:"max_runtime" json:"max_runtime,omitempty"`
+	Retries            int                     `mapstructure:"retries" yaml:"retries" json:"retries,omitempty"`
+	RetryBackoff       time.Duration           `mapstructure:"retry_backoff" yaml:"retry_backoff" json:"retry_backoff,omitempty"`
+	RetryOn            []string                `mapstructure:"retry_on" yaml:"retry_on" json:"retry_on,omitempty"`
 	NMQual             bool                    `mapstructure:"nmqual" yaml:"nmqual" json:"nmqual,omitempty"`
 	JSON               bool                    `mapstructure:"json" yaml:"json" json:"json,omitempty"`
 	Logfile            string                  `mapstructure:"log_file" yaml:"log_file" json:"log_file,omitempty"`
@@ -34,9 +47,26 @@ type Config struct {
 	MPIExecPath        string                  `mapstructure:"mpi_exec_path" yaml:"mpi_exec_path" json:"mpi_exec_path,omitempty"`
 	ParallelTimeout    int                     `mapstructure:"parallel_timeout" yaml:"parallel_timeout" json:"parallel_timeout,omitempty"`
 	Parafile           string                  `mapstructure:"parafile" yaml:"parafile" json:"parafile,omitempty"`
+	ParallelMode       string                  `mapstructure:"parallel_mode" yaml:"parallel_mode" json:"parallel_mode,omitempty"`
+	Hostfile           string                  `mapstructure:"hostfile" yaml:"hostfile" json:"hostfile,omitempty"`
+	ParallelEnv        string                  `mapstructure:"parallel_environment" yaml:"parallel_environment" json:"parallel_environment,omitempty"`
+	PreWorkExecutable  string                  `mapstructure:"pre_work_executable" yaml:"pre_work_executable" json:"pre_work_executable,omitempty"`
 	PostWorkExecutable string                  `mapstructure:"post_work_executable" yaml:"post_work_executable" json:"post_work_executable,omitempty"`
+	PostWorkHooks      []PostWorkHook          `mapstructure:"post_work_hooks" yaml:"post_work_hooks" json:"post_work_hooks,omitempty"`
+	HookConcurrency    int                     `mapstructure:"post_work_concurrency" yaml:"post_work_concurrency" json:"post_work_concurrency,omitempty"`
+	Notifications      []Notification          `mapstructure:"notifications" yaml:"notifications" json:"notifications,omitempty"`
 	postWorkExecEnvs   []string                `mapstructure:"additional_post_work_envs" yaml:"additional_post_work_envs" json:"additional_post_work_envs,omitempty"`
 	GridNamePrefix     string                  `mapstructure:"grid_name_prefix" yaml:"grid_name_prefix" json:"grid_name_prefix,omitempty"`
+	CacheDir           string                  `mapstructure:"cache_dir" yaml:"cache_dir" json:"cache_dir,omitempty"`
+	CacheExe           string                  `mapstructure:"cache_exe" yaml:"cache_exe" json:"cache_exe,omitempty"`
+	SaveExe            string                  `mapstructure:"save_exe" yaml:"save_exe" json:"save_exe,omitempty"`
+	CacheMaxEntries    int                     `mapstructure:"cache_max_entries" yaml:"cache_max_entries" json:"cache_max_entries,omitempty"`
+	//Profile is the name of the profile applied over the configuration files
+	Profile string `mapstructure:"profile" yaml:"profile,omitempty" json:"profile,omitempty"`
+	//ProfileApplied marks a configuration saved with a run, whose settings already include its profile
+	ProfileApplied bool `mapstructure:"profile_applied" yaml:"profile_applied,omitempty" json:"profile_applied,omitempty"`
+	//Profiles are named sets of settings, one of which is selected with --profile
+	Profiles map[string]map[string]interface{} `mapstructure:"profiles" yaml:"profiles,omitempty" json:"-"`
 }
 
 func (c *Config) GetPostWorkExecEnvs() []string {
@@ -54,6 +84,25 @@ type NonMemDetail struct {
 	Default    bool   `mapstructure:"default" yaml:"default" json:"default,omitempty"`
 }
 
+//PostWorkHook is a script or binary run after each model, in order with the other hooks. A failed required hook fails
+//the model
+type PostWorkHook struct {
+	Name       string        `mapstructure:"name" yaml:"name" json:"name,omitempty"`
+	Executable string        `mapstructure:"executable" yaml:"executable" json:"executable,omitempty"`
+	Timeout    time.Duration `mapstructure:"timeout" yaml:"timeout" json:"timeout,omitempty"`
+	Required   bool          `mapstructure:"required" yaml:"required" json:"required,omitempty"`
+}
+
+//Notification is a sink for batch level notifications. Either a URL to which the payload is posted, or a shell command
+//which receives it on stdin
+type Notification struct {
+	URL     string            `mapstructure:"url" yaml:"url" json:"url,omitempty"`
+	Command string            `mapstructure:"command" yaml:"command" json:"command,omitempty"`
+	Headers map[string]string `mapstructure:"headers" yaml:"headers" json:"headers,omitempty"`
+	On      []string          `mapstructure:"on" yaml:"on" json:"on,omitempty"`
+	Timeout time.Duration     `mapstructure:"timeout" yaml:"timeout" json:"timeout,omitempty"`
+}
+
 type LocalDetail struct {
 	CreateChildDirs bool `mapstructure:"create_child_dirs" yaml:"create_child_dirs" json:"create_child_dirs,omitempty"`
 }
@@ -130,10 +179,16 @@ func WriteViperConfig(path string, sge bool, config Config) error {
 		//around the SGE output streams
 		log.Debug("Updating bbi config to overwrite=false. This avoids IO contention with the grid engine for the next execution round")
 		config.Overwrite = false
+		config.Archive = false
 		config.SaveConfig = false
 		config.Local.CreateChildDirs = false
 	}
 
+	//The saved configuration already has its profile applied. Only the name is kept as a record, marked as applied so
+	//that a profile of the same name in the system or user configuration isn't applied again when it is read
+	config.Profiles = nil
+	config.ProfileApplied = config.Profile != ""
+
 	log.Debugf("Requested save of config file %s", path)
 
 	err := config.RenderYamlToFile(path)
@@ -171,54 +226,366 @@ func ReadSpecifiedFileIntoConfigStruct(config string) (Config, error) {
 	return returnConfig, nil
 }
 
-func LocateAndReadConfigFile() (Config, error) {
+//SystemConfigFile is the configuration shared by every user of the machine, read before any other configuration
+var SystemConfigFile = "/etc/bbi/bbi.yaml"
 
-	var config Config
+//ConfigLayer is a configuration file merged into the effective configuration. Later layers take precedence
+type ConfigLayer struct {
+	Name  string `json:"name"`
+	Path  string `json:"path"`
+	Found bool   `json:"found"`
+}
 
-	if len(viper.GetString("config")) == 0 {
-		log.Debug("No config has been specified. Attempting to load default")
-		currentDir, err := os.Getwd()
+//UserConfigFile is the configuration of the current user, within $XDG_CONFIG_HOME or ~/.config
+func UserConfigFile() (string, error) {
+	if xdg := os.Getenv("XDG_CONFIG_HOME"); xdg != "" {
+		return filepath.Join(xdg, "bbi", "bbi.yaml"), nil
+	}
 
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(home, ".config", "bbi", "bbi.yaml"), nil
+}
+
+//ConfigLayers lists the system, user, project and --config files in the order they are merged
+func ConfigLayers() ([]ConfigLayer, error) {
+	var layers []ConfigLayer
+
+	layers = append(layers, ConfigLayer{Name: "system", Path: SystemConfigFile})
+
+	//Without a home directory, there is simply no user configuration
+	if user, err := UserConfigFile(); err == nil {
+		layers = append(layers, ConfigLayer{Name: "user", Path: user})
+	}
+
+	currentDir, err := os.Getwd()
+	if err != nil {
+		return layers, fmt.Errorf("unable to determine the current directory to locate bbi.yaml: %w", err)
+	}
+
+	project := filepath.Join(currentDir, "bbi.yaml")
+	layers = append(layers, ConfigLayer{Name: "project", Path: project})
+
+	if specified := viper.GetString("config"); specified != "" {
+		specified, err = filepath.Abs(specified)
 		if err != nil {
-			log.Fatalf("No specific config file provided, and we couldn't get the current working directory for some reason: %s", err)
+			return layers, err
 		}
 
-		config, err = ReadSpecifiedFileIntoConfigStruct(filepath.Join(currentDir, "bbi.yaml"))
+		//A --config pointing at the project file is only read once
+		if specified != project {
+			layers = append(layers, ConfigLayer{Name: "config", Path: specified})
+		}
+	}
 
-		if err != nil {
-			log.Fatalf("We couldn't open and read the details from the default configuration file location: %s", err)
+	for i, l := range layers {
+		if info, err := os.Stat(l.Path); err == nil && !info.IsDir() {
+			layers[i].Found = true
 		}
+	}
+
+	return layers, nil
+}
+
+//deprecatedKeys maps the former names of settings to their current names. Configurations using the former names are
+//still read
+var deprecatedKeys = map[string]string{
+	"cacheDir":        "cache_dir",
+	"cacheExe":        "cache_exe",
+	"saveExe":         "save_exe",
+	"cacheMaxEntries": "cache_max_entries",
+}
 
-		log.Infof("Successfully loaded default configuration from %s", filepath.Join(currentDir, "bbi.yaml"))
+func init() {
+	for former, key := range deprecatedKeys {
+		viper.RegisterAlias(former, key)
 	}
+}
 
-	//Config provided
-	if len(viper.GetString("config")) > 0 {
-		log.Debugf("A config file has been specified at %s", viper.GetString("config"))
-		var err error
-		config, err = ReadSpecifiedFileIntoConfigStruct(viper.GetString("config"))
+//RenamedKey returns the current name of a setting, which differs from name if it is the former name of the setting
+func RenamedKey(name string) string {
+	for former, key := range deprecatedKeys {
+		if strings.EqualFold(name, former) {
+			return key
+		}
+	}
 
+	return name
+}
+
+//renameDeprecatedKeys moves settings provided under their former names to their current names, returning the former
+//names used. Viper only resolves aliases for the values it is given after they are registered, so merged configurations
+//are renamed before merging. A setting provided under both names keeps the value of its current name
+func renameDeprecatedKeys(settings map[string]interface{}) []string {
+	var renamed []string
+
+	for name, value := range settings {
+		key := RenamedKey(name)
+		if key == name {
+			continue
+		}
+
+		delete(settings, name)
+		if _, ok := settings[key]; !ok {
+			settings[key] = value
+		}
+
+		renamed = append(renamed, name)
+	}
+
+	sort.Strings(renamed)
+	return renamed
+}
+
+//pathSettings are the settings holding paths, which are relative to the directory of the file declaring them
+var pathSettings = []string{
+	"post_work_executable",
+	"pre_work_executable",
+	"post_work_hooks",
+	"notifications",
+	"parafile",
+	"hostfile",
+	"cache_dir",
+}
+
+//declaredSetting is the value of a path setting as declared by a configuration file, along with the directory of the file
+type declaredSetting struct {
+	dir   string
+	value interface{}
+}
+
+//readConfigLayers validates each configuration file found and merges them into viper, followed by the selected
+//profile. The settings of the profile are returned, along with the path settings declared by the files
+func readConfigLayers(layers []ConfigLayer) (map[string]interface{}, map[string]declaredSetting, error) {
+	read := 0
+	recorded := ""
+	applied := false
+	declared := make(map[string]declaredSetting)
+
+	for _, l := range layers {
+		if !l.Found {
+			if l.Name == "config" {
+				return nil, nil, fmt.Errorf("the configuration file provided at %s does not exist", l.Path)
+			}
+
+			continue
+		}
+
+		contents, err := ioutil.ReadFile(l.Path)
 		if err != nil {
-			log.Fatalf("Configuration file provided at %s could not be loaded. Error is: %s ", viper.GetString("config"), err)
+			return nil, nil, fmt.Errorf("unable to read the %s configuration at %s: %w", l.Name, l.Path, err)
+		}
+
+		if err = ValidateConfigContents(l.Path, contents); err != nil {
+			return nil, nil, err
+		}
+
+		var document interface{}
+		if err = yaml.Unmarshal(contents, &document); err != nil {
+			return nil, nil, err
+		}
+
+		//The first file replaces anything viper read previously, with the rest merged over it
+		if read == 0 {
+			viper.ReadConfig(bytes.NewReader(nil))
+		}
+
+		if settings, ok := normalizeYaml(document).(map[string]interface{}); ok {
+			for _, name := range renameDeprecatedKeys(settings) {
+				log.Warnf("The %s setting in %s has been renamed %s", name, l.Path, RenamedKey(name))
+			}
+
+			if err = viper.MergeConfigMap(settings); err != nil {
+				return nil, nil, fmt.Errorf("unable to merge the %s configuration at %s: %w", l.Name, l.Path, err)
+			}
+
+			for _, key := range pathSettings {
+				for k, v := range settings {
+					if strings.EqualFold(k, key) {
+						declared[key] = declaredSetting{dir: filepath.Dir(l.Path), value: v}
+					}
+				}
+			}
+
+			if profile, ok := settings["profile"].(string); ok {
+				recorded = profile
+				applied, _ = settings["profile_applied"].(bool)
+			}
+		}
+
+		log.Debugf("Loaded the %s configuration from %s", l.Name, l.Path)
+		read++
+	}
+
+	if read == 0 {
+		var searched []string
+		for _, l := range layers {
+			searched = append(searched, l.Path)
+		}
+
+		return nil, nil, fmt.Errorf("no configuration was located at %s. Run bbi init to create a bbi.yaml", strings.Join(searched, ", "))
+	}
+
+	profile, err := applyProfile(recorded, applied)
+
+	return profile, declared, err
+}
+
+//applyProfile merges the profile selected with --profile, BBI_PROFILE or the profile key over the configuration files.
+//Configurations saved with a run have their profile applied already, so the profile they record is not applied again,
+//even when the system or user configuration defines it
+func applyProfile(recorded string, applied bool) (map[string]interface{}, error) {
+	name := viper.GetString("profile")
+	if name == "" {
+		return nil, nil
+	}
+
+	if applied && strings.EqualFold(name, recorded) {
+		log.Debugf("The profile %s was applied when the configuration was saved", name)
+		return nil, nil
+	}
+
+	profiles := viper.GetStringMap("profiles")
+
+	//Viper stores the names of profiles in lower case
+	if profile, ok := profiles[strings.ToLower(name)]; ok {
+		settings, _ := profile.(map[string]interface{})
+		for _, former := range renameDeprecatedKeys(settings) {
+			log.Warnf("The %s setting of the profile %s has been renamed %s", former, name, RenamedKey(former))
 		}
 
-		log.Infof("Successfully loaded specified configuration from %s", viper.GetString("config"))
+		if err := viper.MergeConfigMap(settings); err != nil {
+			return nil, fmt.Errorf("unable to apply the profile %s: %w", name, err)
+		}
+
+		log.Debugf("Applied the profile %s", name)
+		return settings, nil
+	}
+
+	if len(profiles) == 0 && strings.EqualFold(name, recorded) {
+		return nil, nil
+	}
+
+	var available []string
+	for p := range profiles {
+		available = append(available, p)
+	}
+	sort.Strings(available)
+
+	if len(available) == 0 {
+		return nil, fmt.Errorf("the profile %s was selected, but no profiles are defined in the configuration", name)
+	}
+
+	return nil, fmt.Errorf("the profile %s is not defined. The profiles available are %s", name, strings.Join(available, ", "))
+}
+
+//LocateAndReadConfigFile merges the system, user, project and --config files, with flags and BBI_ environment variables
+//taking precedence over them, into the configuration used for execution
+func LocateAndReadConfigFile() (Config, error) {
+
+	var config Config
+
+	layers, err := ConfigLayers()
+	if err != nil {
+		return config, err
+	}
+
+	_, declared, err := readConfigLayers(layers)
+	if err != nil {
+		return config, err
+	}
+
+	if err = viper.Unmarshal(&config); err != nil {
+		return config, fmt.Errorf("unable to process the configuration: %w", err)
+	}
+
+	for _, l := range layers {
+		if l.Found {
+			log.Infof("Successfully loaded %s configuration from %s", l.Name, l.Path)
+		}
+	}
+
+	if config.Profile != "" {
+		log.Infof("Using the %s profile", config.Profile)
 	}
 
 	// Write in the additional (private) contents
 	config.SetPostWorkExecEnvs(viper.GetStringSlice("additional_post_work_envs"))
 
-	// Now, let's make sure we have a fully qualified path to the Execution script
-	if config.PostWorkExecutable != "" && !filepath.IsAbs(config.PostWorkExecutable) {
-		//Let's re-write with the full path.
-		whereami, err := os.Getwd()
+	if err = config.resolvePaths(declared); err != nil {
+		return config, err
+	}
+
+	return config, nil
+}
 
-		if err != nil {
-			return config, err
+//resolvePaths qualifies the relative paths of the configuration. Paths declared by a configuration file are relative to
+//the directory of that file, so that a path in the user configuration refers to the same place from every project.
+//Paths given through flags, environment variables or profiles are relative to the current directory
+func (c *Config) resolvePaths(declared map[string]declaredSetting) error {
+	whereami, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+
+	//A value which differs from the one declared by a file was overridden, so isn't relative to that file. Lists are
+	//only ever declared by files
+	dir := func(key string, value string) string {
+		if d, ok := declared[key]; ok && (value == "" || fmt.Sprint(d.value) == value) {
+			return d.dir
 		}
 
-		config.PostWorkExecutable = filepath.Join(whereami, config.PostWorkExecutable)
+		return whereami
 	}
 
-	return config, nil
+	resolve := func(key string, value string) string {
+		if value == "" || filepath.IsAbs(value) {
+			return value
+		}
+
+		return filepath.Join(dir(key, value), value)
+	}
+
+	c.PostWorkExecutable = resolve("post_work_executable", c.PostWorkExecutable)
+	c.PreWorkExecutable = resolve("pre_work_executable", c.PreWorkExecutable)
+
+	for i, h := range c.PostWorkHooks {
+		if h.Executable != "" && !filepath.IsAbs(h.Executable) {
+			c.PostWorkHooks[i].Executable = filepath.Join(dir("post_work_hooks", ""), h.Executable)
+		}
+	}
+
+	//Notification commands run through the shell from other directories, so only the executable leading the command is
+	//qualified. Executables without a directory are located on the path
+	for i, n := range c.Notifications {
+		command := strings.TrimSpace(n.Command)
+		executable, arguments := command, ""
+		if split := strings.IndexAny(command, " \t"); split >= 0 {
+			executable, arguments = command[:split], command[split:]
+		}
+
+		if executable != "" && !filepath.IsAbs(executable) && strings.ContainsRune(executable, filepath.Separator) {
+			c.Notifications[i].Command = shellQuote(filepath.Join(dir("notifications", ""), executable)) + arguments
+		}
+	}
+
+	//The parafile is read from within each output directory, and the cache is shared between models in different
+	//directories, so they are fully qualified as well
+	c.Parafile = resolve("parafile", c.Parafile)
+	c.Hostfile = resolve("hostfile", c.Hostfile)
+	c.CacheDir = resolve("cache_dir", c.CacheDir)
+
+	return nil
+}
+
+//shellQuote quotes a path for the shell if it contains any characters the shell would interpret
+func shellQuote(path string) string {
+	if !strings.ContainsAny(path, " \t\n'\"\\$`;&|<>()*?[]#~{}") {
+		return path
+	}
+
+	return "'" + strings.ReplaceAll(path, "'", `'\''`) + "'"
 }
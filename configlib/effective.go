@@ -0,0 +1,129 @@
+package configlib
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v2"
+)
+
+// ConfigValue is a setting of the effective configuration, along with where its value came from
+type ConfigValue struct {
+	Key   string      `json:"key"`
+	Value interface{} `json:"value"`
+	//Source is default, flag, env, profile or the name of the configuration layer which set the value
+	Source string `json:"source"`
+	//Origin is the file, environment variable, profile or flag providing the value
+	Origin string `json:"origin,omitempty"`
+}
+
+// EffectiveConfig merges the configuration layers and reports each resulting setting along with its source. flagChanged
+// indicates whether the flag bound to a key was provided on the command line
+func EffectiveConfig(flagChanged func(key string) bool) ([]ConfigLayer, []ConfigValue, error) {
+	layers, err := ConfigLayers()
+	if err != nil {
+		return layers, nil, err
+	}
+
+	profile, _, err := readConfigLayers(layers)
+	if err != nil {
+		return layers, nil, err
+	}
+
+	profileKeys := make(map[string]bool)
+	flattenKeys(profile, "", profileKeys)
+
+	//The keys set by each file
+	layerKeys := make([]map[string]bool, len(layers))
+	for i, l := range layers {
+		layerKeys[i] = make(map[string]bool)
+
+		if !l.Found {
+			continue
+		}
+
+		contents, err := ioutil.ReadFile(l.Path)
+		if err != nil {
+			return layers, nil, err
+		}
+
+		var document interface{}
+		if err = yaml.Unmarshal(contents, &document); err != nil {
+			return layers, nil, err
+		}
+
+		settings := normalizeYaml(document)
+		if m, ok := settings.(map[string]interface{}); ok {
+			renameDeprecatedKeys(m)
+		}
+
+		flattenKeys(settings, "", layerKeys[i])
+	}
+
+	var values []ConfigValue
+
+	keys := viper.AllKeys()
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		//Viper lists the former names of settings alongside their current names
+		if RenamedKey(key) != key {
+			continue
+		}
+
+		value := ConfigValue{
+			Key:    key,
+			Value:  viper.Get(key),
+			Source: "default",
+		}
+
+		envName := "BBI_" + strings.ToUpper(key)
+
+		switch _, fromEnv := os.LookupEnv(envName); {
+		case flagChanged != nil && flagChanged(key):
+			value.Source = "flag"
+			value.Origin = "--" + key[strings.LastIndex(key, ".")+1:]
+		case fromEnv:
+			value.Source = "env"
+			value.Origin = envName
+		case profileKeys[key]:
+			value.Source = "profile"
+			value.Origin = viper.GetString("profile")
+		default:
+			for i := len(layers) - 1; i >= 0; i-- {
+				if layerKeys[i][key] {
+					value.Source = layers[i].Name
+					value.Origin = layers[i].Path
+					break
+				}
+			}
+		}
+
+		values = append(values, value)
+	}
+
+	return layers, values, nil
+}
+
+// flattenKeys collects the dotted, lower case keys of the settings within a document, as viper names them
+func flattenKeys(value interface{}, prefix string, keys map[string]bool) {
+	settings, ok := value.(map[string]interface{})
+	if !ok {
+		if prefix != "" {
+			keys[prefix] = true
+		}
+		return
+	}
+
+	for k, v := range settings {
+		key := strings.ToLower(k)
+		if prefix != "" {
+			key = prefix + "." + key
+		}
+
+		flattenKeys(v, key, keys)
+	}
+}
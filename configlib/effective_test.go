@@ -0,0 +1,303 @@
+package configlib
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestEffectiveConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bbi_config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	system := filepath.Join(dir, "etc", "bbi.yaml")
+	user := filepath.Join(dir, "xdg", "bbi", "bbi.yaml")
+	project := filepath.Join(dir, "project")
+	specified := filepath.Join(dir, "ci.yaml")
+
+	for _, d := range []string{filepath.Dir(system), filepath.Dir(user), project} {
+		os.MkdirAll(d, 0750)
+	}
+
+	ioutil.WriteFile(system, []byte("threads: 2\nclean_lvl: 2\nnonmem:\n  nm74gf:\n    home: /opt/NONMEM/nm74gf\n"), 0640)
+	//The cache settings are still read under their former names
+	ioutil.WriteFile(user, []byte("threads: 4\noverwrite: true\ncacheDir: nmcache\n"), 0640)
+	ioutil.WriteFile(filepath.Join(project, "bbi.yaml"), []byte("threads: 8\nnonmem:\n  nm74gf:\n    executable: nmfe74\nnotifications:\n  - command: notify.sh\n    on: [model_failed]\n"), 0640)
+	ioutil.WriteFile(specified, []byte("copy_lvl: 1\n"), 0640)
+
+	previousSystem := SystemConfigFile
+	SystemConfigFile = system
+	defer func() { SystemConfigFile = previousSystem }()
+
+	os.Setenv("XDG_CONFIG_HOME", filepath.Join(dir, "xdg"))
+	defer os.Unsetenv("XDG_CONFIG_HOME")
+
+	os.Setenv("BBI_COPY_LVL", "3")
+	defer os.Unsetenv("BBI_COPY_LVL")
+
+	whereami, _ := os.Getwd()
+	os.Chdir(project)
+	defer os.Chdir(whereami)
+
+	viper.Reset()
+	viper.SetConfigType("yaml")
+	viper.AutomaticEnv()
+	viper.SetEnvPrefix("bbi")
+	viper.Set("config", specified)
+	defer viper.Reset()
+
+	layers, values, err := EffectiveConfig(func(key string) bool { return key == "clean_lvl" })
+	if err != nil {
+		t.Fatalf("EffectiveConfig() error = %s", err)
+	}
+
+	if len(layers) != 4 || layers[3].Name != "config" {
+		t.Fatalf("EffectiveConfig() layers = %+v", layers)
+	}
+
+	sources := make(map[string]string)
+	for _, v := range values {
+		sources[v.Key] = v.Source
+	}
+
+	want := map[string]string{
+		"threads":                  "project",
+		"overwrite":                "user",
+		"nonmem.nm74gf.home":       "system",
+		"nonmem.nm74gf.executable": "project",
+		"copy_lvl":                 "env",
+		"clean_lvl":                "flag",
+		"cache_dir":                "user",
+	}
+
+	for key, source := range want {
+		if sources[key] != source {
+			t.Errorf("%s came from %s, want %s", key, sources[key], source)
+		}
+	}
+
+	if _, ok := sources["cachedir"]; ok {
+		t.Errorf("EffectiveConfig() listed the former name of cache_dir")
+	}
+
+	config, err := LocateAndReadConfigFile()
+	if err != nil {
+		t.Fatalf("LocateAndReadConfigFile() error = %s", err)
+	}
+
+	if config.CacheDir != filepath.Join(filepath.Dir(user), "nmcache") {
+		t.Errorf("LocateAndReadConfigFile() cache_dir = %s, want the value of cacheDir", config.CacheDir)
+	}
+
+	if config.Threads != 8 || !config.Overwrite || config.Nonmem["nm74gf"].Home != "/opt/NONMEM/nm74gf" || config.CopyLvl != 3 {
+		t.Errorf("LocateAndReadConfigFile() = %+v, want the merged configuration", config)
+	}
+
+	//yaml 1.1 reads the on key as a boolean
+	if len(config.Notifications) != 1 || len(config.Notifications[0].On) != 1 || config.Notifications[0].On[0] != "model_failed" {
+		t.Errorf("LocateAndReadConfigFile() notifications = %+v, want the events of the on key", config.Notifications)
+	}
+
+	//Invalid files are reported rather than ignored
+	ioutil.WriteFile(user, []byte("thread: 4\n"), 0640)
+
+	if _, err := LocateAndReadConfigFile(); err == nil {
+		t.Errorf("LocateAndReadConfigFile() accepted an unknown key")
+	}
+}
+
+func TestRelativePaths(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bbi_config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	user := filepath.Join(dir, "xdg", "bbi")
+	project := filepath.Join(dir, "project")
+
+	for _, d := range []string{user, project} {
+		os.MkdirAll(d, 0750)
+	}
+
+	ioutil.WriteFile(filepath.Join(user, "bbi.yaml"), []byte("cache_dir: cache\npost_work_executable: post.sh\nnotifications:\n  - command: bin/notify.sh --channel models\n"), 0640)
+	ioutil.WriteFile(filepath.Join(project, "bbi.yaml"), []byte("parafile: mpi.pnm\n"), 0640)
+
+	previousSystem := SystemConfigFile
+	SystemConfigFile = filepath.Join(dir, "missing.yaml")
+	defer func() { SystemConfigFile = previousSystem }()
+
+	os.Setenv("XDG_CONFIG_HOME", filepath.Join(dir, "xdg"))
+	defer os.Unsetenv("XDG_CONFIG_HOME")
+
+	whereami, _ := os.Getwd()
+	os.Chdir(project)
+	defer os.Chdir(whereami)
+
+	viper.Reset()
+	viper.SetConfigType("yaml")
+	//A flag overrides the path of the user configuration, so is relative to the current directory
+	viper.Set("post_work_executable", "flagged.sh")
+	defer viper.Reset()
+
+	config, err := LocateAndReadConfigFile()
+	if err != nil {
+		t.Fatalf("LocateAndReadConfigFile() error = %s", err)
+	}
+
+	want := map[string][2]string{
+		"cache_dir":            {config.CacheDir, filepath.Join(user, "cache")},
+		"notifications":        {strings.TrimSuffix(config.Notifications[0].Command, " --channel models"), filepath.Join(user, "bin", "notify.sh")},
+		"parafile":             {config.Parafile, filepath.Join(project, "mpi.pnm")},
+		"post_work_executable": {config.PostWorkExecutable, filepath.Join(project, "flagged.sh")},
+	}
+
+	for key, paths := range want {
+		//The temporary directory may be reached through a symlink
+		got, _ := filepath.EvalSymlinks(filepath.Dir(paths[0]))
+		expected, _ := filepath.EvalSymlinks(filepath.Dir(paths[1]))
+
+		if got != expected || filepath.Base(paths[0]) != filepath.Base(paths[1]) {
+			t.Errorf("LocateAndReadConfigFile() %s = %s, want %s", key, paths[0], paths[1])
+		}
+	}
+
+	//Only the executable of a notification command is qualified
+	if !strings.HasSuffix(config.Notifications[0].Command, " --channel models") {
+		t.Errorf("LocateAndReadConfigFile() notification command = %s, want its arguments kept", config.Notifications[0].Command)
+	}
+
+	if got := shellQuote("/data/my project/notify.sh"); got != "'/data/my project/notify.sh'" {
+		t.Errorf("shellQuote() = %s, want the path quoted", got)
+	}
+}
+
+func TestProfiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bbi_profiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "bbi.yaml"), []byte(`threads: 4
+nm_version: nm74gf
+profiles:
+  quick:
+    threads: 1
+    clean_lvl: 0
+  Grid:
+    threads: 32
+    parallel: true
+    nmfe_options:
+      maxlim: 2
+  validated:
+    nmqual: true
+    nm_version: nm74nmqual
+`), 0640)
+
+	previousSystem := SystemConfigFile
+	SystemConfigFile = filepath.Join(dir, "missing.yaml")
+	defer func() { SystemConfigFile = previousSystem }()
+
+	os.Setenv("XDG_CONFIG_HOME", filepath.Join(dir, "xdg"))
+	defer os.Unsetenv("XDG_CONFIG_HOME")
+
+	whereami, _ := os.Getwd()
+	os.Chdir(dir)
+	defer os.Chdir(whereami)
+
+	defer viper.Reset()
+
+	tests := []struct {
+		profile  string
+		threads  int
+		parallel bool
+		maxlim   int
+		version  string
+		wantErr  bool
+	}{
+		{profile: "", threads: 4, version: "nm74gf"},
+		{profile: "grid", threads: 32, parallel: true, maxlim: 2, version: "nm74gf"},
+		{profile: "validated", threads: 4, version: "nm74nmqual"},
+		{profile: "missing", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.profile, func(t *testing.T) {
+			viper.Reset()
+			viper.Set("profile", tt.profile)
+
+			config, err := LocateAndReadConfigFile()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LocateAndReadConfigFile() error = %v, wantErr %t", err, tt.wantErr)
+			}
+
+			if tt.wantErr {
+				return
+			}
+
+			if config.Threads != tt.threads || config.Parallel != tt.parallel || config.NMFEOptions.MaxLim != tt.maxlim || config.NMVersion != tt.version || config.Profile != tt.profile {
+				t.Errorf("LocateAndReadConfigFile() with profile %s = %+v", tt.profile, config)
+			}
+		})
+	}
+
+	//Saved configurations record the profile which was applied, and are read without the profiles
+	viper.Reset()
+	viper.Set("profile", "grid")
+
+	config, err := LocateAndReadConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	output := filepath.Join(dir, "run001")
+	os.Mkdir(output, 0750)
+	WriteViperConfig(output, true, config)
+
+	os.Chdir(output)
+	viper.Reset()
+
+	saved, err := LocateAndReadConfigFile()
+	if err != nil {
+		t.Fatalf("LocateAndReadConfigFile() of the saved configuration error = %s", err)
+	}
+
+	if saved.Profile != "grid" || saved.Threads != 32 || len(saved.Profiles) != 0 {
+		t.Errorf("LocateAndReadConfigFile() of the saved configuration = %+v", saved)
+	}
+
+	//A profile of the same name in the user configuration doesn't undo the flags given when the run was submitted
+	viper.Reset()
+	os.Chdir(dir)
+	viper.Set("profile", "grid")
+	viper.Set("threads", 4)
+
+	config, err = LocateAndReadConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	WriteViperConfig(output, true, config)
+
+	os.MkdirAll(filepath.Join(dir, "xdg", "bbi"), 0750)
+	ioutil.WriteFile(filepath.Join(dir, "xdg", "bbi", "bbi.yaml"), []byte("profiles:\n  grid:\n    threads: 16\n"), 0640)
+
+	os.Chdir(output)
+	viper.Reset()
+
+	saved, err = LocateAndReadConfigFile()
+	if err != nil {
+		t.Fatalf("LocateAndReadConfigFile() of the saved configuration error = %s", err)
+	}
+
+	if saved.Threads != 4 || !saved.ProfileApplied {
+		t.Errorf("LocateAndReadConfigFile() of the saved configuration applied the profile again: threads = %d", saved.Threads)
+	}
+}
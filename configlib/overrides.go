@@ -0,0 +1,159 @@
+package configlib
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mitchellh/mapstructure"
+)
+
+// ParseOverrides converts settings written as dotted keys and string values, such as nmfe_options.maxlim=3, into the
+// nested and typed form of bbi.yaml. Only settings holding a single value or a comma separated list may be overridden
+func ParseOverrides(assignments map[string]string) (map[string]interface{}, error) {
+	schema := Schema()
+	overrides := make(map[string]interface{})
+
+	var keys []string
+	for k := range assignments {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		path := strings.Split(key, ".")
+
+		setting, err := settingSchema(schema, path)
+		if err != nil {
+			return nil, err
+		}
+
+		value, err := parseSettingValue(setting, assignments[key])
+		if err != nil {
+			return nil, ValidationError{Key: key, Message: err.Error()}
+		}
+
+		//Build the nested maps leading to the setting
+		target := overrides
+		for _, p := range path[:len(path)-1] {
+			child, ok := target[p].(map[string]interface{})
+			if !ok {
+				child = make(map[string]interface{})
+				target[p] = child
+			}
+			target = child
+		}
+
+		target[path[len(path)-1]] = value
+	}
+
+	if errs := validateAgainstSchema(schema, overrides, ""); len(errs) > 0 {
+		return nil, errs
+	}
+
+	return overrides, nil
+}
+
+// settingSchema locates the schema of a setting which can be overridden from its dotted path
+func settingSchema(schema map[string]interface{}, path []string) (map[string]interface{}, error) {
+	current := schema
+
+	for i, p := range path {
+		key := strings.Join(path[:i+1], ".")
+		properties, _ := current["properties"].(map[string]interface{})
+
+		property, ok := lookupProperty(properties, p)
+		if !ok {
+			return nil, ValidationError{Key: key, Message: unknownKeyMessage(p, properties)}
+		}
+
+		current = property.(map[string]interface{})
+
+		if current["type"] == "object" && i == len(path)-1 {
+			return nil, ValidationError{Key: key, Message: "is a group of settings. Set one of the settings within it instead"}
+		}
+	}
+
+	if key := strings.Join(path, "."); key == "profile" || key == "profiles" {
+		return nil, ValidationError{Key: key, Message: "can only be selected for the whole batch"}
+	}
+
+	if items, ok := current["items"].(map[string]interface{}); ok && items["type"] == "object" {
+		return nil, ValidationError{Key: strings.Join(path, "."), Message: "cannot be set for a single model"}
+	}
+
+	return current, nil
+}
+
+// parseSettingValue converts the string form of a value into the type of the setting
+func parseSettingValue(setting map[string]interface{}, value string) (interface{}, error) {
+	switch setting["type"] {
+	case "boolean":
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("must be true or false, not %s", value)
+		}
+		return parsed, nil
+	case "integer":
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("must be an integer, not %s", value)
+		}
+		return parsed, nil
+	case "number":
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("must be a number, not %s", value)
+		}
+		return parsed, nil
+	case "array":
+		var items []interface{}
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		return items, nil
+	}
+
+	//Strings and durations, which are validated as strings
+	return value, nil
+}
+
+// ApplyOverrides returns a copy of the configuration with the overrides produced by ParseOverrides merged over it
+func (c Config) ApplyOverrides(overrides map[string]interface{}) (Config, error) {
+	merged := c
+
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook: mapstructure.ComposeDecodeHookFunc(
+			mapstructure.StringToTimeDurationHookFunc(),
+			mapstructure.StringToSliceHookFunc(","),
+		),
+		WeaklyTypedInput: true,
+		Result:           &merged,
+	})
+
+	if err != nil {
+		return c, err
+	}
+
+	//Lists are replaced rather than decoded into, so they must not share their backing arrays with the batch
+	t := reflect.TypeOf(merged)
+	v := reflect.ValueOf(&merged).Elem()
+
+	for i := 0; i < t.NumField(); i++ {
+		key := strings.Split(t.Field(i).Tag.Get("mapstructure"), ",")[0]
+
+		if _, ok := overrides[key].([]interface{}); ok && v.Field(i).CanSet() {
+			v.Field(i).Set(reflect.Zero(t.Field(i).Type))
+		}
+	}
+
+	if err = decoder.Decode(overrides); err != nil {
+		return c, err
+	}
+
+	return merged, nil
+}
@@ -0,0 +1,89 @@
+package configlib
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseOverrides(t *testing.T) {
+	tests := []struct {
+		name        string
+		assignments map[string]string
+		wantErr     string
+	}{
+		{
+			name:        "valid settings",
+			assignments: map[string]string{"parallel": "true", "threads": "8", "nmfe_options.maxlim": "2", "max_runtime": "2h"},
+		},
+		{
+			name:        "typo",
+			assignments: map[string]string{"thread": "8"},
+			wantErr:     "Did you mean threads?",
+		},
+		{
+			name:        "wrong type",
+			assignments: map[string]string{"threads": "many"},
+			wantErr:     "must be an integer",
+		},
+		{
+			name:        "invalid enum",
+			assignments: map[string]string{"parallel_mode": "openmp"},
+			wantErr:     "must be one of",
+		},
+		{
+			name:        "group of settings",
+			assignments: map[string]string{"nmfe_options": "maxlim"},
+			wantErr:     "is a group of settings",
+		},
+		{
+			name:        "profile",
+			assignments: map[string]string{"profile": "cluster"},
+			wantErr:     "whole batch",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseOverrides(tt.assignments)
+
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("ParseOverrides() error = %s", err)
+			}
+
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("ParseOverrides() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestApplyOverrides(t *testing.T) {
+	config := Config{
+		Threads:     2,
+		RetryOn:     []string{"timeout", "signal"},
+		NMFEOptions: NMFEOptions{PRSame: true, MaxLim: 3},
+	}
+
+	overrides, err := ParseOverrides(map[string]string{"threads": "8", "nmfe_options.maxlim": "2", "retry_on": "license", "max_runtime": "90m"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	merged, err := config.ApplyOverrides(overrides)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if merged.Threads != 8 || merged.NMFEOptions.MaxLim != 2 || !merged.NMFEOptions.PRSame || merged.MaxRuntime != 90*time.Minute {
+		t.Errorf("ApplyOverrides() = %+v", merged)
+	}
+
+	if len(merged.RetryOn) != 1 || merged.RetryOn[0] != "license" {
+		t.Errorf("RetryOn = %v, want [license]", merged.RetryOn)
+	}
+
+	if config.Threads != 2 || config.RetryOn[0] != "timeout" || len(config.RetryOn) != 2 {
+		t.Errorf("the original configuration was changed: %+v", config)
+	}
+}
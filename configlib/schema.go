@@ -0,0 +1,444 @@
+package configlib
+
+import (
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// SchemaID identifies the JSON Schema describing bbi.yaml
+const SchemaID string = "https://metrumresearchgroup.github.io/bbi/bbi.schema.json"
+
+// schemaConstraints narrows the values of settings beyond their type. Keys are the dotted paths of settings, with * in
+// place of map keys and list items
+var schemaConstraints = map[string]map[string]interface{}{
+	"clean_lvl":             {"minimum": 0},
+	"copy_lvl":              {"minimum": 0},
+	"threads":               {"minimum": 0},
+	"delay":                 {"minimum": 0},
+	"retries":               {"minimum": 0},
+	"parallel_timeout":      {"minimum": 0},
+	"post_work_concurrency": {"minimum": 0},
+	"cache_max_entries":     {"minimum": 0},
+	"parallel_mode":         {"enum": []interface{}{"", "mpi", "fpi"}},
+	"archive_format":        {"enum": []interface{}{"", "dir", "tar.gz"}},
+	"notifications.*.on.*":  {"enum": []interface{}{"batch_finished", "model_failed"}},
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// Schema returns the JSON Schema of bbi.yaml, generated from the mapstructure keys of Config
+func Schema() map[string]interface{} {
+	schema := typeSchema(reflect.TypeOf(Config{}), "")
+
+	//Profiles may set anything the configuration can, other than selecting or defining profiles
+	profile := typeSchema(reflect.TypeOf(Config{}), "")
+	delete(profile["properties"].(map[string]interface{}), "profile")
+	delete(profile["properties"].(map[string]interface{}), "profiles")
+	delete(profile["properties"].(map[string]interface{}), "profile_applied")
+
+	//Settings which have been renamed are still accepted under their former names
+	for former, key := range deprecatedKeys {
+		for _, s := range []map[string]interface{}{schema, profile} {
+			properties := s["properties"].(map[string]interface{})
+			properties[former] = properties[key]
+		}
+	}
+
+	schema["properties"].(map[string]interface{})["profiles"] = map[string]interface{}{
+		"type":                 "object",
+		"additionalProperties": profile,
+	}
+
+	schema["$schema"] = "http://json-schema.org/draft-07/schema#"
+	schema["$id"] = SchemaID
+	schema["title"] = "bbi configuration"
+
+	return schema
+}
+
+func typeSchema(t reflect.Type, path string) map[string]interface{} {
+	schema := make(map[string]interface{})
+
+	switch {
+	case t == durationType:
+		//Durations are written as strings such as 36h, or as nanoseconds when bbi saves the configuration
+		schema["type"] = []interface{}{"string", "integer"}
+		schema["format"] = "duration"
+	case t.Kind() == reflect.Struct:
+		properties := make(map[string]interface{})
+
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			key := strings.Split(field.Tag.Get("mapstructure"), ",")[0]
+			if key == "" || key == "-" {
+				continue
+			}
+
+			properties[key] = typeSchema(field.Type, joinSchemaPath(path, key))
+		}
+
+		schema["type"] = "object"
+		schema["properties"] = properties
+		schema["additionalProperties"] = false
+	case t.Kind() == reflect.Map:
+		schema["type"] = "object"
+		schema["additionalProperties"] = typeSchema(t.Elem(), joinSchemaPath(path, "*"))
+	case t.Kind() == reflect.Slice:
+		schema["type"] = "array"
+		schema["items"] = typeSchema(t.Elem(), joinSchemaPath(path, "*"))
+	case t.Kind() == reflect.String:
+		schema["type"] = "string"
+	case t.Kind() == reflect.Bool:
+		schema["type"] = "boolean"
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Uint64:
+		schema["type"] = "integer"
+	case t.Kind() == reflect.Float32 || t.Kind() == reflect.Float64:
+		schema["type"] = "number"
+	}
+
+	for k, v := range schemaConstraints[path] {
+		schema[k] = v
+	}
+
+	return schema
+}
+
+func joinSchemaPath(path string, key string) string {
+	if path == "" {
+		return key
+	}
+
+	return path + "." + key
+}
+
+// ValidationError describes a setting in a configuration file which doesn't match the schema
+type ValidationError struct {
+	File    string `json:"file,omitempty"`
+	Key     string `json:"key"`
+	Message string `json:"message"`
+}
+
+func (v ValidationError) Error() string {
+	if v.File == "" {
+		return fmt.Sprintf("%s: %s", v.Key, v.Message)
+	}
+
+	return fmt.Sprintf("%s: %s: %s", v.File, v.Key, v.Message)
+}
+
+// ValidationErrors are all of the problems located in a configuration file
+type ValidationErrors []ValidationError
+
+func (v ValidationErrors) Error() string {
+	var messages []string
+	for _, e := range v {
+		messages = append(messages, e.Error())
+	}
+
+	return strings.Join(messages, "\n")
+}
+
+// ValidateConfigFile validates the contents of a yaml configuration file against the schema
+func ValidateConfigFile(file string) error {
+	contents, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	return ValidateConfigContents(file, contents)
+}
+
+// ValidateConfigContents validates yaml configuration against the schema, returning ValidationErrors naming each
+// offending key
+func ValidateConfigContents(file string, contents []byte) error {
+	var document interface{}
+
+	if err := yaml.Unmarshal(contents, &document); err != nil {
+		return fmt.Errorf("%s is not valid yaml: %w", file, err)
+	}
+
+	//An empty file is an empty configuration
+	if document == nil {
+		return nil
+	}
+
+	errs := validateAgainstSchema(Schema(), normalizeYaml(document), "")
+
+	if len(errs) == 0 {
+		return nil
+	}
+
+	for i := range errs {
+		errs[i].File = file
+	}
+
+	return errs
+}
+
+// normalizeYaml converts the maps decoded by yaml.v2 into maps with string keys, as in JSON. yaml 1.1 reads unquoted
+// on and off keys, such as the on of notifications, as booleans, so these are restored
+func normalizeYaml(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		normalized := make(map[string]interface{})
+		for key, item := range v {
+			name := fmt.Sprint(key)
+
+			if b, ok := key.(bool); ok {
+				name = "off"
+				if b {
+					name = "on"
+				}
+			}
+
+			normalized[name] = normalizeYaml(item)
+		}
+		return normalized
+	case []interface{}:
+		for i, item := range v {
+			v[i] = normalizeYaml(item)
+		}
+		return v
+	}
+
+	return value
+}
+
+// validateAgainstSchema checks the subset of JSON Schema generated by Schema
+func validateAgainstSchema(schema map[string]interface{}, value interface{}, key string) ValidationErrors {
+	var errs ValidationErrors
+
+	//Keys without values are left unset
+	if value == nil {
+		return errs
+	}
+
+	if !matchesSchemaType(schema["type"], value) {
+		return append(errs, ValidationError{Key: key, Message: fmt.Sprintf("must be %s, not %s", describeSchemaType(schema["type"]), describeValue(value))})
+	}
+
+	if schema["format"] == "duration" {
+		if s, ok := value.(string); ok {
+			if _, err := time.ParseDuration(s); err != nil {
+				errs = append(errs, ValidationError{Key: key, Message: fmt.Sprintf("%s is not a duration such as 90s, 30m or 36h", s)})
+			}
+		}
+	}
+
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		var allowed []string
+
+		for _, e := range enum {
+			//Settings such as parallel_mode are compared ignoring case
+			if e == value || strings.EqualFold(fmt.Sprint(e), fmt.Sprint(value)) {
+				found = true
+			}
+			if e != "" {
+				allowed = append(allowed, fmt.Sprint(e))
+			}
+		}
+
+		if !found {
+			errs = append(errs, ValidationError{Key: key, Message: fmt.Sprintf("%v must be one of %s", value, strings.Join(allowed, ", "))})
+		}
+	}
+
+	if minimum, ok := schema["minimum"].(int); ok {
+		if n, isInt := value.(int); isInt && n < minimum {
+			errs = append(errs, ValidationError{Key: key, Message: fmt.Sprintf("must be at least %d, not %d", minimum, n)})
+		}
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		properties, _ := schema["properties"].(map[string]interface{})
+
+		var keys []string
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			child := joinSchemaPath(key, k)
+
+			if property, ok := lookupProperty(properties, k); ok {
+				errs = append(errs, validateAgainstSchema(property.(map[string]interface{}), v[k], child)...)
+				continue
+			}
+
+			switch additional := schema["additionalProperties"].(type) {
+			case map[string]interface{}:
+				errs = append(errs, validateAgainstSchema(additional, v[k], child)...)
+			case bool:
+				if !additional {
+					errs = append(errs, ValidationError{Key: child, Message: unknownKeyMessage(k, properties)})
+				}
+			}
+		}
+	case []interface{}:
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			for i, item := range v {
+				errs = append(errs, validateAgainstSchema(items, item, fmt.Sprintf("%s[%d]", key, i))...)
+			}
+		}
+	}
+
+	return errs
+}
+
+// lookupProperty finds the schema of a key, ignoring case as viper does
+func lookupProperty(properties map[string]interface{}, key string) (interface{}, bool) {
+	if property, ok := properties[key]; ok {
+		return property, true
+	}
+
+	for k, property := range properties {
+		if strings.EqualFold(k, key) {
+			return property, true
+		}
+	}
+
+	return nil, false
+}
+
+func matchesSchemaType(schemaType interface{}, value interface{}) bool {
+	if types, ok := schemaType.([]interface{}); ok {
+		for _, t := range types {
+			if matchesSchemaType(t, value) {
+				return true
+			}
+		}
+		return false
+	}
+
+	switch schemaType {
+	case "object":
+		_, ok := value.(map[string]interface{})
+		return ok
+	case "array":
+		_, ok := value.([]interface{})
+		return ok
+	case "string":
+		_, ok := value.(string)
+		return ok
+	case "boolean":
+		_, ok := value.(bool)
+		return ok
+	case "integer":
+		switch value.(type) {
+		case int, int64, uint64:
+			return true
+		}
+		return false
+	case "number":
+		switch value.(type) {
+		case int, int64, uint64, float64:
+			return true
+		}
+		return false
+	}
+
+	return true
+}
+
+func describeSchemaType(schemaType interface{}) string {
+	if types, ok := schemaType.([]interface{}); ok {
+		var described []string
+		for _, t := range types {
+			described = append(described, describeSchemaType(t))
+		}
+		return strings.Join(described, " or ")
+	}
+
+	switch schemaType {
+	case "object":
+		return "a map of settings"
+	case "array":
+		return "a list"
+	case "integer":
+		return "an integer"
+	}
+
+	return fmt.Sprintf("a %s", schemaType)
+}
+
+func describeValue(value interface{}) string {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return "a map of settings"
+	case []interface{}:
+		return "a list"
+	case string:
+		return fmt.Sprintf("the string %q", v)
+	}
+
+	return fmt.Sprintf("%v", value)
+}
+
+// unknownKeyMessage reports a key which isn't in the schema, suggesting the closest known key when it is likely a typo
+func unknownKeyMessage(key string, properties map[string]interface{}) string {
+	message := "not a recognized setting"
+
+	closest := ""
+	distance := -1
+
+	for known := range properties {
+		d := editDistance(strings.ToLower(key), strings.ToLower(known))
+		if distance == -1 || d < distance || (d == distance && known < closest) {
+			closest = known
+			distance = d
+		}
+	}
+
+	if closest != "" && distance <= len(key)/3+1 {
+		message = fmt.Sprintf("%s. Did you mean %s?", message, closest)
+	}
+
+	return message
+}
+
+// editDistance is the Levenshtein distance between two strings
+func editDistance(a string, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+
+			current[j] = minInt(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+
+		previous, current = current, previous
+	}
+
+	return previous[len(b)]
+}
+
+func minInt(values ...int) int {
+	smallest := values[0]
+	for _, v := range values[1:] {
+		if v < smallest {
+			smallest = v
+		}
+	}
+
+	return smallest
+}
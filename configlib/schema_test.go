@@ -0,0 +1,112 @@
+package configlib
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestValidateConfigContents(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string
+		want     []string
+	}{
+		{
+			name: "valid",
+			contents: `threads: 8
+parallel_mode: FPI
+max_runtime: 36h
+retry_backoff: 30000000000
+nonmem:
+  nm74gf:
+    home: /opt/NONMEM/nm74gf
+    executable: nmfe74
+    default: true
+post_work_hooks:
+  - executable: scripts/upload.sh
+    timeout: 5m
+notifications:
+  - url: https://hooks.example.com/bbi
+    on: [model_failed]
+cache_dir:
+cacheMaxEntries: 10
+`,
+		},
+		{
+			name:     "misspelled keys",
+			contents: "thread: 8\nnonmem:\n  nm74gf:\n    hom: /opt/NONMEM/nm74gf\n",
+			want:     []string{"nonmem.nm74gf.hom", "thread"},
+		},
+		{
+			name:     "profiles",
+			contents: "profiles:\n  grid:\n    threads: 32\n    paralel: true\n    profile: quick\n  quick: 1\n",
+			want:     []string{"profiles.grid.paralel", "profiles.grid.profile", "profiles.quick"},
+		},
+		{
+			name:     "wrong types and values",
+			contents: "threads: eight\noverwrite: 1\nmax_runtime: 3 days\nparallel_mode: pvm\nretries: -1\nnotifications:\n  - command: notify.sh\n    on: [finished]\n",
+			want:     []string{"max_runtime", "notifications[0].on[0]", "overwrite", "parallel_mode", "retries", "threads"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateConfigContents("bbi.yaml", []byte(tt.contents))
+
+			var keys []string
+			if errs, ok := err.(ValidationErrors); ok {
+				for _, e := range errs {
+					keys = append(keys, e.Key)
+				}
+			} else if err != nil {
+				t.Fatalf("ValidateConfigContents() error = %v", err)
+			}
+
+			if !reflect.DeepEqual(keys, tt.want) {
+				t.Errorf("ValidateConfigContents() flagged %v, want %v. Errors: %v", keys, tt.want, err)
+			}
+		})
+	}
+}
+
+func TestUnknownKeyMessage(t *testing.T) {
+	properties := Schema()["properties"].(map[string]interface{})
+
+	if got, want := unknownKeyMessage("thread", properties), "not a recognized setting. Did you mean threads?"; got != want {
+		t.Errorf("unknownKeyMessage() = %s, want %s", got, want)
+	}
+
+	if got, want := unknownKeyMessage("colour_scheme", properties), "not a recognized setting"; got != want {
+		t.Errorf("unknownKeyMessage() = %s, want %s", got, want)
+	}
+}
+
+func TestSavedConfigValidates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bbi_schema")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := Config{
+		Threads:    4,
+		MaxRuntime: 36 * time.Hour,
+		Nonmem: map[string]NonMemDetail{
+			"nm74gf": {Home: "/opt/NONMEM/nm74gf", Executable: "nmfe74", Default: true},
+		},
+		PostWorkHooks: []PostWorkHook{{Name: "upload", Executable: "/scripts/upload.sh", Timeout: time.Minute}},
+		Notifications: []Notification{{Command: "notify.sh", On: []string{"model_failed"}}},
+	}
+
+	if err := WriteViperConfig(dir, true, config); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ValidateConfigFile(filepath.Join(dir, "bbi.yaml")); err != nil {
+		t.Errorf("The configuration saved for grid jobs is invalid: %s", err)
+	}
+}
@@ -0,0 +1,431 @@
+package parser
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ControlStreamEstimate is an initial estimate declared in the $THETA, $OMEGA or $SIGMA records of a control stream.
+// Names follow the ext file conventions, such as THETA3 or OMEGA(2,1)
+type ControlStreamEstimate struct {
+	Name    string
+	Record  string
+	Lower   string
+	Initial string
+	Upper   string
+	Fixed   bool
+	// Block indicates the estimate belongs to a BLOCK(n) structure, where FIX applies to the block as a whole
+	Block bool
+	// Diagonal is true for variances (OMEGA(n,n) / SIGMA(n,n)) and false for covariances
+	Diagonal bool
+
+	line       int
+	valueStart int
+	valueEnd   int
+	// span covers the entire declaration (bounds, value and any FIX) when it is contained on a single line
+	spanStart int
+	spanEnd   int
+}
+
+// Value is the numeric representation of the initial estimate
+func (e ControlStreamEstimate) Value() (float64, error) {
+	return parseControlStreamNumber(e.Initial)
+}
+
+// Bounds returns the lower and upper boundaries of a THETA. Missing or infinite bounds are returned as +/- Inf
+func (e ControlStreamEstimate) Bounds() (float64, float64) {
+	lower, err := parseControlStreamNumber(e.Lower)
+	if err != nil {
+		lower = math.Inf(-1)
+	}
+
+	upper, err := parseControlStreamNumber(e.Upper)
+	if err != nil {
+		upper = math.Inf(1)
+	}
+
+	return lower, upper
+}
+
+// EstimateUpdate is the replacement initial estimate for a control stream parameter
+type EstimateUpdate struct {
+	Value float64
+	Fix   bool
+}
+
+const (
+	csNumber = iota
+	csWord
+	csOpen
+	csClose
+	csComma
+)
+
+type csToken struct {
+	kind  int
+	text  string
+	start int
+	end   int
+	line  int
+}
+
+var csNumberRegex = regexp.MustCompile(`^[-+]?(\d+\.?\d*|\.\d+)([EeDd][-+]?\d+)?`)
+var csInfinityRegex = regexp.MustCompile(`^(?i)[-+]?INF`)
+var csWordRegex = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]*`)
+
+func parseControlStreamNumber(s string) (float64, error) {
+	if s == "" {
+		return 0, fmt.Errorf("no value provided")
+	}
+
+	upper := strings.ToUpper(s)
+	switch upper {
+	case "INF", "+INF":
+		return math.Inf(1), nil
+	case "-INF":
+		return math.Inf(-1), nil
+	}
+
+	return strconv.ParseFloat(strings.Replace(upper, "D", "E", 1), 64)
+}
+
+// FormatEstimate renders a value in a form NONMEM will accept as an initial estimate
+func FormatEstimate(value float64) string {
+	return strconv.FormatFloat(value, 'G', 8, 64)
+}
+
+func tokenizeEstimateLine(s string) []csToken {
+	var tokens []csToken
+	i := 0
+	for i < len(s) {
+		c := s[i]
+		switch {
+		case c == '(':
+			tokens = append(tokens, csToken{kind: csOpen, text: "(", start: i, end: i + 1})
+			i++
+		case c == ')':
+			tokens = append(tokens, csToken{kind: csClose, text: ")", start: i, end: i + 1})
+			i++
+		case c == ',':
+			tokens = append(tokens, csToken{kind: csComma, text: ",", start: i, end: i + 1})
+			i++
+		default:
+			if m := csInfinityRegex.FindString(s[i:]); m != "" {
+				tokens = append(tokens, csToken{kind: csNumber, text: m, start: i, end: i + len(m)})
+				i += len(m)
+				continue
+			}
+			if m := csNumberRegex.FindString(s[i:]); m != "" {
+				tokens = append(tokens, csToken{kind: csNumber, text: m, start: i, end: i + len(m)})
+				i += len(m)
+				continue
+			}
+			if m := csWordRegex.FindString(s[i:]); m != "" {
+				tokens = append(tokens, csToken{kind: csWord, text: strings.ToUpper(m), start: i, end: i + len(m)})
+				i += len(m)
+				continue
+			}
+			i++
+		}
+	}
+	return tokens
+}
+
+func estimateRecordName(record string) string {
+	switch strings.ToUpper(record) {
+	case "THE", "THET", "THETA":
+		return "THETA"
+	case "OME", "OMEG", "OMEGA":
+		return "OMEGA"
+	case "SIG", "SIGM", "SIGMA":
+		return "SIGMA"
+	}
+	return ""
+}
+
+// ParseControlStreamEstimates locates the initial estimates in the $THETA, $OMEGA and $SIGMA records of a control stream
+func ParseControlStreamEstimates(lines []string) []ControlStreamEstimate {
+	var estimates []ControlStreamEstimate
+
+	record := ""
+	thetaCount := 0
+	dimensions := map[string]int{}
+
+	// THETA group state
+	inGroup := false
+	var groupValues []csToken
+	groupFixed := false
+	groupLine := 0
+	groupStart := 0
+
+	// OMEGA / SIGMA block state
+	recordStart := 0
+	blockSize := 0
+	lastBlockSize := 0
+	blockRow, blockCol := 1, 1
+	expectBlockSize := false
+	expectSameCount := false
+	expectDiagonalCount := false
+	ignoreParens := false
+	blockFixed := false
+
+	for lineIndex, raw := range lines {
+		content := raw
+		if idx := strings.Index(content, ";"); idx >= 0 {
+			content = content[:idx]
+		}
+
+		offset := 0
+		trimmed := strings.TrimLeft(content, " \t")
+		if strings.HasPrefix(trimmed, "$") {
+			start := len(content) - len(trimmed)
+			name := csWordRegex.FindString(trimmed[1:])
+			record = estimateRecordName(name)
+			offset = start + 1 + len(name)
+			inGroup = false
+			recordStart = len(estimates)
+			blockSize = 0
+			expectBlockSize = false
+			expectSameCount = false
+			expectDiagonalCount = false
+			ignoreParens = false
+			blockFixed = false
+		}
+
+		if record == "" {
+			continue
+		}
+
+		for _, tok := range tokenizeEstimateLine(content[offset:]) {
+			tok.start += offset
+			tok.end += offset
+			tok.line = lineIndex
+
+			if record == "THETA" {
+				switch {
+				case tok.kind == csOpen:
+					inGroup = true
+					groupValues = nil
+					groupFixed = false
+					groupLine = lineIndex
+					groupStart = tok.start
+				case tok.kind == csNumber && inGroup:
+					groupValues = append(groupValues, tok)
+				case tok.kind == csWord && (tok.text == "FIX" || tok.text == "FIXED"):
+					if inGroup {
+						groupFixed = true
+					} else if len(estimates) > recordStart {
+						last := &estimates[len(estimates)-1]
+						last.Fixed = true
+						if last.line == lineIndex && last.spanStart >= 0 {
+							last.spanEnd = tok.end
+						}
+					}
+				case tok.kind == csClose && inGroup:
+					inGroup = false
+					if len(groupValues) == 0 {
+						continue
+					}
+					thetaCount++
+					e := ControlStreamEstimate{
+						Name:      fmt.Sprintf("THETA%d", thetaCount),
+						Record:    record,
+						Fixed:     groupFixed,
+						spanStart: groupStart,
+						spanEnd:   tok.end,
+					}
+					var value csToken
+					switch len(groupValues) {
+					case 1:
+						value = groupValues[0]
+					case 2:
+						e.Lower = groupValues[0].text
+						value = groupValues[1]
+					default:
+						e.Lower = groupValues[0].text
+						value = groupValues[1]
+						e.Upper = groupValues[2].text
+					}
+					e.Initial = value.text
+					e.line = value.line
+					e.valueStart = value.start
+					e.valueEnd = value.end
+					if groupLine != lineIndex {
+						e.spanStart = -1
+					}
+					estimates = append(estimates, e)
+				case tok.kind == csNumber:
+					thetaCount++
+					estimates = append(estimates, ControlStreamEstimate{
+						Name:       fmt.Sprintf("THETA%d", thetaCount),
+						Record:     record,
+						Initial:    tok.text,
+						line:       lineIndex,
+						valueStart: tok.start,
+						valueEnd:   tok.end,
+						spanStart:  tok.start,
+						spanEnd:    tok.end,
+					})
+				}
+				continue
+			}
+
+			// OMEGA and SIGMA
+			switch {
+			case expectSameCount && tok.kind == csOpen:
+				ignoreParens = true
+			case expectSameCount && tok.kind == csNumber && ignoreParens:
+				// SAME(n) repeats the previous block n times
+				n, _ := strconv.Atoi(tok.text)
+				if n > 1 {
+					dimensions[record] += lastBlockSize * (n - 1)
+				}
+			case expectSameCount && tok.kind == csClose:
+				expectSameCount = false
+				ignoreParens = false
+			case expectDiagonalCount && tok.kind == csOpen:
+				ignoreParens = true
+			case expectDiagonalCount && tok.kind == csNumber && ignoreParens:
+				// DIAGONAL(n) only counts the diagonal elements that follow, which are read as they appear
+			case expectDiagonalCount && tok.kind == csClose:
+				expectDiagonalCount = false
+				ignoreParens = false
+			case expectBlockSize && tok.kind == csOpen:
+				ignoreParens = true
+			case expectBlockSize && tok.kind == csNumber && ignoreParens:
+				n, _ := strconv.Atoi(tok.text)
+				if n > 0 {
+					blockSize = n
+					lastBlockSize = n
+					blockRow, blockCol = 1, 1
+				}
+			case expectBlockSize && tok.kind == csClose:
+				expectBlockSize = false
+				ignoreParens = false
+			case tok.kind == csWord && tok.text == "BLOCK":
+				expectBlockSize = true
+			case tok.kind == csWord && strings.HasPrefix(tok.text, "DIAG"):
+				expectDiagonalCount = true
+				blockSize = 0
+			case tok.kind == csWord && tok.text == "SAME":
+				dimensions[record] += lastBlockSize
+				blockSize = 0
+				expectSameCount = true
+			case tok.kind == csWord && (tok.text == "FIX" || tok.text == "FIXED"):
+				if blockSize > 0 || (len(estimates) > recordStart && estimates[len(estimates)-1].Block) {
+					blockFixed = true
+					for i := recordStart; i < len(estimates); i++ {
+						estimates[i].Fixed = true
+					}
+				} else if len(estimates) > recordStart {
+					last := &estimates[len(estimates)-1]
+					last.Fixed = true
+					if last.line == lineIndex {
+						last.spanEnd = tok.end
+					}
+				}
+			case tok.kind == csNumber:
+				e := ControlStreamEstimate{
+					Record:     record,
+					Initial:    tok.text,
+					line:       lineIndex,
+					valueStart: tok.start,
+					valueEnd:   tok.end,
+					spanStart:  tok.start,
+					spanEnd:    tok.end,
+				}
+				if blockSize > 0 {
+					base := dimensions[record]
+					e.Name = fmt.Sprintf("%s(%d,%d)", record, base+blockRow, base+blockCol)
+					e.Block = true
+					e.Fixed = blockFixed
+					e.Diagonal = blockRow == blockCol
+					blockCol++
+					if blockCol > blockRow {
+						blockRow++
+						blockCol = 1
+					}
+					if blockRow > blockSize {
+						dimensions[record] += blockSize
+						blockSize = 0
+					}
+				} else {
+					dimensions[record]++
+					n := dimensions[record]
+					e.Name = fmt.Sprintf("%s(%d,%d)", record, n, n)
+					e.Diagonal = true
+				}
+				estimates = append(estimates, e)
+			}
+		}
+	}
+
+	return estimates
+}
+
+type csEdit struct {
+	line  int
+	start int
+	end   int
+	text  string
+}
+
+// UpdateInitialEstimates returns a copy of the control stream with the initial estimates of the named parameters replaced.
+// Fixing a THETA removes its boundaries, as they no longer apply to a fixed value
+func UpdateInitialEstimates(lines []string, updates map[string]EstimateUpdate) ([]string, error) {
+	estimates := ParseControlStreamEstimates(lines)
+	located := make(map[string]ControlStreamEstimate)
+	for _, e := range estimates {
+		located[e.Name] = e
+	}
+
+	var edits []csEdit
+	for name, update := range updates {
+		e, ok := located[name]
+		if !ok {
+			return nil, fmt.Errorf("no initial estimate for %s was located in the control stream", name)
+		}
+
+		value := FormatEstimate(update.Value)
+
+		if !update.Fix {
+			edits = append(edits, csEdit{e.line, e.valueStart, e.valueEnd, value})
+			continue
+		}
+
+		if e.Block && !e.Fixed {
+			return nil, fmt.Errorf("%s is part of a BLOCK and cannot be fixed on its own", name)
+		}
+
+		switch {
+		case e.Block:
+			edits = append(edits, csEdit{e.line, e.valueStart, e.valueEnd, value})
+		case e.spanStart < 0:
+			return nil, fmt.Errorf("the declaration of %s spans multiple lines and cannot be rewritten", name)
+		default:
+			edits = append(edits, csEdit{e.line, e.spanStart, e.spanEnd, value + " FIX"})
+		}
+	}
+
+	// Apply from the end of each line backwards so earlier offsets remain valid
+	sort.Slice(edits, func(i, j int) bool {
+		if edits[i].line != edits[j].line {
+			return edits[i].line < edits[j].line
+		}
+		return edits[i].start > edits[j].start
+	})
+
+	output := make([]string, len(lines))
+	copy(output, lines)
+
+	for _, edit := range edits {
+		line := output[edit.line]
+		output[edit.line] = line[:edit.start] + edit.text + line[edit.end:]
+	}
+
+	return output, nil
+}
@@ -0,0 +1,140 @@
+package parser
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var controlStreamEstimates01 = []string{
+	"$PROBLEM PK model 1 cmt base",
+	"$DATA ../acop.csv IGNORE=@",
+	"$THETA",
+	"(0, 2)  ; KA",
+	"(0, 3)  ; CL",
+	"(0, 10, 100) ; V2",
+	"$THETA(0.02)  ; RUVp",
+	" 1 FIX    ; RUVa",
+	"$OMEGA",
+	"0.05    ; iiv CL",
+	"0.2     ; iiv V2",
+	"$OMEGA BLOCK(2)",
+	"0.06          ;CL BSV",
+	"0.01 0.06   ;VC BSV",
+	"$OMEGA BLOCK(2) SAME",
+	"$OMEGA 0.1 FIX",
+	"$SIGMA",
+	"1 FIX",
+	"$EST METHOD=1 INTERACTION MAXEVAL=9999",
+}
+
+func TestParseControlStreamEstimates(t *testing.T) {
+	estimates := ParseControlStreamEstimates(controlStreamEstimates01)
+
+	var names []string
+	for _, e := range estimates {
+		names = append(names, e.Name)
+	}
+
+	assert.Equal(t, []string{
+		"THETA1", "THETA2", "THETA3", "THETA4", "THETA5",
+		"OMEGA(1,1)", "OMEGA(2,2)",
+		"OMEGA(3,3)", "OMEGA(4,3)", "OMEGA(4,4)",
+		"OMEGA(7,7)",
+		"SIGMA(1,1)",
+	}, names)
+
+	assert.Equal(t, "0", estimates[2].Lower)
+	assert.Equal(t, "10", estimates[2].Initial)
+	assert.Equal(t, "100", estimates[2].Upper)
+	assert.False(t, estimates[2].Fixed)
+	assert.True(t, estimates[4].Fixed)
+
+	lower, upper := estimates[1].Bounds()
+	assert.Equal(t, 0.0, lower)
+	assert.True(t, math.IsInf(upper, 1))
+
+	assert.True(t, estimates[8].Block)
+	assert.False(t, estimates[8].Diagonal)
+	assert.True(t, estimates[10].Fixed)
+	assert.True(t, estimates[11].Fixed)
+}
+
+func TestParseControlStreamEstimatesDiagonal(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []string
+		want  []string
+	}{
+		{
+			name: "DIAGONAL(n)",
+			lines: []string{
+				"$OMEGA DIAGONAL(2) 0.1 0.2",
+				"$OMEGA 0.3",
+			},
+			want: []string{"OMEGA(1,1)", "OMEGA(2,2)", "OMEGA(3,3)"},
+		},
+		{
+			name: "DIAGONAL then SAME",
+			lines: []string{
+				"$OMEGA BLOCK(2) 0.1 0.01 0.2",
+				"$OMEGA DIAGONAL(2) 0.3 0.4",
+				"$OMEGA BLOCK SAME",
+				"$OMEGA 0.5",
+			},
+			want: []string{"OMEGA(1,1)", "OMEGA(2,1)", "OMEGA(2,2)", "OMEGA(3,3)", "OMEGA(4,4)", "OMEGA(7,7)"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			estimates := ParseControlStreamEstimates(tt.lines)
+
+			var names []string
+			for _, e := range estimates {
+				names = append(names, e.Name)
+				if e.Record == "OMEGA" && !e.Block {
+					assert.True(t, e.Diagonal, e.Name)
+				}
+			}
+
+			assert.Equal(t, tt.want, names)
+		})
+	}
+
+	//Perturbing a DIAGONAL element replaces it alone rather than treating it as part of a block
+	updated, err := UpdateInitialEstimates([]string{"$OMEGA DIAGONAL(2) 0.1 0.2"}, map[string]EstimateUpdate{"OMEGA(2,2)": {Value: 0.4}})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"$OMEGA DIAGONAL(2) 0.1 0.4"}, updated)
+}
+
+func TestUpdateInitialEstimates(t *testing.T) {
+	updated, err := UpdateInitialEstimates(controlStreamEstimates01, map[string]EstimateUpdate{
+		"THETA2":     {Value: 4.5, Fix: true},
+		"THETA3":     {Value: 12},
+		"THETA5":     {Value: 2, Fix: true},
+		"OMEGA(2,2)": {Value: 0.3},
+		"OMEGA(4,3)": {Value: 0.02},
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, "4.5 FIX  ; CL", updated[4])
+	assert.Equal(t, "(0, 12, 100) ; V2", updated[5])
+	assert.Equal(t, " 2 FIX    ; RUVa", updated[7])
+	assert.Equal(t, "0.3     ; iiv V2", updated[10])
+	assert.Equal(t, "0.02 0.06   ;VC BSV", updated[13])
+
+	// Original content should be untouched
+	assert.Equal(t, "(0, 3)  ; CL", controlStreamEstimates01[4])
+
+	_, err = UpdateInitialEstimates(controlStreamEstimates01, map[string]EstimateUpdate{
+		"OMEGA(3,3)": {Value: 0.1, Fix: true},
+	})
+	assert.NotNil(t, err)
+
+	_, err = UpdateInitialEstimates(controlStreamEstimates01, map[string]EstimateUpdate{
+		"THETA9": {Value: 1},
+	})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,76 @@
+package parser
+
+import (
+	"regexp"
+	"strings"
+)
+
+var msfoRegex = regexp.MustCompile(`(?i)\bMSFO\s*=\s*([^\s,;]+)`)
+
+// ModelSpecificationFileOutput returns the file declared with MSFO= on the $ESTIMATION records of the control stream,
+// or an empty string if the model does not write a model specification file
+func ModelSpecificationFileOutput(lines []string) string {
+	inEstimation := false
+
+	for _, line := range lines {
+		content := strings.TrimSpace(strings.SplitN(line, ";", 2)[0])
+
+		if strings.HasPrefix(content, "$") {
+			record := strings.ToUpper(strings.Fields(content)[0])
+			inEstimation = strings.HasPrefix(record, "$EST")
+		}
+
+		if !inEstimation {
+			continue
+		}
+
+		if matches := msfoRegex.FindStringSubmatch(content); matches != nil {
+			return matches[1]
+		}
+	}
+
+	return ""
+}
+
+// HasModelSpecificationFileInput indicates whether the control stream reads a model specification file via $MSFI
+func HasModelSpecificationFileInput(lines []string) bool {
+	for _, line := range lines {
+		if isMSFIRecord(line) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ReplaceModelSpecificationFileInput points any $MSFI records at the provided file, keeping their options
+func ReplaceModelSpecificationFileInput(lines []string, file string) []string {
+	var output []string
+
+	for _, line := range lines {
+		if !isMSFIRecord(line) {
+			output = append(output, line)
+			continue
+		}
+
+		fields := strings.Fields(line)
+		record := fields[0]
+		var remainder []string
+
+		if strings.Contains(record, "=") {
+			// $MSFI=run001.msf
+			record = strings.SplitN(record, "=", 2)[0]
+			remainder = fields[1:]
+		} else if len(fields) > 1 {
+			remainder = fields[2:]
+		}
+
+		output = append(output, strings.Join(append([]string{record, file}, remainder...), " "))
+	}
+
+	return output
+}
+
+func isMSFIRecord(line string) bool {
+	return strings.HasPrefix(strings.ToUpper(strings.TrimSpace(line)), "$MSFI")
+}
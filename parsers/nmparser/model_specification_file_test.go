@@ -0,0 +1,41 @@
+package parser
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestModelSpecificationFileOutput(t *testing.T) {
+	lines := []string{
+		"$PROBLEM MSFO=not_this.msf",
+		"$DATA ../acop.csv IGNORE=@",
+		"$EST METHOD=1 INTERACTION",
+		"  MAXEVAL=9999 MSFO = run001.msf ; written for run002",
+		"$COV",
+	}
+
+	assert.Equal(t, "run001.msf", ModelSpecificationFileOutput(lines))
+	assert.Equal(t, "", ModelSpecificationFileOutput(lines[:3]))
+}
+
+func TestReplaceModelSpecificationFileInput(t *testing.T) {
+	lines := []string{
+		"$PROBLEM continue run001",
+		"$MSFI run001.msf NPOPETAS=2",
+		"$msfi=old.msf",
+		"$EST METHOD=1",
+	}
+
+	assert.True(t, HasModelSpecificationFileInput(lines))
+	assert.False(t, HasModelSpecificationFileInput([]string{"$EST METHOD=1"}))
+
+	updated := ReplaceModelSpecificationFileInput(lines, "../run001/run001.msf")
+
+	assert.Equal(t, []string{
+		"$PROBLEM continue run001",
+		"$MSFI ../run001/run001.msf NPOPETAS=2",
+		"$msfi ../run001/run001.msf",
+		"$EST METHOD=1",
+	}, updated)
+}
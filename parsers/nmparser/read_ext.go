@@ -1,6 +1,8 @@
 package parser
 
 import (
+	"errors"
+	"fmt"
 	"log"
 	"strconv"
 	"strings"
@@ -145,3 +147,96 @@ func ParseExtData(ed ExtData) ([]ParametersData, ParameterNames) {
 		Sigma: sigmas,
 	}
 }
+
+// ExtLineValues returns the values of the last estimation method on the line flagged with the provided
+// iteration number, keyed by the ext column names (THETA1, OMEGA(1,1), OBJ, etc).
+// For example, -1000000000 provides the final estimates and -1000000001 the standard errors
+func ExtLineValues(ed ExtData, iteration int) (map[string]float64, error) {
+	if len(ed.EstimationLines) == 0 || len(ed.ParameterNames) == 0 {
+		return nil, errors.New("no estimation details were present in the ext data")
+	}
+
+	lines := ed.EstimationLines[len(ed.EstimationLines)-1]
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		step, err := strconv.Atoi(fields[0])
+		if err != nil || step != iteration {
+			continue
+		}
+
+		if len(fields) != len(ed.ParameterNames) {
+			return nil, fmt.Errorf("line for iteration %d has %d values but %d columns were declared", iteration, len(fields), len(ed.ParameterNames))
+		}
+
+		values := make(map[string]float64)
+		for i, val := range fields {
+			if i == 0 {
+				continue
+			}
+			n, err := strconv.ParseFloat(val, 64)
+			if err != nil {
+				return nil, fmt.Errorf("error converting value in ext file to number: %s", val)
+			}
+			values[ed.ParameterNames[i]] = n
+		}
+
+		return values, nil
+	}
+
+	return nil, fmt.Errorf("no line for iteration %d was found in the final estimation method", iteration)
+}
+
+// ParseExtProgress returns the most recent iteration and objective function value of the last estimation method. Lines
+// which are incomplete, as the ext file may still be being written, are ignored
+func ParseExtProgress(ed ExtData) (ExtProgress, error) {
+	progress := ExtProgress{}
+
+	if len(ed.EstimationLines) == 0 || len(ed.ParameterNames) == 0 {
+		return progress, errors.New("no estimation details were present in the ext data")
+	}
+
+	if len(ed.EstimationMethods) > 0 {
+		method := strings.SplitN(ed.EstimationMethods[len(ed.EstimationMethods)-1], ":", 3)
+		if len(method) > 1 {
+			progress.Method = strings.TrimSpace(method[1])
+		}
+	}
+
+	found := false
+	for _, line := range ed.EstimationLines[len(ed.EstimationLines)-1] {
+		fields := strings.Fields(line)
+		if len(fields) != len(ed.ParameterNames) {
+			continue
+		}
+
+		step, err := strconv.Atoi(fields[0])
+		if err != nil {
+			continue
+		}
+
+		// Negative one billion and below are the summary lines written once the method has finished
+		if step <= -1000000000 {
+			progress.Complete = true
+			continue
+		}
+
+		ofv, err := strconv.ParseFloat(fields[len(fields)-1], 64)
+		if err != nil {
+			continue
+		}
+
+		progress.Iteration = step
+		progress.OFV = ofv
+		found = true
+	}
+
+	if !found {
+		return progress, errors.New("no iterations have been written for the last estimation method")
+	}
+
+	return progress, nil
+}
@@ -78,3 +78,53 @@ func TestReadExt(t *testing.T) {
 		assert.Equal(t, 7.0, pd[1].Fixed.Theta[0], "Fail :"+tt.context)
 	}
 }
+
+func TestExtLineValues(t *testing.T) {
+	lines := []string{
+		"TABLE NO.     1: First Order Conditional Estimation with Interaction: Goal Function=MINIMUM VALUE OF OBJECTIVE FUNCTION: Problem=1 Subproblem=0 Superproblem1=0 Iteration1=0 Superproblem2=0 Iteration2=0",
+		" ITERATION    THETA1       THETA2       SIGMA(1,1)   OMEGA(1,1)   OBJ",
+		"            0  2.00000E+00  3.00000E+00  1.00000E+00  5.00000E-02    2700.1",
+		"  -1000000000  2.31000E+00  5.42000E+01  1.00000E+00  9.00000E-02    2636.5",
+		"  -1000000001  8.60000E-02  3.30000E+00  0.00000E+00  2.00000E-02    0.0",
+	}
+
+	ed := ParseExtLines(lines)
+
+	values, err := ExtLineValues(ed, -1000000001)
+	assert.Nil(t, err)
+	assert.Equal(t, 3.3, values["THETA2"])
+	assert.Equal(t, 0.02, values["OMEGA(1,1)"])
+
+	values, err = ExtLineValues(ed, -1000000000)
+	assert.Nil(t, err)
+	assert.Equal(t, 2636.5, values["OBJ"])
+
+	_, err = ExtLineValues(ed, -1000000006)
+	assert.NotNil(t, err)
+}
+
+func TestParseExtProgress(t *testing.T) {
+	lines := []string{
+		"TABLE NO.     1: First Order Conditional Estimation with Interaction: Goal Function=MINIMUM VALUE OF OBJECTIVE FUNCTION: Problem=1 Subproblem=0 Superproblem1=0 Iteration1=0 Superproblem2=0 Iteration2=0",
+		" ITERATION    THETA1       THETA2       SIGMA(1,1)   OMEGA(1,1)   OBJ",
+		"            0  2.00000E+00  3.00000E+00  1.00000E+00  5.00000E-02    2700.1",
+		"            5  2.10000E+00  3.50000E+00  1.00000E+00  6.00000E-02    2680.4",
+		"           10  2.20000E+00  4.1",
+	}
+
+	progress, err := ParseExtProgress(ParseExtLines(lines))
+	assert.Nil(t, err)
+	assert.Equal(t, "First Order Conditional Estimation with Interaction", progress.Method)
+	assert.Equal(t, 5, progress.Iteration)
+	assert.Equal(t, 2680.4, progress.OFV)
+	assert.False(t, progress.Complete)
+
+	lines = append(lines[:4], "  -1000000000  2.31000E+00  5.42000E+01  1.00000E+00  9.00000E-02    2636.5")
+	progress, err = ParseExtProgress(ParseExtLines(lines))
+	assert.Nil(t, err)
+	assert.Equal(t, 5, progress.Iteration)
+	assert.True(t, progress.Complete)
+
+	_, err = ParseExtProgress(ParseExtLines(lines[:2]))
+	assert.NotNil(t, err)
+}
@@ -165,6 +165,15 @@ type ExtData struct {
 	EstimationLines   [][]string
 }
 
+// ExtProgress is the latest iteration written to the ext file of an estimation which may still be running
+type ExtProgress struct {
+	Method    string
+	Iteration int
+	OFV       float64
+	// Complete is set once the final result line of the last estimation method has been written
+	Complete bool
+}
+
 // MatrixData ...
 type MatrixData struct {
 	Values     [][]float64